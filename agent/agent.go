@@ -5,6 +5,15 @@ package agent
 import (
 	"context"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/charmbracelet/lipgloss"
 	"github.com/onkernel/kernel-go-sdk"
@@ -15,12 +24,59 @@ var (
 	HeaderStyle  = lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("12"))
 	SuccessStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("10"))
 	DimStyle     = lipgloss.NewStyle().Foreground(lipgloss.Color("8"))
+	WarningStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("11"))
 )
 
-// MCPServer represents a single MCP server configuration
+// UsePlainStyles drops all styling from this package's output, for terminals
+// without color support
+func UsePlainStyles() {
+	HeaderStyle = lipgloss.NewStyle()
+	SuccessStyle = lipgloss.NewStyle()
+	DimStyle = lipgloss.NewStyle()
+	WarningStyle = lipgloss.NewStyle()
+}
+
+// Phases that prefix progress output, e.g. "[install] Installing Cursor..."
+const (
+	phaseInstall = "install"
+	phaseMCP     = "mcp"
+	phaseAgent   = "agent"
+)
+
+// status prints a progress line prefixed with its phase
+func status(phase, line string) {
+	fmt.Println(DimStyle.Render("["+phase+"] ") + line)
+}
+
+// MCP server transport types
+const (
+	MCPTransportStdio = "stdio"
+	MCPTransportHTTP  = "http"
+	MCPTransportSSE   = "sse"
+)
+
+// MCPServer represents a single MCP server configuration. Stdio servers (the
+// default) are launched with Command and Args; HTTP and SSE servers are
+// reached at URL with optional Headers.
 type MCPServer struct {
-	Command string   `json:"command"`
-	Args    []string `json:"args"`
+	Type    string            `json:"type,omitempty"`
+	Command string            `json:"command,omitempty"`
+	Args    []string          `json:"args,omitempty"`
+	URL     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// Transport returns the server's transport type, defaulting to stdio
+func (s MCPServer) Transport() string {
+	if s.Type == "" {
+		return MCPTransportStdio
+	}
+	return s.Type
+}
+
+// IsRemote reports whether the server is reached over HTTP or SSE
+func (s MCPServer) IsRemote() bool {
+	return s.Transport() != MCPTransportStdio
 }
 
 // MCPConfig represents MCP server configuration for an agent
@@ -28,51 +84,337 @@ type MCPConfig struct {
 	MCPServers map[string]MCPServer `json:"mcpServers"`
 }
 
-// PlaywriterMCPConfig returns the standard MCP config for playwriter built from source
-func PlaywriterMCPConfig() MCPConfig {
+// PlaywriterMCPConfig returns the standard MCP config for playwriter built from source.
+// name is the server's key in the config, which agents use to prefix its
+// tools; an empty name defaults to PlaywriterServerName. runtime is the
+// interpreter used to launch the server: "node", "bun", or an absolute path
+// to a runtime binary. An empty runtime defaults to "node". Agents put the
+// bun install dir (~/.bun/bin) on PATH so "bun" resolves.
+func PlaywriterMCPConfig(name, runtime string) MCPConfig {
+	if runtime == "" {
+		runtime = "node"
+	}
 	return MCPConfig{
 		MCPServers: map[string]MCPServer{
-			"playwriter": {
-				Command: "node",
+			serverName(name): {
+				Command: runtime,
 				Args:    []string{"/home/kernel/playwriter/playwriter/dist/cli.js"},
 			},
 		},
 	}
 }
 
+// ExternalRelayMCPConfig returns the MCP config for a relay run outside the
+// session (-external-relay). Playwriter isn't built in the session then, so
+// the published package is run with npx and pointed at endpoint with --host.
+// name is as for PlaywriterMCPConfig.
+func ExternalRelayMCPConfig(name, endpoint string) MCPConfig {
+	return MCPConfig{
+		MCPServers: map[string]MCPServer{
+			serverName(name): {
+				Command: "npx",
+				Args:    []string{"-y", "playwriter@latest", "--host", endpoint},
+			},
+		},
+	}
+}
+
+// serverName returns name, or PlaywriterServerName if it's empty
+func serverName(name string) string {
+	if name == "" {
+		return PlaywriterServerName
+	}
+	return name
+}
+
+// plainWordPattern matches plain words of letters, digits, '-' and '_'. The
+// conversation IDs agents report (UUIDs and the like) are plain words, and
+// every agent's MCP config format accepts them as server names.
+var plainWordPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ValidateResumeID checks that id looks like a conversation ID an agent
+// reported, so it can be passed on its command line as-is
+func ValidateResumeID(id string) error {
+	if !plainWordPattern.MatchString(id) {
+		return fmt.Errorf("invalid resume ID %q: may only contain letters, digits, '-' and '_'", id)
+	}
+	return nil
+}
+
+// ValidateMCPConfig checks that config has at least one server, that server
+// names are valid and unique ignoring case, and that every server has a
+// command (stdio) or URL (http, sse). The error names the offending server
+// and field.
+func ValidateMCPConfig(config MCPConfig) error {
+	if len(config.MCPServers) == 0 {
+		return errors.New("invalid MCP config: mcpServers is empty")
+	}
+
+	names := make([]string, 0, len(config.MCPServers))
+	for name := range config.MCPServers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	seen := make(map[string]string)
+	for _, name := range names {
+		if !plainWordPattern.MatchString(name) {
+			return fmt.Errorf("invalid MCP config: server name %q may only contain letters, digits, '-' and '_'", name)
+		}
+		if other, ok := seen[strings.ToLower(name)]; ok {
+			return fmt.Errorf("invalid MCP config: server names %q and %q differ only in case", other, name)
+		}
+		seen[strings.ToLower(name)] = name
+
+		server := config.MCPServers[name]
+		switch server.Transport() {
+		case MCPTransportStdio:
+			if strings.TrimSpace(server.Command) == "" {
+				return fmt.Errorf("invalid MCP config: server %q: command is empty", name)
+			}
+		case MCPTransportHTTP, MCPTransportSSE:
+			if strings.TrimSpace(server.URL) == "" {
+				return fmt.Errorf("invalid MCP config: server %q: url is empty", name)
+			}
+		default:
+			return fmt.Errorf("invalid MCP config: server %q: unknown type %q (expected stdio, http, or sse)", name, server.Type)
+		}
+	}
+	return nil
+}
+
 // RunOptions contains options for running an agent
 type RunOptions struct {
 	Prompt       string
 	Model        string
 	APIKey       string            // Primary API key (for agents with single provider)
 	EnvVars      map[string]string // Additional env vars to forward (for multi-provider agents)
-	AgentTimeout int64             // Hard timeout in seconds (0 = no limit)
+	AgentTimeout int64             // Hard timeout in seconds (0 = no limit); ignored if Deadline is set
+	AsRoot       bool              // Run as root instead of switching to the kernel user
+	Stdin        io.Reader         // If set, data read from Stdin is forwarded to the agent process
+	NoPTY        bool              // Run without allocating a PTY via `script`
+	WorkDir      string            // Directory the agent runs in (default DefaultWorkDir)
+	StreamText   bool              // Ask the agent for text deltas (StreamDeltaEventType) where supported
+	AutoApprove  bool              // Approve tool and MCP use without prompting (cursor -f --approve-mcps, claude --dangerously-skip-permissions)
+
+	// Heartbeat, if set, sends a HeartbeatEventType event whenever the agent
+	// has produced no output for this long, to keep downstream connections
+	// from idling out
+	Heartbeat time.Duration
+
+	// Deadline, if set, is an absolute time the run must finish by. It takes
+	// precedence over AgentTimeout, for callers that already track one.
+	Deadline time.Time
+
+	// RetryOnTransient re-runs the prompt once if the agent fails with a
+	// transient error (see IsTransientFailure). The AgentTimeout covers
+	// both attempts. Ignored when Stdin is set, since input can't be replayed.
+	RetryOnTransient bool
+
+	// ApproveTools answers approval requests for these tools (see
+	// ApprovalPolicy) with a yes on the agent's stdin, for runs without
+	// AutoApprove. Requests for other tools are passed on to the handler.
+	ApproveTools ApprovalPolicy
+
+	// BrowserCheck, if set, is called every BrowserCheckInterval (default
+	// DefaultBrowserCheckInterval) while the agent runs to check the browser
+	// is still up. If it fails twice in a row, the run is stopped and Run
+	// returns an ErrBrowserDown error, rather than the agent retrying tools
+	// against a dead browser.
+	BrowserCheck         func(ctx context.Context) error
+	BrowserCheckInterval time.Duration
+
+	// Timing stamps every event with TS and DeltaMS as it's handled, for
+	// latency analysis of recordings and webhooks
+	Timing bool
+
+	// TextOutput runs the agent with plain text output instead of its JSON
+	// stream, as a fallback for CLI versions whose JSON mode misbehaves. Each
+	// line is handled as a TextOutputEventType event; tool calls, approval
+	// requests, and streamed text aren't seen.
+	TextOutput bool
+
+	// ResumeID, if set, continues the agent's own conversation with this ID,
+	// as reported in StreamEvent.SessionID, instead of starting a new one
+	ResumeID string
+
+	// MaxTurns, if non-zero, caps the number of agentic turns the agent may
+	// take before it stops. Only claude supports it; other agents ignore it.
+	MaxTurns int
+
+	// AllowedTools and DisallowedTools restrict which tools the agent may use.
+	// Agents whose CLI has no equivalent ignore them with a warning.
+	AllowedTools    []string
+	DisallowedTools []string
 }
 
 // StreamHandler is called for each event from the agent's output stream
 type StreamHandler func(event StreamEvent)
 
+// TeeHandler returns a handler passing each event to every one of handlers,
+// in order, so display, recording, and forwarding can be composed. Nil
+// handlers are skipped.
+func TeeHandler(handlers ...StreamHandler) StreamHandler {
+	return func(event StreamEvent) {
+		for _, h := range handlers {
+			if h != nil {
+				h(event)
+			}
+		}
+	}
+}
+
 // StreamEvent represents a JSON event from an agent's stream output
 type StreamEvent struct {
 	Type    string `json:"type"`
 	Subtype string `json:"subtype,omitempty"`
 	Message struct {
-		Content []struct {
-			Type string `json:"type"`
-			Text string `json:"text"`
-		} `json:"content"`
+		Content []ContentBlock `json:"content"`
 	} `json:"message,omitempty"`
 	ToolCall struct {
 		MCPToolCall struct {
 			Args struct {
-				Name     string `json:"name"`
-				ToolName string `json:"toolName"`
-				Args     struct {
-					Code string `json:"code"`
-				} `json:"args"`
+				Name     string   `json:"name"`
+				ToolName string   `json:"toolName"`
+				Args     ToolArgs `json:"args"`
 			} `json:"args"`
 		} `json:"mcpToolCall"`
 	} `json:"tool_call,omitempty"`
+	// SessionID is the agent's own conversation ID, which RunOptions.ResumeID
+	// takes to continue it. Not every event carries it.
+	SessionID string `json:"session_id,omitempty"`
+	// TS is the Unix time in milliseconds of a heartbeat event, or of any
+	// event with RunOptions.Timing
+	TS int64 `json:"ts,omitempty"`
+	// DeltaMS is set with RunOptions.Timing to the milliseconds since the
+	// previous event, or since the run started for the first
+	DeltaMS *int64 `json:"delta_ms,omitempty"`
+	// Result and IsError are set on the final "result" event
+	Result  string `json:"result,omitempty"`
+	IsError bool   `json:"is_error,omitempty"`
+	// Event carries a partial-message update (type "stream_event"), emitted
+	// by agents that stream text as deltas
+	Event struct {
+		Type  string `json:"type"`
+		Delta struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"delta"`
+	} `json:"event,omitempty"`
+
+	// Raw is the exact JSON the event was decoded from, including fields not
+	// modeled here. For OpenCode it's the original OpenCode event. Events
+	// made up locally (stderr, heartbeat, retry, auto-approval) have none.
+	// It isn't marshaled; recordings and webhooks send it in place of the
+	// decoded fields.
+	Raw json.RawMessage `json:"-"`
+}
+
+// StreamDeltaEventType is the StreamEvent type for partial-message updates.
+// Event.Type "content_block_delta" with a "text_delta" carries new text;
+// "content_block_stop" and "message_stop" end the current block.
+const StreamDeltaEventType = "stream_event"
+
+// MessageCompleteSubtype marks an "assistant" StreamEvent whose message is
+// finished, so consumers know nothing more will be added to it. Agents that
+// only send whole messages mark every one; text streamed before it arrives
+// as StreamDeltaEventType events.
+const MessageCompleteSubtype = "complete"
+
+// IsMessageComplete reports whether event is a finished assistant message
+func IsMessageComplete(event StreamEvent) bool {
+	return event.Type == "assistant" && event.Subtype == MessageCompleteSubtype
+}
+
+// StderrEventType is the StreamEvent type used for chunks of the agent's stderr.
+// The text is carried as a single text content block in Message.Content.
+const StderrEventType = "stderr"
+
+// TextOutputEventType is the StreamEvent type for a line of an agent's plain
+// text output (RunOptions.TextOutput). The line is carried as a single text
+// block in Message.Content.
+const TextOutputEventType = "text_output"
+
+// RetryEventType is the StreamEvent type sent before the prompt is re-run
+// after a transient failure. The text carries the reason. Events before it
+// belong to the failed attempt.
+const RetryEventType = "retry"
+
+// RunTagEventType is the StreamEvent type written at the start of a recording
+// to carry the run's -tag as its text
+const RunTagEventType = "run_tag"
+
+// TextEvent builds a StreamEvent of the given type carrying a single text block
+func TextEvent(eventType, text string) StreamEvent {
+	var event StreamEvent
+	event.Type = eventType
+	event.Message.Content = []ContentBlock{{Type: "text", Text: text}}
+	return event
+}
+
+// ContentBlock is one block of a message's content. Claude sends tool calls
+// and their results as blocks of the assistant and user messages, alongside
+// the text; other agents only send text blocks.
+type ContentBlock struct {
+	// Type is "text", "tool_use", or "tool_result"
+	Type string `json:"type"`
+	Text string `json:"text,omitempty"`
+
+	// ID, Name, and Input describe a "tool_use" block
+	ID    string   `json:"id,omitempty"`
+	Name  string   `json:"name,omitempty"`
+	Input ToolArgs `json:"input,omitempty"`
+
+	// ToolUseID, Content, and IsError describe a "tool_result" block.
+	// Content is a string or an array of content blocks; see ResultText.
+	ToolUseID string          `json:"tool_use_id,omitempty"`
+	Content   json.RawMessage `json:"content,omitempty"`
+	IsError   bool            `json:"is_error,omitempty"`
+}
+
+// ResultText returns the text of a "tool_result" block, joining the text
+// blocks if its content is an array
+func (b ContentBlock) ResultText() string {
+	if len(b.Content) == 0 {
+		return ""
+	}
+	var s string
+	if err := json.Unmarshal(b.Content, &s); err == nil {
+		return s
+	}
+	var blocks []ContentBlock
+	if err := json.Unmarshal(b.Content, &blocks); err != nil {
+		return ""
+	}
+	var parts []string
+	for _, block := range blocks {
+		if block.Text != "" {
+			parts = append(parts, block.Text)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// ToolArgs holds the arguments an agent passed to an MCP tool
+type ToolArgs map[string]any
+
+// Code returns the "code" argument used by playwriter's execute tool
+func (a ToolArgs) Code() string {
+	return a.Get("code")
+}
+
+// Get returns the argument for key as a string. Non-string values are
+// rendered as compact JSON; missing keys return an empty string.
+func (a ToolArgs) Get(key string) string {
+	v, ok := a[key]
+	if !ok || v == nil {
+		return ""
+	}
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
 }
 
 // Agent represents an AI coding agent that can run prompts with MCP tools
@@ -86,6 +428,17 @@ type Agent interface {
 	// ConfigureMCP sets up the MCP server configuration
 	ConfigureMCP(ctx context.Context, client kernel.Client, sessionID string, config MCPConfig) error
 
+	// VerifyMCP checks that the agent picks up the MCP config written by
+	// ConfigureMCP and that it includes server, using the agent's own
+	// listing command where it has one and probing the config file otherwise
+	VerifyMCP(ctx context.Context, client kernel.Client, sessionID, server string) error
+
+	// Command returns the bash command Run would spawn for opts, without a
+	// session: the PTY variant isn't detected and long prompts aren't
+	// written out. For debugging quoting (-print-command); it contains
+	// opts.APIKey, so redact it before showing it.
+	Command(opts RunOptions) string
+
 	// Run executes a prompt and returns the exit code
 	// The handler is called for each event in the output stream
 	Run(ctx context.Context, client kernel.Client, sessionID string, opts RunOptions, handler StreamHandler) (exitCode int64, err error)
@@ -101,10 +454,275 @@ type Agent interface {
 
 	// DefaultModel returns the default model to use if none is specified
 	DefaultModel() string
+
+	// ModelAlias maps a model alias (see ModelAliases) to a concrete model.
+	// Returns false if alias isn't one.
+	ModelAlias(alias string) (string, bool)
+
+	// KnownModels returns model names the agent's CLI is known to accept,
+	// used only to warn about likely typos. nil skips the check, for agents
+	// whose models can't be listed.
+	KnownModels() []string
+
+	// MaxPromptBytes returns the longest prompt, in bytes, the agent's CLI
+	// can be given, or 0 if there's no limit
+	MaxPromptBytes() int
+}
+
+// Model aliases accepted by -m in place of a concrete model name
+const (
+	ModelAliasFast    = "fast"    // cheaper, quicker model for simple tasks
+	ModelAliasSmart   = "smart"   // strongest model for complex tasks
+	ModelAliasDefault = "default" // the agent's DefaultModel
+)
+
+// ResolveModel returns the model ag should run with: its default model if
+// model is empty, the mapped model if model is an alias, or model itself
+func ResolveModel(ag Agent, model string) string {
+	if model == "" {
+		return ag.DefaultModel()
+	}
+	if resolved, ok := ag.ModelAlias(model); ok {
+		return resolved
+	}
+	return model
+}
+
+// CheckModel reports whether model is one of ag's KnownModels, and if not,
+// the closest known model as a suggestion ("" if none is close). Models
+// change often, so an unknown model is worth a warning, not a failure.
+func CheckModel(ag Agent, model string) (known bool, suggestion string) {
+	models := ag.KnownModels()
+	if len(models) == 0 {
+		return true, ""
+	}
+	best := -1
+	for _, m := range models {
+		if strings.EqualFold(m, model) {
+			return true, ""
+		}
+		d := editDistance(strings.ToLower(m), strings.ToLower(model))
+		// Further than a third of the name away isn't a typo
+		if d <= max(len(m)/3, 2) && (best < 0 || d < best) {
+			best, suggestion = d, m
+		}
+	}
+	return false, suggestion
+}
+
+// editDistance returns the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// ErrAgentNotInstalled is returned by Run when the agent CLI is missing from the session
+var ErrAgentNotInstalled = errors.New("agent not installed")
+
+// IsInstalled reports whether binary (a name or absolute path) resolves to an
+// executable in the session, searching the kernel user's usual install dirs
+func IsInstalled(ctx context.Context, client kernel.Client, sessionID, binary string) bool {
+	result, err := client.Browsers.Process.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
+		Command:    "bash",
+		Args:       []string{"-c", `export PATH="/home/kernel/.opencode/bin:/home/kernel/.local/bin:/usr/local/bin:$PATH" && command -v ` + binary},
+		TimeoutSec: kernel.Opt(int64(10)),
+	})
+	return err == nil && result.ExitCode == 0
+}
+
+// notInstalledError builds an actionable ErrAgentNotInstalled error
+func notInstalledError(name, binary string) error {
+	return fmt.Errorf("%w: %s (%s) was not found in the session; run without -s to set up a new session, or check the install output", ErrAgentNotInstalled, name, binary)
+}
+
+// installScript returns the bash command installing an agent: override if
+// it's set, otherwise def, with HOME pointing at the kernel user's home
+func installScript(override, def string) string {
+	if override != "" {
+		status(phaseInstall, DimStyle.Render("Using custom install command: "+override))
+		def = override
+	}
+	return "export HOME=/home/kernel && " + def
+}
+
+// DefaultWorkDir is the directory agents run in unless RunOptions.WorkDir is set
+const DefaultWorkDir = "/home/kernel"
+
+// runContext applies opts.Deadline, or else opts.AgentTimeout, to ctx
+func runContext(ctx context.Context, opts RunOptions) (context.Context, context.CancelFunc) {
+	if !opts.Deadline.IsZero() {
+		return context.WithDeadline(ctx, opts.Deadline)
+	}
+	if opts.AgentTimeout > 0 {
+		return context.WithTimeout(ctx, time.Duration(opts.AgentTimeout)*time.Second)
+	}
+	return ctx, func() {}
+}
+
+// workDir returns the directory the agent should run in
+func workDir(opts RunOptions) string {
+	if opts.WorkDir != "" {
+		return opts.WorkDir
+	}
+	return DefaultWorkDir
+}
+
+// checkWorkDir verifies that dir exists in the session before the agent is started
+func checkWorkDir(ctx context.Context, client kernel.Client, sessionID, dir string) error {
+	result, err := client.Browsers.Process.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
+		Command:    "bash",
+		Args:       []string{"-c", "test -d " + shellQuote(dir)},
+		TimeoutSec: kernel.Opt(int64(5)),
+	})
+	if err != nil {
+		return fmt.Errorf("check working directory: %w", err)
+	}
+	if result.ExitCode != 0 {
+		return fmt.Errorf("working directory %s does not exist in the session", dir)
+	}
+	return nil
+}
+
+// PromptFilePath is where prompts too long to embed in the agent command are
+// written in the session
+const PromptFilePath = "/tmp/playwriter-prompt.txt"
+
+// InlinePromptLimit is the longest prompt, in bytes, embedded in the agent
+// command. The command is passed to bash as one argument, and Linux caps a
+// single argument at 128 KiB ("argument list too long").
+var InlinePromptLimit = 64 * 1024
+
+// maxArgBytes is the longest single command-line argument Linux accepts:
+// 128 KiB including the terminating NUL
+const maxArgBytes = 128*1024 - 1
+
+// CheckPromptSize returns an error if prompt is longer than ag can be given
+// (see Agent.MaxPromptBytes)
+func CheckPromptSize(ag Agent, prompt string) error {
+	if limit := ag.MaxPromptBytes(); limit > 0 && len(prompt) > limit {
+		return fmt.Errorf("prompt is %d bytes, but %s takes at most %d; shorten it or use claude or opencode, which read long prompts from stdin", len(prompt), ag.Name(), limit)
+	}
+	return nil
+}
+
+// promptStaged reports whether prompt is too long to embed in the agent
+// command, so the agent reads it from PromptFilePath instead
+func promptStaged(prompt string) bool {
+	return len(prompt) > InlinePromptLimit
+}
+
+// stagePrompt writes prompt to PromptFilePath, readable by the kernel user, if
+// promptStaged says the agent should read it from there
+func stagePrompt(ctx context.Context, client kernel.Client, sessionID, prompt string) error {
+	if !promptStaged(prompt) {
+		return nil
+	}
+	debugf("prompt is %d bytes, passing it via %s", len(prompt), PromptFilePath)
+
+	if err := client.Browsers.Fs.WriteFile(ctx, sessionID, strings.NewReader(prompt), kernel.BrowserFWriteFileParams{
+		Path: PromptFilePath,
+	}); err != nil {
+		return fmt.Errorf("write prompt file: %w", err)
+	}
+	result, err := client.Browsers.Process.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
+		Command: "chown", Args: []string{"kernel:kernel", PromptFilePath},
+		AsRoot: kernel.Opt(true), TimeoutSec: kernel.Opt(int64(10)),
+	})
+	if err != nil {
+		return fmt.Errorf("chown prompt file: %w", err)
+	}
+	if result.ExitCode != 0 {
+		return fmt.Errorf("chown prompt file failed (exit %d): %s", result.ExitCode, DecodeB64(result.StderrB64))
+	}
+	return nil
+}
+
+// shellQuote single-quotes s for use as one bash word
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "'\"'\"'") + "'"
 }
 
-// DecodeB64 decodes a base64 string, returning empty string on error
+// shellJoin quotes each of words with shellQuote and joins them with spaces
+func shellJoin(words []string) string {
+	quoted := make([]string, len(words))
+	for i, w := range words {
+		quoted[i] = shellQuote(w)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// warnAutoApproveUnsupported warns that the agent can't disable auto-approval
+func warnAutoApproveUnsupported(name string, opts RunOptions) {
+	if !opts.AutoApprove {
+		status(phaseAgent, WarningStyle.Render(fmt.Sprintf("Warning: %s does not support -auto-approve=false; its configured permissions apply", name)))
+	}
+}
+
+// warnToolsUnsupported warns that the agent ignores tool restrictions in opts
+func warnToolsUnsupported(name string, opts RunOptions) {
+	if len(opts.AllowedTools) > 0 || len(opts.DisallowedTools) > 0 {
+		status(phaseAgent, WarningStyle.Render(fmt.Sprintf("Warning: %s does not support -allow-tool/-deny-tool; ignoring them", name)))
+	}
+}
+
+// Verbose enables debug output about the agent's process and output stream
+var Verbose bool
+
+// debugf prints a debug message to stderr when Verbose is set
+func debugf(format string, args ...any) {
+	if Verbose {
+		fmt.Fprintln(os.Stderr, DimStyle.Render("[debug] "+fmt.Sprintf(format, args...)))
+	}
+}
+
+// DecodeB64 decodes a base64 string, returning empty string on error. The
+// error is logged with -verbose.
 func DecodeB64(s string) string {
-	decoded, _ := base64.StdEncoding.DecodeString(s)
+	decoded, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		debugf("decode base64 (%d bytes): %v", len(s), err)
+		return ""
+	}
 	return string(decoded)
 }
+
+// WriteStdin sends data to the stdin of a process spawned in the session
+func WriteStdin(ctx context.Context, client kernel.Client, sessionID, processID string, data []byte) error {
+	_, err := client.Browsers.Process.Stdin(ctx, processID, kernel.BrowserProcessStdinParams{
+		ID:      sessionID,
+		DataB64: base64.StdEncoding.EncodeToString(data),
+	})
+	return err
+}
+
+// pipeStdin forwards everything read from r to the process stdin until r is
+// exhausted, a write fails, or ctx is cancelled
+func pipeStdin(ctx context.Context, runner ProcessRunner, processID string, r io.Reader) {
+	buf := make([]byte, 4096)
+	for ctx.Err() == nil {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if werr := runner.WriteStdin(ctx, processID, buf[:n]); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,655 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os/exec"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPromptPathSelection(t *testing.T) {
+	short := "open example.com"
+	long := strings.Repeat("x", InlinePromptLimit+1)
+	tests := []struct {
+		name      string
+		agent     Agent
+		line      string // prefix of the line running the agent
+		prompt    string
+		want      string
+		forbidden string
+	}{
+		{"claude inline", &ClaudeAgent{}, "/usr/local/bin/claude ", short, `"open example.com"`, PromptFilePath},
+		{"claude staged", &ClaudeAgent{}, "/usr/local/bin/claude ", long, "< " + PromptFilePath, long},
+		{"opencode inline", &OpenCodeAgent{}, "/home/kernel/.opencode/bin/opencode ", short, `"open example.com"`, PromptFilePath},
+		{"opencode staged", &OpenCodeAgent{}, "/home/kernel/.opencode/bin/opencode ", long, "< " + PromptFilePath, "$(cat"},
+		{"cursor inline", &CursorAgent{}, "export HOME=", short, `open example.com`, PromptFilePath},
+		{"cursor staged", &CursorAgent{}, "export HOME=", long, `$(cat ` + PromptFilePath + ")", long},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			line := commandLine(t, tt.agent.Command(RunOptions{Prompt: tt.prompt}), tt.line)
+			if !strings.Contains(line, tt.want) {
+				t.Errorf("missing %q in:\n%.300s", tt.want, line)
+			}
+			if strings.Contains(line, tt.forbidden) {
+				t.Errorf("unexpected %.40q in:\n%.300s", tt.forbidden, line)
+			}
+		})
+	}
+}
+
+func TestCheckPromptSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		agent   Agent
+		size    int
+		wantErr bool
+	}{
+		{"cursor inline", &CursorAgent{}, InlinePromptLimit, false},
+		{"cursor staged within the argument limit", &CursorAgent{}, maxArgBytes, false},
+		{"cursor over the argument limit", &CursorAgent{}, maxArgBytes + 1, true},
+		{"claude reads stdin", &ClaudeAgent{}, 1 << 20, false},
+		{"opencode reads stdin", &OpenCodeAgent{}, 1 << 20, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckPromptSize(tt.agent, strings.Repeat("x", tt.size))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CheckPromptSize(%d bytes) = %v, wantErr %v", tt.size, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfigDirQuoting(t *testing.T) {
+	dir := `/tmp/it's a "dir" $HOME`
+	tests := []struct {
+		name   string
+		agent  Agent
+		envVar string
+	}{
+		{"claude", &ClaudeAgent{ConfigDir: dir}, "CLAUDE_CONFIG_DIR"},
+		{"cursor", &CursorAgent{ConfigDir: dir}, "XDG_CONFIG_HOME"},
+		{"opencode", &OpenCodeAgent{ConfigDir: dir}, "XDG_CONFIG_HOME"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := tt.agent.Command(RunOptions{Prompt: "hi"})
+			// Pick out the export, whether on its own line or in a && chain
+			var export string
+			for _, line := range strings.Split(cmd, "\n") {
+				for _, part := range strings.Split(line, " && ") {
+					if strings.HasPrefix(part, "export "+tt.envVar+"=") {
+						export = part
+					}
+				}
+			}
+			if export == "" {
+				t.Fatalf("no %s export in:\n%s", tt.envVar, cmd)
+			}
+			out, err := exec.Command("bash", "-c", export+` && printf %s "$`+tt.envVar+`"`).CombinedOutput()
+			if err != nil {
+				t.Fatalf("%s: %v: %s", export, err, out)
+			}
+			if string(out) != dir {
+				t.Errorf("%s = %q, want %q", tt.envVar, out, dir)
+			}
+		})
+	}
+}
+
+func TestShellJoin(t *testing.T) {
+	words := []string{"/plain", "/with space", "/it's"}
+	out, err := exec.Command("bash", "-c", `printf '%s\n' `+shellJoin(words)).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n"); !slices.Equal(got, words) {
+		t.Errorf("bash read %q, want %q", got, words)
+	}
+}
+
+func TestValidateMCPConfig(t *testing.T) {
+	stdio := MCPServer{Command: "node", Args: []string{"cli.js"}}
+	tests := []struct {
+		name    string
+		servers map[string]MCPServer
+		wantErr string // substring; "" for valid
+	}{
+		{name: "stdio server", servers: map[string]MCPServer{"playwriter": stdio}},
+		{name: "http and sse servers", servers: map[string]MCPServer{
+			"docs":   {Type: "http", URL: "https://mcp.example.com"},
+			"events": {Type: "sse", URL: "https://mcp.example.com/sse"},
+		}},
+		{name: "empty map", servers: map[string]MCPServer{}, wantErr: "mcpServers is empty"},
+		{name: "nil map", wantErr: "mcpServers is empty"},
+		{name: "missing command", servers: map[string]MCPServer{"playwriter": {Args: []string{"x"}}}, wantErr: `server "playwriter": command is empty`},
+		{name: "blank command", servers: map[string]MCPServer{"playwriter": {Command: "  "}}, wantErr: `server "playwriter": command is empty`},
+		{name: "http without a url", servers: map[string]MCPServer{"docs": {Type: "http", Command: "node"}}, wantErr: `server "docs": url is empty`},
+		{name: "unknown type", servers: map[string]MCPServer{"docs": {Type: "websocket", URL: "wss://x"}}, wantErr: `unknown type "websocket"`},
+		{name: "invalid name", servers: map[string]MCPServer{"play writer": stdio}, wantErr: `server name "play writer"`},
+		{name: "duplicate names", servers: map[string]MCPServer{"Playwriter": stdio, "playwriter": stdio}, wantErr: `"Playwriter" and "playwriter" differ only in case`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateMCPConfig(MCPConfig{MCPServers: tt.servers})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("ValidateMCPConfig() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ValidateMCPConfig() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfigureMCPValidates(t *testing.T) {
+	invalid := MCPConfig{MCPServers: map[string]MCPServer{"playwriter": {}}}
+	for _, ag := range []Agent{&ClaudeAgent{}, &CursorAgent{}, &OpenCodeAgent{}} {
+		t.Run(ag.Name(), func(t *testing.T) {
+			fake, client := newFakeKernel(t)
+			if err := ag.ConfigureMCP(context.Background(), client, testSessionID, invalid); err == nil {
+				t.Error("invalid config accepted")
+			}
+			if len(fake.execs) != 0 {
+				t.Errorf("ran %d commands before rejecting the config", len(fake.execs))
+			}
+		})
+	}
+}
+
+func TestConfigureMCPTransports(t *testing.T) {
+	config := MCPConfig{MCPServers: map[string]MCPServer{
+		"playwriter": {Command: "node", Args: []string{"cli.js"}},
+		"docs":       {Type: MCPTransportHTTP, URL: "https://mcp.example.com", Headers: map[string]string{"Authorization": "Bearer x"}},
+		"events":     {Type: MCPTransportSSE, URL: "https://mcp.example.com/sse"},
+	}}
+	tests := []struct {
+		name  string
+		agent Agent
+		paths []string
+		want  string // servers in the agent's format
+	}{
+		{
+			name:  "claude",
+			agent: &ClaudeAgent{},
+			paths: []string{"/home/kernel/.mcp.json"},
+			want: `{"mcpServers":{
+				"docs":{"type":"http","url":"https://mcp.example.com","headers":{"Authorization":"Bearer x"}},
+				"events":{"type":"sse","url":"https://mcp.example.com/sse"},
+				"playwriter":{"command":"node","args":["cli.js"]}}}`,
+		},
+		{
+			name:  "cursor",
+			agent: &CursorAgent{},
+			paths: []string{"/home/kernel/.cursor/mcp.json", "/home/kernel/.config/cursor/mcp.json"},
+			want: `{"mcpServers":{
+				"docs":{"url":"https://mcp.example.com","headers":{"Authorization":"Bearer x"}},
+				"events":{"url":"https://mcp.example.com/sse"},
+				"playwriter":{"command":"node","args":["cli.js"]}}}`,
+		},
+		{
+			name:  "opencode",
+			agent: &OpenCodeAgent{},
+			paths: []string{"/home/kernel/.config/opencode/opencode.json"},
+			want: `{"mcp":{
+				"docs":{"type":"remote","url":"https://mcp.example.com","headers":{"Authorization":"Bearer x"},"enabled":true},
+				"events":{"type":"remote","url":"https://mcp.example.com/sse","enabled":true},
+				"playwriter":{"type":"local","command":["node","cli.js"],"enabled":true}}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, client := newFakeKernel(t)
+			if err := tt.agent.ConfigureMCP(context.Background(), client, testSessionID, config); err != nil {
+				t.Fatal(err)
+			}
+			for _, path := range tt.paths {
+				assertJSONFile(t, fake, path, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigureMCPServerName(t *testing.T) {
+	const cli = "/home/kernel/playwriter/playwriter/dist/cli.js"
+	tests := []struct {
+		name       string
+		serverName string
+		agent      Agent
+		path       string
+		want       string
+	}{
+		{
+			name:  "claude default",
+			agent: &ClaudeAgent{},
+			path:  "/home/kernel/.mcp.json",
+			want:  `{"mcpServers":{"playwriter":{"command":"node","args":["` + cli + `"]}}}`,
+		},
+		{
+			name:       "claude",
+			serverName: "browser",
+			agent:      &ClaudeAgent{},
+			path:       "/home/kernel/.mcp.json",
+			want:       `{"mcpServers":{"browser":{"command":"node","args":["` + cli + `"]}}}`,
+		},
+		{
+			name:       "cursor",
+			serverName: "browser",
+			agent:      &CursorAgent{},
+			path:       "/home/kernel/.cursor/mcp.json",
+			want:       `{"mcpServers":{"browser":{"command":"node","args":["` + cli + `"]}}}`,
+		},
+		{
+			name:       "opencode",
+			serverName: "browser",
+			agent:      &OpenCodeAgent{},
+			path:       "/home/kernel/.config/opencode/opencode.json",
+			want:       `{"mcp":{"browser":{"type":"local","command":["node","` + cli + `"],"enabled":true}}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, client := newFakeKernel(t)
+			if err := tt.agent.ConfigureMCP(context.Background(), client, testSessionID, PlaywriterMCPConfig(tt.serverName, "")); err != nil {
+				t.Fatal(err)
+			}
+			assertJSONFile(t, fake, tt.path, tt.want)
+		})
+	}
+}
+
+func TestTextOutputCommand(t *testing.T) {
+	tests := []struct {
+		name     string
+		command  func(RunOptions, PTYVariant) string
+		jsonArgs []string // only in JSON mode
+		textArgs []string // only in text mode
+	}{
+		{
+			name:     "claude",
+			command:  (&ClaudeAgent{}).command,
+			jsonArgs: []string{"--verbose", "--output-format stream-json", "--include-partial-messages"},
+			textArgs: []string{"--output-format text"},
+		},
+		{
+			name:     "cursor",
+			command:  (&CursorAgent{}).command,
+			jsonArgs: []string{"--output-format stream-json"},
+			textArgs: []string{"--output-format text"},
+		},
+		{
+			name:     "opencode",
+			command:  (&OpenCodeAgent{}).command,
+			jsonArgs: []string{"--format json"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, text := range []bool{false, true} {
+				cmd := tt.command(RunOptions{Prompt: "hi", StreamText: true, TextOutput: text}, PTYNone)
+				want, unwanted := tt.jsonArgs, tt.textArgs
+				if text {
+					want, unwanted = tt.textArgs, tt.jsonArgs
+				}
+				for _, arg := range want {
+					if !strings.Contains(cmd, arg) {
+						t.Errorf("TextOutput=%v: %s missing:\n%s", text, arg, cmd)
+					}
+				}
+				for _, arg := range unwanted {
+					if strings.Contains(cmd, arg) {
+						t.Errorf("TextOutput=%v: unexpected %s:\n%s", text, arg, cmd)
+					}
+				}
+			}
+		})
+	}
+}
+
+// assertJSONFile checks that the fake session's file at path holds the same
+// JSON as want
+func assertJSONFile(t *testing.T, fake *fakeKernel, path, want string) {
+	t.Helper()
+	written, ok := fake.files[path]
+	if !ok {
+		t.Fatalf("%s not written; files: %v", path, slices.Collect(maps.Keys(fake.files)))
+	}
+	var got, wantJSON any
+	if err := json.Unmarshal([]byte(written), &got); err != nil {
+		t.Fatalf("%s isn't valid JSON: %v\n%s", path, err, written)
+	}
+	if err := json.Unmarshal([]byte(want), &wantJSON); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, wantJSON) {
+		t.Errorf("%s =\n%s\nwant\n%s", path, written, want)
+	}
+}
+
+func TestAutoApproveArgs(t *testing.T) {
+	tests := []struct {
+		name        string
+		agent       Agent
+		line        string
+		autoApprove bool
+		want        []string
+		forbidden   []string
+	}{
+		{"cursor enabled", &CursorAgent{}, "export HOME=", true, []string{"cursor-agent -f --approve-mcps --output-format"}, nil},
+		{"cursor disabled", &CursorAgent{}, "export HOME=", false, []string{"cursor-agent --output-format"}, []string{" -f ", "--approve-mcps"}},
+		{"claude enabled", &ClaudeAgent{}, "/usr/local/bin/claude ", true, []string{" --dangerously-skip-permissions"}, nil},
+		{"claude disabled", &ClaudeAgent{}, "/usr/local/bin/claude ", false, nil, []string{"--dangerously-skip-permissions"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			line := commandLine(t, tt.agent.Command(RunOptions{Prompt: "hi", AutoApprove: tt.autoApprove}), tt.line)
+			for _, want := range tt.want {
+				if !strings.Contains(line, want) {
+					t.Errorf("missing %q in:\n%s", want, line)
+				}
+			}
+			for _, forbidden := range tt.forbidden {
+				if strings.Contains(line, forbidden) {
+					t.Errorf("unexpected %q in:\n%s", forbidden, line)
+				}
+			}
+		})
+	}
+}
+
+func TestResolveModel(t *testing.T) {
+	tests := []struct {
+		agent Agent
+		model string
+		want  string
+	}{
+		{&ClaudeAgent{}, "", "opus-4.5"},
+		{&ClaudeAgent{}, ModelAliasFast, "haiku"},
+		{&ClaudeAgent{}, ModelAliasSmart, "opus"},
+		{&ClaudeAgent{}, ModelAliasDefault, "opus-4.5"},
+		{&ClaudeAgent{}, "claude-sonnet-4-5", "claude-sonnet-4-5"},
+		{&CursorAgent{}, ModelAliasFast, "sonnet-4.5"},
+		{&CursorAgent{}, ModelAliasSmart, "opus-4.5"},
+		{&CursorAgent{}, ModelAliasDefault, "opus-4.5"},
+		{&CursorAgent{}, "gpt-5", "gpt-5"},
+		{&OpenCodeAgent{}, ModelAliasFast, "anthropic/claude-haiku-4-5"},
+		{&OpenCodeAgent{}, ModelAliasSmart, "anthropic/claude-opus-4-5"},
+		{&OpenCodeAgent{}, ModelAliasDefault, "anthropic/claude-opus-4-5"},
+		{&OpenCodeAgent{}, "openai/gpt-5", "openai/gpt-5"},
+		// Aliases are exact; anything else is a literal model name
+		{&ClaudeAgent{}, "Fast", "Fast"},
+	}
+	for _, tt := range tests {
+		if got := ResolveModel(tt.agent, tt.model); got != tt.want {
+			t.Errorf("%s: ResolveModel(%q) = %q, want %q", tt.agent.Name(), tt.model, got, tt.want)
+		}
+	}
+}
+
+func TestInstallCommand(t *testing.T) {
+	const custom = "npm install -g my-fork@1.2.3"
+	tests := []struct {
+		name  string
+		agent Agent
+		want  string
+	}{
+		{"cursor default", &CursorAgent{}, "curl -fsSL https://cursor.com/install | bash"},
+		{"cursor override", &CursorAgent{InstallCommand: custom}, custom},
+		{"claude default", &ClaudeAgent{}, "flock /tmp/npm-global.lock npm install -g @anthropic-ai/claude-code"},
+		{"claude override", &ClaudeAgent{InstallCommand: custom}, custom},
+		{"opencode default", &OpenCodeAgent{}, "curl -fsSL https://opencode.ai/install | bash"},
+		{"opencode override", &OpenCodeAgent{InstallCommand: custom}, custom},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, client := newFakeKernel(t)
+			if err := tt.agent.Install(context.Background(), client, testSessionID); err != nil {
+				t.Fatal(err)
+			}
+			want := "export HOME=/home/kernel && " + tt.want
+			if calls := fake.ran(want); len(calls) != 1 || calls[0].Args[1] != want {
+				t.Errorf("install commands %v, want exactly %q", fake.execs, want)
+			}
+
+			fake.exec = func(call execCall) (int, string) { return 1, "" }
+			if err := tt.agent.Install(context.Background(), client, testSessionID); err == nil || !strings.Contains(err.Error(), "exit 1") {
+				t.Errorf("failed install err = %v, want the exit code", err)
+			}
+		})
+	}
+}
+
+func TestTeeHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		handlers int
+		nils     []int // indexes of nil handlers
+	}{
+		{name: "none", handlers: 0},
+		{name: "one", handlers: 1},
+		{name: "several in order", handlers: 3},
+		{name: "nil handlers skipped", handlers: 4, nils: []int{0, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got, want []string
+			handlers := make([]StreamHandler, tt.handlers)
+			for i := range handlers {
+				if slices.Contains(tt.nils, i) {
+					continue
+				}
+				handlers[i] = func(event StreamEvent) { got = append(got, fmt.Sprintf("%d:%s", i, event.Type)) }
+			}
+			for _, eventType := range []string{"system", "result"} {
+				for i := range handlers {
+					if handlers[i] != nil {
+						want = append(want, fmt.Sprintf("%d:%s", i, eventType))
+					}
+				}
+			}
+
+			tee := TeeHandler(handlers...)
+			tee(StreamEvent{Type: "system"})
+			tee(StreamEvent{Type: "result"})
+			if !slices.Equal(got, want) {
+				t.Errorf("handled %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	deadline := time.Now().Add(time.Hour)
+	tests := []struct {
+		name   string
+		opts   RunOptions
+		parent time.Duration // parent context timeout; 0 for none
+		want   time.Duration // deadline from now; 0 for none
+	}{
+		{name: "neither"},
+		{name: "agent timeout", opts: RunOptions{AgentTimeout: 90}, want: 90 * time.Second},
+		{name: "deadline", opts: RunOptions{Deadline: deadline}, want: time.Hour},
+		{name: "deadline beats agent timeout", opts: RunOptions{Deadline: deadline, AgentTimeout: 90}, want: time.Hour},
+		{name: "parent deadline kept", opts: RunOptions{AgentTimeout: 90}, parent: time.Minute, want: time.Minute},
+		{name: "parent deadline without limits", parent: time.Minute, want: time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := context.Background()
+			if tt.parent > 0 {
+				var cancel context.CancelFunc
+				parent, cancel = context.WithTimeout(parent, tt.parent)
+				defer cancel()
+			}
+			ctx, cancel := runContext(parent, tt.opts)
+			defer cancel()
+
+			got, ok := ctx.Deadline()
+			if tt.want == 0 {
+				if ok {
+					t.Errorf("deadline %v, want none", got)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("no deadline, want %v from now", tt.want)
+			}
+			if diff := time.Until(got) - tt.want; diff > time.Second || diff < -time.Second {
+				t.Errorf("deadline %v from now, want %v", time.Until(got), tt.want)
+			}
+		})
+	}
+
+	// A deadline already past ends the run straight away
+	ctx, cancel := runContext(context.Background(), RunOptions{Deadline: time.Now().Add(-time.Second), AgentTimeout: 90})
+	defer cancel()
+	if ctx.Err() != context.DeadlineExceeded {
+		t.Errorf("ctx.Err() = %v, want DeadlineExceeded", ctx.Err())
+	}
+}
+
+func TestCheckModel(t *testing.T) {
+	tests := []struct {
+		agent          Agent
+		model          string
+		wantKnown      bool
+		wantSuggestion string
+	}{
+		{&CursorAgent{}, "sonnet-4.5", true, ""},
+		{&CursorAgent{}, "Sonnet-4.5", true, ""},
+		{&CursorAgent{}, "sonet-4.5", false, "sonnet-4.5"},
+		{&CursorAgent{}, "gpt5", false, "gpt-5"},
+		{&CursorAgent{}, "llama-3-70b", false, ""},
+		{&ClaudeAgent{}, "claude-sonnet-4-5", true, ""},
+		{&ClaudeAgent{}, "claude-sonet-4-5", false, "claude-sonnet-4-5"},
+		{&ClaudeAgent{}, "opsu", false, "opus"},
+		{&ClaudeAgent{}, "gpt-5", false, ""},
+		{&OpenCodeAgent{}, "anthropic/claude-sonnet-4-5", true, ""},
+		{&OpenCodeAgent{}, "anything", true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.agent.Name()+"/"+tt.model, func(t *testing.T) {
+			known, suggestion := CheckModel(tt.agent, tt.model)
+			if known != tt.wantKnown || suggestion != tt.wantSuggestion {
+				t.Errorf("CheckModel(%q) = %v, %q, want %v, %q", tt.model, known, suggestion, tt.wantKnown, tt.wantSuggestion)
+			}
+		})
+	}
+
+	// Defaults and aliases never trigger the warning
+	for _, ag := range []Agent{&CursorAgent{}, &ClaudeAgent{}, &OpenCodeAgent{}} {
+		for _, alias := range []string{"", ModelAliasFast, ModelAliasSmart, ModelAliasDefault} {
+			if model := ResolveModel(ag, alias); model != "" {
+				if known, _ := CheckModel(ag, model); !known {
+					t.Errorf("%s: %q resolves to unknown model %q", ag.Name(), alias, model)
+				}
+			}
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"opus", "", 4},
+		{"opus", "opus", 0},
+		{"opus", "opsu", 2},
+		{"sonnet", "sonet", 1},
+		{"kitten", "sitting", 3},
+	}
+	for _, tt := range tests {
+		if got := editDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestMessageComplete(t *testing.T) {
+	opencode := (&OpenCodeAgent{}).decodeEvent
+	tests := []struct {
+		name   string
+		decode DecodeFunc
+		line   string
+		want   bool
+	}{
+		{"cursor message", decodeStreamEvent, `{"type":"assistant","message":{"role":"assistant","content":[{"type":"text","text":"Done"}]},"session_id":"c1"}`, true},
+		{"claude message", decodeStreamEvent, `{"type":"assistant","message":{"content":[{"type":"text","text":"Done"}]},"session_id":"s1"}`, true},
+		{"claude tool use message", decodeStreamEvent, `{"type":"assistant","message":{"content":[{"type":"tool_use","name":"mcp__playwriter__execute","input":{}}]}}`, true},
+		{"claude delta", decodeStreamEvent, `{"type":"stream_event","event":{"type":"content_block_delta","delta":{"type":"text_delta","text":"Do"}}}`, false},
+		{"tool call", decodeStreamEvent, `{"type":"tool_call","subtype":"started"}`, false},
+		{"result", decodeStreamEvent, `{"type":"result","subtype":"success","result":"Done"}`, false},
+		{"opencode finished part", opencode, `{"type":"text","sessionID":"ses_1","part":{"text":"Done","time":{"start":1700000000000,"end":1700000001000}}}`, true},
+		{"opencode untimed part", opencode, `{"type":"text","sessionID":"ses_1","part":{"text":"Done"}}`, true},
+		{"opencode part in progress", opencode, `{"type":"text","sessionID":"ses_1","part":{"text":"Do","time":{"start":1700000000000}}}`, false},
+		{"opencode tool use", opencode, `{"type":"tool_use","sessionID":"ses_1","part":{"tool":"playwriter_execute","state":{"status":"running"}}}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, ok := tt.decode([]byte(tt.line))
+			if !ok {
+				t.Fatalf("line not decoded: %s", tt.line)
+			}
+			if got := IsMessageComplete(event); got != tt.want {
+				t.Errorf("IsMessageComplete() = %v (type %q, subtype %q), want %v", got, event.Type, event.Subtype, tt.want)
+			}
+		})
+	}
+}
+
+func TestExternalRelayMCPConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		server   string
+		wantName string
+	}{
+		{"default name", "", PlaywriterServerName},
+		{"custom name", "browser", "browser"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := ExternalRelayMCPConfig(tt.server, "https://relay.example.com")
+			server, ok := config.MCPServers[tt.wantName]
+			if !ok || len(config.MCPServers) != 1 {
+				t.Fatalf("servers = %v, want only %q", config.MCPServers, tt.wantName)
+			}
+			wantArgs := []string{"-y", "playwriter@latest", "--host", "https://relay.example.com"}
+			if server.Command != "npx" || !slices.Equal(server.Args, wantArgs) {
+				t.Errorf("server = %s %q, want npx %q", server.Command, server.Args, wantArgs)
+			}
+			if err := ValidateMCPConfig(config); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestContentBlockResultText(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{``, ""},
+		{`"Example Domain"`, "Example Domain"},
+		{`[{"type":"text","text":"line one"},{"type":"image","source":{}},{"type":"text","text":"line two"}]`, "line one\nline two"},
+		{`{"unexpected":true}`, ""},
+	}
+	for _, tt := range tests {
+		block := ContentBlock{Type: "tool_result", Content: json.RawMessage(tt.content)}
+		if got := block.ResultText(); got != tt.want {
+			t.Errorf("ResultText() of %s = %q, want %q", tt.content, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"context"
+	"strings"
+)
+
+// approvalTypes are event types and subtypes agents use to request tool approval
+var approvalTypes = map[string]bool{
+	"approval_request":    true,
+	"permission_request":  true,
+	"approval_required":   true,
+	"permission_required": true,
+	"awaiting_approval":   true,
+}
+
+// AutoApprovedEventType replaces an approval request the run loop answered
+// itself under RunOptions.ApproveTools. The rest of the event is unchanged.
+const AutoApprovedEventType = "auto_approved"
+
+// approvalResponse is written to the agent's stdin to approve a request
+const approvalResponse = "y\n"
+
+// IsApprovalRequest reports whether an event asks for tool approval. Agents run
+// non-interactively, so such a request would otherwise look like a silent hang.
+func IsApprovalRequest(event StreamEvent) bool {
+	return approvalTypes[event.Type] || approvalTypes[event.Subtype]
+}
+
+// ApprovalTool returns the name of the tool an approval request is for, or
+// "" if the event doesn't say
+func ApprovalTool(event StreamEvent) string {
+	if name := event.ToolCall.MCPToolCall.Args.Name; name != "" {
+		return name
+	}
+	return event.ToolCall.MCPToolCall.Args.ToolName
+}
+
+// ApprovalPolicy lists the tools whose approval requests are answered
+// automatically. Entries match tool names ignoring case; an entry ending in
+// "*" matches by prefix, e.g. "mcp__playwriter__*".
+type ApprovalPolicy []string
+
+// Approves reports whether tool's approval requests are answered automatically
+func (p ApprovalPolicy) Approves(tool string) bool {
+	if tool == "" {
+		return false
+	}
+	tool = strings.ToLower(tool)
+	for _, entry := range p {
+		entry = strings.ToLower(entry)
+		if prefix, ok := strings.CutSuffix(entry, "*"); ok {
+			if strings.HasPrefix(tool, prefix) {
+				return true
+			}
+		} else if tool == entry {
+			return true
+		}
+	}
+	return false
+}
+
+// answerApproval approves event on the process's stdin if it's an approval
+// request for a tool policy approves, returning the AutoApprovedEventType
+// event to hand on instead. Other events are returned unchanged.
+func answerApproval(ctx context.Context, runner ProcessRunner, processID string, policy ApprovalPolicy, event StreamEvent) StreamEvent {
+	if len(policy) == 0 || processID == "" || !IsApprovalRequest(event) {
+		return event
+	}
+	tool := ApprovalTool(event)
+	if !policy.Approves(tool) {
+		return event
+	}
+	if err := runner.WriteStdin(ctx, processID, []byte(approvalResponse)); err != nil {
+		debugf("approval: answering %s: %v", tool, err)
+		return event
+	}
+	// The approval is ours now; the request's JSON no longer describes it
+	event.Type, event.Subtype = AutoApprovedEventType, ""
+	event.Raw = nil
+	return event
+}
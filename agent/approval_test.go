@@ -0,0 +1,84 @@
+package agent
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestApprovalPolicyApproves(t *testing.T) {
+	policy := ApprovalPolicy{"mcp__playwriter__*", "Read", "navigate"}
+	tests := []struct {
+		tool string
+		want bool
+	}{
+		{"mcp__playwriter__execute", true},
+		{"MCP__Playwriter__Screenshot", true},
+		{"mcp__playwriter__", true},
+		{"mcp__other__execute", false},
+		{"read", true},
+		{"ReadFile", false},
+		{"navigate", true},
+		{"navigate_back", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := policy.Approves(tt.tool); got != tt.want {
+			t.Errorf("Approves(%q) = %v, want %v", tt.tool, got, tt.want)
+		}
+	}
+	if (ApprovalPolicy{}).Approves("navigate") {
+		t.Error("empty policy approved a tool")
+	}
+	if (ApprovalPolicy{"*"}).Approves("") {
+		t.Error("request without a tool name approved")
+	}
+}
+
+func TestAnswerApproval(t *testing.T) {
+	request := func(eventType, subtype, tool string) StreamEvent {
+		var event StreamEvent
+		event.Type, event.Subtype = eventType, subtype
+		event.ToolCall.MCPToolCall.Args.ToolName = tool
+		event.Raw = []byte(`{"type":"` + eventType + `"}`)
+		return event
+	}
+	policy := ApprovalPolicy{"mcp__playwriter__*"}
+	tests := []struct {
+		name         string
+		policy       ApprovalPolicy
+		processID    string
+		event        StreamEvent
+		wantApproved bool
+	}{
+		{"approved by type", policy, "proc-1", request("approval_request", "", "mcp__playwriter__execute"), true},
+		{"approved by subtype", policy, "proc-1", request("tool_call", "permission_required", "mcp__playwriter__execute"), true},
+		{"tool not in policy", policy, "proc-1", request("approval_request", "", "Bash"), false},
+		{"no tool named", policy, "proc-1", request("approval_request", "", ""), false},
+		{"no policy", nil, "proc-1", request("approval_request", "", "mcp__playwriter__execute"), false},
+		{"no process to answer", policy, "", request("approval_request", "", "mcp__playwriter__execute"), false},
+		{"not a request", policy, "proc-1", request("tool_call", "started", "mcp__playwriter__execute"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := &fakeRunner{}
+			got := answerApproval(context.Background(), runner, tt.processID, tt.policy, tt.event)
+
+			wantStdin := []string(nil)
+			if tt.wantApproved {
+				wantStdin = []string{approvalResponse}
+				if got.Type != AutoApprovedEventType || got.Subtype != "" || got.Raw != nil {
+					t.Errorf("event = %s/%s raw %s, want %s without the request's JSON", got.Type, got.Subtype, got.Raw, AutoApprovedEventType)
+				}
+				if ApprovalTool(got) != ApprovalTool(tt.event) {
+					t.Errorf("tool = %q, want it kept", ApprovalTool(got))
+				}
+			} else if got.Type != tt.event.Type || got.Subtype != tt.event.Subtype || got.Raw == nil {
+				t.Errorf("event = %s/%s, want it unchanged", got.Type, got.Subtype)
+			}
+			if !slices.Equal(runner.stdin, wantStdin) {
+				t.Errorf("stdin = %q, want %q", runner.stdin, wantStdin)
+			}
+		})
+	}
+}
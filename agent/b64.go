@@ -0,0 +1,38 @@
+package agent
+
+import (
+	"encoding/base64"
+	"strings"
+)
+
+// B64Chunks decodes process output arriving as base64 stream events. The
+// Kernel API encodes each chunk of output on its own, so every event should
+// carry whole base64, but nothing guarantees it; a payload split mid-quantum
+// would otherwise decode to garbage. Data is buffered per stream until whole
+// 4-character quanta have arrived.
+type B64Chunks map[string]string
+
+// Decode appends data to stream's pending base64 and returns the bytes of
+// every complete quantum. Payloads may follow each other without a break, so
+// the input is decoded in segments ending at padding. Data that doesn't
+// decode is dropped and logged with -verbose.
+func (c B64Chunks) Decode(stream, data string) string {
+	pending := c[stream] + data
+	n := len(pending) - len(pending)%4
+	c[stream] = pending[n:]
+
+	var out strings.Builder
+	start := 0
+	for i := 0; i < n; i += 4 {
+		if i+4 == n || strings.Contains(pending[i:i+4], "=") {
+			decoded, err := base64.StdEncoding.DecodeString(pending[start : i+4])
+			if err != nil {
+				debugf("stream: dropping %d bytes of invalid base64 on %q: %v", i+4-start, stream, err)
+			} else {
+				out.Write(decoded)
+			}
+			start = i + 4
+		}
+	}
+	return out.String()
+}
@@ -0,0 +1,59 @@
+package agent
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestB64ChunksDecode(t *testing.T) {
+	enc := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	hello := enc("hello") // aGVsbG8=
+	tests := []struct {
+		name   string
+		chunks []string // base64 received on one stream, in order
+		want   string
+	}{
+		{"whole payload", []string{hello}, "hello"},
+		{"split mid-quantum", []string{hello[:3], hello[3:]}, "hello"},
+		{"split in every quantum", []string{hello[:1], hello[1:5], hello[5:7], hello[7:]}, "hello"},
+		{"payloads back to back", []string{hello + enc("hi")}, "hellohi"},
+		{"padded payloads split across events", []string{hello[:6], hello[6:] + enc("hi")[:2], enc("hi")[2:]}, "hellohi"},
+		{"invalid data dropped", []string{"!!!!", hello}, "hello"},
+		{"incomplete quantum held back", []string{hello[:6]}, "hel"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := B64Chunks{}
+			var got strings.Builder
+			for _, data := range tt.chunks {
+				got.WriteString(chunks.Decode("stdout", data))
+			}
+			if got.String() != tt.want {
+				t.Errorf("decoded %q, want %q", got.String(), tt.want)
+			}
+		})
+	}
+
+	// Streams are buffered separately
+	chunks := B64Chunks{}
+	out := chunks.Decode("stdout", hello[:3]) + chunks.Decode("stderr", enc("err")) + chunks.Decode("stdout", hello[3:])
+	if out != "errhello" {
+		t.Errorf("interleaved streams decoded %q, want %q", out, "errhello")
+	}
+}
+
+func TestDecodeB64(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{base64.StdEncoding.EncodeToString([]byte("ok\n")), "ok\n"},
+		{"", ""},
+		{"not base64!", ""},
+	}
+	for _, tt := range tests {
+		if got := DecodeB64(tt.in); got != tt.want {
+			t.Errorf("DecodeB64(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -5,13 +5,31 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
-	"time"
 
 	"github.com/onkernel/kernel-go-sdk"
 )
 
 // ClaudeAgent implements the Agent interface for Anthropic's Claude Code CLI
-type ClaudeAgent struct{}
+type ClaudeAgent struct {
+	// ConfigDir overrides Claude's config directory (CLAUDE_CONFIG_DIR).
+	// Empty uses the default ~/.claude with the MCP config at ~/.mcp.json.
+	ConfigDir string
+
+	// InstallCommand, if set, replaces the default install command. It runs
+	// with bash as root, with HOME=/home/kernel.
+	InstallCommand string
+
+	// ReplaceMCP makes ConfigureMCP overwrite the MCP config instead of
+	// merging into servers already configured in the session
+	ReplaceMCP bool
+
+	// OutputFile, if set, has the agent write its output stream to this file
+	// in the session, which is tailed instead of the PTY's stdout
+	OutputFile string
+}
+
+// claudeVersionCmd prints the installed Claude Code version
+const claudeVersionCmd = "/usr/local/bin/claude --version"
 
 // NewClaudeAgent creates a new Claude agent
 func NewClaudeAgent() *ClaudeAgent {
@@ -33,18 +51,62 @@ func (a *ClaudeAgent) DefaultModel() string {
 	return "opus-4.5"
 }
 
+// ModelAlias maps the fast, smart, and default aliases to Claude models
+func (a *ClaudeAgent) ModelAlias(alias string) (string, bool) {
+	switch alias {
+	case ModelAliasFast:
+		return "haiku", true
+	case ModelAliasSmart:
+		return "opus", true
+	case ModelAliasDefault:
+		return a.DefaultModel(), true
+	}
+	return "", false
+}
+
+// MaxPromptBytes returns 0: long prompts are read from stdin
+func (a *ClaudeAgent) MaxPromptBytes() int {
+	return 0
+}
+
+// KnownModels returns the models Claude accepts with --model
+func (a *ClaudeAgent) KnownModels() []string {
+	return []string{
+		"opus", "sonnet", "haiku", "opusplan", "opus-4.5",
+		"claude-opus-4-5", "claude-sonnet-4-5", "claude-haiku-4-5",
+	}
+}
+
 // ProviderEnvVars returns nil since Claude only needs ANTHROPIC_API_KEY
 func (a *ClaudeAgent) ProviderEnvVars() []string {
 	return nil
 }
 
+// configDir returns the directory Claude reads its config from
+func (a *ClaudeAgent) configDir() string {
+	if a.ConfigDir != "" {
+		return a.ConfigDir
+	}
+	return "/home/kernel/.claude"
+}
+
+// mcpConfigPath returns the file the MCP config is written to and loaded from
+func (a *ClaudeAgent) mcpConfigPath() string {
+	if a.ConfigDir != "" {
+		return a.ConfigDir + "/mcp.json"
+	}
+	return "/home/kernel/.mcp.json"
+}
+
 // Install installs Claude Code in the browser environment
 func (a *ClaudeAgent) Install(ctx context.Context, client kernel.Client, sessionID string) error {
-	fmt.Println(HeaderStyle.Render("Installing Claude Code..."))
+	status(phaseInstall, HeaderStyle.Render("Installing Claude Code..."))
 
+	// Global npm installs can't run concurrently; playwriter's setup installs
+	// pnpm under the same lock
 	result, err := client.Browsers.Process.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
 		Command:    "bash",
-		Args:       []string{"-c", "export HOME=/home/kernel && npm install -g @anthropic-ai/claude-code"},
+		Args:       []string{"-c", installScript(a.InstallCommand, "flock /tmp/npm-global.lock npm install -g @anthropic-ai/claude-code")},
 		TimeoutSec: kernel.Opt(int64(300)),
 	})
 	if err != nil {
@@ -55,54 +117,107 @@ func (a *ClaudeAgent) Install(ctx context.Context, client kernel.Client, session
 		return fmt.Errorf("claude code install failed (exit %d): %s", result.ExitCode, stderr)
 	}
 
-	fmt.Println(SuccessStyle.Render("Claude Code installed"))
+	status(phaseInstall, SuccessStyle.Render("Claude Code installed"))
+	warnCLIVersion(ctx, client, sessionID, "claude", claudeVersionCmd, claudeBaseRequirement)
 	return nil
 }
 
 // ConfigureMCP sets up the MCP server configuration for Claude Code
 func (a *ClaudeAgent) ConfigureMCP(ctx context.Context, client kernel.Client, sessionID string, config MCPConfig) error {
-	fmt.Println(HeaderStyle.Render("Configuring MCP..."))
+	if err := ValidateMCPConfig(config); err != nil {
+		return err
+	}
+
+	status(phaseMCP, HeaderStyle.Render("Configuring MCP..."))
 
 	proc := client.Browsers.Process
 
-	// Create .claude directory
+	// Create config directory
 	proc.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
 		Command: "bash",
-		Args:    []string{"-c", "mkdir -p /home/kernel/.claude"},
+		Args:    []string{"-c", "mkdir -p " + shellQuote(a.configDir())},
 	})
 
-	// Write MCP config (used via --mcp-config flag at runtime)
+	// Write MCP config (used via --mcp-config flag at runtime). Claude reads
+	// MCPConfig as-is, including the type/url/headers of http and sse servers.
 	mcpJSON, _ := json.MarshalIndent(config, "", "  ")
+	mcpJSON = mergeMCPFile(ctx, client, sessionID, a.mcpConfigPath(), "mcpServers", mcpJSON, a.ReplaceMCP)
 	proc.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
 		Command: "bash",
-		Args:    []string{"-c", fmt.Sprintf("cat > /home/kernel/.mcp.json << 'EOF'\n%s\nEOF", mcpJSON)},
+		Args:    []string{"-c", fmt.Sprintf("cat > %s << 'EOF'\n%s\nEOF", shellQuote(a.mcpConfigPath()), mcpJSON)},
 	})
 
 	// Fix ownership
 	proc.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
 		Command: "bash",
-		Args:    []string{"-c", "chown -R kernel:kernel /home/kernel/.claude /home/kernel/.mcp.json"},
+		Args:    []string{"-c", "chown -R kernel:kernel " + shellJoin([]string{a.configDir(), a.mcpConfigPath()})},
 		AsRoot:  kernel.Opt(true),
 	})
 
-	fmt.Println(SuccessStyle.Render("MCP configured"))
+	status(phaseMCP, SuccessStyle.Render("MCP configured"))
 	return nil
 }
 
+// VerifyMCP checks that the MCP config passed via --mcp-config has server.
+// `claude mcp list` doesn't read --mcp-config files, so only the file is probed.
+func (a *ClaudeAgent) VerifyMCP(ctx context.Context, client kernel.Client, sessionID, server string) error {
+	return checkMCPFile(ctx, client, sessionID, a.mcpConfigPath(), "mcpServers", server)
+}
+
 // Run executes a prompt using Claude Code
 func (a *ClaudeAgent) Run(ctx context.Context, client kernel.Client, sessionID string, opts RunOptions, handler StreamHandler) (int64, error) {
-	if opts.AgentTimeout > 0 {
-		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, time.Duration(opts.AgentTimeout)*time.Second)
-		defer cancel()
+	ctx, cancel := runContext(ctx, opts)
+	defer cancel()
+
+	// Claude Code refuses --dangerously-skip-permissions when run as root
+	if opts.AsRoot && opts.AutoApprove {
+		return 1, fmt.Errorf("claude cannot run as root with auto-approval: --dangerously-skip-permissions is refused for root")
 	}
 
-	fmt.Println(HeaderStyle.Render("Running Claude Code..."))
+	if !IsInstalled(ctx, client, sessionID, "/usr/local/bin/claude") {
+		return 1, notInstalledError("claude", "/usr/local/bin/claude")
+	}
+	requirements := []cliRequirement{claudeBaseRequirement}
+	if opts.StreamText {
+		requirements = append(requirements, claudePartialRequirement)
+	}
+	if err := checkCLIVersion(ctx, client, sessionID, "claude", claudeVersionCmd, requirements...); err != nil {
+		return 1, err
+	}
+	dir := workDir(opts)
+	if err := checkWorkDir(ctx, client, sessionID, dir); err != nil {
+		return 1, err
+	}
+
+	status(phaseAgent, HeaderStyle.Render("Running Claude Code..."))
 	fmt.Println()
 
-	// Escape prompt for shell
+	if err := stagePrompt(ctx, client, sessionID, opts.Prompt); err != nil {
+		return 1, err
+	}
+	cmd := a.command(opts, ptyVariant(ctx, client, sessionID, opts))
+
+	return baseRun(ctx, KernelProcesses(client, sessionID), "claude", cmd, opts, outputFor(a.OutputFile), decodeStreamEvent, handler)
+}
+
+// Command returns the command Run spawns for opts, assuming util-linux
+// script for the PTY
+func (a *ClaudeAgent) Command(opts RunOptions) string {
+	return a.command(opts, defaultPTYVariant(opts))
+}
+
+// command builds the bash command that runs Claude Code under pty
+func (a *ClaudeAgent) command(opts RunOptions, pty PTYVariant) string {
+	dir := workDir(opts)
+
+	// Escape prompt for shell. Long prompts are read from stdin instead,
+	// which has no length limit.
 	escaped := strings.ReplaceAll(opts.Prompt, "'", "'\"'\"'")
 	escaped = strings.ReplaceAll(escaped, `"`, `\"`)
+	promptArg := `"` + escaped + `"`
+	if promptStaged(opts.Prompt) {
+		promptArg = "< " + PromptFilePath
+	}
 
 	// Build model argument
 	modelArg := ""
@@ -110,90 +225,94 @@ func (a *ClaudeAgent) Run(ctx context.Context, client kernel.Client, sessionID s
 		modelArg = fmt.Sprintf(" --model %s", opts.Model)
 	}
 
+	// Restrict tools; each name is single-quoted since patterns like
+	// Bash(git log:*) contain spaces and parentheses. The lists take any
+	// number of values, so they go before -p, never right before the prompt.
+	toolArgs := claudeToolArgs("--allowedTools", opts.AllowedTools) + claudeToolArgs("--disallowedTools", opts.DisallowedTools)
+
+	// Continue an earlier conversation
+	resumeArg := ""
+	if opts.ResumeID != "" {
+		resumeArg = " --resume " + shellQuote(opts.ResumeID)
+	}
+
+	// Cap the number of agentic turns
+	maxTurnsArg := ""
+	if opts.MaxTurns > 0 {
+		maxTurnsArg = fmt.Sprintf(" --max-turns %d", opts.MaxTurns)
+	}
+
+	// Skip permission prompts unless approvals should surface to the caller
+	permissionArg := ""
+	if opts.AutoApprove {
+		permissionArg = " --dangerously-skip-permissions"
+	}
+
+	// Stream text as deltas for incremental rendering
+	partialArg := ""
+	if opts.StreamText && !opts.TextOutput {
+		partialArg = " --include-partial-messages"
+	}
+
+	// Plain text output, which needs no --verbose
+	formatArg := " --verbose --output-format stream-json"
+	if opts.TextOutput {
+		formatArg = " --output-format text"
+	}
+
+	// Point Claude at the custom config directory if one is set
+	configEnv := ""
+	if a.ConfigDir != "" {
+		configEnv = "export CLAUDE_CONFIG_DIR=" + shellQuote(a.ConfigDir) + "\n"
+	}
+
 	// Claude Code flags:
 	// - -p (--print): non-interactive mode
 	// - --verbose: required for stream-json output
-	// - --output-format stream-json: streaming JSON output
-	// - --dangerously-skip-permissions: allow MCP tools without prompting
+	// - --output-format stream-json: streaming JSON output (text with TextOutput)
+	// - --dangerously-skip-permissions: allow MCP tools without prompting (AutoApprove)
 	// - --mcp-config: load MCP config from file
+	// - --allowedTools/--disallowedTools: tool restrictions, if any
+	// - --max-turns: turn limit (MaxTurns), if any
+	// - --resume: continue an earlier conversation (ResumeID), if any
+	// - --include-partial-messages: text deltas as stream_event events (StreamText)
 	// Must run as 'kernel' user (--dangerously-skip-permissions fails as root)
 	script := fmt.Sprintf(`#!/bin/bash
 export HOME=/home/kernel
+export PATH="$HOME/.bun/bin:$PATH"
 export ANTHROPIC_API_KEY='%s'
-cd /home/kernel
-/usr/local/bin/claude --mcp-config /home/kernel/.mcp.json -p --verbose --output-format stream-json --dangerously-skip-permissions%s "%s"
-`, opts.APIKey, modelArg, escaped)
+%scd %s
+/usr/local/bin/claude --mcp-config %s%s -p%s%s%s%s%s%s %s%s
+`, opts.APIKey, configEnv, shellQuote(dir), shellQuote(a.mcpConfigPath()), toolArgs, formatArg, permissionArg, partialArg, modelArg, maxTurnsArg, resumeArg, promptArg, outputRedirect(a.OutputFile))
+
+	// Run as kernel user unless root was requested
+	runCmd := "su - kernel -c '/tmp/run_claude.sh'"
+	if opts.AsRoot {
+		runCmd = "/tmp/run_claude.sh"
+	}
 
-	// Write script and run as kernel user with PTY (using 'script' command)
+	// Write script and run with PTY (using 'script' command)
 	cmd := fmt.Sprintf(
 		`cat > /tmp/run_claude.sh << 'SCRIPT'
 %s
 SCRIPT
 chmod +x /tmp/run_claude.sh
-script -q -c "su - kernel -c '/tmp/run_claude.sh'" /dev/null`,
-		script,
+%s`,
+		script, ptyWrap(pty, runCmd),
 	)
 
-	spawn, err := client.Browsers.Process.Spawn(ctx, sessionID, kernel.BrowserProcessSpawnParams{
-		Command: "bash", Args: []string{"-c", cmd},
-	})
-	if err != nil {
-		return 1, fmt.Errorf("spawn claude: %w", err)
-	}
-
-	stream := client.Browsers.Process.StdoutStreamStreaming(ctx, spawn.ProcessID, kernel.BrowserProcessStdoutStreamParams{
-		ID: sessionID,
-	})
+	return cmd
+}
 
-	var jsonBuffer strings.Builder
-	var exitCode int64
-	decoder := json.NewDecoder(strings.NewReader(""))
-
-	for stream.Next() {
-		event := stream.Current()
-
-		if event.Event == kernel.BrowserProcessStdoutStreamResponseEventExit {
-			exitCode = event.ExitCode
-			break
-		}
-
-		if event.DataB64 != "" {
-			data := DecodeB64(event.DataB64)
-			jsonBuffer.WriteString(data)
-
-			// Try to parse all complete JSON objects from buffer
-			decoder = json.NewDecoder(strings.NewReader(jsonBuffer.String()))
-			var consumed int
-			for {
-				var streamEvent StreamEvent
-				if err := decoder.Decode(&streamEvent); err != nil {
-					break // incomplete JSON, wait for more data
-				}
-				handler(streamEvent)
-				consumed = int(decoder.InputOffset())
-			}
-			// Keep only unparsed data in buffer
-			if consumed > 0 {
-				remaining := jsonBuffer.String()[consumed:]
-				jsonBuffer.Reset()
-				jsonBuffer.WriteString(remaining)
-			}
-		}
-	}
-
-	// Process any remaining complete JSON in buffer
-	decoder = json.NewDecoder(strings.NewReader(jsonBuffer.String()))
-	for {
-		var streamEvent StreamEvent
-		if err := decoder.Decode(&streamEvent); err != nil {
-			break
-		}
-		handler(streamEvent)
-	}
-
-	if err := stream.Err(); err != nil {
-		return 1, fmt.Errorf("stream error: %w", err)
-	}
-
-	return exitCode, nil
+// claudeToolArgs builds a Claude CLI tool list flag, or "" if tools is empty
+func claudeToolArgs(flagName string, tools []string) string {
+	if len(tools) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString(" " + flagName)
+	for _, tool := range tools {
+		b.WriteString(" " + shellQuote(tool))
+	}
+	return b.String()
 }
@@ -0,0 +1,144 @@
+package agent
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// commandLine returns the line of a generated run script starting with prefix
+func commandLine(t *testing.T, cmd, prefix string) string {
+	t.Helper()
+	for _, line := range strings.Split(cmd, "\n") {
+		if strings.HasPrefix(line, prefix) {
+			return line
+		}
+	}
+	t.Fatalf("no line starting with %q in:\n%s", prefix, cmd)
+	return ""
+}
+
+func TestClaudeCommandPromptArg(t *testing.T) {
+	longPrompt := strings.Repeat("x", InlinePromptLimit+1)
+	tests := []struct {
+		name       string
+		opts       RunOptions
+		wantSuffix string
+	}{
+		{
+			name:       "no tool restrictions",
+			opts:       RunOptions{Prompt: "open example.com"},
+			wantSuffix: ` "open example.com"`,
+		},
+		{
+			name:       "allowed tools",
+			opts:       RunOptions{Prompt: "open example.com", AllowedTools: []string{"mcp__playwriter__*", "Bash(git log:*)"}},
+			wantSuffix: ` "open example.com"`,
+		},
+		{
+			name:       "allowed and disallowed tools",
+			opts:       RunOptions{Prompt: "open example.com", AllowedTools: []string{"Read"}, DisallowedTools: []string{"Bash"}, ResumeID: "abc"},
+			wantSuffix: ` "open example.com"`,
+		},
+		{
+			name:       "staged prompt",
+			opts:       RunOptions{Prompt: longPrompt, DisallowedTools: []string{"Bash"}},
+			wantSuffix: " < " + PromptFilePath,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			line := commandLine(t, (&ClaudeAgent{}).command(tt.opts, PTYNone), "/usr/local/bin/claude ")
+			if !strings.HasSuffix(line, tt.wantSuffix) {
+				t.Errorf("prompt is not the last argument:\n%s", line)
+			}
+			// The variadic tool lists must be closed by -p, not by the prompt
+			_, afterPrint, ok := strings.Cut(line, " -p ")
+			if !ok {
+				t.Fatalf("no -p in:\n%s", line)
+			}
+			for _, flag := range []string{"--allowedTools", "--disallowedTools"} {
+				if strings.Contains(afterPrint, flag) {
+					t.Errorf("%s follows -p:\n%s", flag, line)
+				}
+			}
+			for _, tool := range append(tt.opts.AllowedTools, tt.opts.DisallowedTools...) {
+				if !strings.Contains(line, shellQuote(tool)) {
+					t.Errorf("tool %q missing:\n%s", tool, line)
+				}
+			}
+		})
+	}
+}
+
+func TestClaudeCommandMaxTurns(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxTurns int
+		want     string // "" for no --max-turns
+	}{
+		{"no limit", 0, ""},
+		{"limit", 5, " --max-turns 5 "},
+		{"large limit", 200, " --max-turns 200 "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := RunOptions{Prompt: "open example.com", MaxTurns: tt.maxTurns, ResumeID: "abc"}
+			line := commandLine(t, (&ClaudeAgent{}).command(opts, PTYNone), "/usr/local/bin/claude ")
+			if tt.want == "" {
+				if strings.Contains(line, "--max-turns") {
+					t.Errorf("--max-turns passed without a limit:\n%s", line)
+				}
+				return
+			}
+			if strings.Count(line, "--max-turns") != 1 || !strings.Contains(line, tt.want) {
+				t.Errorf("want %q once in:\n%s", tt.want, line)
+			}
+			// Before the prompt, which must stay the last argument
+			if !strings.HasSuffix(line, ` "open example.com"`) {
+				t.Errorf("prompt is not the last argument:\n%s", line)
+			}
+		})
+	}
+
+	// Other agents have no turn limit to pass
+	for _, ag := range []Agent{&CursorAgent{}, &OpenCodeAgent{}} {
+		if cmd := ag.Command(RunOptions{Prompt: "open example.com", MaxTurns: 5}); strings.Contains(cmd, "max-turns") {
+			t.Errorf("%s command has --max-turns:\n%s", ag.Name(), cmd)
+		}
+	}
+}
+
+func TestClaudeAsRoot(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     RunOptions
+		wantUser bool // switches to the kernel user
+		wantErr  bool
+	}{
+		{name: "kernel user", opts: RunOptions{Prompt: "hi", AutoApprove: true}, wantUser: true},
+		{name: "root without auto-approval", opts: RunOptions{Prompt: "hi", AsRoot: true}},
+		{name: "root with auto-approval", opts: RunOptions{Prompt: "hi", AsRoot: true, AutoApprove: true}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.wantErr {
+				fake, client := newFakeKernel(t)
+				if _, err := (&ClaudeAgent{}).Run(context.Background(), client, testSessionID, tt.opts, func(StreamEvent) {}); err == nil {
+					t.Error("Run() accepted root with auto-approval")
+				}
+				if len(fake.execs) != 0 {
+					t.Errorf("ran %d commands before rejecting root", len(fake.execs))
+				}
+				return
+			}
+			cmd := (&ClaudeAgent{}).command(tt.opts, PTYNone)
+			if got := strings.Contains(cmd, "su - kernel -c '/tmp/run_claude.sh'"); got != tt.wantUser {
+				t.Errorf("switches to the kernel user = %v, want %v:\n%s", got, tt.wantUser, cmd)
+			}
+			if !tt.wantUser && !strings.HasSuffix(cmd, `bash -c "/tmp/run_claude.sh"`) {
+				t.Errorf("script not run directly:\n%s", cmd)
+			}
+		})
+	}
+}
@@ -5,13 +5,31 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
-	"time"
 
 	"github.com/onkernel/kernel-go-sdk"
 )
 
 // CursorAgent implements the Agent interface for Cursor's cursor-agent CLI
-type CursorAgent struct{}
+type CursorAgent struct {
+	// ConfigDir overrides the config home (XDG_CONFIG_HOME); the MCP config is
+	// written to ConfigDir/cursor/mcp.json. Empty uses ~/.cursor and ~/.config/cursor.
+	ConfigDir string
+
+	// InstallCommand, if set, replaces the default install command. It runs
+	// with bash as root, with HOME=/home/kernel.
+	InstallCommand string
+
+	// ReplaceMCP makes ConfigureMCP overwrite the MCP config instead of
+	// merging into servers already configured in the session
+	ReplaceMCP bool
+
+	// OutputFile, if set, has the agent write its output stream to this file
+	// in the session, which is tailed instead of the PTY's stdout
+	OutputFile string
+}
+
+// cursorVersionCmd prints the installed cursor-agent version
+const cursorVersionCmd = `export HOME=/home/kernel && export PATH="$HOME/.local/bin:$PATH" && cursor-agent --version`
 
 // NewCursorAgent creates a new Cursor agent
 func NewCursorAgent() *CursorAgent {
@@ -33,6 +51,34 @@ func (a *CursorAgent) DefaultModel() string {
 	return "opus-4.5"
 }
 
+// ModelAlias maps the fast, smart, and default aliases to Cursor models
+func (a *CursorAgent) ModelAlias(alias string) (string, bool) {
+	switch alias {
+	case ModelAliasFast:
+		return "sonnet-4.5", true
+	case ModelAliasSmart:
+		return "opus-4.5", true
+	case ModelAliasDefault:
+		return a.DefaultModel(), true
+	}
+	return "", false
+}
+
+// MaxPromptBytes returns the longest single command-line argument:
+// cursor-agent takes the prompt only as an argument, so even a prompt read
+// from a file is passed as one
+func (a *CursorAgent) MaxPromptBytes() int {
+	return maxArgBytes
+}
+
+// KnownModels returns the models Cursor accepts with --model
+func (a *CursorAgent) KnownModels() []string {
+	return []string{
+		"auto", "composer-1", "sonnet-4.5", "sonnet-4.5-thinking",
+		"opus-4.5", "opus-4.5-thinking", "gpt-5", "gpt-5-codex", "grok",
+	}
+}
+
 // ProviderEnvVars returns nil since Cursor only needs CURSOR_API_KEY
 func (a *CursorAgent) ProviderEnvVars() []string {
 	return nil
@@ -40,11 +86,11 @@ func (a *CursorAgent) ProviderEnvVars() []string {
 
 // Install installs cursor-agent in the browser environment
 func (a *CursorAgent) Install(ctx context.Context, client kernel.Client, sessionID string) error {
-	fmt.Println(HeaderStyle.Render("Installing Cursor..."))
+	status(phaseInstall, HeaderStyle.Render("Installing Cursor..."))
 
 	result, err := client.Browsers.Process.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
 		Command:    "bash",
-		Args:       []string{"-c", "export HOME=/home/kernel && curl -fsSL https://cursor.com/install | bash"},
+		Args:       []string{"-c", installScript(a.InstallCommand, "curl -fsSL https://cursor.com/install | bash")},
 		TimeoutSec: kernel.Opt(int64(300)),
 	})
 	if err != nil {
@@ -55,56 +101,145 @@ func (a *CursorAgent) Install(ctx context.Context, client kernel.Client, session
 		return fmt.Errorf("cursor install failed (exit %d): %s", result.ExitCode, stderr)
 	}
 
-	fmt.Println(SuccessStyle.Render("Cursor installed"))
+	status(phaseInstall, SuccessStyle.Render("Cursor installed"))
+	warnCLIVersion(ctx, client, sessionID, "cursor-agent", cursorVersionCmd, cursorBaseRequirement)
 	return nil
 }
 
 // ConfigureMCP sets up the MCP server configuration for Cursor
 func (a *CursorAgent) ConfigureMCP(ctx context.Context, client kernel.Client, sessionID string, config MCPConfig) error {
-	fmt.Println(HeaderStyle.Render("Configuring MCP..."))
+	if err := ValidateMCPConfig(config); err != nil {
+		return err
+	}
+
+	status(phaseMCP, HeaderStyle.Render("Configuring MCP..."))
+
+	// Cursor infers the transport from whether a url is set and rejects "type"
+	cursorConfig := MCPConfig{MCPServers: make(map[string]MCPServer, len(config.MCPServers))}
+	for name, server := range config.MCPServers {
+		server.Type = ""
+		cursorConfig.MCPServers[name] = server
+	}
 
-	mcpJSON, _ := json.MarshalIndent(config, "", "  ")
+	mcpJSON, _ := json.MarshalIndent(cursorConfig, "", "  ")
 	proc := client.Browsers.Process
 
+	dirs := []string{"/home/kernel/.cursor", "/home/kernel/.config/cursor"}
+	if a.ConfigDir != "" {
+		dirs = []string{a.ConfigDir + "/cursor"}
+	}
+
 	// Create config directories
 	proc.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
 		Command: "bash",
-		Args:    []string{"-c", "mkdir -p /home/kernel/.cursor /home/kernel/.config/cursor"},
+		Args:    []string{"-c", "mkdir -p " + shellJoin(dirs)},
 	})
 
-	// Write MCP config to both possible locations
-	for _, path := range []string{"/home/kernel/.cursor/mcp.json", "/home/kernel/.config/cursor/mcp.json"} {
+	// Write MCP config to every location cursor-agent may read, each merged
+	// with what that file already has
+	for _, dir := range dirs {
+		fileJSON := mergeMCPFile(ctx, client, sessionID, dir+"/mcp.json", "mcpServers", mcpJSON, a.ReplaceMCP)
 		proc.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
 			Command: "bash",
-			Args:    []string{"-c", fmt.Sprintf("cat > %s << 'EOF'\n%s\nEOF", path, mcpJSON)},
+			Args:    []string{"-c", fmt.Sprintf("cat > %s << 'EOF'\n%s\nEOF", shellQuote(dir+"/mcp.json"), fileJSON)},
 		})
 	}
 
 	// Fix ownership
 	proc.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
 		Command: "bash",
-		Args:    []string{"-c", "chown -R kernel:kernel /home/kernel/.cursor /home/kernel/.config/cursor"},
+		Args:    []string{"-c", "chown -R kernel:kernel " + shellJoin(dirs)},
 		AsRoot:  kernel.Opt(true),
 	})
 
-	fmt.Println(SuccessStyle.Render("MCP configured"))
+	status(phaseMCP, SuccessStyle.Render("MCP configured"))
 	return nil
 }
 
+// VerifyMCP checks that cursor-agent lists server via `cursor-agent mcp list`,
+// falling back to probing the config files if the command isn't available
+func (a *CursorAgent) VerifyMCP(ctx context.Context, client kernel.Client, sessionID, server string) error {
+	configEnv := ""
+	dirs := []string{"/home/kernel/.cursor", "/home/kernel/.config/cursor"}
+	if a.ConfigDir != "" {
+		configEnv = " && export XDG_CONFIG_HOME=" + shellQuote(a.ConfigDir)
+		dirs = []string{a.ConfigDir + "/cursor"}
+	}
+	cmd := `export HOME=/home/kernel && export PATH="$HOME/.local/bin:$PATH"` + configEnv + " && cursor-agent mcp list"
+	if listed, ok := mcpListCheck(ctx, client, sessionID, cmd, server); ok && listed {
+		return nil
+	}
+
+	// cursor-agent reads the first of these that exists; any valid one will do
+	var err error
+	for _, dir := range dirs {
+		if err = checkMCPFile(ctx, client, sessionID, dir+"/mcp.json", "mcpServers", server); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
 // Run executes a prompt using cursor-agent
 func (a *CursorAgent) Run(ctx context.Context, client kernel.Client, sessionID string, opts RunOptions, handler StreamHandler) (int64, error) {
-	if opts.AgentTimeout > 0 {
-		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, time.Duration(opts.AgentTimeout)*time.Second)
-		defer cancel()
+	ctx, cancel := runContext(ctx, opts)
+	defer cancel()
+
+	if opts.ResumeID != "" {
+		if err := ValidateResumeID(opts.ResumeID); err != nil {
+			return 1, err
+		}
+	}
+
+	if !IsInstalled(ctx, client, sessionID, "cursor-agent") {
+		return 1, notInstalledError("cursor-agent", "cursor-agent")
+	}
+	requirements := []cliRequirement{cursorBaseRequirement}
+	if opts.AutoApprove {
+		requirements = append(requirements, cursorApproveRequirement)
+	}
+	if err := checkCLIVersion(ctx, client, sessionID, "cursor-agent", cursorVersionCmd, requirements...); err != nil {
+		return 1, err
+	}
+	dir := workDir(opts)
+	if err := checkWorkDir(ctx, client, sessionID, dir); err != nil {
+		return 1, err
 	}
 
-	fmt.Println(HeaderStyle.Render("Running cursor-agent..."))
+	status(phaseAgent, HeaderStyle.Render("Running cursor-agent..."))
 	fmt.Println()
 
-	// Escape prompt for shell
+	warnToolsUnsupported("cursor", opts)
+
+	if err := CheckPromptSize(a, opts.Prompt); err != nil {
+		return 1, err
+	}
+	if err := stagePrompt(ctx, client, sessionID, opts.Prompt); err != nil {
+		return 1, err
+	}
+	cmd := a.command(opts, ptyVariant(ctx, client, sessionID, opts))
+
+	return baseRun(ctx, KernelProcesses(client, sessionID), "cursor-agent", cmd, opts, outputFor(a.OutputFile), decodeStreamEvent, handler)
+}
+
+// Command returns the command Run spawns for opts, assuming util-linux
+// script for the PTY
+func (a *CursorAgent) Command(opts RunOptions) string {
+	return a.command(opts, defaultPTYVariant(opts))
+}
+
+// command builds the bash command that runs cursor-agent under pty
+func (a *CursorAgent) command(opts RunOptions, pty PTYVariant) string {
+	dir := workDir(opts)
+
+	// Escape prompt for shell. Long prompts are read from a file inside the
+	// PTY's shell ($ escaped so the outer shell leaves it alone) rather than
+	// embedded in the command.
 	escaped := strings.ReplaceAll(opts.Prompt, "'", "'\"'\"'")
 	escaped = strings.ReplaceAll(escaped, `"`, `\"`)
+	if promptStaged(opts.Prompt) {
+		escaped = `\$(cat ` + PromptFilePath + ")"
+	}
 
 	// Build command with optional model flag
 	modelArg := ""
@@ -112,72 +247,35 @@ func (a *CursorAgent) Run(ctx context.Context, client kernel.Client, sessionID s
 		modelArg = fmt.Sprintf(" --model %s", opts.Model)
 	}
 
-	// cursor-agent requires a PTY, so we use 'script' to allocate one
-	cmd := fmt.Sprintf(
-		`export HOME=/home/kernel && export PATH="$HOME/.local/bin:$PATH" && export CURSOR_API_KEY='%s' && script -q -c "cursor-agent -f --approve-mcps --output-format stream-json%s -p \"%s\"" /dev/null`,
-		opts.APIKey, modelArg, escaped,
-	)
-
-	spawn, err := client.Browsers.Process.Spawn(ctx, sessionID, kernel.BrowserProcessSpawnParams{
-		Command: "bash", Args: []string{"-c", cmd},
-	})
-	if err != nil {
-		return 1, fmt.Errorf("spawn cursor-agent: %w", err)
+	// Continue an earlier chat. Run only accepts plain word IDs, which stay
+	// quoted inside the PTY command's double quotes.
+	resumeArg := ""
+	if opts.ResumeID != "" {
+		resumeArg = " --resume " + shellQuote(opts.ResumeID)
 	}
 
-	stream := client.Browsers.Process.StdoutStreamStreaming(ctx, spawn.ProcessID, kernel.BrowserProcessStdoutStreamParams{
-		ID: sessionID,
-	})
-
-	var jsonBuffer strings.Builder
-	var exitCode int64
-	decoder := json.NewDecoder(strings.NewReader(""))
-
-	for stream.Next() {
-		event := stream.Current()
-
-		if event.Event == kernel.BrowserProcessStdoutStreamResponseEventExit {
-			exitCode = event.ExitCode
-			break
-		}
-
-		if event.DataB64 != "" {
-			data := DecodeB64(event.DataB64)
-			jsonBuffer.WriteString(data)
-
-			// Try to parse all complete JSON objects from buffer
-			decoder = json.NewDecoder(strings.NewReader(jsonBuffer.String()))
-			var consumed int
-			for {
-				var streamEvent StreamEvent
-				if err := decoder.Decode(&streamEvent); err != nil {
-					break // incomplete JSON, wait for more data
-				}
-				handler(streamEvent)
-				consumed = int(decoder.InputOffset())
-			}
-			// Keep only unparsed data in buffer
-			if consumed > 0 {
-				remaining := jsonBuffer.String()[consumed:]
-				jsonBuffer.Reset()
-				jsonBuffer.WriteString(remaining)
-			}
-		}
+	// Point cursor-agent at the custom config home if one is set
+	configEnv := ""
+	if a.ConfigDir != "" {
+		configEnv = " && export XDG_CONFIG_HOME=" + shellQuote(a.ConfigDir)
 	}
 
-	// Process any remaining complete JSON in buffer
-	decoder = json.NewDecoder(strings.NewReader(jsonBuffer.String()))
-	for {
-		var streamEvent StreamEvent
-		if err := decoder.Decode(&streamEvent); err != nil {
-			break
-		}
-		handler(streamEvent)
+	// cursor-agent requires a PTY, so we use 'script' to allocate one.
+	// It runs as the spawning (root) user, so opts.AsRoot needs no special handling.
+	// -f and --approve-mcps auto-approve commands and MCP servers
+	approveArg := ""
+	if opts.AutoApprove {
+		approveArg = " -f --approve-mcps"
 	}
-
-	if err := stream.Err(); err != nil {
-		return 1, fmt.Errorf("stream error: %w", err)
+	format := "stream-json"
+	if opts.TextOutput {
+		format = "text"
 	}
+	agentCmd := fmt.Sprintf(`cursor-agent%s --output-format %s%s%s -p \"%s\"%s`, approveArg, format, modelArg, resumeArg, escaped, outputRedirect(a.OutputFile))
+	cmd := fmt.Sprintf(
+		`export HOME=/home/kernel && export PATH="$HOME/.bun/bin:$HOME/.local/bin:$PATH" && export CURSOR_API_KEY='%s'%s && cd %s && %s`,
+		opts.APIKey, configEnv, shellQuote(dir), ptyWrap(pty, agentCmd),
+	)
 
-	return exitCode, nil
+	return cmd
 }
@@ -0,0 +1,45 @@
+package agent
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCursorResume(t *testing.T) {
+	tests := []struct {
+		name     string
+		resumeID string
+		wantArg  string // in the command; "" for none
+		wantErr  bool
+	}{
+		{name: "new chat"},
+		{name: "resumed chat", resumeID: "4f2a9c1e-77b0-4d2e-9a55-0c3b1f6e2d81", wantArg: " --resume '4f2a9c1e-77b0-4d2e-9a55-0c3b1f6e2d81'"},
+		{name: "shell in the ID", resumeID: "x; rm -rf ~", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := RunOptions{Prompt: "hi", ResumeID: tt.resumeID}
+			if tt.wantErr {
+				fake, client := newFakeKernel(t)
+				_, err := (&CursorAgent{}).Run(context.Background(), client, testSessionID, opts, func(StreamEvent) {})
+				if err == nil || !strings.Contains(err.Error(), "invalid resume ID") {
+					t.Errorf("Run() err = %v, want the ID rejected", err)
+				}
+				if len(fake.execs) != 0 {
+					t.Errorf("ran %d commands before rejecting the ID", len(fake.execs))
+				}
+				return
+			}
+
+			cmd := (&CursorAgent{}).command(opts, PTYNone)
+			if tt.wantArg == "" {
+				if strings.Contains(cmd, "--resume") {
+					t.Errorf("unexpected --resume:\n%s", cmd)
+				}
+			} else if !strings.Contains(cmd, tt.wantArg) {
+				t.Errorf("%s missing:\n%s", tt.wantArg, cmd)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"sync"
+	"time"
+)
+
+// HeartbeatEventType is the StreamEvent type sent when the agent has produced
+// no output for RunOptions.Heartbeat. TS holds the time it was sent.
+const HeartbeatEventType = "heartbeat"
+
+// withHeartbeat wraps handler so that a heartbeat event is sent whenever no
+// event has been handled for interval. Real events reset the interval, so
+// heartbeats only appear during quiet periods. Calls to handler are
+// serialized. stop ends the heartbeats; once it returns, handler isn't called
+// with another one.
+func withHeartbeat(handler StreamHandler, interval time.Duration) (wrapped StreamHandler, stop func()) {
+	var mu sync.Mutex
+	last := time.Now()
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		wait := interval
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(wait):
+			}
+
+			mu.Lock()
+			select {
+			case <-done:
+				mu.Unlock()
+				return
+			default:
+			}
+			if quiet := time.Since(last); quiet >= interval {
+				handler(StreamEvent{Type: HeartbeatEventType, TS: time.Now().UnixMilli()})
+				last = time.Now()
+				wait = interval
+			} else {
+				wait = interval - quiet
+			}
+			mu.Unlock()
+		}
+	}()
+
+	wrapped = func(event StreamEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		last = time.Now()
+		handler(event)
+	}
+	return wrapped, func() {
+		close(done)
+		<-stopped
+	}
+}
@@ -0,0 +1,45 @@
+package agent
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatStop(t *testing.T) {
+	var mu sync.Mutex
+	heartbeats := 0
+	stopped := false
+	var late bool
+	handler := func(event StreamEvent) {
+		// Slow enough that stop usually lands mid-heartbeat
+		time.Sleep(2 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		if stopped {
+			late = true
+		}
+		heartbeats++
+	}
+
+	for range 20 {
+		_, stop := withHeartbeat(handler, time.Millisecond)
+		time.Sleep(5 * time.Millisecond)
+		stop()
+		mu.Lock()
+		stopped = true
+		mu.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		if late {
+			mu.Unlock()
+			t.Fatal("heartbeat handled after stop returned")
+		}
+		stopped = false
+		mu.Unlock()
+	}
+	if heartbeats == 0 {
+		t.Error("no heartbeats sent")
+	}
+}
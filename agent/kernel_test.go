@@ -0,0 +1,136 @@
+package agent
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/onkernel/kernel-go-sdk"
+	"github.com/onkernel/kernel-go-sdk/option"
+)
+
+// testSessionID is the session every fakeKernel request is made against
+const testSessionID = "test-session"
+
+// execCall is a command run through Process.Exec
+type execCall struct {
+	Command string            `json:"command"`
+	Args    []string          `json:"args"`
+	Env     map[string]string `json:"env"`
+}
+
+// line returns the call as one shell-like line, e.g. "bash -c ..."
+func (c execCall) line() string {
+	return strings.Join(append([]string{c.Command}, c.Args...), " ")
+}
+
+// fakeKernel serves the Process.Exec and file calls agents make outside a
+// run, keeping the session's files in memory. Runs themselves go through
+// fakeRunner.
+type fakeKernel struct {
+	mu    sync.Mutex
+	files map[string]string
+	execs []execCall
+
+	// exec answers Process.Exec; unset, a command exits 0 printing nothing
+	exec func(call execCall) (exitCode int, stdout string)
+
+	// fail, if set, answers every request with a server error
+	fail bool
+}
+
+// newFakeKernel starts a fake Kernel API and returns a client talking to it
+func newFakeKernel(t *testing.T) (*fakeKernel, kernel.Client) {
+	t.Helper()
+	f := &fakeKernel{files: make(map[string]string)}
+	srv := httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(srv.Close)
+	client := kernel.NewClient(
+		option.WithBaseURL(srv.URL+"/"),
+		option.WithAPIKey("test"),
+		option.WithMaxRetries(0),
+	)
+	return f, client
+}
+
+func (f *fakeKernel) serve(w http.ResponseWriter, r *http.Request) {
+	if f.fail {
+		http.Error(w, `{"message":"unavailable"}`, http.StatusServiceUnavailable)
+		return
+	}
+	route, ok := strings.CutPrefix(r.URL.Path, "/browsers/"+testSessionID+"/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	w.Header().Set("Content-Type", "application/json")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch route {
+	case "fs/read_file":
+		contents, ok := f.files[r.URL.Query().Get("path")]
+		if !ok {
+			http.Error(w, `{"message":"not found"}`, http.StatusNotFound)
+			return
+		}
+		io.WriteString(w, contents)
+	case "fs/write_file":
+		f.files[r.URL.Query().Get("path")] = string(body)
+	case "process/exec":
+		var call execCall
+		json.Unmarshal(body, &call)
+		f.execs = append(f.execs, call)
+		if path, contents, ok := heredocWrite(call); ok {
+			f.files[path] = contents
+		}
+		var exitCode int
+		var stdout string
+		if f.exec != nil {
+			exitCode, stdout = f.exec(call)
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"exit_code":  exitCode,
+			"stdout_b64": base64.StdEncoding.EncodeToString([]byte(stdout)),
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// heredocPattern matches the first line of a `cat > 'path' << 'EOF'` script,
+// which agents write config files with
+var heredocPattern = regexp.MustCompile(`^cat > '([^']+)' << 'EOF'$`)
+
+// heredocWrite returns the file a heredoc script writes and its contents
+func heredocWrite(call execCall) (path, contents string, ok bool) {
+	if call.Command != "bash" || len(call.Args) != 2 {
+		return "", "", false
+	}
+	first, rest, _ := strings.Cut(call.Args[1], "\n")
+	m := heredocPattern.FindStringSubmatch(first)
+	if m == nil {
+		return "", "", false
+	}
+	return m[1], strings.TrimSuffix(rest, "\nEOF"), true
+}
+
+// ran returns the exec calls whose line contains substr
+func (f *fakeKernel) ran(substr string) []execCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var calls []execCall
+	for _, call := range f.execs {
+		if strings.Contains(call.line(), substr) {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
@@ -0,0 +1,59 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrBrowserDown is returned by Run when RunOptions.BrowserCheck finds the
+// browser down mid-run, e.g. because Chrome crashed
+var ErrBrowserDown = errors.New("browser is down")
+
+// DefaultBrowserCheckInterval is how often RunOptions.BrowserCheck runs when
+// RunOptions.BrowserCheckInterval is 0
+const DefaultBrowserCheckInterval = 30 * time.Second
+
+// browserDownAfter is how many failed checks in a row mean the browser is
+// down, so one slow probe doesn't abort a run
+const browserDownAfter = 2
+
+// watchBrowser runs check every interval until stop is called. After
+// browserDownAfter failures in a row it cancels the run with an
+// ErrBrowserDown cause naming the last failure.
+func watchBrowser(ctx context.Context, cancel context.CancelCauseFunc, check func(context.Context) error, interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		interval = DefaultBrowserCheckInterval
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		failures := 0
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			err := check(ctx)
+			if err == nil {
+				failures = 0
+				continue
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			failures++
+			debugf("browser check failed (%d/%d): %v", failures, browserDownAfter, err)
+			if failures >= browserDownAfter {
+				cancel(fmt.Errorf("%w: %v", ErrBrowserDown, err))
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,80 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/onkernel/kernel-go-sdk"
+)
+
+// PlaywriterServerName is the default name of the playwriter server in MCPConfig
+const PlaywriterServerName = "playwriter"
+
+// ansiPattern matches terminal escape sequences in CLI output
+var ansiPattern = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
+
+// mcpListed reports whether the output of an agent's `mcp list` command
+// names server at the start of a line, as in "playwriter: node ..." or
+// "- playwriter (connected)"
+func mcpListed(output, server string) bool {
+	line := regexp.MustCompile(`(?m)^\s*(?:[-*•✓✔]\s*)?` + regexp.QuoteMeta(server) + `(?:[\s:]|$)`)
+	return line.MatchString(ansiPattern.ReplaceAllString(output, ""))
+}
+
+// mcpListCheck runs an agent's `mcp list` command (cmd, a shell command) and
+// reports whether it ran and listed server. ok is false if the command
+// failed, e.g. because the CLI version has no such command; the caller then
+// falls back to checking the config file.
+func mcpListCheck(ctx context.Context, client kernel.Client, sessionID, cmd, server string) (listed, ok bool) {
+	result, err := client.Browsers.Process.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
+		Command:    "bash",
+		Args:       []string{"-c", cmd},
+		TimeoutSec: kernel.Opt(int64(30)),
+	})
+	if err != nil || result.ExitCode != 0 {
+		return false, false
+	}
+	return mcpListed(DecodeB64(result.StdoutB64), server), true
+}
+
+// checkMCPFile checks that the JSON config file at path exists, parses, and
+// has server under the serversKey object
+func checkMCPFile(ctx context.Context, client kernel.Client, sessionID, path, serversKey, server string) error {
+	result, err := client.Browsers.Process.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
+		Command:    "bash",
+		Args:       []string{"-c", "cat " + shellQuote(path)},
+		AsRoot:     kernel.Opt(true),
+		TimeoutSec: kernel.Opt(int64(10)),
+	})
+	if err != nil {
+		return fmt.Errorf("read MCP config %s: %w", path, err)
+	}
+	if result.ExitCode != 0 {
+		return fmt.Errorf("MCP config %s was not written", path)
+	}
+	return checkMCPJSON(path, DecodeB64(result.StdoutB64), serversKey, server)
+}
+
+// checkMCPJSON checks that data, the contents of the config file at path,
+// has server under the serversKey object
+func checkMCPJSON(path, data, serversKey, server string) error {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(data), &doc); err != nil {
+		return fmt.Errorf("MCP config %s is not valid JSON: %w", path, err)
+	}
+	var servers map[string]json.RawMessage
+	if raw, ok := doc[serversKey]; !ok || json.Unmarshal(raw, &servers) != nil {
+		return fmt.Errorf("MCP config %s has no %q object", path, serversKey)
+	}
+	if _, ok := servers[server]; !ok {
+		names := make([]string, 0, len(servers))
+		for name := range servers {
+			names = append(names, name)
+		}
+		return fmt.Errorf("MCP config %s has no %q server (found: %s)", path, server, strings.Join(names, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package agent
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestMCPListed(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   bool
+	}{
+		{"name and command", "playwriter: npx playwriter@latest\n", true},
+		{"bulleted with status", "Servers:\n  - playwriter (connected)\n", true},
+		{"checkmark", "✓ playwriter\n", true},
+		{"colored", "\x1b[32m✓\x1b[0m \x1b[1mplaywriter\x1b[0m: ready\n", true},
+		{"name alone", "other\nplaywriter", true},
+		{"only a prefix", "playwriter-dev: npx playwriter@latest\n", false},
+		{"mentioned mid-line", "No servers. Add playwriter with `mcp add`\n", false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mcpListed(tt.output, "playwriter"); got != tt.want {
+				t.Errorf("mcpListed(%q) = %v, want %v", tt.output, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyMCP(t *testing.T) {
+	const (
+		cursorConfig   = `{"mcpServers":{"playwriter":{"command":"npx"}}}`
+		opencodeConfig = `{"mcp":{"playwriter":{"type":"local"}}}`
+	)
+	tests := []struct {
+		name     string
+		agent    Agent
+		list     string // `mcp list` output; "" if the command fails
+		files    map[string]string
+		wantErr  string
+		wantList bool // `mcp list` is tried
+	}{
+		{
+			name:     "cursor listed",
+			agent:    &CursorAgent{},
+			list:     "playwriter: npx playwriter@latest\n",
+			wantList: true,
+		},
+		{
+			name:     "cursor falls back to the second config file",
+			agent:    &CursorAgent{},
+			files:    map[string]string{"/home/kernel/.config/cursor/mcp.json": cursorConfig},
+			wantList: true,
+		},
+		{
+			name:     "cursor listed without the server checks files",
+			agent:    &CursorAgent{},
+			list:     "other: node server.js\n",
+			wantErr:  "/home/kernel/.config/cursor/mcp.json was not written",
+			wantList: true,
+		},
+		{
+			name:     "cursor config dir",
+			agent:    &CursorAgent{ConfigDir: "/tmp/cfg"},
+			files:    map[string]string{"/tmp/cfg/cursor/mcp.json": cursorConfig},
+			wantList: true,
+		},
+		{
+			name:     "opencode listed",
+			agent:    &OpenCodeAgent{},
+			list:     "✓ playwriter connected\n",
+			wantList: true,
+		},
+		{
+			name:     "opencode config file",
+			agent:    &OpenCodeAgent{},
+			files:    map[string]string{"/home/kernel/.config/opencode/opencode.json": opencodeConfig},
+			wantList: true,
+		},
+		{
+			name:    "claude only checks the file",
+			agent:   &ClaudeAgent{},
+			list:    "playwriter: npx playwriter@latest\n",
+			files:   map[string]string{"/home/kernel/.mcp.json": `{"mcpServers":{"other":{}}}`},
+			wantErr: `has no "playwriter" server (found: other)`,
+		},
+		{
+			name:    "claude invalid config",
+			agent:   &ClaudeAgent{},
+			files:   map[string]string{"/home/kernel/.mcp.json": `{"mcpServers":`},
+			wantErr: "is not valid JSON",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, client := newFakeKernel(t)
+			fake.exec = func(call execCall) (int, string) {
+				script := call.Args[len(call.Args)-1]
+				if strings.HasSuffix(script, " mcp list") {
+					if tt.list == "" {
+						return 1, "error: unknown command 'mcp'"
+					}
+					return 0, tt.list
+				}
+				if path, ok := strings.CutPrefix(script, "cat "); ok {
+					contents, ok := tt.files[strings.Trim(path, "'")]
+					if !ok {
+						return 1, ""
+					}
+					return 0, contents
+				}
+				return 0, ""
+			}
+
+			err := tt.agent.VerifyMCP(context.Background(), client, testSessionID, "playwriter")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if listed := len(fake.ran("mcp list")) > 0; listed != tt.wantList {
+				t.Errorf("mcp list run = %v, want %v", listed, tt.wantList)
+			}
+		})
+	}
+}
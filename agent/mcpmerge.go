@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/onkernel/kernel-go-sdk"
+)
+
+// mergeMCPFile merges data, a new MCP config with its servers under
+// serversKey, into the config file already at path, so a reused session
+// keeps servers configured before. Servers in data replace same-named ones;
+// other servers and settings in the file are kept. A missing, empty, or
+// invalid file leaves data as-is. With replace, data is returned unchanged.
+func mergeMCPFile(ctx context.Context, client kernel.Client, sessionID, path, serversKey string, data []byte, replace bool) []byte {
+	if replace {
+		return data
+	}
+
+	resp, err := client.Browsers.Fs.ReadFile(ctx, sessionID, kernel.BrowserFReadFileParams{Path: path})
+	if err != nil {
+		if !isNotFound(err) {
+			debugf("mcp: read %s: %v", path, err)
+		}
+		return data
+	}
+	defer resp.Body.Close()
+	existing, err := io.ReadAll(resp.Body)
+	if err != nil {
+		debugf("mcp: read %s: %v", path, err)
+		return data
+	}
+
+	merged, kept, err := mergeMCPJSON(existing, data, serversKey)
+	if err != nil {
+		status(phaseMCP, DimStyle.Render(fmt.Sprintf("Existing MCP config %s is invalid (%v), replacing it", path, err)))
+		return data
+	}
+	if kept > 0 {
+		status(phaseMCP, DimStyle.Render(fmt.Sprintf("Keeping %d existing MCP server(s) from %s", kept, path)))
+	}
+	return merged
+}
+
+// mergeMCPJSON merges the JSON config data into existing; see mergeMCPFile.
+// Returns the merged config and how many servers were kept from existing.
+func mergeMCPJSON(existing, data []byte, serversKey string) ([]byte, int, error) {
+	if len(bytes.TrimSpace(existing)) == 0 {
+		return data, 0, nil
+	}
+
+	var doc, update map[string]json.RawMessage
+	if err := json.Unmarshal(existing, &doc); err != nil {
+		return nil, 0, err
+	}
+	if err := json.Unmarshal(data, &update); err != nil {
+		return nil, 0, err
+	}
+
+	var servers, added map[string]json.RawMessage
+	if raw, ok := doc[serversKey]; ok {
+		if err := json.Unmarshal(raw, &servers); err != nil {
+			return nil, 0, fmt.Errorf("%q is not an object", serversKey)
+		}
+	}
+	if raw, ok := update[serversKey]; ok {
+		if err := json.Unmarshal(raw, &added); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	kept := 0
+	for name := range servers {
+		if _, ok := added[name]; !ok {
+			kept++
+		}
+	}
+	if servers == nil {
+		servers = make(map[string]json.RawMessage, len(added))
+	}
+	for name, server := range added {
+		servers[name] = server
+	}
+
+	for key, value := range update {
+		doc[key] = value
+	}
+	doc[serversKey], _ = json.Marshal(servers)
+
+	merged, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, 0, err
+	}
+	return merged, kept, nil
+}
@@ -0,0 +1,132 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestMergeMCPJSON(t *testing.T) {
+	const data = `{"mcpServers":{"playwriter":{"command":"node"}}}`
+	tests := []struct {
+		name     string
+		existing string
+		want     string
+		wantKept int
+		wantErr  bool
+	}{
+		{name: "no file", want: data},
+		{name: "blank file", existing: " \n", want: data},
+		{
+			name:     "other servers kept",
+			existing: `{"mcpServers":{"docs":{"url":"https://mcp.example.com"}}}`,
+			want:     `{"mcpServers":{"docs":{"url":"https://mcp.example.com"},"playwriter":{"command":"node"}}}`,
+			wantKept: 1,
+		},
+		{
+			name:     "same-named server replaced",
+			existing: `{"mcpServers":{"playwriter":{"command":"npx","args":["playwriter@0.1"]}}}`,
+			want:     data,
+		},
+		{
+			name:     "other settings kept",
+			existing: `{"$schema":"https://example.com/schema.json","theme":"dark"}`,
+			want:     `{"$schema":"https://example.com/schema.json","theme":"dark","mcpServers":{"playwriter":{"command":"node"}}}`,
+		},
+		{name: "invalid JSON", existing: `{"mcpServers":`, wantErr: true},
+		{name: "servers not an object", existing: `{"mcpServers":["docs"]}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merged, kept, err := mergeMCPJSON([]byte(tt.existing), []byte(data), "mcpServers")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !jsonEqual(merged, tt.want) {
+				t.Errorf("merged =\n%s\nwant\n%s", merged, tt.want)
+			}
+			if kept != tt.wantKept {
+				t.Errorf("kept %d servers, want %d", kept, tt.wantKept)
+			}
+		})
+	}
+}
+
+func TestConfigureMCPMerge(t *testing.T) {
+	config := MCPConfig{MCPServers: map[string]MCPServer{"playwriter": {Command: "node"}}}
+	tests := []struct {
+		name     string
+		agent    Agent
+		path     string
+		existing string
+		want     string
+	}{
+		{
+			name:     "claude merges",
+			agent:    &ClaudeAgent{},
+			path:     "/home/kernel/.mcp.json",
+			existing: `{"mcpServers":{"docs":{"url":"https://mcp.example.com"}}}`,
+			want:     `{"mcpServers":{"docs":{"url":"https://mcp.example.com"},"playwriter":{"command":"node"}}}`,
+		},
+		{
+			name:     "claude replaces",
+			agent:    &ClaudeAgent{ReplaceMCP: true},
+			path:     "/home/kernel/.mcp.json",
+			existing: `{"mcpServers":{"docs":{"url":"https://mcp.example.com"}}}`,
+			want:     `{"mcpServers":{"playwriter":{"command":"node"}}}`,
+		},
+		{
+			name:     "cursor merges",
+			agent:    &CursorAgent{},
+			path:     "/home/kernel/.cursor/mcp.json",
+			existing: `{"mcpServers":{"docs":{"url":"https://mcp.example.com"}}}`,
+			want:     `{"mcpServers":{"docs":{"url":"https://mcp.example.com"},"playwriter":{"command":"node"}}}`,
+		},
+		{
+			name:     "opencode keeps settings",
+			agent:    &OpenCodeAgent{},
+			path:     "/home/kernel/.config/opencode/opencode.json",
+			existing: `{"model":"anthropic/claude-sonnet-4-5","mcp":{"docs":{"type":"remote","url":"https://mcp.example.com"}}}`,
+			want: `{"model":"anthropic/claude-sonnet-4-5","mcp":{
+				"docs":{"type":"remote","url":"https://mcp.example.com"},
+				"playwriter":{"type":"local","command":["node"],"enabled":true}}}`,
+		},
+		{
+			name:     "opencode replaces",
+			agent:    &OpenCodeAgent{ReplaceMCP: true},
+			path:     "/home/kernel/.config/opencode/opencode.json",
+			existing: `{"model":"anthropic/claude-sonnet-4-5","mcp":{"docs":{"type":"remote","url":"https://mcp.example.com"}}}`,
+			want:     `{"mcp":{"playwriter":{"type":"local","command":["node"],"enabled":true}}}`,
+		},
+		{
+			name:     "invalid file replaced",
+			agent:    &ClaudeAgent{},
+			path:     "/home/kernel/.mcp.json",
+			existing: `{"mcpServers":`,
+			want:     `{"mcpServers":{"playwriter":{"command":"node"}}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, client := newFakeKernel(t)
+			fake.files[tt.path] = tt.existing
+			if err := tt.agent.ConfigureMCP(context.Background(), client, testSessionID, config); err != nil {
+				t.Fatal(err)
+			}
+			assertJSONFile(t, fake, tt.path, tt.want)
+		})
+	}
+}
+
+// jsonEqual reports whether data holds the same JSON as want
+func jsonEqual(data []byte, want string) bool {
+	var got, wantJSON any
+	if json.Unmarshal(data, &got) != nil || json.Unmarshal([]byte(want), &wantJSON) != nil {
+		return false
+	}
+	return reflect.DeepEqual(got, wantJSON)
+}
@@ -5,13 +5,28 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
-	"time"
 
 	"github.com/onkernel/kernel-go-sdk"
 )
 
 // OpenCodeAgent implements the Agent interface for OpenCode CLI
-type OpenCodeAgent struct{}
+type OpenCodeAgent struct {
+	// ConfigDir overrides the config home (XDG_CONFIG_HOME); the config is
+	// written to ConfigDir/opencode/opencode.json. Empty uses ~/.config.
+	ConfigDir string
+
+	// InstallCommand, if set, replaces the default install command. It runs
+	// with bash as root, with HOME=/home/kernel.
+	InstallCommand string
+
+	// ReplaceMCP makes ConfigureMCP overwrite the MCP config instead of
+	// merging into servers already configured in the session
+	ReplaceMCP bool
+
+	// OutputFile, if set, has the agent write its output stream to this file
+	// in the session, which is tailed instead of the PTY's stdout
+	OutputFile string
+}
 
 // NewOpenCodeAgent creates a new OpenCode agent
 func NewOpenCodeAgent() *OpenCodeAgent {
@@ -34,6 +49,30 @@ func (a *OpenCodeAgent) DefaultModel() string {
 	return "anthropic/claude-opus-4-5"
 }
 
+// ModelAlias maps the fast, smart, and default aliases to OpenCode models
+func (a *OpenCodeAgent) ModelAlias(alias string) (string, bool) {
+	switch alias {
+	case ModelAliasFast:
+		return "anthropic/claude-haiku-4-5", true
+	case ModelAliasSmart:
+		return "anthropic/claude-opus-4-5", true
+	case ModelAliasDefault:
+		return a.DefaultModel(), true
+	}
+	return "", false
+}
+
+// MaxPromptBytes returns 0: long prompts are read from stdin
+func (a *OpenCodeAgent) MaxPromptBytes() int {
+	return 0
+}
+
+// KnownModels returns nil: OpenCode takes provider/model names for any
+// configured provider, so there's no list to check against
+func (a *OpenCodeAgent) KnownModels() []string {
+	return nil
+}
+
 // OpenCodeProviderEnvVars lists all environment variables that OpenCode recognizes
 // for provider authentication. These are forwarded to the Kernel environment.
 var OpenCodeProviderEnvVars = []string{
@@ -59,6 +98,14 @@ var OpenCodeProviderEnvVars = []string{
 	"SAMBANOVA_API_KEY",
 }
 
+// configHome returns the XDG config home OpenCode reads from
+func (a *OpenCodeAgent) configHome() string {
+	if a.ConfigDir != "" {
+		return a.ConfigDir
+	}
+	return "/home/kernel/.config"
+}
+
 // ProviderEnvVars returns all provider env vars that OpenCode supports
 func (a *OpenCodeAgent) ProviderEnvVars() []string {
 	return OpenCodeProviderEnvVars
@@ -66,14 +113,14 @@ func (a *OpenCodeAgent) ProviderEnvVars() []string {
 
 // Install installs OpenCode in the browser environment
 func (a *OpenCodeAgent) Install(ctx context.Context, client kernel.Client, sessionID string) error {
-	fmt.Println(HeaderStyle.Render("Installing OpenCode..."))
+	status(phaseInstall, HeaderStyle.Render("Installing OpenCode..."))
 
 	proc := client.Browsers.Process
 
 	// Install opencode
 	result, err := proc.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
 		Command:    "bash",
-		Args:       []string{"-c", "export HOME=/home/kernel && curl -fsSL https://opencode.ai/install | bash"},
+		Args:       []string{"-c", installScript(a.InstallCommand, "curl -fsSL https://opencode.ai/install | bash")},
 		TimeoutSec: kernel.Opt(int64(300)),
 	})
 	if err != nil {
@@ -91,28 +138,47 @@ func (a *OpenCodeAgent) Install(ctx context.Context, client kernel.Client, sessi
 		AsRoot:  kernel.Opt(true),
 	})
 
-	fmt.Println(SuccessStyle.Render("OpenCode installed"))
+	status(phaseInstall, SuccessStyle.Render("OpenCode installed"))
 	return nil
 }
 
 // ConfigureMCP sets up the MCP server configuration for OpenCode
 func (a *OpenCodeAgent) ConfigureMCP(ctx context.Context, client kernel.Client, sessionID string, config MCPConfig) error {
-	fmt.Println(HeaderStyle.Render("Configuring MCP..."))
+	if err := ValidateMCPConfig(config); err != nil {
+		return err
+	}
+
+	status(phaseMCP, HeaderStyle.Render("Configuring MCP..."))
 
 	proc := client.Browsers.Process
 
-	// Create .config/opencode directory
+	configDir := a.configHome() + "/opencode"
+
+	// Create opencode config directory
 	proc.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
 		Command: "bash",
-		Args:    []string{"-c", "mkdir -p /home/kernel/.config/opencode"},
+		Args:    []string{"-c", "mkdir -p " + shellQuote(configDir)},
 	})
 
 	// Convert MCPConfig to OpenCode format
 	// OpenCode uses: {"mcp": {"name": {"type": "local", "command": [...], "enabled": true}}}
+	// and {"type": "remote", "url": "...", "headers": {...}} for HTTP/SSE servers
 	opencodeMCP := make(map[string]any)
 	mcpServers := make(map[string]any)
 
 	for name, server := range config.MCPServers {
+		if server.IsRemote() {
+			remote := map[string]any{
+				"type":    "remote",
+				"url":     server.URL,
+				"enabled": true,
+			}
+			if len(server.Headers) > 0 {
+				remote["headers"] = server.Headers
+			}
+			mcpServers[name] = remote
+			continue
+		}
 		// Build command array: [command, ...args]
 		cmdArray := append([]string{server.Command}, server.Args...)
 		mcpServers[name] = map[string]any{
@@ -123,23 +189,35 @@ func (a *OpenCodeAgent) ConfigureMCP(ctx context.Context, client kernel.Client,
 	}
 	opencodeMCP["mcp"] = mcpServers
 
+	// Other settings in an existing opencode.json are kept as well
 	mcpJSON, _ := json.MarshalIndent(opencodeMCP, "", "  ")
+	mcpJSON = mergeMCPFile(ctx, client, sessionID, configDir+"/opencode.json", "mcp", mcpJSON, a.ReplaceMCP)
 	proc.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
 		Command: "bash",
-		Args:    []string{"-c", fmt.Sprintf("cat > /home/kernel/.config/opencode/opencode.json << 'EOF'\n%s\nEOF", mcpJSON)},
+		Args:    []string{"-c", fmt.Sprintf("cat > %s << 'EOF'\n%s\nEOF", shellQuote(configDir+"/opencode.json"), mcpJSON)},
 	})
 
 	// Fix ownership
 	proc.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
 		Command: "bash",
-		Args:    []string{"-c", "chown -R kernel:kernel /home/kernel/.config/opencode"},
+		Args:    []string{"-c", "chown -R kernel:kernel " + shellQuote(configDir)},
 		AsRoot:  kernel.Opt(true),
 	})
 
-	fmt.Println(SuccessStyle.Render("MCP configured"))
+	status(phaseMCP, SuccessStyle.Render("MCP configured"))
 	return nil
 }
 
+// VerifyMCP checks that OpenCode lists server via `opencode mcp list`,
+// falling back to probing opencode.json if the command isn't available
+func (a *OpenCodeAgent) VerifyMCP(ctx context.Context, client kernel.Client, sessionID, server string) error {
+	cmd := `export HOME=/home/kernel && export PATH="$HOME/.opencode/bin:$PATH" && export XDG_CONFIG_HOME=` + shellQuote(a.configHome()) + " && opencode mcp list"
+	if listed, ok := mcpListCheck(ctx, client, sessionID, cmd, server); ok && listed {
+		return nil
+	}
+	return checkMCPFile(ctx, client, sessionID, a.configHome()+"/opencode/opencode.json", "mcp", server)
+}
+
 // OpenCodeStreamEvent represents a JSON event from OpenCode's stream output
 type OpenCodeStreamEvent struct {
 	Type      string `json:"type"`
@@ -150,30 +228,67 @@ type OpenCodeStreamEvent struct {
 		Type string `json:"type"`
 		Text string `json:"text,omitempty"`
 		Tool string `json:"tool,omitempty"`
+		// For text events; End is set once the part is finished
+		Time struct {
+			Start int64 `json:"start,omitempty"`
+			End   int64 `json:"end,omitempty"`
+		} `json:"time,omitempty"`
 		// For tool_use events
 		State struct {
-			Status string `json:"status,omitempty"`
-			Input  struct {
-				Code string `json:"code,omitempty"`
-			} `json:"input,omitempty"`
+			Status string   `json:"status,omitempty"`
+			Input  ToolArgs `json:"input,omitempty"`
 		} `json:"state,omitempty"`
 	} `json:"part,omitempty"`
+	// For error events
+	Error json.RawMessage `json:"error,omitempty"`
 }
 
 // Run executes a prompt using OpenCode
 func (a *OpenCodeAgent) Run(ctx context.Context, client kernel.Client, sessionID string, opts RunOptions, handler StreamHandler) (int64, error) {
-	if opts.AgentTimeout > 0 {
-		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, time.Duration(opts.AgentTimeout)*time.Second)
-		defer cancel()
+	ctx, cancel := runContext(ctx, opts)
+	defer cancel()
+
+	if !IsInstalled(ctx, client, sessionID, "/home/kernel/.opencode/bin/opencode") {
+		return 1, notInstalledError("opencode", "/home/kernel/.opencode/bin/opencode")
+	}
+	dir := workDir(opts)
+	if err := checkWorkDir(ctx, client, sessionID, dir); err != nil {
+		return 1, err
 	}
 
-	fmt.Println(HeaderStyle.Render("Running OpenCode..."))
+	status(phaseAgent, HeaderStyle.Render("Running OpenCode..."))
 	fmt.Println()
 
-	// Escape prompt for shell
+	warnToolsUnsupported("opencode", opts)
+	warnAutoApproveUnsupported("opencode", opts)
+
+	if err := stagePrompt(ctx, client, sessionID, opts.Prompt); err != nil {
+		return 1, err
+	}
+	cmd := a.command(opts, ptyVariant(ctx, client, sessionID, opts))
+
+	return baseRun(ctx, KernelProcesses(client, sessionID), "opencode", cmd, opts, outputFor(a.OutputFile), a.decodeEvent, handler)
+}
+
+// Command returns the command Run spawns for opts, assuming util-linux
+// script for the PTY
+func (a *OpenCodeAgent) Command(opts RunOptions) string {
+	return a.command(opts, defaultPTYVariant(opts))
+}
+
+// command builds the bash command that runs OpenCode under pty
+func (a *OpenCodeAgent) command(opts RunOptions, pty PTYVariant) string {
+	dir := workDir(opts)
+
+	// Escape prompt for shell. Long prompts are read from stdin instead,
+	// which has no length limit; opencode run appends piped input to its
+	// message.
 	escaped := strings.ReplaceAll(opts.Prompt, "'", "'\"'\"'")
 	escaped = strings.ReplaceAll(escaped, `"`, `\"`)
+	promptArg := ` "` + escaped + `"`
+	if promptStaged(opts.Prompt) {
+		promptArg = " < " + PromptFilePath
+	}
 
 	// Build model argument
 	modelArg := ""
@@ -181,6 +296,18 @@ func (a *OpenCodeAgent) Run(ctx context.Context, client kernel.Client, sessionID
 		modelArg = fmt.Sprintf(" -m %s", opts.Model)
 	}
 
+	// JSON events, unless plain text output was asked for
+	formatArg := " --format json"
+	if opts.TextOutput {
+		formatArg = ""
+	}
+
+	// Continue an earlier OpenCode session
+	resumeArg := ""
+	if opts.ResumeID != "" {
+		resumeArg = " --session " + shellQuote(opts.ResumeID)
+	}
+
 	// Build environment variable exports from the EnvVars map
 	var envExports strings.Builder
 	for key, value := range opts.EnvVars {
@@ -191,93 +318,50 @@ func (a *OpenCodeAgent) Run(ctx context.Context, client kernel.Client, sessionID
 		}
 	}
 
+	// Point OpenCode at the custom config home if one is set
+	if a.ConfigDir != "" {
+		envExports.WriteString("export XDG_CONFIG_HOME=" + shellQuote(a.ConfigDir) + "\n")
+	}
+
 	// OpenCode flags:
 	// - run: non-interactive mode
-	// - --format json: JSON streaming output
+	// - --format json: JSON streaming output (omitted with TextOutput)
+	// - --session: continue an earlier session (ResumeID), if any
 	// OpenCode supports multiple providers via environment variables
 	// Note: opencode installs to ~/.opencode/bin/opencode
 	script := fmt.Sprintf(`#!/bin/bash
 export HOME=/home/kernel
-export PATH="$HOME/.opencode/bin:$HOME/.local/bin:$PATH"
-%scd /home/kernel
-/home/kernel/.opencode/bin/opencode run --format json%s "%s"
-`, envExports.String(), modelArg, escaped)
+export PATH="$HOME/.opencode/bin:$HOME/.bun/bin:$HOME/.local/bin:$PATH"
+%scd %s
+/home/kernel/.opencode/bin/opencode run%s%s%s%s%s
+`, envExports.String(), shellQuote(dir), formatArg, modelArg, resumeArg, promptArg, outputRedirect(a.OutputFile))
+
+	// Run as kernel user unless root was requested
+	runCmd := "su - kernel -c '/tmp/run_opencode.sh'"
+	if opts.AsRoot {
+		runCmd = "/tmp/run_opencode.sh"
+	}
 
-	// Write script and run as kernel user with PTY (using 'script' command)
+	// Write script and run with PTY (using 'script' command)
 	cmd := fmt.Sprintf(
 		`cat > /tmp/run_opencode.sh << 'SCRIPT'
 %s
 SCRIPT
 chmod +x /tmp/run_opencode.sh
-script -q -c "su - kernel -c '/tmp/run_opencode.sh'" /dev/null`,
-		script,
+%s`,
+		script, ptyWrap(pty, runCmd),
 	)
 
-	spawn, err := client.Browsers.Process.Spawn(ctx, sessionID, kernel.BrowserProcessSpawnParams{
-		Command: "bash", Args: []string{"-c", cmd},
-	})
-	if err != nil {
-		return 1, fmt.Errorf("spawn opencode: %w", err)
-	}
-
-	stream := client.Browsers.Process.StdoutStreamStreaming(ctx, spawn.ProcessID, kernel.BrowserProcessStdoutStreamParams{
-		ID: sessionID,
-	})
-
-	var jsonBuffer strings.Builder
-	var exitCode int64
-	decoder := json.NewDecoder(strings.NewReader(""))
-
-	for stream.Next() {
-		event := stream.Current()
-
-		if event.Event == kernel.BrowserProcessStdoutStreamResponseEventExit {
-			exitCode = event.ExitCode
-			break
-		}
-
-		if event.DataB64 != "" {
-			data := DecodeB64(event.DataB64)
-			jsonBuffer.WriteString(data)
-
-			// Try to parse all complete JSON objects from buffer
-			decoder = json.NewDecoder(strings.NewReader(jsonBuffer.String()))
-			var consumed int
-			for {
-				var ocEvent OpenCodeStreamEvent
-				if err := decoder.Decode(&ocEvent); err != nil {
-					break // incomplete JSON, wait for more data
-				}
-				// Convert OpenCode event to common StreamEvent format
-				streamEvent := a.convertEvent(ocEvent)
-				handler(streamEvent)
-				consumed = int(decoder.InputOffset())
-			}
-			// Keep only unparsed data in buffer
-			if consumed > 0 {
-				remaining := jsonBuffer.String()[consumed:]
-				jsonBuffer.Reset()
-				jsonBuffer.WriteString(remaining)
-			}
-		}
-	}
-
-	// Process any remaining complete JSON in buffer
-	decoder = json.NewDecoder(strings.NewReader(jsonBuffer.String()))
-	for {
-		var ocEvent OpenCodeStreamEvent
-		if err := decoder.Decode(&ocEvent); err != nil {
-			break
-		}
-		streamEvent := a.convertEvent(ocEvent)
-		handler(streamEvent)
-	}
+	return cmd
+}
 
-	if err := stream.Err(); err != nil {
-		return 1, fmt.Errorf("stream error: %w", err)
+// decodeEvent decodes an OpenCode JSON event into the common StreamEvent format
+func (a *OpenCodeAgent) decodeEvent(raw json.RawMessage) (StreamEvent, bool) {
+	var ocEvent OpenCodeStreamEvent
+	if err := json.Unmarshal(raw, &ocEvent); err != nil {
+		return StreamEvent{}, false
 	}
-
-	return exitCode, nil
+	return a.convertEvent(ocEvent), true
 }
 
 // convertEvent converts an OpenCode stream event to the common StreamEvent format
@@ -288,12 +372,11 @@ func (a *OpenCodeAgent) convertEvent(ocEvent OpenCodeStreamEvent) StreamEvent {
 	case "text":
 		streamEvent.Type = "assistant"
 		if ocEvent.Part.Text != "" {
-			streamEvent.Message.Content = []struct {
-				Type string `json:"type"`
-				Text string `json:"text"`
-			}{
-				{Type: "text", Text: ocEvent.Part.Text},
-			}
+			streamEvent = TextEvent("assistant", ocEvent.Part.Text)
+		}
+		// Parts without timing are sent whole
+		if ocEvent.Part.Time.End != 0 || ocEvent.Part.Time.Start == 0 {
+			streamEvent.Subtype = MessageCompleteSubtype
 		}
 	case "tool_use":
 		streamEvent.Type = "tool_call"
@@ -302,11 +385,16 @@ func (a *OpenCodeAgent) convertEvent(ocEvent OpenCodeStreamEvent) StreamEvent {
 			streamEvent.Subtype = "started"
 		}
 		streamEvent.ToolCall.MCPToolCall.Args.Name = ocEvent.Part.Tool
-		streamEvent.ToolCall.MCPToolCall.Args.Args.Code = ocEvent.Part.State.Input.Code
+		streamEvent.ToolCall.MCPToolCall.Args.Args = ocEvent.Part.State.Input
+	case "error":
+		streamEvent.Type = "error"
+		streamEvent.IsError = true
+		streamEvent.Result = string(ocEvent.Error)
 	default:
 		// Pass through other event types
 		streamEvent.Type = ocEvent.Type
 	}
 
+	streamEvent.SessionID = ocEvent.SessionID
 	return streamEvent
 }
@@ -0,0 +1,83 @@
+package agent
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestOpenCodeCommandResume(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     RunOptions
+		wantArgs string // after "opencode run"
+	}{
+		{
+			name:     "new session",
+			opts:     RunOptions{Prompt: "hi"},
+			wantArgs: ` --format json "hi"`,
+		},
+		{
+			name:     "resumed session",
+			opts:     RunOptions{Prompt: "hi", ResumeID: "ses_4f2a9c"},
+			wantArgs: ` --format json --session 'ses_4f2a9c' "hi"`,
+		},
+		{
+			name:     "resumed with a model",
+			opts:     RunOptions{Prompt: "hi", Model: "anthropic/claude-sonnet-4-5", ResumeID: "ses_4f2a9c"},
+			wantArgs: ` --format json -m anthropic/claude-sonnet-4-5 --session 'ses_4f2a9c' "hi"`,
+		},
+	}
+	const prefix = "/home/kernel/.opencode/bin/opencode run"
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			line := commandLine(t, (&OpenCodeAgent{}).command(tt.opts, PTYNone), prefix)
+			if got := strings.TrimPrefix(line, prefix); got != tt.wantArgs {
+				t.Errorf("opencode run args = %s\nwant %s", got, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestOpenCodeSessionID(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  []string // SessionID of each event
+	}{
+		{
+			name: "every event carries the session",
+			lines: []string{
+				`{"type":"step_start","sessionID":"ses_1","part":{}}`,
+				`{"type":"tool_use","sessionID":"ses_1","part":{"tool":"playwriter_execute","state":{"status":"completed","input":{"code":"1"}}}}`,
+				`{"type":"text","sessionID":"ses_1","part":{"type":"text","text":"done"}}`,
+			},
+			want: []string{"ses_1", "ses_1", "ses_1"},
+		},
+		{
+			name: "events without one",
+			lines: []string{
+				`{"type":"step_start","part":{}}`,
+				`{"type":"text","sessionID":"ses_2","part":{"type":"text","text":"done"}}`,
+			},
+			want: []string{"", "ses_2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := &fakeRunner{conns: []fakeConn{{events: []OutputEvent{stdout(strings.Join(tt.lines, "\n") + "\n"), exited(0)}}}}
+			var got []string
+			a := &OpenCodeAgent{}
+			_, err := baseRun(context.Background(), runner, "opencode", "opencode run", RunOptions{}, stdoutSource{}, a.decodeEvent, func(event StreamEvent) {
+				got = append(got, event.SessionID)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("session IDs = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
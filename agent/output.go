@@ -0,0 +1,141 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/onkernel/kernel-go-sdk"
+)
+
+// How often a file output source checks its file for new data
+const outputFilePollInterval = 500 * time.Millisecond
+
+// outputSource is where the shared run loop reads an agent's JSON stream
+// from. Most agents write it to stdout; agents whose stdout is polluted (by
+// the PTY, for instance) can write it to a file instead.
+type outputSource interface {
+	// follow starts delivering the stream to onData, before the agent is
+	// spawned. It returns the function the process's stdout chunks are
+	// passed to, and finish, which is called once the process has exited
+	// to deliver any remaining data and stop following.
+	follow(ctx context.Context, runner ProcessRunner, onData func(string)) (onStdout func(string), finish func() error)
+}
+
+// stdoutSource reads the stream from the process's stdout
+type stdoutSource struct{}
+
+func (stdoutSource) follow(ctx context.Context, runner ProcessRunner, onData func(string)) (func(string), func() error) {
+	return onData, func() error { return nil }
+}
+
+// fileSource tails the stream from a file in the session, such as one passed
+// to an agent's --output-file flag. The process's stdout is only logged.
+type fileSource struct {
+	path string
+}
+
+// fileOutput returns a source tailing the file at path
+func fileOutput(path string) outputSource {
+	return fileSource{path: path}
+}
+
+func (s fileSource) follow(ctx context.Context, runner ProcessRunner, onData func(string)) (func(string), func() error) {
+	// A file left by an earlier run would be replayed as this run's output
+	if err := runner.DeleteFile(ctx, s.path); err != nil {
+		debugf("output file: %v", err)
+	}
+
+	tail := &fileTail{path: s.path}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(outputFilePollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := tail.poll(ctx, runner, onData); err != nil {
+					debugf("output file: %v", err)
+				}
+			}
+		}
+	}()
+
+	onStdout := func(data string) {
+		debugf("stdout: %d bytes ignored, output is read from %s", len(data), s.path)
+	}
+	var once sync.Once
+	finish := func() error {
+		var err error
+		once.Do(func() {
+			close(done)
+			<-stopped
+			// The agent may have written its last events after the final poll
+			err = tail.poll(context.WithoutCancel(ctx), runner, onData)
+		})
+		return err
+	}
+	return onStdout, finish
+}
+
+// outputFor returns the source for an agent's stream: the file it's
+// redirected to (see outputRedirect), or stdout if file is ""
+func outputFor(file string) outputSource {
+	if file == "" {
+		return stdoutSource{}
+	}
+	return fileOutput(file)
+}
+
+// outputRedirect returns what to append to an agent's command line to write
+// its stream to file, or "" to leave it on stdout
+func outputRedirect(file string) string {
+	if file == "" {
+		return ""
+	}
+	return " > " + shellQuote(file)
+}
+
+// fileTail tracks how much of a growing file was delivered. The Fs API
+// reads whole files, so each poll skips the bytes already handled.
+type fileTail struct {
+	path    string
+	handled int
+}
+
+// poll delivers data appended to the file since the last poll. A file that
+// doesn't exist yet has no data.
+func (t *fileTail) poll(ctx context.Context, runner ProcessRunner, onData func(string)) error {
+	data, err := runner.ReadFile(ctx, t.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(data) < t.handled {
+		// Truncated or replaced; start over rather than skip new data
+		debugf("output file: %s shrank from %d to %d bytes", t.path, t.handled, len(data))
+		t.handled = 0
+	}
+	if len(data) > t.handled {
+		onData(string(data[t.handled:]))
+		t.handled = len(data)
+	}
+	return nil
+}
+
+// isNotFound reports whether err is the API's 404
+func isNotFound(err error) bool {
+	var apiErr *kernel.Error
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
@@ -0,0 +1,125 @@
+package agent
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestFileTailPoll(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents []string // file contents at each poll; "-" for no file
+		want     []string
+	}{
+		{
+			name:     "missing file has no data",
+			contents: []string{"-", "-"},
+		},
+		{
+			name:     "growing file delivers only new data",
+			contents: []string{"ab", "ab", "abcd", "abcdef"},
+			want:     []string{"ab", "cd", "ef"},
+		},
+		{
+			name:     "file appears later",
+			contents: []string{"-", "ab"},
+			want:     []string{"ab"},
+		},
+		{
+			name:     "truncated file starts over",
+			contents: []string{"abcd", "x", "xy"},
+			want:     []string{"abcd", "x", "y"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := &fakeRunner{}
+			tail := &fileTail{path: "/tmp/out.jsonl"}
+			var got []string
+			for _, contents := range tt.contents {
+				if contents == "-" {
+					runner.DeleteFile(context.Background(), tail.path)
+				} else {
+					runner.writeFile(tail.path, contents)
+				}
+				if err := tail.poll(context.Background(), runner, func(data string) { got = append(got, data) }); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("delivered %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileOutputRun(t *testing.T) {
+	const path = "/tmp/agent-output.jsonl"
+	tests := []struct {
+		name   string
+		stale  string // left over from an earlier run
+		output string // written by the agent
+		want   []string
+	}{
+		{
+			name:   "stream read from the file",
+			output: initLine + resultLine,
+			want:   []string{"system/init", "result/success"},
+		},
+		{
+			name:   "stale file is not replayed",
+			stale:  `{"type":"result","subtype":"error"}` + "\n",
+			output: resultLine,
+			want:   []string{"result/success"},
+		},
+		{
+			name:   "last event without a newline",
+			output: initLine + strings.TrimSuffix(resultLine, "\n"),
+			want:   []string{"system/init", "result/success"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := &fakeRunner{conns: []fakeConn{
+				// The PTY's stdout is noise that must not reach the handler
+				{events: []OutputEvent{stdout("\x1b[?25lspinner\r\n"), exited(0)}},
+			}}
+			if tt.stale != "" {
+				runner.writeFile(path, tt.stale)
+			}
+			runner.spawned = func() { runner.writeFile(path, tt.output) }
+			var got eventRecorder
+			if _, err := baseRun(context.Background(), runner, "test", "agent", RunOptions{}, outputFor(path), decodeStreamEvent, got.handle); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got.events(), tt.want) {
+				t.Errorf("events = %q, want %q", got.events(), tt.want)
+			}
+		})
+	}
+}
+
+func TestOutputRedirect(t *testing.T) {
+	tests := []struct {
+		name  string
+		agent Agent
+		line  string
+	}{
+		{"claude", &ClaudeAgent{OutputFile: "/tmp/out.jsonl"}, "/usr/local/bin/claude "},
+		{"cursor", &CursorAgent{OutputFile: "/tmp/out.jsonl"}, "export HOME="},
+		{"opencode", &OpenCodeAgent{OutputFile: "/tmp/out.jsonl"}, "/home/kernel/.opencode/bin/opencode "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			line := commandLine(t, tt.agent.Command(RunOptions{Prompt: "hi"}), tt.line)
+			if !strings.Contains(line, `"hi`) || !strings.Contains(line, " > '/tmp/out.jsonl'") {
+				t.Errorf("stream not redirected to the output file:\n%s", line)
+			}
+		})
+	}
+	if _, ok := outputFor("").(stdoutSource); !ok {
+		t.Error("outputFor(\"\") is not stdout")
+	}
+}
@@ -0,0 +1,121 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+
+	"github.com/onkernel/kernel-go-sdk"
+	"github.com/onkernel/kernel-go-sdk/packages/ssestream"
+)
+
+// ProcessRunner spawns agent processes in a session and follows their output.
+// The shared run loop reaches the session only through it, so the loop can be
+// driven without one; KernelProcesses is the implementation for real runs.
+type ProcessRunner interface {
+	// Spawn starts cmd with bash and returns its process ID
+	Spawn(ctx context.Context, cmd string) (processID string, err error)
+	// Output opens the process's output stream. The API takes no offset, so a
+	// reopened stream may start again from the beginning of the output.
+	Output(ctx context.Context, processID string) OutputStream
+	// WriteStdin sends data to the process's stdin
+	WriteStdin(ctx context.Context, processID string, data []byte) error
+	// ReadFile returns the contents of the file at path; a missing file is
+	// reported with an error wrapping fs.ErrNotExist
+	ReadFile(ctx context.Context, path string) ([]byte, error)
+	// DeleteFile removes the file at path if it exists
+	DeleteFile(ctx context.Context, path string) error
+}
+
+// OutputStream is an open process output stream, read like the SDK's streams
+type OutputStream interface {
+	Next() bool
+	Current() OutputEvent
+	Err() error
+	Close() error
+}
+
+// OutputEvent is one event of a process output stream
+type OutputEvent struct {
+	Event    string // OutputExitEvent or another lifecycle event; "" for data
+	Stream   string // OutputStdout, OutputStderr, or "" for untagged chunks
+	DataB64  string
+	ExitCode int64
+}
+
+// Values of OutputEvent's Event and Stream
+const (
+	OutputExitEvent = string(kernel.BrowserProcessStdoutStreamResponseEventExit)
+	OutputStdout    = string(kernel.BrowserProcessStdoutStreamResponseStreamStdout)
+	OutputStderr    = string(kernel.BrowserProcessStdoutStreamResponseStreamStderr)
+)
+
+// KernelProcesses returns the ProcessRunner for a Kernel browser session
+func KernelProcesses(client kernel.Client, sessionID string) ProcessRunner {
+	return kernelProcesses{client: client, sessionID: sessionID}
+}
+
+type kernelProcesses struct {
+	client    kernel.Client
+	sessionID string
+}
+
+func (k kernelProcesses) Spawn(ctx context.Context, cmd string) (string, error) {
+	spawn, err := k.client.Browsers.Process.Spawn(ctx, k.sessionID, kernel.BrowserProcessSpawnParams{
+		Command: "bash", Args: []string{"-c", cmd},
+	})
+	if err != nil {
+		return "", err
+	}
+	return spawn.ProcessID, nil
+}
+
+func (k kernelProcesses) Output(ctx context.Context, processID string) OutputStream {
+	return kernelStream{k.client.Browsers.Process.StdoutStreamStreaming(ctx, processID, kernel.BrowserProcessStdoutStreamParams{
+		ID: k.sessionID,
+	})}
+}
+
+func (k kernelProcesses) WriteStdin(ctx context.Context, processID string, data []byte) error {
+	return WriteStdin(ctx, k.client, k.sessionID, processID, data)
+}
+
+func (k kernelProcesses) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	resp, err := k.client.Browsers.Fs.ReadFile(ctx, k.sessionID, kernel.BrowserFReadFileParams{Path: path})
+	if isNotFound(err) {
+		return nil, fmt.Errorf("read %s: %w", path, fs.ErrNotExist)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	return data, nil
+}
+
+func (k kernelProcesses) DeleteFile(ctx context.Context, path string) error {
+	err := k.client.Browsers.Fs.DeleteFile(ctx, k.sessionID, kernel.BrowserFDeleteFileParams{Path: path})
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("delete %s: %w", path, err)
+	}
+	return nil
+}
+
+// kernelStream adapts the SDK's stdout stream to OutputStream
+type kernelStream struct {
+	*ssestream.Stream[kernel.BrowserProcessStdoutStreamResponse]
+}
+
+func (s kernelStream) Current() OutputEvent {
+	event := s.Stream.Current()
+	return OutputEvent{
+		Event:    string(event.Event),
+		Stream:   string(event.Stream),
+		DataB64:  event.DataB64,
+		ExitCode: event.ExitCode,
+	}
+}
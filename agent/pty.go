@@ -0,0 +1,67 @@
+package agent
+
+import (
+	"context"
+	"strings"
+
+	"github.com/onkernel/kernel-go-sdk"
+)
+
+// PTYVariant identifies how a command is given a pseudo-terminal
+type PTYVariant int
+
+const (
+	// PTYUtilLinux uses util-linux script syntax: script -q -c "cmd" /dev/null
+	PTYUtilLinux PTYVariant = iota
+	// PTYBSD uses BSD script syntax: script -q /dev/null bash -c "cmd"
+	PTYBSD
+	// PTYNone runs the command without a PTY
+	PTYNone
+)
+
+// DetectPTYVariant checks which flavor of `script` the session has.
+// util-linux is assumed if detection fails, since that's what Kernel images ship.
+func DetectPTYVariant(ctx context.Context, client kernel.Client, sessionID string) PTYVariant {
+	result, err := client.Browsers.Process.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
+		Command:    "bash",
+		Args:       []string{"-c", "script --version 2>&1 || true"},
+		TimeoutSec: kernel.Opt(int64(5)),
+	})
+	if err != nil {
+		return PTYUtilLinux
+	}
+	if strings.Contains(DecodeB64(result.StdoutB64), "util-linux") {
+		return PTYUtilLinux
+	}
+	return PTYBSD
+}
+
+// ptyVariant returns the variant to use for a run, honoring opts.NoPTY
+func ptyVariant(ctx context.Context, client kernel.Client, sessionID string, opts RunOptions) PTYVariant {
+	if opts.NoPTY {
+		return PTYNone
+	}
+	return DetectPTYVariant(ctx, client, sessionID)
+}
+
+// defaultPTYVariant is ptyVariant without detection, for building a command
+// without a session
+func defaultPTYVariant(opts RunOptions) PTYVariant {
+	if opts.NoPTY {
+		return PTYNone
+	}
+	return PTYUtilLinux
+}
+
+// ptyWrap wraps cmd so it runs under the given PTY variant. cmd is placed
+// inside double quotes in every variant, so callers escape it the same way.
+func ptyWrap(variant PTYVariant, cmd string) string {
+	switch variant {
+	case PTYBSD:
+		return `script -q /dev/null bash -c "` + cmd + `"`
+	case PTYNone:
+		return `bash -c "` + cmd + `"`
+	default:
+		return `script -q -c "` + cmd + `" /dev/null`
+	}
+}
@@ -0,0 +1,90 @@
+package agent
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestPTYWrap(t *testing.T) {
+	const cmd = `echo \"hi there\"; test -t 1 && echo tty || echo no-tty`
+	tests := []struct {
+		name    string
+		variant PTYVariant
+		want    string
+		// Output when run here, or "" if this system's script can't run it
+		wantOutput string
+	}{
+		{
+			name:       "util-linux",
+			variant:    PTYUtilLinux,
+			want:       `script -q -c "` + cmd + `" /dev/null`,
+			wantOutput: "hi there\r\ntty\r\n",
+		},
+		{
+			name:    "BSD",
+			variant: PTYBSD,
+			want:    `script -q /dev/null bash -c "` + cmd + `"`,
+		},
+		{
+			name:       "no PTY",
+			variant:    PTYNone,
+			want:       `bash -c "` + cmd + `"`,
+			wantOutput: "hi there\nno-tty\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wrapped := ptyWrap(tt.variant, cmd)
+			if wrapped != tt.want {
+				t.Fatalf("ptyWrap() = %s\nwant %s", wrapped, tt.want)
+			}
+			if tt.wantOutput == "" {
+				return
+			}
+			if tt.variant == PTYUtilLinux {
+				if out, _ := exec.Command("script", "--version").CombinedOutput(); !strings.Contains(string(out), "util-linux") {
+					t.Skip("util-linux script not installed")
+				}
+			}
+			out, err := exec.Command("bash", "-c", wrapped).Output()
+			if err != nil {
+				t.Fatalf("%s: %v", wrapped, err)
+			}
+			if string(out) != tt.wantOutput {
+				t.Errorf("output = %q, want %q", out, tt.wantOutput)
+			}
+		})
+	}
+}
+
+func TestDetectPTYVariant(t *testing.T) {
+	tests := []struct {
+		name   string
+		stdout string
+		want   PTYVariant
+	}{
+		{"util-linux", "script from util-linux 2.38.1\n", PTYUtilLinux},
+		{"BSD rejects --version", "script: illegal option -- -\nusage: script [-adkpqr] [-F pipe] [-t time] [file [command ...]]\n", PTYBSD},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, client := newFakeKernel(t)
+			fake.exec = func(call execCall) (int, string) { return 0, tt.stdout }
+			if got := DetectPTYVariant(context.Background(), client, testSessionID); got != tt.want {
+				t.Errorf("DetectPTYVariant() = %v, want %v", got, tt.want)
+			}
+			if got := ptyVariant(context.Background(), client, testSessionID, RunOptions{NoPTY: true}); got != PTYNone {
+				t.Errorf("ptyVariant(NoPTY) = %v, want PTYNone", got)
+			}
+		})
+	}
+
+	// util-linux is assumed when the check itself fails
+	fake, client := newFakeKernel(t)
+	fake.fail = true
+	if got := DetectPTYVariant(context.Background(), client, testSessionID); got != PTYUtilLinux {
+		t.Errorf("DetectPTYVariant() after a failed check = %v, want PTYUtilLinux", got)
+	}
+}
@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"strings"
+)
+
+// transientPatterns are lowercase fragments of error messages for failures
+// that are likely to succeed when retried: rate limits, provider overload,
+// and dropped connections
+var transientPatterns = []string{
+	"rate limit",
+	"rate_limit",
+	"too many requests",
+	"overloaded",
+	"service unavailable",
+	"bad gateway",
+	"gateway timeout",
+	"econnreset",
+	"connection reset",
+	"socket hang up",
+	"etimedout",
+	"network error",
+	"fetch failed",
+}
+
+// isTerminalEvent reports whether event reports the outcome of a run: a
+// "result" event or an "error" event
+func isTerminalEvent(event StreamEvent) bool {
+	return event.Type == "result" || event.Type == "error"
+}
+
+// isFailure reports whether event is an error or a result marked as failed,
+// e.g. claude's "error_max_turns"
+func isFailure(event StreamEvent) bool {
+	switch event.Type {
+	case "error":
+		return true
+	case "result":
+		return event.IsError || strings.HasPrefix(event.Subtype, "error")
+	}
+	return false
+}
+
+// ResultError describes a failed result or error event: its message,
+// including the error subtype if any. Returns "" for successful results and
+// any other event.
+func ResultError(event StreamEvent) string {
+	if !isFailure(event) {
+		return ""
+	}
+	if text := failureText(event); text != "" {
+		return text
+	}
+	return "unknown error"
+}
+
+// IsTransientFailure reports whether event is a failed result or an error
+// whose message matches a known transient failure. Other failures, and
+// successful results, are not retryable.
+func IsTransientFailure(event StreamEvent) bool {
+	if !isFailure(event) {
+		return false
+	}
+
+	text := strings.ToLower(failureText(event))
+	for _, pattern := range transientPatterns {
+		if strings.Contains(text, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// failureText returns the message of a result or error event
+func failureText(event StreamEvent) string {
+	parts := []string{event.Result}
+	for _, c := range event.Message.Content {
+		parts = append(parts, c.Text)
+	}
+	if event.Subtype != "" {
+		parts = append(parts, event.Subtype)
+	}
+	text := strings.Join(strings.Fields(strings.Join(parts, " ")), " ")
+	if len(text) > 200 {
+		text = text[:200] + "..."
+	}
+	return text
+}
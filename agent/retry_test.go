@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"testing"
+)
+
+func TestResultError(t *testing.T) {
+	tests := []struct {
+		name          string
+		line          string
+		want          string
+		wantTransient bool
+	}{
+		{
+			name: "cursor success",
+			line: `{"type":"result","subtype":"success","is_error":false,"duration_ms":5210,"result":"The title is Example Domain","session_id":"c1"}`,
+		},
+		{
+			name: "cursor is_error",
+			line: `{"type":"result","subtype":"success","is_error":true,"result":"Model call failed: 429 Too Many Requests","session_id":"c1"}`,
+			want: "Model call failed: 429 Too Many Requests success", wantTransient: true,
+		},
+		{
+			name: "claude success",
+			line: `{"type":"result","subtype":"success","is_error":false,"num_turns":4,"result":"Done","session_id":"s1","total_cost_usd":0.02}`,
+		},
+		{
+			name: "claude max turns without is_error",
+			line: `{"type":"result","subtype":"error_max_turns","is_error":false,"num_turns":10,"session_id":"s1"}`,
+			want: "error_max_turns",
+		},
+		{
+			name: "claude API error",
+			line: `{"type":"result","subtype":"success","is_error":true,"result":"API Error: 529 {\"type\":\"error\",\"error\":{\"type\":\"overloaded_error\",\"message\":\"Overloaded\"}}"}`,
+			want: `API Error: 529 {"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}} success`, wantTransient: true,
+		},
+		{
+			name: "error without a message",
+			line: `{"type":"error"}`,
+			want: "unknown error",
+		},
+		{
+			name: "other events ignored",
+			line: `{"type":"assistant","is_error":true,"message":{"content":[{"type":"text","text":"error"}]}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, ok := decodeStreamEvent([]byte(tt.line))
+			if !ok {
+				t.Fatalf("line not decoded: %s", tt.line)
+			}
+			if got := ResultError(event); got != tt.want {
+				t.Errorf("ResultError() = %q, want %q", got, tt.want)
+			}
+			if got := IsTransientFailure(event); got != tt.wantTransient {
+				t.Errorf("IsTransientFailure() = %v, want %v", got, tt.wantTransient)
+			}
+		})
+	}
+}
@@ -0,0 +1,384 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often, and how quickly, a dropped output stream is reconnected
+const (
+	streamReconnectAttempts = 3
+	streamReconnectDelay    = 1 * time.Second
+)
+
+// DecodeFunc converts one raw JSON value from an agent's stdout into a
+// StreamEvent. It returns false to skip values that aren't events.
+type DecodeFunc func(raw json.RawMessage) (StreamEvent, bool)
+
+// decodeStreamEvent decodes agents whose output already uses the StreamEvent
+// format. Their assistant events are whole messages, with any partial text
+// sent before as stream_event deltas, so each is marked complete.
+func decodeStreamEvent(raw json.RawMessage) (StreamEvent, bool) {
+	var event StreamEvent
+	if err := json.Unmarshal(raw, &event); err != nil {
+		return StreamEvent{}, false
+	}
+	if event.Type == "assistant" && event.Subtype == "" {
+		event.Subtype = MessageCompleteSubtype
+	}
+	return event, true
+}
+
+// DecodeRecorded decodes an event as recordings store it: the event's
+// original JSON (StreamEvent.Raw), with any timing stamps added, or the JSON
+// of an event made locally. OpenCode events, which name their session
+// "sessionID" where StreamEvents use "session_id", are converted as
+// OpenCodeAgent does; anything else is read like decodeStreamEvent.
+func DecodeRecorded(raw json.RawMessage) (StreamEvent, error) {
+	var stamps struct {
+		OpenCodeSessionID *string `json:"sessionID"`
+		TS                int64   `json:"ts"`
+		DeltaMS           *int64  `json:"delta_ms"`
+	}
+	if err := json.Unmarshal(raw, &stamps); err != nil {
+		return StreamEvent{}, err
+	}
+	if stamps.OpenCodeSessionID == nil {
+		event, _ := decodeStreamEvent(raw)
+		return event, nil
+	}
+	var ocEvent OpenCodeStreamEvent
+	if err := json.Unmarshal(raw, &ocEvent); err != nil {
+		return StreamEvent{}, err
+	}
+	event := (&OpenCodeAgent{}).convertEvent(ocEvent)
+	event.TS, event.DeltaMS = stamps.TS, stamps.DeltaMS
+	return event, nil
+}
+
+// baseRun spawns cmd with runner and streams its output to handler until
+// the process exits. The JSON stream, read from source, is decoded as a
+// sequence of JSON values with decode; stderr chunks are passed through as StderrEventType events. A
+// dropped stream is reconnected without handling output twice. With
+// opts.RetryOnTransient, a run that fails transiently is started once more
+// after a RetryEventType event. With opts.Heartbeat, quiet periods produce
+// HeartbeatEventType events. With opts.Timing, events carry TS and DeltaMS.
+// With opts.BrowserCheck, a browser found down stops the run with an
+// ErrBrowserDown error. Approval requests for opts.ApproveTools are answered
+// on stdin. With opts.TextOutput, stdout is plain text and each line is
+// passed on as a TextOutputEventType event instead. name identifies the
+// agent in errors.
+// Returns the process exit code.
+func baseRun(ctx context.Context, runner ProcessRunner, name, cmd string, opts RunOptions, source outputSource, decode DecodeFunc, handler StreamHandler) (int64, error) {
+	// Heartbeats are wrapped around timing so they're stamped too
+	if opts.Timing {
+		handler = withTiming(handler)
+	}
+	if opts.Heartbeat > 0 {
+		var stop func()
+		handler, stop = withHeartbeat(handler, opts.Heartbeat)
+		defer stop()
+	}
+
+	if opts.BrowserCheck != nil {
+		var cancel context.CancelCauseFunc
+		ctx, cancel = context.WithCancelCause(ctx)
+		defer cancel(nil)
+		stop := watchBrowser(ctx, cancel, opts.BrowserCheck, opts.BrowserCheckInterval)
+		defer stop()
+		exitCode, err := runRetrying(ctx, runner, name, cmd, opts, source, decode, handler)
+		if cause := context.Cause(ctx); errors.Is(cause, ErrBrowserDown) {
+			return 1, fmt.Errorf("%w; the agent was stopped. Check the live view, or run without -s for a new session", cause)
+		}
+		return exitCode, err
+	}
+	return runRetrying(ctx, runner, name, cmd, opts, source, decode, handler)
+}
+
+// runRetrying runs cmd, and with opts.RetryOnTransient runs it once more
+// after a transient failure; see baseRun
+func runRetrying(ctx context.Context, runner ProcessRunner, name, cmd string, opts RunOptions, source outputSource, decode DecodeFunc, handler StreamHandler) (int64, error) {
+	retry := opts.RetryOnTransient && opts.Stdin == nil
+	for {
+		// Remember the last result or error event to classify a failure
+		var last StreamEvent
+		exitCode, err := runOnce(ctx, runner, name, cmd, opts.Stdin, opts.ApproveTools, source, decode, opts.TextOutput, func(event StreamEvent) {
+			if isTerminalEvent(event) {
+				last = event
+			}
+			handler(event)
+		})
+		if !retry || err != nil || exitCode == 0 || ctx.Err() != nil || !IsTransientFailure(last) {
+			return exitCode, err
+		}
+		retry = false
+		handler(TextEvent(RetryEventType, fmt.Sprintf("%s failed with a transient error (%s), retrying once", name, failureText(last))))
+	}
+}
+
+// runOnce runs cmd a single time; see baseRun
+func runOnce(ctx context.Context, runner ProcessRunner, name, cmd string, stdin io.Reader, approve ApprovalPolicy, source outputSource, decode DecodeFunc, text bool, handler StreamHandler) (int64, error) {
+	// A source other than stdout delivers data from its own goroutine, while
+	// stderr events come from the process stream
+	var mu sync.Mutex
+	var processID string // set under mu once spawned
+	locked := handler
+	handler = func(event StreamEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		locked(answerApproval(ctx, runner, processID, approve, event))
+	}
+
+	var jsonBuffer strings.Builder
+	onStdout, finish := source.follow(ctx, runner, func(data string) {
+		jsonBuffer.WriteString(data)
+
+		// Keep only unparsed data in buffer
+		var consumed int
+		if text {
+			consumed = decodeLines(jsonBuffer.String(), handler)
+		} else {
+			consumed = decodeBuffered(jsonBuffer.String(), decode, handler)
+		}
+		if consumed > 0 {
+			remaining := jsonBuffer.String()[consumed:]
+			jsonBuffer.Reset()
+			jsonBuffer.WriteString(remaining)
+		}
+	})
+
+	// However the run ends (exit, stream error, cancellation), let the source
+	// deliver what it still holds and handle what's left in the buffer, so
+	// the last partial chunk isn't lost
+	var flushOnce sync.Once
+	var finishErr error
+	flush := func() {
+		flushOnce.Do(func() {
+			finishErr = finish()
+			if text {
+				flushLines(jsonBuffer.String(), handler)
+			} else {
+				flushBuffered(jsonBuffer.String(), decode, handler)
+			}
+		})
+	}
+	defer flush()
+
+	spawned, err := runner.Spawn(ctx, cmd)
+	if err != nil {
+		return 1, fmt.Errorf("spawn %s: %w", name, err)
+	}
+	mu.Lock()
+	processID = spawned
+	mu.Unlock()
+
+	// Forward caller input to the agent for interactive flows
+	if stdin != nil {
+		go pipeStdin(ctx, runner, spawned, stdin)
+	}
+
+	offsets := &streamOffsets{}
+
+	for attempt := 0; ; attempt++ {
+		exitCode, exited, err := streamOutput(ctx, runner, spawned, offsets, onStdout, handler)
+
+		// Reconnect if the stream dropped while the agent was still running
+		if err != nil && !exited && ctx.Err() == nil && attempt < streamReconnectAttempts {
+			status(phaseAgent, DimStyle.Render(fmt.Sprintf("Output stream interrupted (%v), reconnecting...", err)))
+			if sleepErr := sleepContext(ctx, streamReconnectDelay); sleepErr == nil {
+				continue
+			}
+		}
+
+		flush()
+		if finishErr != nil && err == nil {
+			err = finishErr
+		}
+		if err != nil {
+			return 1, fmt.Errorf("stream error: %w", err)
+		}
+		return exitCode, nil
+	}
+}
+
+// streamOutput follows the process output stream until the process exits or
+// the stream ends, passing unseen stdout to onStdout and stderr chunks to
+// handler. exited reports whether the exit event was received.
+func streamOutput(ctx context.Context, runner ProcessRunner, processID string, offsets *streamOffsets, onStdout func(string), handler StreamHandler) (exitCode int64, exited bool, err error) {
+	stream := runner.Output(ctx, processID)
+	defer stream.Close()
+	offsets.reset()
+	chunks := B64Chunks{}
+
+	for stream.Next() {
+		event := stream.Current()
+
+		switch event.Event {
+		case OutputExitEvent:
+			return event.ExitCode, true, nil
+		case "":
+		default:
+			// Lifecycle events other than exit carry nothing we act on yet;
+			// any data they hold is still handled below
+			debugf("stream: %s event on %q", event.Event, event.Stream)
+		}
+
+		if event.DataB64 == "" {
+			if event.Event == "" {
+				debugf("stream: empty chunk on %q", event.Stream)
+			}
+			continue
+		}
+		data := offsets.unseen(event.Stream, chunks.Decode(event.Stream, event.DataB64))
+		if data == "" {
+			continue
+		}
+
+		switch event.Stream {
+		case OutputStdout, "":
+			// Chunks without a stream name predate stream tagging and are stdout
+			onStdout(data)
+		case OutputStderr:
+			// stderr isn't part of the JSON stream; hand it over as its own event
+			handler(TextEvent(StderrEventType, data))
+		default:
+			// Only stdout carries the agent's JSON; treat any other stream
+			// as diagnostic output so it isn't lost or mistaken for events
+			debugf("stream: %d bytes on unknown stream %q, treating as stderr", len(data), event.Stream)
+			handler(TextEvent(StderrEventType, data))
+		}
+	}
+	return 0, false, stream.Err()
+}
+
+// replayCheckBytes is how much of each output stream is kept to recognize a
+// reconnected stream that starts over from the beginning
+const replayCheckBytes = 4096
+
+// streamOffsets tracks how many bytes of each output stream were handled. The
+// stdout stream API takes no offset, so a reconnected stream may start again
+// from the beginning of the process output or pick up where the last one
+// left off. The first data of each stream on a new connection is compared
+// with the start of what was handled: on a replay, bytes up to the handled
+// offset are skipped so no event reaches the handler twice; otherwise the
+// data is taken as new.
+type streamOffsets struct {
+	handled map[string]int    // bytes handled per stream across connections
+	head    map[string]string // the first replayCheckBytes handled per stream
+	pos     map[string]int    // position per stream on the current connection
+	seen    map[string]bool   // streams with data on the current connection
+}
+
+// reset starts counting a new connection
+func (o *streamOffsets) reset() {
+	o.pos = make(map[string]int)
+	o.seen = make(map[string]bool)
+	if o.handled == nil {
+		o.handled = make(map[string]int)
+	}
+	if o.head == nil {
+		o.head = make(map[string]string)
+	}
+}
+
+// unseen returns the part of data, received on stream, that wasn't handled yet
+func (o *streamOffsets) unseen(stream, data string) string {
+	if !o.seen[stream] {
+		o.seen[stream] = true
+		if handled := o.handled[stream]; handled > 0 {
+			head := o.head[stream]
+			n := min(len(head), len(data))
+			if data[:n] == head[:n] {
+				debugf("stream: %q replayed from the start, skipping %d handled bytes", stream, handled)
+			} else {
+				debugf("stream: %q resumed after %d handled bytes", stream, handled)
+				o.pos[stream] = handled
+			}
+		}
+	}
+
+	start := o.pos[stream]
+	o.pos[stream] += len(data)
+	if start == len(o.head[stream]) && start < replayCheckBytes {
+		o.head[stream] += data[:min(len(data), replayCheckBytes-start)]
+	}
+	if skip := o.handled[stream] - start; skip > 0 {
+		if skip >= len(data) {
+			return ""
+		}
+		data = data[skip:]
+	}
+	o.handled[stream] = o.pos[stream]
+	return data
+}
+
+// sleepContext waits for d, returning early with ctx's error if it's cancelled
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// decodeBuffered passes every complete JSON value in data through decode to
+// handler and returns the number of bytes consumed
+func decodeBuffered(data string, decode DecodeFunc, handler StreamHandler) int {
+	decoder := json.NewDecoder(strings.NewReader(data))
+	var consumed int
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			return consumed // incomplete JSON, wait for more data
+		}
+		if event, ok := decode(raw); ok {
+			event.Raw = raw
+			handler(event)
+		}
+		consumed = int(decoder.InputOffset())
+	}
+}
+
+// flushBuffered handles the data left when the output ends: complete JSON
+// values are decoded as usual, and anything after them, such as a value cut
+// short by cancellation, is passed on as a StderrEventType event so it shows
+// up in the stderr tail instead of being dropped
+func flushBuffered(data string, decode DecodeFunc, handler StreamHandler) {
+	consumed := decodeBuffered(data, decode, handler)
+	if rest := strings.TrimSpace(data[consumed:]); rest != "" {
+		debugf("stream: %d bytes of unfinished output at exit", len(rest))
+		handler(TextEvent(StderrEventType, rest+"\n"))
+	}
+}
+
+// decodeLines passes every complete line of plain text output in data to
+// handler as a TextOutputEventType event and returns the number of bytes
+// consumed
+func decodeLines(data string, handler StreamHandler) int {
+	end := strings.LastIndex(data, "\n")
+	if end < 0 {
+		return 0
+	}
+	for _, line := range strings.Split(data[:end], "\n") {
+		handler(TextEvent(TextOutputEventType, strings.TrimRight(line, "\r")))
+	}
+	return end + 1
+}
+
+// flushLines handles the plain text output left when the output ends,
+// including a last line without a newline
+func flushLines(data string, handler StreamHandler) {
+	consumed := decodeLines(data, handler)
+	if rest := strings.TrimRight(data[consumed:], "\r"); rest != "" {
+		handler(TextEvent(TextOutputEventType, rest))
+	}
+}
@@ -0,0 +1,557 @@
+package agent
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConn is one connection to a fakeRunner's output stream
+type fakeConn struct {
+	delay  time.Duration // wait before the first event
+	events []OutputEvent
+	err    error // reported by Err once the events are read
+	hang   bool  // after the events, block until the context is cancelled
+}
+
+// fakeRunner is a ProcessRunner serving scripted output connections, one per
+// Output call, and keeping files and stdin in memory
+type fakeRunner struct {
+	mu       sync.Mutex
+	conns    []fakeConn
+	opened   int
+	commands []string
+	stdin    []string
+	files    map[string][]byte
+	spawned  func() // called after each spawn, e.g. to write files
+}
+
+func (r *fakeRunner) Spawn(ctx context.Context, cmd string) (string, error) {
+	r.mu.Lock()
+	r.commands = append(r.commands, cmd)
+	id := fmt.Sprintf("proc-%d", len(r.commands))
+	r.mu.Unlock()
+	if r.spawned != nil {
+		r.spawned()
+	}
+	return id, nil
+}
+
+func (r *fakeRunner) Output(ctx context.Context, processID string) OutputStream {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.opened >= len(r.conns) {
+		return &fakeStream{ctx: ctx, conn: fakeConn{err: errors.New("no more connections")}}
+	}
+	r.opened++
+	return &fakeStream{ctx: ctx, conn: r.conns[r.opened-1]}
+}
+
+func (r *fakeRunner) WriteStdin(ctx context.Context, processID string, data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stdin = append(r.stdin, string(data))
+	return nil
+}
+
+func (r *fakeRunner) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data, ok := r.files[path]
+	if !ok {
+		return nil, fmt.Errorf("read %s: %w", path, fs.ErrNotExist)
+	}
+	return slices.Clone(data), nil
+}
+
+func (r *fakeRunner) DeleteFile(ctx context.Context, path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.files, path)
+	return nil
+}
+
+// writeFile sets the contents of a file in the fake session
+func (r *fakeRunner) writeFile(path, data string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.files == nil {
+		r.files = make(map[string][]byte)
+	}
+	r.files[path] = []byte(data)
+}
+
+type fakeStream struct {
+	ctx  context.Context
+	conn fakeConn
+	next int
+	err  error
+}
+
+func (s *fakeStream) Next() bool {
+	if s.next == 0 && s.conn.delay > 0 {
+		if sleepContext(s.ctx, s.conn.delay) != nil {
+			s.err = s.ctx.Err()
+			return false
+		}
+	}
+	if s.next < len(s.conn.events) {
+		s.next++
+		return true
+	}
+	if s.conn.hang {
+		<-s.ctx.Done()
+		s.err = s.ctx.Err()
+		return false
+	}
+	s.err = s.conn.err
+	return false
+}
+
+func (s *fakeStream) Current() OutputEvent { return s.conn.events[s.next-1] }
+func (s *fakeStream) Err() error           { return s.err }
+func (s *fakeStream) Close() error         { return nil }
+
+// stdout is an output event carrying data on stdout
+func stdout(data string) OutputEvent {
+	return OutputEvent{Stream: OutputStdout, DataB64: base64.StdEncoding.EncodeToString([]byte(data))}
+}
+
+// stderr is an output event carrying data on stderr
+func stderr(data string) OutputEvent {
+	return OutputEvent{Stream: OutputStderr, DataB64: base64.StdEncoding.EncodeToString([]byte(data))}
+}
+
+// exited is the output event for the process exiting with code
+func exited(code int64) OutputEvent {
+	return OutputEvent{Event: OutputExitEvent, ExitCode: code}
+}
+
+// eventRecorder collects handled events as short labels
+type eventRecorder struct {
+	mu     sync.Mutex
+	labels []string
+}
+
+func (r *eventRecorder) handle(event StreamEvent) {
+	label := event.Type
+	if event.Subtype != "" {
+		label += "/" + event.Subtype
+	}
+	if text := eventText(event); text != "" {
+		label += ":" + text
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.labels = append(r.labels, label)
+}
+
+func (r *eventRecorder) events() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.labels)
+}
+
+func eventText(event StreamEvent) string {
+	var text strings.Builder
+	for _, block := range event.Message.Content {
+		text.WriteString(block.Text)
+	}
+	return text.String()
+}
+
+const (
+	initLine   = `{"type":"system","subtype":"init"}` + "\n"
+	resultLine = `{"type":"result","subtype":"success","result":"done"}` + "\n"
+)
+
+func TestBaseRunReconnect(t *testing.T) {
+	all := initLine + resultLine
+	tests := []struct {
+		name     string
+		conns    []fakeConn
+		wantCode int64
+		wantErr  bool
+		want     []string
+	}{
+		{
+			name: "single connection",
+			conns: []fakeConn{
+				{events: []OutputEvent{stdout(initLine), stdout(resultLine), exited(0)}},
+			},
+			want: []string{"system/init", "result/success"},
+		},
+		{
+			name: "replayed from the start after a drop",
+			conns: []fakeConn{
+				{events: []OutputEvent{stdout(initLine), stdout(resultLine[:10])}, err: errors.New("connection reset")},
+				{events: []OutputEvent{stdout(all), exited(0)}},
+			},
+			want: []string{"system/init", "result/success"},
+		},
+		{
+			name: "resumed where the last connection stopped",
+			conns: []fakeConn{
+				{events: []OutputEvent{stdout(initLine), stdout(resultLine[:10])}, err: errors.New("connection reset")},
+				{events: []OutputEvent{stdout(resultLine[10:]), exited(0)}},
+			},
+			want: []string{"system/init", "result/success"},
+		},
+		{
+			name: "replayed after two drops",
+			conns: []fakeConn{
+				{events: []OutputEvent{stdout(initLine)}, err: errors.New("connection reset")},
+				{events: []OutputEvent{stdout(initLine), stdout(resultLine[:10])}, err: errors.New("connection reset")},
+				{events: []OutputEvent{stdout(initLine), stdout(resultLine), exited(0)}},
+			},
+			want: []string{"system/init", "result/success"},
+		},
+		{
+			name: "stderr resumed while stdout replayed",
+			conns: []fakeConn{
+				{events: []OutputEvent{stderr("one\n"), stdout(initLine)}, err: errors.New("connection reset")},
+				{events: []OutputEvent{stderr("two\n"), stdout(all), exited(0)}},
+			},
+			want: []string{"stderr:one\n", "system/init", "stderr:two\n", "result/success"},
+		},
+		{
+			name: "stderr not repeated on replay",
+			conns: []fakeConn{
+				{events: []OutputEvent{stderr("warn\n"), stdout(initLine)}, err: errors.New("connection reset")},
+				{events: []OutputEvent{stderr("warn\n"), stdout(all), exited(3)}},
+			},
+			wantCode: 3,
+			want:     []string{"stderr:warn\n", "system/init", "result/success"},
+		},
+		{
+			name: "gives up after the reconnect attempts",
+			conns: []fakeConn{
+				{events: []OutputEvent{stdout(initLine)}, err: errors.New("connection reset")},
+			},
+			wantCode: 1,
+			wantErr:  true,
+			want:     []string{"system/init"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.wantErr && testing.Short() {
+				t.Skip("waits for reconnect delays")
+			}
+			runner := &fakeRunner{conns: tt.conns}
+			var got eventRecorder
+			code, err := baseRun(context.Background(), runner, "test", "agent", RunOptions{}, stdoutSource{}, decodeStreamEvent, got.handle)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if code != tt.wantCode {
+				t.Errorf("exit code = %d, want %d", code, tt.wantCode)
+			}
+			if !slices.Equal(got.events(), tt.want) {
+				t.Errorf("events = %q, want %q", got.events(), tt.want)
+			}
+		})
+	}
+}
+
+func TestBaseRunStderrOnFailure(t *testing.T) {
+	tests := []struct {
+		name     string
+		events   []OutputEvent
+		wantCode int64
+		want     []string
+	}{
+		{
+			name:     "failure message on stderr",
+			events:   []OutputEvent{stderr("Error: invalid API key\n"), exited(1)},
+			wantCode: 1,
+			want:     []string{"stderr:Error: invalid API key\n"},
+		},
+		{
+			name:     "stderr split mid-line and interleaved with stdout",
+			events:   []OutputEvent{stdout(initLine), stderr("Error: rate"), stderr(" limited\n"), exited(2)},
+			wantCode: 2,
+			want:     []string{"system/init", "stderr:Error: rate", "stderr: limited\n"},
+		},
+		{
+			name:     "stderr of a successful run still delivered",
+			events:   []OutputEvent{stderr("warning: deprecated flag\n"), stdout(resultLine), exited(0)},
+			wantCode: 0,
+			want:     []string{"stderr:warning: deprecated flag\n", "result/success"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := &fakeRunner{conns: []fakeConn{{events: tt.events}}}
+			var got eventRecorder
+			code, err := baseRun(context.Background(), runner, "test", "agent", RunOptions{}, stdoutSource{}, decodeStreamEvent, got.handle)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code != tt.wantCode {
+				t.Errorf("exit code = %d, want %d", code, tt.wantCode)
+			}
+			if !slices.Equal(got.events(), tt.want) {
+				t.Errorf("events = %q, want %q", got.events(), tt.want)
+			}
+		})
+	}
+}
+
+func TestBaseRunUnknownEvents(t *testing.T) {
+	// A lifecycle event other than exit, with or without data
+	lifecycle := func(name string, data OutputEvent) OutputEvent {
+		data.Event = name
+		return data
+	}
+	tests := []struct {
+		name   string
+		events []OutputEvent
+		want   []string
+	}{
+		{
+			name:   "lifecycle events skipped",
+			events: []OutputEvent{lifecycle("start", OutputEvent{}), stdout(initLine), lifecycle("signal", OutputEvent{Stream: OutputStderr})},
+			want:   []string{"system/init"},
+		},
+		{
+			name:   "data on a lifecycle event still handled",
+			events: []OutputEvent{lifecycle("start", stdout(initLine)), stdout(resultLine)},
+			want:   []string{"system/init", "result/success"},
+		},
+		{
+			name:   "empty chunks skipped",
+			events: []OutputEvent{{Stream: OutputStdout}, stdout(initLine), {Stream: OutputStderr}},
+			want:   []string{"system/init"},
+		},
+		{
+			name:   "untagged chunks are stdout",
+			events: []OutputEvent{{DataB64: stdout(initLine).DataB64}},
+			want:   []string{"system/init"},
+		},
+		{
+			name: "unknown streams treated as stderr",
+			events: []OutputEvent{
+				{Stream: "pty", DataB64: stdout(resultLine).DataB64},
+				stdout(initLine),
+				{Stream: "pty", DataB64: stdout("more\n").DataB64},
+			},
+			want: []string{"stderr:" + resultLine, "system/init", "stderr:more\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := &fakeRunner{conns: []fakeConn{{events: append(tt.events, exited(0))}}}
+			var got eventRecorder
+			code, err := baseRun(context.Background(), runner, "test", "agent", RunOptions{}, stdoutSource{}, decodeStreamEvent, got.handle)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code != 0 {
+				t.Errorf("exit code = %d, want 0", code)
+			}
+			if !slices.Equal(got.events(), tt.want) {
+				t.Errorf("events = %q, want %q", got.events(), tt.want)
+			}
+		})
+	}
+}
+
+func TestBaseRunTextOutput(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []OutputEvent
+		want   []string
+	}{
+		{
+			name:   "lines split across chunks",
+			events: []OutputEvent{stdout("Opening the page\nThe ti"), stdout("tle is Example\r\n")},
+			want:   []string{"text_output:Opening the page", "text_output:The title is Example"},
+		},
+		{
+			name:   "JSON passed through as text",
+			events: []OutputEvent{stdout(resultLine)},
+			want:   []string{"text_output:" + strings.TrimSuffix(resultLine, "\n")},
+		},
+		{
+			name:   "last line without a newline",
+			events: []OutputEvent{stdout("one\n\ntwo")},
+			want:   []string{"text_output:one", "text_output", "text_output:two"},
+		},
+		{
+			name:   "stderr kept apart",
+			events: []OutputEvent{stderr("warn\n"), stdout("answer\n")},
+			want:   []string{"stderr:warn\n", "text_output:answer"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := &fakeRunner{conns: []fakeConn{{events: append(tt.events, exited(0))}}}
+			var got eventRecorder
+			if _, err := baseRun(context.Background(), runner, "test", "agent", RunOptions{TextOutput: true}, stdoutSource{}, decodeStreamEvent, got.handle); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got.events(), tt.want) {
+				t.Errorf("events = %q, want %q", got.events(), tt.want)
+			}
+		})
+	}
+}
+
+func TestRunOnceFlushOnCancel(t *testing.T) {
+	tests := []struct {
+		name string
+		text bool
+		data string
+		want []string
+	}{
+		{
+			name: "partial JSON becomes stderr",
+			data: initLine + `{"type":"result","sub`,
+			want: []string{"system/init", `stderr:{"type":"result","sub` + "\n"},
+		},
+		{
+			name: "last text line without newline",
+			text: true,
+			data: "first\nsecond",
+			want: []string{"text_output:first", "text_output:second"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := &fakeRunner{conns: []fakeConn{{events: []OutputEvent{stdout(tt.data)}, hang: true}}}
+			ctx, cancel := context.WithCancel(context.Background())
+			var got eventRecorder
+			done := make(chan error, 1)
+			go func() {
+				_, err := runOnce(ctx, runner, "test", "agent", nil, nil, stdoutSource{}, decodeStreamEvent, tt.text, got.handle)
+				done <- err
+			}()
+			waitFor(t, func() bool { return len(got.events()) > 0 })
+			cancel()
+			if err := <-done; !errors.Is(err, context.Canceled) {
+				t.Errorf("err = %v, want context.Canceled", err)
+			}
+			if !slices.Equal(got.events(), tt.want) {
+				t.Errorf("events = %q, want %q", got.events(), tt.want)
+			}
+		})
+	}
+}
+
+func TestBaseRunHeartbeat(t *testing.T) {
+	runner := &fakeRunner{conns: []fakeConn{
+		{delay: 100 * time.Millisecond, events: []OutputEvent{stdout(resultLine), exited(0)}},
+	}}
+	var got eventRecorder
+	opts := RunOptions{Heartbeat: 20 * time.Millisecond}
+	if _, err := baseRun(context.Background(), runner, "test", "agent", opts, stdoutSource{}, decodeStreamEvent, got.handle); err != nil {
+		t.Fatal(err)
+	}
+	events := got.events()
+	if len(events) < 2 || events[0] != HeartbeatEventType || events[len(events)-1] != "result/success" {
+		t.Errorf("events = %q, want heartbeats then the result", events)
+	}
+}
+
+func TestBaseRunBrowserCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int // checks failing before they pass; -1 for all
+		wantDown bool
+	}{
+		{name: "browser up", failures: 0},
+		{name: "one slow probe tolerated", failures: 1},
+		{name: "browser down", failures: -1, wantDown: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := fakeConn{delay: 100 * time.Millisecond, events: []OutputEvent{stdout(resultLine), exited(0)}}
+			if tt.wantDown {
+				conn = fakeConn{hang: true}
+			}
+			var mu sync.Mutex
+			checks := 0
+			opts := RunOptions{
+				BrowserCheckInterval: 10 * time.Millisecond,
+				BrowserCheck: func(ctx context.Context) error {
+					mu.Lock()
+					defer mu.Unlock()
+					checks++
+					if tt.failures < 0 || checks <= tt.failures {
+						return errors.New("chrome not responding")
+					}
+					return nil
+				},
+			}
+			runner := &fakeRunner{conns: []fakeConn{conn}}
+			var got eventRecorder
+			code, err := baseRun(context.Background(), runner, "test", "agent", opts, stdoutSource{}, decodeStreamEvent, got.handle)
+			if errors.Is(err, ErrBrowserDown) != tt.wantDown {
+				t.Fatalf("err = %v, want ErrBrowserDown %v", err, tt.wantDown)
+			}
+			if tt.wantDown && code != 1 {
+				t.Errorf("exit code = %d, want 1", code)
+			}
+			if !tt.wantDown && (err != nil || !slices.Equal(got.events(), []string{"result/success"})) {
+				t.Errorf("err = %v, events = %q", err, got.events())
+			}
+		})
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after a few seconds
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRawRoundTrip(t *testing.T) {
+	claudeLine := `{"type":"result","subtype":"success","result":"done","total_cost_usd":0.01,"usage":{"input_tokens":3,"cache":[1,2]}}`
+	openCodeLine := `{"type":"text","timestamp":4,"sessionID":"ses_1","part":{"id":"p3","type":"text","text":"hi","time":{"start":4,"end":5},"extra":true}}`
+	tests := []struct {
+		name   string
+		decode DecodeFunc
+		lines  []string
+	}{
+		{"stream-json with unknown fields", decodeStreamEvent, []string{claudeLine, initLine[:len(initLine)-1]}},
+		{"OpenCode event", (&OpenCodeAgent{}).decodeEvent, []string{openCodeLine}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var events []OutputEvent
+			for _, line := range tt.lines {
+				events = append(events, stdout(line+"\n"))
+			}
+			runner := &fakeRunner{conns: []fakeConn{{events: append(events, exited(0))}}}
+			var raws []string
+			_, err := baseRun(context.Background(), runner, "test", "agent", RunOptions{}, stdoutSource{}, tt.decode, func(event StreamEvent) {
+				raws = append(raws, string(event.Raw))
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(raws, tt.lines) {
+				t.Errorf("Raw = %q, want %q", raws, tt.lines)
+			}
+			for _, raw := range raws {
+				if _, err := DecodeRecorded([]byte(raw)); err != nil {
+					t.Errorf("DecodeRecorded(%s): %v", raw, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package agent
+
+import (
+	"sync"
+	"time"
+)
+
+// withTiming wraps handler so that each event carries when it was handled:
+// TS, in Unix milliseconds, and DeltaMS, the milliseconds since the previous
+// event (or since the run started, for the first). Both are measured on the
+// monotonic clock from the start of the run, so a wall clock change mid-run
+// doesn't skew them.
+func withTiming(handler StreamHandler) StreamHandler {
+	var mu sync.Mutex
+	start := time.Now()
+	var last time.Duration
+	return func(event StreamEvent) {
+		mu.Lock()
+		elapsed := time.Since(start)
+		delta := (elapsed - last).Milliseconds()
+		last = elapsed
+		mu.Unlock()
+
+		event.TS = start.Add(elapsed).UnixMilli()
+		event.DeltaMS = &delta
+		handler(event)
+	}
+}
@@ -0,0 +1,47 @@
+package agent
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWithTiming(t *testing.T) {
+	// Delays before each event is handled
+	delays := []time.Duration{20 * time.Millisecond, 0, 50 * time.Millisecond}
+
+	var got []StreamEvent
+	before := time.Now().UnixMilli()
+	handler := withTiming(func(event StreamEvent) { got = append(got, event) })
+	for _, delay := range delays {
+		time.Sleep(delay)
+		handler(StreamEvent{Type: "assistant"})
+	}
+	after := time.Now().UnixMilli()
+
+	if len(got) != len(delays) {
+		t.Fatalf("handled %d events, want %d", len(got), len(delays))
+	}
+	prev := before
+	for i, event := range got {
+		if event.DeltaMS == nil {
+			t.Fatalf("event %d has no DeltaMS", i)
+		}
+		delta := *event.DeltaMS
+		if delta < delays[i].Milliseconds() || delta > delays[i].Milliseconds()+100 {
+			t.Errorf("event %d: DeltaMS = %d, want about %d", i, delta, delays[i].Milliseconds())
+		}
+		if event.TS < prev || event.TS > after {
+			t.Errorf("event %d: TS = %d, want between %d and %d", i, event.TS, prev, after)
+		}
+		prev = event.TS
+	}
+
+	// The deltas add up to the time since the run started
+	var total int64
+	for _, event := range got {
+		total += *event.DeltaMS
+	}
+	if elapsed := got[len(got)-1].TS - before; total < elapsed-5 || total > elapsed+5 {
+		t.Errorf("deltas total %dms, want about %dms", total, elapsed)
+	}
+}
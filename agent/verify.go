@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var (
+	// ErrInvalidKey is returned when a provider rejects an API key
+	ErrInvalidKey = errors.New("invalid API key")
+
+	// ErrVerifyUnsupported is returned when there is no cheap way to check a key
+	ErrVerifyUnsupported = errors.New("key verification not supported")
+)
+
+// keyVerifier describes a cheap authenticated request used to check an API key
+type keyVerifier struct {
+	URL     string
+	Headers func(key string) map[string]string
+}
+
+// keyVerifiers maps provider env vars to their verification requests
+var keyVerifiers = map[string]keyVerifier{
+	"ANTHROPIC_API_KEY": {
+		URL: "https://api.anthropic.com/v1/models",
+		Headers: func(key string) map[string]string {
+			return map[string]string{"x-api-key": key, "anthropic-version": "2023-06-01"}
+		},
+	},
+	"OPENAI_API_KEY": {
+		URL: "https://api.openai.com/v1/models",
+		Headers: func(key string) map[string]string {
+			return map[string]string{"Authorization": "Bearer " + key}
+		},
+	},
+}
+
+// VerifyAPIKey checks that the provider behind envVar accepts key. Returns
+// ErrInvalidKey if the key is rejected and ErrVerifyUnsupported if the
+// provider has no known verification endpoint (e.g. CURSOR_API_KEY).
+func VerifyAPIKey(ctx context.Context, envVar, key string) error {
+	verifier, ok := keyVerifiers[envVar]
+	if !ok {
+		return ErrVerifyUnsupported
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, verifier.URL, nil)
+	if err != nil {
+		return fmt.Errorf("build request: %w", err)
+	}
+	for name, value := range verifier.Headers(key) {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("verify %s: %w", envVar, err)
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("%s: %w", envVar, ErrInvalidKey)
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("verify %s: unexpected status %d", envVar, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/onkernel/kernel-go-sdk"
+)
+
+// cliRequirement is the oldest version of an agent CLI accepting a flag we
+// pass. Versions are compared numerically, part by part.
+type cliRequirement struct {
+	Flag       string
+	MinVersion string
+}
+
+// Oldest Claude Code versions accepting the flags Run passes
+var (
+	claudeBaseRequirement    = cliRequirement{"--output-format stream-json --mcp-config", "1.0.0"}
+	claudePartialRequirement = cliRequirement{"--include-partial-messages", "1.0.86"}
+)
+
+// Oldest cursor-agent versions accepting the flags Run passes. cursor-agent
+// versions are dates, e.g. 2025.09.18-7ae6800.
+var (
+	cursorBaseRequirement    = cliRequirement{"--output-format stream-json", "2025.08.08"}
+	cursorApproveRequirement = cliRequirement{"--approve-mcps", "2025.09.04"}
+)
+
+// versionPattern matches the first dotted version number in CLI output
+var versionPattern = regexp.MustCompile(`\d+(?:\.\d+)+`)
+
+// parseVersion extracts the dotted version number from a CLI's version
+// output, such as "1.0.86 (Claude Code)" or "2025.09.18-7ae6800"
+func parseVersion(s string) ([]int, bool) {
+	match := versionPattern.FindString(s)
+	if match == "" {
+		return nil, false
+	}
+	var parts []int
+	for _, p := range strings.Split(match, ".") {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, false
+		}
+		parts = append(parts, n)
+	}
+	return parts, true
+}
+
+// compareVersions compares parsed versions part by part, treating missing
+// parts as 0. Returns -1, 0, or 1.
+func compareVersions(a, b []int) int {
+	for i := 0; i < max(len(a), len(b)); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// cliVersion runs versionCmd, a shell command printing an agent CLI's
+// version, and returns its trimmed output
+func cliVersion(ctx context.Context, client kernel.Client, sessionID, versionCmd string) (string, error) {
+	result, err := client.Browsers.Process.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
+		Command:    "bash",
+		Args:       []string{"-c", versionCmd},
+		TimeoutSec: kernel.Opt(int64(30)),
+	})
+	if err != nil {
+		return "", fmt.Errorf("get version: %w", err)
+	}
+	if result.ExitCode != 0 {
+		return "", fmt.Errorf("get version failed (exit %d): %s", result.ExitCode, DecodeB64(result.StderrB64))
+	}
+	return strings.TrimSpace(DecodeB64(result.StdoutB64)), nil
+}
+
+// checkCLIVersion checks that the installed CLI, whose version versionCmd
+// prints, meets every requirement. A version that can't be read or parsed
+// passes, since the CLI may still work; only a version known to be too old
+// is an error.
+func checkCLIVersion(ctx context.Context, client kernel.Client, sessionID, name, versionCmd string, requirements ...cliRequirement) error {
+	output, err := cliVersion(ctx, client, sessionID, versionCmd)
+	if err != nil {
+		debugf("version: %s: %v", name, err)
+		return nil
+	}
+	installed, ok := parseVersion(output)
+	if !ok {
+		debugf("version: %s: can't parse %q", name, output)
+		return nil
+	}
+	for _, req := range requirements {
+		minimum, _ := parseVersion(req.MinVersion)
+		if compareVersions(installed, minimum) < 0 {
+			return fmt.Errorf("%s %s is too old for %s (needs %s or newer); update it, e.g. with install_commands in the config file", name, versionPattern.FindString(output), req.Flag, req.MinVersion)
+		}
+	}
+	return nil
+}
+
+// warnCLIVersion is checkCLIVersion for after installing, printing a warning
+// instead of failing, since Run checks again with the flags it will pass
+func warnCLIVersion(ctx context.Context, client kernel.Client, sessionID, name, versionCmd string, requirements ...cliRequirement) {
+	if err := checkCLIVersion(ctx, client, sessionID, name, versionCmd, requirements...); err != nil {
+		status(phaseInstall, WarningStyle.Render("Warning: "+err.Error()))
+	}
+}
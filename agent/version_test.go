@@ -0,0 +1,83 @@
+package agent
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		output string
+		want   []int
+		ok     bool
+	}{
+		{"1.0.86 (Claude Code)", []int{1, 0, 86}, true},
+		{"2025.09.18-7ae6800", []int{2025, 9, 18}, true},
+		{"opencode v0.15.2\n", []int{0, 15, 2}, true},
+		{"version 2", nil, false},
+		{"", nil, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseVersion(tt.output)
+		if ok != tt.ok || !slices.Equal(got, tt.want) {
+			t.Errorf("parseVersion(%q) = %v, %v, want %v, %v", tt.output, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0.86", "1.0.86", 0},
+		{"1.0.85", "1.0.86", -1},
+		{"1.0.100", "1.0.86", 1},
+		{"1.1", "1.0.86", 1},
+		{"1.0", "1.0.0", 0},
+		{"1.0", "1.0.1", -1},
+		{"2025.09.18", "2025.08.08", 1},
+		{"2025.08.08", "2025.09.04", -1},
+	}
+	for _, tt := range tests {
+		a, _ := parseVersion(tt.a)
+		b, _ := parseVersion(tt.b)
+		if got := compareVersions(a, b); got != tt.want {
+			t.Errorf("compareVersions(%s, %s) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestCheckCLIVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		exitCode int
+		output   string
+		wantErr  string
+	}{
+		{name: "new enough", output: "1.0.86 (Claude Code)\n"},
+		{name: "newer", output: "2.0.1 (Claude Code)"},
+		{name: "too old for the base flags", output: "0.2.9 (Claude Code)", wantErr: "claude 0.2.9 is too old for --output-format stream-json --mcp-config (needs 1.0.0 or newer)"},
+		{name: "too old for partial messages", output: "1.0.50 (Claude Code)", wantErr: "claude 1.0.50 is too old for --include-partial-messages (needs 1.0.86 or newer)"},
+		{name: "unparseable version passes", output: "Claude Code dev build"},
+		{name: "failed version command passes", exitCode: 127, output: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, client := newFakeKernel(t)
+			fake.exec = func(call execCall) (int, string) { return tt.exitCode, tt.output }
+			err := checkCLIVersion(context.Background(), client, testSessionID, "claude", claudeVersionCmd, claudeBaseRequirement, claudePartialRequirement)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
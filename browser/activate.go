@@ -0,0 +1,118 @@
+package browser
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/onkernel/kernel-go-sdk"
+)
+
+// triggerCode finds the Playwriter extension's service worker and asks it to
+// connect the active tab, the same action as clicking the toolbar icon.
+// Playwriter exposes toggleExtensionForActiveTab on the worker's global scope.
+// Returns "triggered", "no-hook" if the worker lacks that function, or
+// "not-found" if no Playwriter worker is running.
+const triggerCode = `
+	let workers = context.serviceWorkers().filter(w => w.url().startsWith("chrome-extension://"));
+	if (workers.length === 0) {
+		// MV3 workers may be asleep; opening a page usually wakes them
+		await context.waitForEvent("serviceworker", { timeout: 5000 }).catch(() => null);
+		workers = context.serviceWorkers().filter(w => w.url().startsWith("chrome-extension://"));
+	}
+	let status = "not-found";
+	for (const worker of workers) {
+		const result = await worker.evaluate(async () => {
+			if (!chrome.runtime.getManifest().name.toLowerCase().includes("playwriter")) return "not-found";
+			if (typeof globalThis.toggleExtensionForActiveTab !== "function") return "no-hook";
+			await globalThis.toggleExtensionForActiveTab();
+			return "triggered";
+		}).catch(() => "not-found");
+		if (result === "triggered") return result;
+		if (result === "no-hook") status = result;
+	}
+	return status;
+`
+
+// triggerExtension activates Playwriter through its service worker instead of
+// a mouse click
+func triggerExtension(ctx context.Context, client kernel.Client, sessionID string) error {
+	resp, err := client.Browsers.Playwright.Execute(ctx, sessionID, kernel.BrowserPlaywrightExecuteParams{
+		Code:       triggerCode,
+		TimeoutSec: kernel.Opt(int64(30)),
+	})
+	if err != nil {
+		return fmt.Errorf("trigger extension: %w", err)
+	}
+	if !resp.Success {
+		return fmt.Errorf("trigger extension: %s", resp.Error)
+	}
+	switch resp.Result {
+	case "triggered":
+		return nil
+	case "no-hook":
+		return fmt.Errorf("trigger extension: this Playwriter version has no programmatic activation hook")
+	default:
+		return fmt.Errorf("trigger extension: Playwriter service worker not found")
+	}
+}
+
+// ActivatePlaywriterProgrammatic activates the extension through its service
+// worker, which doesn't depend on the toolbar layout or screen resolution,
+// then waits for it to connect to the relay. If the worker can't be
+// triggered or the extension doesn't connect, it falls back to clicking the
+// toolbar icon as ActivatePlaywriter does.
+func ActivatePlaywriterProgrammatic(ctx context.Context, client kernel.Client, sessionID string) error {
+	status(phaseActivate, headerStyle.Render("Activating Playwriter extension..."))
+
+	err := triggerExtension(ctx, client, sessionID)
+	if err == nil {
+		connected, waitErr := waitForConnection(ctx, client, sessionID, activationWait)
+		if waitErr != nil {
+			return waitErr
+		}
+		if connected {
+			status(phaseActivate, successStyle.Render("Playwriter extension connected"))
+			return nil
+		}
+		err = fmt.Errorf("extension did not connect after being triggered")
+	}
+
+	status(phaseActivate, dimStyle.Render("Programmatic activation failed ("+err.Error()+"), clicking the extension icon"))
+	return clickToActivate(ctx, client, sessionID)
+}
+
+// ActivatePlaywriterHeadless activates the extension in a headless session
+// like ActivatePlaywriterProgrammatic, but without the click fallback since
+// there is no toolbar to click
+func ActivatePlaywriterHeadless(ctx context.Context, client kernel.Client, sessionID string) error {
+	status(phaseActivate, headerStyle.Render("Activating Playwriter extension (headless)..."))
+
+	if err := triggerExtension(ctx, client, sessionID); err != nil {
+		return err
+	}
+	connected, err := waitForConnection(ctx, client, sessionID, activationWait)
+	if err != nil {
+		return err
+	}
+	if !connected {
+		return fmt.Errorf("playwriter extension did not connect to the relay")
+	}
+	status(phaseActivate, successStyle.Render("Playwriter extension connected"))
+	return nil
+}
+
+// waitForConnection polls until the extension is connected to the relay or
+// d has passed. The error is non-nil only if ctx is cancelled.
+func waitForConnection(ctx context.Context, client kernel.Client, sessionID string, d time.Duration) (bool, error) {
+	deadline := time.Now().Add(d)
+	for time.Now().Before(deadline) {
+		if err := sleepContext(ctx, activationPollInterval); err != nil {
+			return false, err
+		}
+		if IsPlaywriterConnected(ctx, client, sessionID) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,127 @@
+package browser
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fastActivation shortens the activation waits for the duration of a test
+func fastActivation(t *testing.T) {
+	wait, poll := activationWait, activationPollInterval
+	activationWait, activationPollInterval = 20*time.Millisecond, time.Millisecond
+	t.Cleanup(func() { activationWait, activationPollInterval = wait, poll })
+}
+
+// connectAfterClicks makes the fake report the extension connected once the
+// icon has been clicked n times
+func connectAfterClicks(fake *fakeKernel, n int) {
+	fake.exec = func(call execCall) execResult {
+		if strings.Contains(call.line(), "ESTABLISHED") && n >= 0 && fake.clicks >= n {
+			return execResult{stdout: "connected\n"}
+		}
+		return execResult{}
+	}
+}
+
+func TestActivatePlaywriter(t *testing.T) {
+	fastActivation(t)
+	tests := []struct {
+		name       string
+		connectsAt int // click that connects the extension; -1 for never
+		wantClicks int
+		wantErr    bool
+	}{
+		{name: "first click connects", connectsAt: 1, wantClicks: 1},
+		{name: "second click connects", connectsAt: 2, wantClicks: 2},
+		{name: "never connects", connectsAt: -1, wantClicks: activationAttempts, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, client := newFakeKernel(t)
+			connectAfterClicks(fake, tt.connectsAt)
+			err := ActivatePlaywriter(context.Background(), client, testSessionID)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if fake.clicks != tt.wantClicks {
+				t.Errorf("clicked %d times, want %d", fake.clicks, tt.wantClicks)
+			}
+		})
+	}
+
+	// A cancelled context stops the retries
+	fake, client := newFakeKernel(t)
+	connectAfterClicks(fake, -1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := ActivatePlaywriter(ctx, client, testSessionID); err == nil {
+		t.Error("activation with a cancelled context succeeded")
+	}
+}
+
+func TestActivatePlaywriterProgrammatic(t *testing.T) {
+	fastActivation(t)
+	tests := []struct {
+		name       string
+		trigger    playwrightResult
+		connects   bool // the trigger connects the extension
+		wantClicks int
+	}{
+		{name: "triggered and connected", trigger: playwrightResult{success: true, result: "triggered"}, connects: true},
+		{name: "no hook falls back to clicking", trigger: playwrightResult{success: true, result: "no-hook"}, wantClicks: 1},
+		{name: "worker not found falls back to clicking", trigger: playwrightResult{success: true, result: "not-found"}, wantClicks: 1},
+		{name: "execution error falls back to clicking", trigger: playwrightResult{error: "target closed"}, wantClicks: 1},
+		{name: "triggered but not connected falls back to clicking", trigger: playwrightResult{success: true, result: "triggered"}, wantClicks: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, client := newFakeKernel(t)
+			fake.execute = func(code string) playwrightResult { return tt.trigger }
+			if tt.connects {
+				connectAfterClicks(fake, 0)
+			} else {
+				connectAfterClicks(fake, 1)
+			}
+			if err := ActivatePlaywriterProgrammatic(context.Background(), client, testSessionID); err != nil {
+				t.Fatal(err)
+			}
+			if fake.clicks != tt.wantClicks {
+				t.Errorf("clicked %d times, want %d", fake.clicks, tt.wantClicks)
+			}
+		})
+	}
+}
+
+func TestActivatePlaywriterHeadless(t *testing.T) {
+	fastActivation(t)
+	tests := []struct {
+		name     string
+		trigger  playwrightResult
+		connects bool
+		wantErr  bool
+	}{
+		{name: "connected", trigger: playwrightResult{success: true, result: "triggered"}, connects: true},
+		{name: "not connected", trigger: playwrightResult{success: true, result: "triggered"}, wantErr: true},
+		{name: "no hook", trigger: playwrightResult{success: true, result: "no-hook"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, client := newFakeKernel(t)
+			fake.execute = func(code string) playwrightResult { return tt.trigger }
+			if tt.connects {
+				connectAfterClicks(fake, 0)
+			} else {
+				connectAfterClicks(fake, -1)
+			}
+			err := ActivatePlaywriterHeadless(context.Background(), client, testSessionID)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if fake.clicks != 0 {
+				t.Errorf("clicked %d times in a headless session", fake.clicks)
+			}
+		})
+	}
+}
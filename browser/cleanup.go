@@ -0,0 +1,122 @@
+package browser
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/onkernel/kernel-go-sdk"
+
+	"playwriter-setup/agent"
+)
+
+// TempFiles are the files a run leaves in the session that SoftCleanup removes
+var TempFiles = []string{"/tmp/run_claude.sh", "/tmp/run_opencode.sh", RelayLogPath, SetupScriptPath}
+
+// PlaywriterDir is where InstallPlaywriterFromSource clones and builds playwriter
+const PlaywriterDir = "/home/kernel/playwriter"
+
+// removePlaywriterCommand is the shell command removing PlaywriterDir. It
+// prints the kilobytes the tree took up, or nothing if it wasn't there.
+func removePlaywriterCommand() string {
+	dir := shellQuote(PlaywriterDir)
+	return "[ -d " + dir + " ] || exit 0; kb=$(du -sk " + dir + " 2>/dev/null | cut -f1); rm -rf " + dir + " && echo \"${kb:-0}\""
+}
+
+// SoftCleanup leaves a session clean for reuse without deleting it: it stops
+// the Playwriter relay, closes all tabs but the first, and removes TempFiles.
+// With removePlaywriter it also removes the playwriter build in PlaywriterDir
+// to reclaim its space; the next run reinstalls it. Each step is best effort.
+// Returns a description of what was cleaned.
+func SoftCleanup(ctx context.Context, client kernel.Client, sessionID string, removePlaywriter bool) []string {
+	var cleaned []string
+	proc := client.Browsers.Process
+
+	// Stop the relay; the next run with -s restarts it
+	result, err := proc.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
+		Command:    "bash",
+		Args:       []string{"-c", "pkill -f 'start-relay-server' && echo stopped || true"},
+		TimeoutSec: kernel.Opt(int64(5)),
+	})
+	if err == nil && strings.TrimSpace(agent.DecodeB64(result.StdoutB64)) == "stopped" {
+		cleaned = append(cleaned, "stopped the Playwriter relay")
+	}
+
+	// Close extra tabs, keeping one so the browser window stays open
+	resp, err := client.Browsers.Playwright.Execute(ctx, sessionID, kernel.BrowserPlaywrightExecuteParams{
+		Code: `
+		const pages = context.pages();
+		for (let i = 1; i < pages.length; i++) await pages[i].close();
+		return Math.max(pages.length - 1, 0);
+	`,
+		TimeoutSec: kernel.Opt(int64(30)),
+	})
+	if err == nil && resp.Success {
+		if closed, ok := resp.Result.(float64); ok && closed > 0 {
+			cleaned = append(cleaned, fmt.Sprintf("closed %d tab(s)", int(closed)))
+		}
+	}
+
+	// Remove temp scripts and logs
+	result, err = proc.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
+		Command:    "bash",
+		Args:       []string{"-c", "for f in " + strings.Join(TempFiles, " ") + "; do [ -e \"$f\" ] && rm -f \"$f\" && echo \"$f\"; done; true"},
+		AsRoot:     kernel.Opt(true),
+		TimeoutSec: kernel.Opt(int64(10)),
+	})
+	if err == nil {
+		for _, f := range strings.Fields(agent.DecodeB64(result.StdoutB64)) {
+			cleaned = append(cleaned, "removed "+f)
+		}
+	}
+
+	// Remove the playwriter build, which runs to hundreds of MB
+	if removePlaywriter {
+		result, err = proc.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
+			Command:    "bash",
+			Args:       []string{"-c", removePlaywriterCommand()},
+			AsRoot:     kernel.Opt(true),
+			TimeoutSec: kernel.Opt(int64(60)),
+		})
+		if err == nil && result.ExitCode == 0 {
+			if kb, err := strconv.ParseInt(strings.TrimSpace(agent.DecodeB64(result.StdoutB64)), 10, 64); err == nil {
+				cleaned = append(cleaned, fmt.Sprintf("removed %s (%d MB reclaimed)", PlaywriterDir, kb/1024))
+			}
+		}
+	}
+
+	return cleaned
+}
+
+// ReapTabs closes all but the keepN most recently active tabs, returning the
+// number closed. Pages aren't timestamped, so recency is approximated: the
+// visible tab counts as most recent, then tabs by how recently they were
+// opened. At least one tab is always kept.
+func ReapTabs(ctx context.Context, client kernel.Client, sessionID string, keepN int) (int, error) {
+	if keepN < 1 {
+		keepN = 1
+	}
+	resp, err := client.Browsers.Playwright.Execute(ctx, sessionID, kernel.BrowserPlaywrightExecuteParams{
+		Code: fmt.Sprintf(`
+		const keep = %d;
+		const pages = context.pages();
+		const visible = await Promise.all(pages.map(p =>
+			p.evaluate(() => document.visibilityState === "visible").catch(() => false)));
+		// Oldest first; the visible tab sorts last so it's kept
+		const order = pages.map((p, i) => i).sort((a, b) => (visible[a] - visible[b]) || (a - b));
+		const victims = order.slice(0, Math.max(order.length - keep, 0));
+		for (const i of victims) await pages[i].close();
+		return victims.length;
+	`, keepN),
+		TimeoutSec: kernel.Opt(int64(30)),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("reap tabs: %w", err)
+	}
+	if !resp.Success {
+		return 0, fmt.Errorf("reap tabs: %s", resp.Error)
+	}
+	closed, _ := resp.Result.(float64)
+	return int(closed), nil
+}
@@ -0,0 +1,170 @@
+package browser
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// runTabsSnippet runs Playwright code in node against fake pages, one per
+// entry in visible, and returns the indexes of the pages it closed and the
+// code's result
+func runTabsSnippet(t *testing.T, code string, visible []bool) (closed []int, result float64) {
+	t.Helper()
+	if _, err := exec.LookPath("node"); err != nil {
+		t.Skip("node not installed")
+	}
+	tabs, _ := json.Marshal(visible)
+	script := `
+	const closed = [];
+	const context = { pages: () => ` + string(tabs) + `.map((visible, i) => ({
+		evaluate: async () => visible,
+		close: async () => { closed.push(i); },
+	})) };
+	(async () => {` + code + `})().then(result => console.log(JSON.stringify({ closed, result })));
+	`
+	out, err := exec.Command("node", "-e", script).Output()
+	if err != nil {
+		t.Fatalf("node: %v", err)
+	}
+	var res struct {
+		Closed []int
+		Result float64
+	}
+	if err := json.Unmarshal(out, &res); err != nil {
+		t.Fatalf("snippet output %q: %v", out, err)
+	}
+	return res.Closed, res.Result
+}
+
+func TestReapTabs(t *testing.T) {
+	tests := []struct {
+		name       string
+		keepN      int
+		visible    []bool
+		wantClosed []int
+	}{
+		{name: "fewer tabs than kept", keepN: 3, visible: []bool{true, false}},
+		{name: "oldest closed first", keepN: 2, visible: []bool{false, false, false, false}, wantClosed: []int{0, 1}},
+		{name: "visible tab kept", keepN: 1, visible: []bool{true, false, false}, wantClosed: []int{1, 2}},
+		{name: "visible old tab outlives newer ones", keepN: 2, visible: []bool{false, true, false, false}, wantClosed: []int{0, 2}},
+		{name: "zero keeps one", keepN: 0, visible: []bool{false, false}, wantClosed: []int{0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, client := newFakeKernel(t)
+			fake.execute = func(code string) playwrightResult {
+				_, result := runTabsSnippet(t, code, tt.visible)
+				return playwrightResult{success: true, result: result}
+			}
+			n, err := ReapTabs(context.Background(), client, testSessionID, tt.keepN)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(tt.wantClosed) {
+				t.Errorf("ReapTabs() = %d, want %d", n, len(tt.wantClosed))
+			}
+			closed, _ := runTabsSnippet(t, fake.codes[0], tt.visible)
+			if !slices.Equal(closed, tt.wantClosed) {
+				t.Errorf("closed tabs %v, want %v", closed, tt.wantClosed)
+			}
+		})
+	}
+
+	fake, client := newFakeKernel(t)
+	fake.execute = func(code string) playwrightResult {
+		return playwrightResult{error: "Target page, context or browser has been closed"}
+	}
+	if _, err := ReapTabs(context.Background(), client, testSessionID, 1); err == nil || !strings.Contains(err.Error(), "has been closed") {
+		t.Errorf("failed execution err = %v, want the Playwright error", err)
+	}
+}
+
+func TestRemovePlaywriterCommand(t *testing.T) {
+	cmd := removePlaywriterCommand()
+	if strings.Count(cmd, shellQuote(PlaywriterDir)) != 3 {
+		t.Errorf("PlaywriterDir not quoted everywhere:\n%s", cmd)
+	}
+
+	// Run it against a scratch directory standing in for PlaywriterDir
+	tests := []struct {
+		name   string
+		create bool
+		want   string
+	}{
+		{name: "present", create: true, want: "kb"},
+		{name: "already gone", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "play writer")
+			if tt.create {
+				os.MkdirAll(filepath.Join(dir, "node_modules"), 0o755)
+				os.WriteFile(filepath.Join(dir, "node_modules", "big.js"), make([]byte, 64*1024), 0o644)
+			}
+			script := strings.ReplaceAll(cmd, shellQuote(PlaywriterDir), shellQuote(dir))
+			out, err := exec.Command("bash", "-c", script).Output()
+			if err != nil {
+				t.Fatalf("%s: %v", script, err)
+			}
+			got := strings.TrimSpace(string(out))
+			switch tt.want {
+			case "kb":
+				if kb, err := strconv.Atoi(got); err != nil || kb <= 0 {
+					t.Errorf("output %q, want the kilobytes removed", got)
+				}
+			default:
+				if got != tt.want {
+					t.Errorf("output %q, want %q", got, tt.want)
+				}
+			}
+			if _, err := os.Stat(dir); !os.IsNotExist(err) {
+				t.Errorf("%s not removed", dir)
+			}
+		})
+	}
+}
+
+func TestSoftCleanupRemovePlaywriter(t *testing.T) {
+	tests := []struct {
+		name             string
+		removePlaywriter bool
+		stdout           string
+		want             string // cleaned entry; "" for none
+	}{
+		{name: "not requested"},
+		{name: "removed", removePlaywriter: true, stdout: "262144\n", want: "removed " + PlaywriterDir + " (256 MB reclaimed)"},
+		{name: "not there", removePlaywriter: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, client := newFakeKernel(t)
+			fake.exec = func(call execCall) execResult {
+				if strings.Contains(call.line(), "rm -rf") {
+					return execResult{stdout: tt.stdout}
+				}
+				return execResult{}
+			}
+			cleaned := SoftCleanup(context.Background(), client, testSessionID, tt.removePlaywriter)
+
+			if ran := len(fake.ran(removePlaywriterCommand())) > 0; ran != tt.removePlaywriter {
+				t.Errorf("removal run = %v, want %v", ran, tt.removePlaywriter)
+			}
+			var got string
+			for _, c := range cleaned {
+				if strings.Contains(c, PlaywriterDir) {
+					got = c
+				}
+			}
+			if got != tt.want {
+				t.Errorf("cleaned %q, want %q", cleaned, tt.want)
+			}
+		})
+	}
+}
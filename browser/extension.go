@@ -0,0 +1,112 @@
+package browser
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/onkernel/kernel-go-sdk"
+)
+
+const (
+	// PlaywriterWebStoreID is the Chrome Web Store listing ID for Playwriter
+	PlaywriterWebStoreID = "jfeammnjpkecdekppnclgkkffahnhfhe"
+
+	// SecurePreferencesPath holds extension settings that Chrome protects with a MAC
+	SecurePreferencesPath = "/home/kernel/user-data/Default/Secure Preferences"
+)
+
+// extensionIDPattern matches a Chrome extension ID: 32 letters a-p
+var extensionIDPattern = regexp.MustCompile(`^[a-p]{32}$`)
+
+// ResolveExtensionID looks up the internal Chrome ID of the playwriter extension
+// using FindExtensionID. Returns PlaywriterExtensionID if no installed extension
+// matches, or if what matched isn't a valid extension ID.
+func ResolveExtensionID(ctx context.Context, client kernel.Client, sessionID string, queries ...string) string {
+	if id, ok := FindExtensionID(ctx, client, sessionID, queries...); ok && extensionIDPattern.MatchString(id) {
+		return id
+	}
+	return PlaywriterExtensionID
+}
+
+// FindExtensionID looks up the internal Chrome ID of an installed extension by
+// matching each query against the extension ID or the name of the directory it
+// was loaded from, then against its manifest name. When several manifest names
+// contain the query, the lowest ID wins, so the result doesn't vary between
+// runs. Chrome must have written its preferences for discovery to work.
+func FindExtensionID(ctx context.Context, client kernel.Client, sessionID string, queries ...string) (string, bool) {
+	for _, prefsPath := range []string{SecurePreferencesPath, PreferencesPath} {
+		settings := readExtensionSettings(ctx, client, sessionID, prefsPath)
+		ids := make([]string, 0, len(settings))
+		for id := range settings {
+			ids = append(ids, id)
+		}
+		slices.Sort(ids)
+		for _, query := range queries {
+			if query == "" {
+				continue
+			}
+			for _, match := range []func(id string, raw any, query string) bool{matchesExtensionExactly, matchesExtensionName} {
+				for _, id := range ids {
+					if match(id, settings[id], query) {
+						return id, true
+					}
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+// readExtensionSettings returns the extensions.settings map from a Chrome
+// preferences file, or nil if the file can't be read or parsed
+func readExtensionSettings(ctx context.Context, client kernel.Client, sessionID, prefsPath string) map[string]any {
+	resp, err := client.Browsers.Fs.ReadFile(ctx, sessionID, kernel.BrowserFReadFileParams{
+		Path: prefsPath,
+	})
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil
+	}
+
+	var prefs struct {
+		Extensions struct {
+			Settings map[string]any `json:"settings"`
+		} `json:"extensions"`
+	}
+	if err := json.Unmarshal(data, &prefs); err != nil {
+		return nil
+	}
+	return prefs.Extensions.Settings
+}
+
+// matchesExtensionExactly reports whether an extensions.settings entry has ID
+// query or was loaded from a directory named query
+func matchesExtensionExactly(id string, raw any, query string) bool {
+	if id == query {
+		return true
+	}
+	entry, _ := raw.(map[string]any)
+	if extPath, _ := entry["path"].(string); extPath != "" {
+		return strings.EqualFold(path.Base(extPath), query)
+	}
+	return false
+}
+
+// matchesExtensionName reports whether an extensions.settings entry's manifest
+// name contains query, ignoring case
+func matchesExtensionName(id string, raw any, query string) bool {
+	entry, _ := raw.(map[string]any)
+	manifest, _ := entry["manifest"].(map[string]any)
+	name, _ := manifest["name"].(string)
+	return name != "" && strings.Contains(strings.ToLower(name), strings.ToLower(query))
+}
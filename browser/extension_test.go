@@ -0,0 +1,99 @@
+package browser
+
+import (
+	"context"
+	"testing"
+)
+
+func TestFindExtensionID(t *testing.T) {
+	const secure = `{"extensions":{"settings":{
+		"aaaa":{"path":"/opt/kernel/extensions/playwriter","manifest":{"name":"Playwriter MCP"}},
+		"bbbb":{"path":"/opt/kernel/extensions/ublock","manifest":{"name":"uBlock Origin"}},
+		"cccc":{"manifest":{"name":"Dark Reader"}}
+	}}}`
+	tests := []struct {
+		name    string
+		secure  string // Secure Preferences; "" for no file
+		prefs   string // Preferences; "" for no file
+		queries []string
+		want    string
+		wantOK  bool
+	}{
+		{name: "by directory name", secure: secure, queries: []string{"ublock"}, want: "bbbb", wantOK: true},
+		{name: "by manifest name, any case", secure: secure, queries: []string{"dark reader"}, want: "cccc", wantOK: true},
+		{name: "by ID", secure: secure, queries: []string{"aaaa"}, want: "aaaa", wantOK: true},
+		{name: "first matching query wins", secure: secure, queries: []string{"", "missing", "playwriter"}, want: "aaaa", wantOK: true},
+		{
+			name:    "falls back to Preferences",
+			prefs:   `{"extensions":{"settings":{"dddd":{"path":"/x/ublock"}}}}`,
+			queries: []string{"ublock"},
+			want:    "dddd",
+			wantOK:  true,
+		},
+		{
+			name: "exact match preferred over a name",
+			secure: `{"extensions":{"settings":{
+				"aaaa":{"manifest":{"name":"Playwriter Helper"}},
+				"bbbb":{"path":"/opt/kernel/extensions/playwriter","manifest":{"name":"Playwriter"}}
+			}}}`,
+			queries: []string{"playwriter"},
+			want:    "bbbb",
+			wantOK:  true,
+		},
+		{
+			name: "lowest ID among name matches",
+			secure: `{"extensions":{"settings":{
+				"dddd":{"manifest":{"name":"Playwriter"}},
+				"cccc":{"manifest":{"name":"Playwriter Helper"}},
+				"eeee":{"manifest":{"name":"Playwriter Beta"}}
+			}}}`,
+			queries: []string{"playwriter"},
+			want:    "cccc",
+			wantOK:  true,
+		},
+		{name: "no match", secure: secure, queries: []string{"adblock-plus"}},
+		{name: "no preferences", queries: []string{"ublock"}},
+		{name: "unparsable preferences", secure: "{", queries: []string{"ublock"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, client := newFakeKernel(t)
+			if tt.secure != "" {
+				fake.files[SecurePreferencesPath] = tt.secure
+			}
+			if tt.prefs != "" {
+				fake.files[PreferencesPath] = tt.prefs
+			}
+			id, ok := FindExtensionID(context.Background(), client, testSessionID, tt.queries...)
+			if id != tt.want || ok != tt.wantOK {
+				t.Errorf("FindExtensionID(%q) = %q, %v, want %q, %v", tt.queries, id, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+
+}
+
+func TestResolveExtensionID(t *testing.T) {
+	const found = "abcdefghijklmnopabcdefghijklmnop"
+	tests := []struct {
+		name   string
+		secure string // Secure Preferences; "" for no file
+		want   string
+	}{
+		{name: "found", secure: `{"extensions":{"settings":{"` + found + `":{"path":"/x/playwriter"}}}}`, want: found},
+		{name: "no preferences", want: PlaywriterExtensionID},
+		{name: "malformed ID", secure: `{"extensions":{"settings":{"x'; rm -rf ~":{"path":"/x/playwriter"}}}}`, want: PlaywriterExtensionID},
+		{name: "letters past p", secure: `{"extensions":{"settings":{"zzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzz":{"path":"/x/playwriter"}}}}`, want: PlaywriterExtensionID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, client := newFakeKernel(t)
+			if tt.secure != "" {
+				fake.files[SecurePreferencesPath] = tt.secure
+			}
+			if id := ResolveExtensionID(context.Background(), client, testSessionID, "playwriter"); id != tt.want {
+				t.Errorf("ResolveExtensionID() = %q, want %q", id, tt.want)
+			}
+		})
+	}
+}
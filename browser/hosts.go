@@ -0,0 +1,80 @@
+package browser
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/onkernel/kernel-go-sdk"
+
+	"playwriter-setup/agent"
+)
+
+// HostsEntry maps a hostname to an IP address in the session's /etc/hosts
+type HostsEntry struct {
+	Name string
+	IP   string
+}
+
+// hostnamePattern matches a DNS hostname: dot-separated labels of letters,
+// digits, and inner hyphens
+var hostnamePattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?)*$`)
+
+// ParseHostsEntry parses name:ip, as given to -host. The IP may be IPv4 or
+// IPv6; the name is everything before the first colon.
+func ParseHostsEntry(s string) (HostsEntry, error) {
+	name, ip, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok || name == "" || ip == "" {
+		return HostsEntry{}, fmt.Errorf("invalid host entry %q (expected name:ip)", s)
+	}
+	if len(name) > 253 || !hostnamePattern.MatchString(name) {
+		return HostsEntry{}, fmt.Errorf("invalid host entry %q: %q is not a valid hostname", s, name)
+	}
+	if net.ParseIP(ip) == nil {
+		return HostsEntry{}, fmt.Errorf("invalid host entry %q: %q is not an IP address", s, ip)
+	}
+	return HostsEntry{Name: name, IP: ip}, nil
+}
+
+// Line returns the entry as an /etc/hosts line
+func (e HostsEntry) Line() string {
+	return e.IP + "\t" + e.Name
+}
+
+// hostsCommand is the shell command appending entries to /etc/hosts, skipping
+// lines already there so a reused session doesn't collect duplicates
+func hostsCommand(entries []HostsEntry) string {
+	var b strings.Builder
+	for _, e := range entries {
+		line := shellQuote(e.Line())
+		fmt.Fprintf(&b, "grep -qxF %s /etc/hosts || echo %s >> /etc/hosts\n", line, line)
+	}
+	return b.String()
+}
+
+// AddHostsEntries appends entries to the session's /etc/hosts, so the browser
+// and agent resolve private hostnames, e.g. of internal test servers
+func AddHostsEntries(ctx context.Context, client kernel.Client, sessionID string, entries []HostsEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	status(phaseHosts, headerStyle.Render("Adding hosts entries..."))
+	result, err := client.Browsers.Process.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
+		Command:    "bash",
+		Args:       []string{"-c", "set -e\n" + hostsCommand(entries)},
+		AsRoot:     kernel.Opt(true),
+		TimeoutSec: kernel.Opt(int64(10)),
+	})
+	if err != nil {
+		return fmt.Errorf("add hosts entries: %w", err)
+	}
+	if result.ExitCode != 0 {
+		return fmt.Errorf("add hosts entries failed (exit %d): %s", result.ExitCode, agent.DecodeB64(result.StderrB64))
+	}
+	for _, e := range entries {
+		status(phaseHosts, dimStyle.Render(e.Name+" -> "+e.IP))
+	}
+	return nil
+}
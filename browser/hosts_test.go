@@ -0,0 +1,118 @@
+package browser
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseHostsEntry(t *testing.T) {
+	tests := []struct {
+		arg     string
+		want    HostsEntry
+		wantErr string
+	}{
+		{arg: "staging.internal:10.0.0.5", want: HostsEntry{Name: "staging.internal", IP: "10.0.0.5"}},
+		{arg: " api:192.168.1.20 ", want: HostsEntry{Name: "api", IP: "192.168.1.20"}},
+		{arg: "db.internal:fd00::1", want: HostsEntry{Name: "db.internal", IP: "fd00::1"}},
+		{arg: "local-v6:::1", want: HostsEntry{Name: "local-v6", IP: "::1"}},
+		{arg: "staging.internal", wantErr: "expected name:ip"},
+		{arg: ":10.0.0.5", wantErr: "expected name:ip"},
+		{arg: "staging.internal:", wantErr: "expected name:ip"},
+		{arg: "bad_host:10.0.0.5", wantErr: "not a valid hostname"},
+		{arg: "-leading.example:10.0.0.5", wantErr: "not a valid hostname"},
+		{arg: "a..b:10.0.0.5", wantErr: "not a valid hostname"},
+		{arg: "x; rm -rf /:10.0.0.5", wantErr: "not a valid hostname"},
+		{arg: "staging.internal:10.0.0.256", wantErr: "not an IP address"},
+		{arg: "staging.internal:example.com", wantErr: "not an IP address"},
+	}
+	for _, tt := range tests {
+		got, err := ParseHostsEntry(tt.arg)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ParseHostsEntry(%q) err = %v, want %q", tt.arg, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseHostsEntry(%q): %v", tt.arg, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseHostsEntry(%q) = %+v, want %+v", tt.arg, got, tt.want)
+		}
+	}
+}
+
+func TestHostsCommand(t *testing.T) {
+	entries := []HostsEntry{{Name: "staging.internal", IP: "10.0.0.5"}, {Name: "db.internal", IP: "fd00::1"}}
+	cmd := hostsCommand(entries)
+	want := "grep -qxF '10.0.0.5\tstaging.internal' /etc/hosts || echo '10.0.0.5\tstaging.internal' >> /etc/hosts\n" +
+		"grep -qxF 'fd00::1\tdb.internal' /etc/hosts || echo 'fd00::1\tdb.internal' >> /etc/hosts\n"
+	if cmd != want {
+		t.Fatalf("hostsCommand() =\n%s\nwant\n%s", cmd, want)
+	}
+
+	// Run against a scratch hosts file that already has the first entry
+	tests := []struct {
+		name     string
+		existing string
+		want     string
+	}{
+		{
+			name:     "entries added",
+			existing: "127.0.0.1\tlocalhost\n",
+			want:     "127.0.0.1\tlocalhost\n10.0.0.5\tstaging.internal\nfd00::1\tdb.internal\n",
+		},
+		{
+			name:     "existing entry not repeated",
+			existing: "127.0.0.1\tlocalhost\n10.0.0.5\tstaging.internal\n",
+			want:     "127.0.0.1\tlocalhost\n10.0.0.5\tstaging.internal\nfd00::1\tdb.internal\n",
+		},
+		{
+			name:     "longer line isn't a match",
+			existing: "10.0.0.5\tstaging.internal.example\n",
+			want:     "10.0.0.5\tstaging.internal.example\n10.0.0.5\tstaging.internal\nfd00::1\tdb.internal\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := filepath.Join(t.TempDir(), "hosts")
+			os.WriteFile(hosts, []byte(tt.existing), 0o644)
+			script := "set -e\n" + strings.ReplaceAll(cmd, "/etc/hosts", hosts)
+			// Running twice adds nothing more
+			for range 2 {
+				if out, err := exec.Command("bash", "-c", script).CombinedOutput(); err != nil {
+					t.Fatalf("%v: %s", err, out)
+				}
+			}
+			got, _ := os.ReadFile(hosts)
+			if string(got) != tt.want {
+				t.Errorf("hosts file =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddHostsEntries(t *testing.T) {
+	fake, client := newFakeKernel(t)
+	if err := AddHostsEntries(context.Background(), client, testSessionID, nil); err != nil || len(fake.execs) != 0 {
+		t.Errorf("no entries: err = %v, ran %d commands", err, len(fake.execs))
+	}
+
+	entries := []HostsEntry{{Name: "staging.internal", IP: "10.0.0.5"}}
+	if err := AddHostsEntries(context.Background(), client, testSessionID, entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.ran("grep -qxF '10.0.0.5\tstaging.internal' /etc/hosts")) != 1 {
+		t.Errorf("hosts command not run: %v", fake.execs)
+	}
+
+	fake.exec = func(call execCall) execResult { return execResult{exitCode: 1} }
+	if err := AddHostsEntries(context.Background(), client, testSessionID, entries); err == nil || !strings.Contains(err.Error(), "exit 1") {
+		t.Errorf("failed command err = %v, want the exit code", err)
+	}
+}
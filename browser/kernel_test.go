@@ -0,0 +1,199 @@
+package browser
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/onkernel/kernel-go-sdk"
+	"github.com/onkernel/kernel-go-sdk/option"
+)
+
+// testSessionID is the session every fakeKernel request is made against
+const testSessionID = "test-session"
+
+// execCall is a command run through Process.Exec
+type execCall struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+}
+
+// line returns the call as one shell-like line, e.g. "bash -c ..."
+func (c execCall) line() string {
+	return strings.Join(append([]string{c.Command}, c.Args...), " ")
+}
+
+// execResult is what a fake exec returns
+type execResult struct {
+	exitCode int
+	stdout   string
+}
+
+// playwrightResult is what a fake Playwright execution returns
+type playwrightResult struct {
+	success bool
+	result  any
+	error   string
+}
+
+// fakeKernel serves the parts of the Kernel API the browser package uses for
+// one session, keeping the session's files in memory
+type fakeKernel struct {
+	mu      sync.Mutex
+	files   map[string]string
+	dirs    []string
+	execs   []execCall
+	spawns  []execCall
+	codes   []string // Playwright code executed
+	clicks  int
+	deleted []string
+	replays []map[string]any // replay recordings, as Replays.List returns them
+	stopped []string         // replay IDs stopped
+
+	// exec and execute answer Process.Exec and Playwright.Execute; unset, an
+	// exec prints nothing and code succeeds with no result
+	exec    func(call execCall) execResult
+	execute func(code string) playwrightResult
+
+	// beforeRead, if set, is called with each path read, e.g. to create the
+	// file while the caller waits for it. It may change files.
+	beforeRead func(path string)
+
+	// hang, if set, blocks every request until the client gives up or the
+	// test ends
+	hang   bool
+	closed chan struct{}
+}
+
+// newFakeKernel starts a fake Kernel API and returns a client talking to it
+func newFakeKernel(t *testing.T) (*fakeKernel, kernel.Client) {
+	t.Helper()
+	f := &fakeKernel{files: make(map[string]string), closed: make(chan struct{})}
+	srv := httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(srv.Close)
+	// Cleanups run last-in first-out, so hung requests end before Close waits on them
+	t.Cleanup(func() { close(f.closed) })
+	client := kernel.NewClient(
+		option.WithBaseURL(srv.URL+"/"),
+		option.WithAPIKey("test"),
+		option.WithMaxRetries(0),
+	)
+	return f, client
+}
+
+func (f *fakeKernel) serve(w http.ResponseWriter, r *http.Request) {
+	if f.hang {
+		select {
+		case <-r.Context().Done():
+		case <-f.closed:
+		}
+		return
+	}
+	route, ok := strings.CutPrefix(r.URL.Path, "/browsers/"+testSessionID+"/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	w.Header().Set("Content-Type", "application/json")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch route {
+	case "fs/read_file":
+		path := r.URL.Query().Get("path")
+		if f.beforeRead != nil {
+			f.beforeRead(path)
+		}
+		contents, ok := f.files[path]
+		if !ok {
+			http.Error(w, `{"message":"not found"}`, http.StatusNotFound)
+			return
+		}
+		io.WriteString(w, contents)
+	case "fs/write_file":
+		f.files[r.URL.Query().Get("path")] = string(body)
+	case "fs/delete_file":
+		var req struct{ Path string }
+		json.Unmarshal(body, &req)
+		if _, ok := f.files[req.Path]; !ok {
+			http.Error(w, `{"message":"not found"}`, http.StatusNotFound)
+			return
+		}
+		delete(f.files, req.Path)
+		f.deleted = append(f.deleted, req.Path)
+	case "fs/create_directory":
+		var req struct{ Path string }
+		json.Unmarshal(body, &req)
+		f.dirs = append(f.dirs, req.Path)
+	case "process/exec":
+		var call execCall
+		json.Unmarshal(body, &call)
+		f.execs = append(f.execs, call)
+		var result execResult
+		if f.exec != nil {
+			result = f.exec(call)
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"exit_code":  result.exitCode,
+			"stdout_b64": base64.StdEncoding.EncodeToString([]byte(result.stdout)),
+		})
+	case "process/spawn":
+		var call execCall
+		json.Unmarshal(body, &call)
+		f.spawns = append(f.spawns, call)
+		json.NewEncoder(w).Encode(map[string]any{"process_id": "proc-1", "pid": 1})
+	case "playwright/execute":
+		var req struct{ Code string }
+		json.Unmarshal(body, &req)
+		f.codes = append(f.codes, req.Code)
+		result := playwrightResult{success: true}
+		if f.execute != nil {
+			result = f.execute(req.Code)
+		}
+		json.NewEncoder(w).Encode(map[string]any{"success": result.success, "result": result.result, "error": result.error})
+	case "computer/click_mouse":
+		f.clicks++
+	case "replays":
+		if r.Method == http.MethodPost {
+			replay := map[string]any{"replay_id": fmt.Sprintf("replay-%d", len(f.replays)+1)}
+			f.replays = append(f.replays, replay)
+			json.NewEncoder(w).Encode(replay)
+			return
+		}
+		json.NewEncoder(w).Encode(f.replays)
+	default:
+		if id, ok := strings.CutPrefix(route, "replays/"); ok && strings.HasSuffix(id, "/stop") {
+			f.stopped = append(f.stopped, strings.TrimSuffix(id, "/stop"))
+			return
+		}
+		http.NotFound(w, r)
+	}
+}
+
+// file returns the contents of path in the session
+func (f *fakeKernel) file(path string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	contents, ok := f.files[path]
+	return contents, ok
+}
+
+// ran returns the exec calls whose line contains substr
+func (f *fakeKernel) ran(substr string) []execCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var calls []execCall
+	for _, call := range f.execs {
+		if strings.Contains(call.line(), substr) {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
@@ -0,0 +1,79 @@
+package browser
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// sessionIDPattern matches a Kernel browser session ID
+var sessionIDPattern = regexp.MustCompile(`^[a-z0-9]{16,40}$`)
+
+// liveViewIDParams are query parameters that carry the session ID directly
+var liveViewIDParams = []string{"session_id", "sessionId", "session", "id"}
+
+// liveViewClaims are JWT claims that carry the session ID
+var liveViewClaims = []string{"session_id", "sessionId", "session", "browser_id", "sub"}
+
+// IsURL reports whether s looks like an http(s) URL rather than a session ID
+func IsURL(s string) bool {
+	return strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "http://")
+}
+
+// SessionIDFromLiveView returns the ID of the session a live view URL belongs
+// to. The ID is looked for in a session query parameter, then in the claims
+// of a jwt query parameter, then in the path, e.g. after /browsers/ in a
+// dashboard URL.
+func SessionIDFromLiveView(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("parse live view URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("not a live view URL: %s", rawURL)
+	}
+
+	query := u.Query()
+	for _, key := range liveViewIDParams {
+		if id := query.Get(key); sessionIDPattern.MatchString(id) {
+			return id, nil
+		}
+	}
+	if id := sessionIDFromJWT(query.Get("jwt")); id != "" {
+		return id, nil
+	}
+
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	for i, segment := range segments {
+		if (segment == "browsers" || segment == "browser" || segment == "sessions") && i+1 < len(segments) && sessionIDPattern.MatchString(segments[i+1]) {
+			return segments[i+1], nil
+		}
+	}
+	return "", fmt.Errorf("no session ID found in live view URL")
+}
+
+// sessionIDFromJWT returns the session ID claim of token, without verifying
+// it, or "" if it has none
+func sessionIDFromJWT(token string) string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+	var claims map[string]any
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	for _, key := range liveViewClaims {
+		if id, ok := claims[key].(string); ok && sessionIDPattern.MatchString(id) {
+			return id
+		}
+	}
+	return ""
+}
@@ -0,0 +1,61 @@
+package browser
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestSessionIDFromLiveView(t *testing.T) {
+	const id = "x7k2m9p4q8r1s5t3"
+	// jwt builds an unsigned token with claims
+	jwt := func(claims string) string {
+		return "eyJhbGciOiJIUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".sig"
+	}
+	tests := []struct {
+		name    string
+		url     string
+		want    string
+		wantErr bool
+	}{
+		{name: "session query parameter", url: "https://live.onkernel.com/view?session_id=" + id + "&readOnly=true", want: id},
+		{name: "id query parameter", url: "https://live.onkernel.com/?id=" + id, want: id},
+		{name: "jwt claim", url: "https://proxy.onkernel.com:8443/browser/live/index.html?jwt=" + jwt(`{"session_id":"`+id+`","exp":1700000000}`), want: id},
+		{name: "jwt sub claim", url: "https://proxy.onkernel.com/?jwt=" + jwt(`{"sub":"`+id+`"}`), want: id},
+		{name: "dashboard path", url: "https://dashboard.onkernel.com/browsers/" + id + "/live", want: id},
+		{name: "query before path", url: "https://dashboard.onkernel.com/browsers/aaaaaaaaaaaaaaaa?session=" + id, want: id},
+		{name: "malformed jwt", url: "https://proxy.onkernel.com/?jwt=not-a-token", wantErr: true},
+		{name: "no ID", url: "https://live.onkernel.com/view?readOnly=true", wantErr: true},
+		{name: "ID too short", url: "https://live.onkernel.com/?session_id=abc", wantErr: true},
+		{name: "bare ID", url: id, wantErr: true},
+		{name: "other scheme", url: "ftp://live.onkernel.com/?session_id=" + id, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SessionIDFromLiveView(tt.url)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SessionIDFromLiveView(%q) err = %v, wantErr %v", tt.url, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("SessionIDFromLiveView(%q) = %q, want %q", tt.url, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsURL(t *testing.T) {
+	tests := []struct {
+		s    string
+		want bool
+	}{
+		{"https://live.onkernel.com/?session_id=x7k2m9p4q8r1s5t3", true},
+		{"http://localhost:8080/browsers/x7k2m9p4q8r1s5t3", true},
+		{"x7k2m9p4q8r1s5t3", false},
+		{"live.onkernel.com/?session_id=x7k2m9p4q8r1s5t3", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := IsURL(tt.s); got != tt.want {
+			t.Errorf("IsURL(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package browser
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/onkernel/kernel-go-sdk"
+)
+
+// RunLockPath is the lock file marking a session as busy with an agent run
+const RunLockPath = "/home/kernel/.playwriter-run.lock"
+
+// The holder rewrites the lock every runLockRefresh; a lock not refreshed
+// within runLockStale was left by a run that died
+var (
+	runLockRefresh = 30 * time.Second
+	runLockStale   = 2 * time.Minute
+)
+
+// ErrSessionBusy is returned by AcquireRunLock when another run holds the lock
+var ErrSessionBusy = errors.New("session is busy")
+
+// RunLock is the content of the lock file
+type RunLock struct {
+	ID        string    `json:"id"` // random, to tell our lock from another's
+	Host      string    `json:"host"`
+	PID       int       `json:"pid"`
+	StartedAt time.Time `json:"started_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Stale reports whether the lock's holder stopped refreshing it
+func (l RunLock) Stale() bool {
+	return time.Since(l.UpdatedAt) > runLockStale
+}
+
+// AcquireRunLock marks the session as busy so a second run against it fails
+// fast instead of sharing the relay and browser. A live lock held by another
+// run returns ErrSessionBusy unless force is set; stale locks are taken over.
+// The lock is kept fresh in the background until release is called. Once
+// another run takes it over with force, the lock is neither refreshed nor
+// removed.
+func AcquireRunLock(ctx context.Context, client kernel.Client, sessionID string, force bool) (release func(), err error) {
+	existing, err := readRunLock(ctx, client, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil && !existing.Stale() && !force {
+		return nil, fmt.Errorf("%w: another run (pid %d on %s) has held it since %s; use -force if it's no longer running",
+			ErrSessionBusy, existing.PID, existing.Host, existing.StartedAt.Local().Format(time.Kitchen))
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	host, _ := os.Hostname()
+	now := time.Now()
+	lock := RunLock{ID: hex.EncodeToString(id), Host: host, PID: os.Getpid(), StartedAt: now, UpdatedAt: now}
+	if err := writeRunLock(ctx, client, sessionID, lock); err != nil {
+		return nil, err
+	}
+
+	// Two runs starting together may both have found the session free; only
+	// the last writer proceeds
+	current, err := readRunLock(ctx, client, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil || current.ID != lock.ID {
+		return nil, fmt.Errorf("%w: another run acquired it at the same time", ErrSessionBusy)
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(runLockRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if !ownsRunLock(ctx, client, sessionID, lock.ID) {
+					return
+				}
+				lock.UpdatedAt = time.Now()
+				writeRunLock(ctx, client, sessionID, lock)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+		// Released even if ctx was cancelled, or the lock would keep others
+		// out until it went stale
+		ctx := context.Background()
+		if ownsRunLock(ctx, client, sessionID, lock.ID) {
+			client.Browsers.Fs.DeleteFile(ctx, sessionID, kernel.BrowserFDeleteFileParams{Path: RunLockPath})
+		}
+	}, nil
+}
+
+// ownsRunLock reports whether the session's run lock is still the one with
+// ID id. It's false once another run took the lock over or removed it, and
+// if the lock can't be read.
+func ownsRunLock(ctx context.Context, client kernel.Client, sessionID, id string) bool {
+	current, err := readRunLock(ctx, client, sessionID)
+	return err == nil && current != nil && current.ID == id
+}
+
+// readRunLock returns the session's run lock, or nil if there is none or it
+// can't be parsed
+func readRunLock(ctx context.Context, client kernel.Client, sessionID string) (*RunLock, error) {
+	resp, err := client.Browsers.Fs.ReadFile(ctx, sessionID, kernel.BrowserFReadFileParams{Path: RunLockPath})
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read run lock: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read run lock: %w", err)
+	}
+	var lock RunLock
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, nil
+	}
+	return &lock, nil
+}
+
+// writeRunLock writes lock to RunLockPath
+func writeRunLock(ctx context.Context, client kernel.Client, sessionID string, lock RunLock) error {
+	data, _ := json.Marshal(lock)
+	if err := client.Browsers.Fs.WriteFile(ctx, sessionID, bytes.NewReader(data), kernel.BrowserFWriteFileParams{
+		Path: RunLockPath,
+	}); err != nil {
+		return fmt.Errorf("write run lock: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package browser
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestAcquireRunLock(t *testing.T) {
+	held := func(updated time.Duration) string {
+		data, _ := json.Marshal(RunLock{ID: "other", Host: "ci-runner", PID: 4242, StartedAt: time.Now().Add(-time.Hour), UpdatedAt: time.Now().Add(-updated)})
+		return string(data)
+	}
+	tests := []struct {
+		name     string
+		existing string // lock file before acquiring; "" for none
+		force    bool
+		race     bool // another run overwrites the lock right after ours is written
+		wantBusy bool
+	}{
+		{name: "free"},
+		{name: "held", existing: held(10 * time.Second), wantBusy: true},
+		{name: "held, forced", existing: held(10 * time.Second), force: true},
+		{name: "stale", existing: held(runLockStale + time.Minute)},
+		{name: "unparseable", existing: "{"},
+		{name: "lost a race", race: true, wantBusy: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, client := newFakeKernel(t)
+			if tt.existing != "" {
+				fake.files[RunLockPath] = tt.existing
+			}
+			if tt.race {
+				reads := 0
+				fake.beforeRead = func(path string) {
+					if reads++; reads == 2 {
+						fake.files[RunLockPath] = held(0)
+					}
+				}
+			}
+
+			release, err := AcquireRunLock(context.Background(), client, testSessionID, tt.force)
+			if tt.wantBusy {
+				if !errors.Is(err, ErrSessionBusy) {
+					t.Fatalf("err = %v, want ErrSessionBusy", err)
+				}
+				contents, _ := fake.file(RunLockPath)
+				var lock RunLock
+				if json.Unmarshal([]byte(contents), &lock); lock.ID != "other" {
+					t.Errorf("another run's lock replaced: %s", contents)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			contents, _ := fake.file(RunLockPath)
+			var lock RunLock
+			if err := json.Unmarshal([]byte(contents), &lock); err != nil {
+				t.Fatalf("lock file %q: %v", contents, err)
+			}
+			if lock.PID != os.Getpid() || lock.ID == "" || lock.ID == "other" || lock.Stale() {
+				t.Errorf("lock = %+v, want a fresh lock held by this process", lock)
+			}
+
+			// A second run is turned away while the lock is held
+			if _, err := AcquireRunLock(context.Background(), client, testSessionID, false); !errors.Is(err, ErrSessionBusy) {
+				t.Errorf("second acquire err = %v, want ErrSessionBusy", err)
+			}
+
+			release()
+			if _, ok := fake.file(RunLockPath); ok || !slices.Contains(fake.deleted, RunLockPath) {
+				t.Error("lock not removed on release")
+			}
+		})
+	}
+}
+
+func TestRunLockTakenOver(t *testing.T) {
+	defer func(d time.Duration) { runLockRefresh = d }(runLockRefresh)
+	runLockRefresh = 10 * time.Millisecond
+
+	tests := []struct {
+		name       string
+		newRelease bool // the run that took over releases too
+	}{
+		{name: "old run releases while the new one holds it"},
+		{name: "new run releases first", newRelease: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, client := newFakeKernel(t)
+			releaseOld, err := AcquireRunLock(context.Background(), client, testSessionID, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			releaseNew, err := AcquireRunLock(context.Background(), client, testSessionID, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			contents, _ := fake.file(RunLockPath)
+			var taken RunLock
+			json.Unmarshal([]byte(contents), &taken)
+			if tt.newRelease {
+				releaseNew()
+			}
+
+			// Let the old run's refresh come round a few times
+			time.Sleep(5 * runLockRefresh)
+			releaseOld()
+
+			contents, ok := fake.file(RunLockPath)
+			if tt.newRelease {
+				if ok {
+					t.Errorf("old run recreated the lock: %s", contents)
+				}
+				return
+			}
+			var lock RunLock
+			if json.Unmarshal([]byte(contents), &lock); lock.ID != taken.ID {
+				t.Errorf("lock = %s, want the new run's lock %s kept", contents, taken.ID)
+			}
+
+			// A third run is still turned away
+			if _, err := AcquireRunLock(context.Background(), client, testSessionID, false); !errors.Is(err, ErrSessionBusy) {
+				t.Errorf("third acquire err = %v, want ErrSessionBusy", err)
+			}
+			releaseNew()
+			if _, ok := fake.file(RunLockPath); ok {
+				t.Error("new run's lock not removed on release")
+			}
+		})
+	}
+}
+
+func TestRunLockStale(t *testing.T) {
+	tests := []struct {
+		updated time.Duration // ago
+		want    bool
+	}{
+		{0, false},
+		{runLockRefresh, false},
+		{runLockStale - time.Second, false},
+		{runLockStale + time.Second, true},
+	}
+	for _, tt := range tests {
+		lock := RunLock{UpdatedAt: time.Now().Add(-tt.updated)}
+		if got := lock.Stale(); got != tt.want {
+			t.Errorf("Stale() updated %v ago = %v, want %v", tt.updated, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package browser
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/onkernel/kernel-go-sdk"
+)
+
+// ProgressEnabled controls the elapsed-time spinner shown during long setup
+// steps. It defaults to on when stdout is a terminal.
+var ProgressEnabled = isTerminal(os.Stdout)
+
+// spinnerFrames are the animation frames for the progress spinner
+var spinnerFrames = []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+
+// isTerminal reports whether f is a character device (an interactive terminal)
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// withProgress runs fn while showing a spinner with the elapsed time on the
+// current line. The line is cleared when fn returns.
+func withProgress(fn func()) {
+	if !ProgressEnabled {
+		fn()
+		return
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		start := time.Now()
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				fmt.Print("\r\033[K")
+				return
+			case <-ticker.C:
+				elapsed := int(time.Since(start).Seconds())
+				fmt.Print("\r" + dimStyle.Render(fmt.Sprintf("  %s %ds", spinnerFrames[i%len(spinnerFrames)], elapsed)))
+			}
+		}
+	}()
+
+	fn()
+	close(done)
+	<-stopped
+}
+
+// execWithProgress runs a process in the session, showing progress while it runs
+func execWithProgress(ctx context.Context, client kernel.Client, sessionID string, params kernel.BrowserProcessExecParams) (res *kernel.BrowserProcessExecResponse, err error) {
+	withProgress(func() {
+		res, err = client.Browsers.Process.Exec(ctx, sessionID, params)
+	})
+	return res, err
+}
@@ -0,0 +1,98 @@
+package browser
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/onkernel/kernel-go-sdk"
+)
+
+// sessionSlotPoll is how often a queued session creation rechecks the number
+// of live sessions
+var sessionSlotPoll = 10 * time.Second
+
+// sessionCreation lets one Setup at a time in this process check for a free
+// slot and create its session, so concurrent calls can't take the same slot
+var sessionCreation = make(chan struct{}, 1)
+
+// ErrQuotaExceeded is returned by Setup when Kernel refuses a new session
+// because the account is at its session limit
+var ErrQuotaExceeded = errors.New("session quota exceeded")
+
+// isQuotaExceeded reports whether err is Kernel refusing to create a session
+// because of the account's limits: a rate limit or payment error, or a
+// forbidden error that mentions a quota or limit
+func isQuotaExceeded(err error) bool {
+	var apiErr *kernel.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.StatusCode {
+	case http.StatusTooManyRequests, http.StatusPaymentRequired:
+		return true
+	case http.StatusForbidden:
+		msg := strings.ToLower(apiErr.Error())
+		return strings.Contains(msg, "quota") || strings.Contains(msg, "limit")
+	}
+	return false
+}
+
+// countSessions returns the number of live browser sessions on the account
+func countSessions(ctx context.Context, client kernel.Client) (int, error) {
+	iter := client.Browsers.ListAutoPaging(ctx, kernel.BrowserListParams{Limit: kernel.Opt(int64(100))})
+	n := 0
+	for iter.Next() {
+		n++
+	}
+	return n, iter.Err()
+}
+
+// acquireSessionSlot waits until fewer than max sessions are live, as
+// reported by count, and returns release, to be called once the new session
+// exists or creating it failed. Within this process, callers are let through
+// one at a time so each sees the sessions created before it. The count is the
+// account's, so runs in other processes, such as a warm pool daemon, share
+// the limit; but two processes checking at the same moment can both get the
+// last slot, so the limit should sit below the account quota.
+func acquireSessionSlot(ctx context.Context, count func(context.Context) (int, error), max int) (release func(), err error) {
+	select {
+	case sessionCreation <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	release = func() { <-sessionCreation }
+	if err := waitForSessionSlot(ctx, count, max); err != nil {
+		release()
+		return nil, err
+	}
+	return release, nil
+}
+
+// waitForSessionSlot blocks until fewer than max sessions are live, as
+// reported by count
+func waitForSessionSlot(ctx context.Context, count func(context.Context) (int, error), max int) error {
+	queued := false
+	for {
+		n, err := count(ctx)
+		if err != nil {
+			return fmt.Errorf("count sessions: %w", err)
+		}
+		if n < max {
+			if queued {
+				status(phaseSetup, dimStyle.Render("Session slot free, continuing"))
+			}
+			return nil
+		}
+		if !queued {
+			status(phaseSetup, dimStyle.Render(fmt.Sprintf("%d of %d sessions in use (-max-concurrent-sessions), waiting for one to end...", n, max)))
+			queued = true
+		}
+		if err := sleepContext(ctx, sessionSlotPoll); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package browser
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/onkernel/kernel-go-sdk"
+)
+
+// fakeSessions counts the live sessions of a fake account
+type fakeSessions struct {
+	mu      sync.Mutex
+	live    int
+	maxLive int
+}
+
+func (f *fakeSessions) count(ctx context.Context) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.live, nil
+}
+
+// create starts a session that ends after d
+func (f *fakeSessions) create(d time.Duration) {
+	f.mu.Lock()
+	f.live++
+	f.maxLive = max(f.maxLive, f.live)
+	f.mu.Unlock()
+	time.AfterFunc(d, func() {
+		f.mu.Lock()
+		f.live--
+		f.mu.Unlock()
+	})
+}
+
+func TestSessionLimitUnderLoad(t *testing.T) {
+	defer func(poll time.Duration) { sessionSlotPoll = poll }(sessionSlotPoll)
+	sessionSlotPoll = time.Millisecond
+
+	tests := []struct {
+		name     string
+		limit    int
+		creators int
+		existing int // sessions live before the run, e.g. from another process
+	}{
+		{name: "one slot", limit: 1, creators: 10},
+		{name: "several slots", limit: 3, creators: 30},
+		{name: "slots taken by other sessions", limit: 4, creators: 20, existing: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sessions := &fakeSessions{live: tt.existing, maxLive: tt.existing}
+			var wg sync.WaitGroup
+			errs := make(chan error, tt.creators)
+			for range tt.creators {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					release, err := acquireSessionSlot(context.Background(), sessions.count, tt.limit)
+					if err != nil {
+						errs <- err
+						return
+					}
+					sessions.create(5 * time.Millisecond)
+					release()
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Error(err)
+			}
+			if sessions.maxLive > tt.limit {
+				t.Errorf("%d sessions live at once, limit %d", sessions.maxLive, tt.limit)
+			}
+		})
+	}
+}
+
+func TestAcquireSessionSlotCancel(t *testing.T) {
+	defer func(poll time.Duration) { sessionSlotPoll = poll }(sessionSlotPoll)
+	sessionSlotPoll = time.Millisecond
+
+	full := func(ctx context.Context) (int, error) { return 2, nil }
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := acquireSessionSlot(ctx, full, 2); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want the context's", err)
+	}
+	// A cancelled wait gives the slot back
+	release, err := acquireSessionSlot(context.Background(), func(ctx context.Context) (int, error) { return 0, nil }, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
+
+func TestIsQuotaExceeded(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"rate limited", &kernel.Error{StatusCode: http.StatusTooManyRequests}, true},
+		{"payment required", &kernel.Error{StatusCode: http.StatusPaymentRequired}, true},
+		{"server error", &kernel.Error{StatusCode: http.StatusInternalServerError}, false},
+		{"not an API error", errors.New("quota exceeded"), false},
+		{"nil", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isQuotaExceeded(tt.err); got != tt.want {
+				t.Errorf("isQuotaExceeded(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
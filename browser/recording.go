@@ -0,0 +1,48 @@
+package browser
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/onkernel/kernel-go-sdk"
+)
+
+// ErrNoRecording is returned by RecordingURL when the session has no replay
+// recording, e.g. because none was started or the session is headless
+var ErrNoRecording = errors.New("no recording available for this session")
+
+// StartRecording starts a replay recording of the session's display and
+// returns its ID. stop ends it; the recording's URL is available from
+// RecordingURL afterwards.
+func StartRecording(ctx context.Context, client kernel.Client, sessionID string) (replayID string, stop func(), err error) {
+	replay, err := client.Browsers.Replays.Start(ctx, sessionID, kernel.BrowserReplayStartParams{})
+	if err != nil {
+		return "", nil, fmt.Errorf("start recording: %w", err)
+	}
+	return replay.ReplayID, func() {
+		// A run that timed out still needs its recording finalized to get a URL
+		client.Browsers.Replays.Stop(context.Background(), replay.ReplayID, kernel.BrowserReplayStopParams{ID: sessionID})
+	}, nil
+}
+
+// RecordingURL returns the view URL of the session's replay recording with ID
+// replayID, or ErrNoRecording if there's no such recording or it has no URL
+func RecordingURL(ctx context.Context, client kernel.Client, sessionID, replayID string) (string, error) {
+	replays, err := client.Browsers.Replays.List(ctx, sessionID)
+	if isNotFound(err) {
+		return "", ErrNoRecording
+	}
+	if err != nil {
+		return "", fmt.Errorf("list recordings: %w", err)
+	}
+	if replays == nil {
+		return "", ErrNoRecording
+	}
+	for _, r := range *replays {
+		if r.ReplayID == replayID && r.ReplayViewURL != "" {
+			return r.ReplayViewURL, nil
+		}
+	}
+	return "", ErrNoRecording
+}
@@ -0,0 +1,70 @@
+package browser
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestRecordingURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		before  []map[string]any // replays already in the session
+		viewURL string           // URL the new replay gets once stopped; "" for none
+		want    string
+		wantErr error
+	}{
+		{
+			name:    "only recording",
+			viewURL: "https://replays.onkernel.com/replay-1",
+			want:    "https://replays.onkernel.com/replay-1",
+		},
+		{
+			name: "newer recording from another run",
+			before: []map[string]any{
+				{"replay_id": "other", "replay_view_url": "https://replays.onkernel.com/other", "started_at": "2099-01-01T00:00:00Z"},
+			},
+			viewURL: "https://replays.onkernel.com/replay-2",
+			want:    "https://replays.onkernel.com/replay-2",
+		},
+		{
+			name: "ours has no URL",
+			before: []map[string]any{
+				{"replay_id": "other", "replay_view_url": "https://replays.onkernel.com/other"},
+			},
+			wantErr: ErrNoRecording,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, client := newFakeKernel(t)
+			fake.replays = tt.before
+			replayID, stop, err := StartRecording(context.Background(), client, testSessionID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stop()
+			if !slices.Equal(fake.stopped, []string{replayID}) {
+				t.Errorf("stopped %v, want %s", fake.stopped, replayID)
+			}
+			if tt.viewURL != "" {
+				fake.replays[len(fake.replays)-1]["replay_view_url"] = tt.viewURL
+			}
+
+			got, err := RecordingURL(context.Background(), client, testSessionID, replayID)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("RecordingURL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package browser
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/onkernel/kernel-go-sdk"
+
+	"playwriter-setup/agent"
+)
+
+// RelayLogPath is the file the Playwriter relay's output is written to
+const RelayLogPath = "/tmp/playwriter-relay.log"
+
+// TailRelayLogs follows the relay log in the session, calling onLine for each
+// new line until the returned stop function is called. stop kills the tail
+// process and waits for the last lines to be delivered.
+func TailRelayLogs(ctx context.Context, client kernel.Client, sessionID string, onLine func(line string)) (stop func(), err error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	// -F keeps following across log rotation and waits for the file to appear
+	spawn, err := client.Browsers.Process.Spawn(ctx, sessionID, kernel.BrowserProcessSpawnParams{
+		Command: "tail",
+		Args:    []string{"-n", "0", "-F", RelayLogPath},
+	})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		stream := client.Browsers.Process.StdoutStreamStreaming(ctx, spawn.ProcessID, kernel.BrowserProcessStdoutStreamParams{
+			ID: sessionID,
+		})
+		defer stream.Close()
+
+		var partial string
+		chunks := agent.B64Chunks{}
+		for stream.Next() {
+			event := stream.Current()
+			if event.Event == kernel.BrowserProcessStdoutStreamResponseEventExit {
+				break
+			}
+			if event.DataB64 == "" || event.Stream != kernel.BrowserProcessStdoutStreamResponseStreamStdout {
+				continue
+			}
+			lines := strings.Split(partial+chunks.Decode(string(event.Stream), event.DataB64), "\n")
+			partial = lines[len(lines)-1]
+			for _, line := range lines[:len(lines)-1] {
+				if line = strings.TrimRight(line, "\r"); line != "" {
+					onLine(line)
+				}
+			}
+		}
+		if partial = strings.TrimSpace(partial); partial != "" {
+			onLine(partial)
+		}
+	}()
+
+	return func() {
+		client.Browsers.Process.Kill(context.Background(), spawn.ProcessID, kernel.BrowserProcessKillParams{
+			ID:     sessionID,
+			Signal: kernel.BrowserProcessKillParamsSignalTerm,
+		})
+		cancel()
+		wg.Wait()
+	}, nil
+}
@@ -0,0 +1,137 @@
+package browser
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/onkernel/kernel-go-sdk"
+)
+
+// requestLogStopURL is the page StopRequestLog opens to tell the listener to
+// stop; the listener closes it again
+const requestLogStopURL = "about:blank#playwriter-request-log-stop"
+
+// requestLogLimit caps the requests kept, so a long run can't grow the
+// result without bound. Requests past it are counted as dropped.
+const requestLogLimit = 50000
+
+// requestLogCode attaches a request listener to the context and collects
+// requests until the stop page (%q) opens. A listener only lives as long as
+// the execute call that added it, so the call runs for the whole agent run.
+const requestLogCode = `
+const stopURL = %q;
+const limit = %d;
+const requests = [];
+let dropped = 0;
+const onRequest = req => {
+	if (req.url() === stopURL) return;
+	if (requests.length >= limit) { dropped++; return; }
+	let page = "";
+	try { page = req.frame().page().url(); } catch {}
+	requests.push({ ts: Date.now(), method: req.method(), url: req.url(), resource_type: req.resourceType(), page });
+};
+context.on("request", onRequest);
+try {
+	for (;;) {
+		const stop = context.pages().find(p => p.url() === stopURL);
+		if (stop) {
+			await stop.close().catch(() => {});
+			break;
+		}
+		await new Promise(r => setTimeout(r, 500));
+	}
+} finally {
+	context.off("request", onRequest);
+}
+return { requests, dropped };
+`
+
+// LoggedRequest is one outbound request the browser made during the run
+type LoggedRequest struct {
+	TS           int64  `json:"ts"` // Unix time in milliseconds
+	Method       string `json:"method"`
+	URL          string `json:"url"`
+	ResourceType string `json:"resource_type"`
+	Page         string `json:"page,omitempty"` // URL of the page that made the request
+}
+
+// RequestLog is a request listener started by StartRequestLog
+type RequestLog struct {
+	done     chan struct{}
+	requests []LoggedRequest
+	dropped  int
+	err      error
+}
+
+// StartRequestLog starts logging the browser's outbound requests, e.g. for a
+// security review of what the agent touched. The listener runs in a Playwright
+// execute call in the background for at most maxDuration; StopRequestLog ends
+// it and returns the requests. Cancelling ctx doesn't end it, so a run that
+// timed out still has its log.
+func StartRequestLog(ctx context.Context, client kernel.Client, sessionID string, maxDuration time.Duration) *RequestLog {
+	log := &RequestLog{done: make(chan struct{})}
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		defer close(log.done)
+		resp, err := client.Browsers.Playwright.Execute(ctx, sessionID, kernel.BrowserPlaywrightExecuteParams{
+			Code:       fmt.Sprintf(requestLogCode, requestLogStopURL, requestLogLimit),
+			TimeoutSec: kernel.Opt(int64(maxDuration / time.Second)),
+		})
+		if err != nil {
+			log.err = fmt.Errorf("request log: %w", err)
+			return
+		}
+		if !resp.Success {
+			log.err = fmt.Errorf("request log: %s", resp.Error)
+			return
+		}
+		// Result is decoded JSON; round-trip it into the typed form
+		data, err := json.Marshal(resp.Result)
+		if err != nil {
+			log.err = fmt.Errorf("request log: %w", err)
+			return
+		}
+		var result struct {
+			Requests []LoggedRequest `json:"requests"`
+			Dropped  int             `json:"dropped"`
+		}
+		if err := json.Unmarshal(data, &result); err != nil {
+			log.err = fmt.Errorf("request log: %w", err)
+			return
+		}
+		log.requests, log.dropped = result.Requests, result.Dropped
+	}()
+	return log
+}
+
+// StopRequestLog stops log and returns the requests it collected, and how
+// many more were dropped past its limit. It waits up to 30 seconds for the
+// listener to finish.
+func StopRequestLog(ctx context.Context, client kernel.Client, sessionID string, log *RequestLog) ([]LoggedRequest, int, error) {
+	select {
+	case <-log.done:
+		// Already ended, e.g. at its time limit
+	default:
+		resp, err := client.Browsers.Playwright.Execute(ctx, sessionID, kernel.BrowserPlaywrightExecuteParams{
+			Code:       fmt.Sprintf("const page = await context.newPage(); await page.goto(%q);", requestLogStopURL),
+			TimeoutSec: kernel.Opt(int64(30)),
+		})
+		if err != nil {
+			return nil, 0, fmt.Errorf("stop request log: %w", err)
+		}
+		if !resp.Success {
+			return nil, 0, fmt.Errorf("stop request log: %s", resp.Error)
+		}
+	}
+
+	select {
+	case <-log.done:
+	case <-time.After(30 * time.Second):
+		return nil, 0, fmt.Errorf("stop request log: listener did not finish")
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	}
+	return log.requests, log.dropped, log.err
+}
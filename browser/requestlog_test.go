@@ -0,0 +1,145 @@
+package browser
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestLogCode(t *testing.T) {
+	if _, err := exec.LookPath("node"); err != nil {
+		t.Skip("node not installed")
+	}
+	code := fmt.Sprintf(requestLogCode, requestLogStopURL, 2)
+
+	// A fake context that fires requests as soon as the listener is added,
+	// then opens the stop page
+	script := `
+	const stopURL = ` + fmt.Sprintf("%q", requestLogStopURL) + `;
+	const pages = [];
+	let listener = null;
+	let closedStop = false;
+	const request = (url, page) => ({
+		url: () => url,
+		method: () => "GET",
+		resourceType: () => "document",
+		frame: () => ({ page: () => ({ url: () => page }) }),
+	});
+	const context = {
+		pages: () => pages,
+		on: (event, fn) => {
+			listener = fn;
+			fn(request("https://example.com/", "about:blank"));
+			fn(request(stopURL, stopURL));
+			fn(request("https://example.com/app.js", "https://example.com/"));
+			fn(request("https://cdn.example.com/font.woff", "https://example.com/"));
+			pages.push({ url: () => stopURL, close: async () => { closedStop = true; } });
+		},
+		off: (event, fn) => { if (fn === listener) listener = null; },
+	};
+	(async () => {` + code + `})().then(result => console.log(JSON.stringify({ result, closedStop, removed: listener === null })));
+	`
+	out, err := exec.Command("node", "-e", script).Output()
+	if err != nil {
+		t.Fatalf("node: %v", err)
+	}
+	var res struct {
+		Result struct {
+			Requests []LoggedRequest `json:"requests"`
+			Dropped  int             `json:"dropped"`
+		}
+		ClosedStop bool
+		Removed    bool
+	}
+	if err := json.Unmarshal(out, &res); err != nil {
+		t.Fatalf("snippet output %q: %v", out, err)
+	}
+
+	var urls, pagesSeen []string
+	for _, req := range res.Result.Requests {
+		if req.TS == 0 || req.Method != "GET" || req.ResourceType != "document" {
+			t.Errorf("request %+v missing fields", req)
+		}
+		urls = append(urls, req.URL)
+		pagesSeen = append(pagesSeen, req.Page)
+	}
+	if want := []string{"https://example.com/", "https://example.com/app.js"}; !reflect.DeepEqual(urls, want) {
+		t.Errorf("logged %v, want %v (stop page skipped, limit 2)", urls, want)
+	}
+	if want := []string{"about:blank", "https://example.com/"}; !reflect.DeepEqual(pagesSeen, want) {
+		t.Errorf("pages %v, want %v", pagesSeen, want)
+	}
+	if res.Result.Dropped != 1 {
+		t.Errorf("dropped = %d, want 1", res.Result.Dropped)
+	}
+	if !res.ClosedStop || !res.Removed {
+		t.Errorf("stop page closed = %v, listener removed = %v; want both", res.ClosedStop, res.Removed)
+	}
+}
+
+func TestRequestLog(t *testing.T) {
+	tests := []struct {
+		name        string
+		result      playwrightResult
+		want        []LoggedRequest
+		wantDropped int
+		wantErr     string
+	}{
+		{
+			name: "requests returned",
+			result: playwrightResult{success: true, result: map[string]any{
+				"requests": []map[string]any{
+					{"ts": 1700000000000, "method": "GET", "url": "https://example.com/", "resource_type": "document"},
+					{"ts": 1700000000100, "method": "POST", "url": "https://example.com/api", "resource_type": "fetch", "page": "https://example.com/"},
+				},
+				"dropped": 3,
+			}},
+			want: []LoggedRequest{
+				{TS: 1700000000000, Method: "GET", URL: "https://example.com/", ResourceType: "document"},
+				{TS: 1700000000100, Method: "POST", URL: "https://example.com/api", ResourceType: "fetch", Page: "https://example.com/"},
+			},
+			wantDropped: 3,
+		},
+		{
+			name:    "listener failed",
+			result:  playwrightResult{error: "Target page, context or browser has been closed"},
+			wantErr: "request log: Target page, context or browser has been closed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, client := newFakeKernel(t)
+			fake.execute = func(code string) playwrightResult {
+				if strings.Contains(code, "context.on(") {
+					return tt.result
+				}
+				return playwrightResult{success: true}
+			}
+			log := StartRequestLog(context.Background(), client, testSessionID, time.Minute)
+			got, dropped, err := StopRequestLog(context.Background(), client, testSessionID, log)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) || dropped != tt.wantDropped {
+				t.Errorf("StopRequestLog() = %+v, %d\nwant %+v, %d", got, dropped, tt.want, tt.wantDropped)
+			}
+			// The stop call can reach the session first
+			for _, code := range fake.codes {
+				if strings.Contains(code, "context.on(") && !strings.Contains(code, fmt.Sprintf("const limit = %d;", requestLogLimit)) {
+					t.Errorf("listener code lacks the request limit:\n%s", code)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package browser
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/onkernel/kernel-go-sdk"
+
+	"playwriter-setup/agent"
+)
+
+// SetupScriptPath is where RunSetupScript writes the script in the session
+const SetupScriptPath = "/tmp/playwriter-setup-script.sh"
+
+// RunSetupScript runs script with bash in the session as the kernel user,
+// from its home directory, streaming each line of its output as it runs.
+// A non-zero exit is returned as an error.
+func RunSetupScript(ctx context.Context, client kernel.Client, sessionID, script string) error {
+	status(phaseSetupScript, headerStyle.Render("Running setup script..."))
+
+	proc := client.Browsers.Process
+
+	// Base64 keeps the script intact whatever quotes or heredoc markers it has
+	encoded := base64.StdEncoding.EncodeToString([]byte(script))
+	result, err := proc.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
+		Command: "bash",
+		Args: []string{"-c", fmt.Sprintf("echo %s | base64 -d > %s && chown kernel:kernel %s && chmod +x %s",
+			encoded, SetupScriptPath, SetupScriptPath, SetupScriptPath)},
+		AsRoot:     kernel.Opt(true),
+		TimeoutSec: kernel.Opt(int64(30)),
+	})
+	if err != nil {
+		return fmt.Errorf("write setup script: %w", err)
+	}
+	if result.ExitCode != 0 {
+		return fmt.Errorf("write setup script failed (exit %d): %s", result.ExitCode, agent.DecodeB64(result.StderrB64))
+	}
+
+	spawn, err := proc.Spawn(ctx, sessionID, kernel.BrowserProcessSpawnParams{
+		Command: "bash",
+		Args:    []string{"-c", "su - kernel -c 'bash " + SetupScriptPath + "'"},
+		AsRoot:  kernel.Opt(true),
+	})
+	if err != nil {
+		return fmt.Errorf("start setup script: %w", err)
+	}
+
+	stream := proc.StdoutStreamStreaming(ctx, spawn.ProcessID, kernel.BrowserProcessStdoutStreamParams{
+		ID: sessionID,
+	})
+	defer stream.Close()
+
+	// Lines are buffered per stream so stdout and stderr don't interleave mid-line
+	partial := make(map[kernel.BrowserProcessStdoutStreamResponseStream]string)
+	chunks := agent.B64Chunks{}
+	printLine := func(s kernel.BrowserProcessStdoutStreamResponseStream, line string) {
+		if s == kernel.BrowserProcessStdoutStreamResponseStreamStderr {
+			status(phaseSetupScript, warningStyle.Render(line))
+		} else {
+			status(phaseSetupScript, line)
+		}
+	}
+	flush := func() {
+		for s, rest := range partial {
+			if rest = strings.TrimRight(rest, "\r"); rest != "" {
+				printLine(s, rest)
+			}
+			delete(partial, s)
+		}
+	}
+
+	for stream.Next() {
+		event := stream.Current()
+		if event.Event == kernel.BrowserProcessStdoutStreamResponseEventExit {
+			flush()
+			if event.ExitCode != 0 {
+				return fmt.Errorf("setup script failed (exit %d)", event.ExitCode)
+			}
+			status(phaseSetupScript, successStyle.Render("Setup script finished"))
+			return nil
+		}
+		if event.DataB64 == "" {
+			continue
+		}
+		lines := strings.Split(partial[event.Stream]+chunks.Decode(string(event.Stream), event.DataB64), "\n")
+		partial[event.Stream] = lines[len(lines)-1]
+		for _, line := range lines[:len(lines)-1] {
+			printLine(event.Stream, strings.TrimRight(line, "\r"))
+		}
+	}
+	flush()
+	if err := stream.Err(); err != nil {
+		return fmt.Errorf("setup script output: %w", err)
+	}
+	return fmt.Errorf("setup script output ended before it exited")
+}
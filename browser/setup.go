@@ -5,36 +5,92 @@ package browser
 import (
 	"bytes"
 	"context"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/charmbracelet/lipgloss"
 	"github.com/onkernel/kernel-go-sdk"
 	"github.com/onkernel/kernel-go-sdk/shared"
+
+	"playwriter-setup/agent"
 )
 
 const (
 	// PlaywriterExtensionID is Chrome's internal ID for the Playwriter extension.
 	// This ID is derived from the extension's public key in manifest.json and is
 	// consistent across all users who upload the same extension to Kernel.
-	// (Note: This differs from the Chrome Web Store listing ID which is jfeammnjpkecdekppnclgkkffahnhfhe)
+	// (Note: This differs from the Chrome Web Store listing ID, PlaywriterWebStoreID)
+	// It is used as a fallback when ResolveExtensionID can't discover the ID at runtime.
 	PlaywriterExtensionID = "hnenofdplkoaanpegekhdmbpckgdecba"
 
 	// PreferencesPath is the Chrome preferences file in Kernel
 	PreferencesPath = "/home/kernel/user-data/Default/Preferences"
 
+	// StartURL is the page the browser is navigated to after setup
+	StartURL = "https://duckduckgo.com"
+
+	// BlankURL is used when navigation is skipped or the start page fails to load
+	BlankURL = "about:blank"
+
+	// RelayURL is where the Playwriter relay listens inside the session
+	RelayURL = "http://127.0.0.1:19988"
+
 	// KernelHome is the home directory for the kernel user
 	KernelHome = "/home/kernel"
 
+	// DefaultPlaywriterRepo is the git repository playwriter is built from
+	DefaultPlaywriterRepo = "https://github.com/remorses/playwriter.git"
+
+	// DefaultPlaywriterPatchFile is the relay source file, relative to the
+	// repository root, whose extension allowlist is patched
+	DefaultPlaywriterPatchFile = "playwriter/src/cdp-relay.ts"
+
+	// How many times to look for a missing Preferences file before creating one
+	preferencesWaitAttempts = 5
+
+	// How often the extension icon is clicked
+	activationAttempts = 3
+
+	// How many times Chrome is checked after a restart
+	chromeStartAttempts = 5
+
 	// Extension icon position in toolbar (1920x1080 resolution)
 	// This is where the pinned Playwriter extension appears
 	ExtensionIconX = 1775
 	ExtensionIconY = 55
 )
 
+// How long Chrome is given to exit after a stop and to come up after a start,
+// and the delay between checks that it's running
+var (
+	chromeStopWait      = 2 * time.Second
+	chromeStartWait     = 5 * time.Second
+	chromeStartInterval = 2 * time.Second
+)
+
+// preferencesWaitInterval is how long to wait for Chrome to write a missing
+// Preferences file between reads
+var preferencesWaitInterval = 1 * time.Second
+
+// How long each activation is given to connect the extension to the relay,
+// and how often the connection is checked meanwhile
+var (
+	activationWait         = 6 * time.Second
+	activationPollInterval = 1 * time.Second
+)
+
+// CheckTimeout bounds each relay and connection check. A parent context's
+// deadline shortens it further.
+var CheckTimeout = 5 * time.Second
+
 // Output styles
 var (
 	headerStyle  = lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("12"))
@@ -43,106 +99,412 @@ var (
 	dimStyle     = lipgloss.NewStyle().Foreground(lipgloss.Color("8"))
 )
 
-// decodeB64 decodes a base64 string
-func decodeB64(s string) string {
-	decoded, _ := base64.StdEncoding.DecodeString(s)
-	return string(decoded)
+// UsePlainStyles drops all styling from this package's output, for terminals
+// without color support
+func UsePlainStyles() {
+	headerStyle = lipgloss.NewStyle()
+	successStyle = lipgloss.NewStyle()
+	warningStyle = lipgloss.NewStyle()
+	dimStyle = lipgloss.NewStyle()
+}
+
+// Phases that prefix progress output, e.g. "[setup] Creating browser session..."
+const (
+	phaseSetup       = "setup"
+	phaseInstall     = "install"
+	phaseRelay       = "relay"
+	phaseActivate    = "activate"
+	phaseSetupScript = "setup-script"
+	phaseUpload      = "upload"
+	phaseHosts       = "hosts"
+)
+
+// status prints a progress line prefixed with its phase
+func status(phase, line string) {
+	fmt.Println(dimStyle.Render("["+phase+"] ") + line)
 }
 
 // SetupOptions contains options for browser setup
 type SetupOptions struct {
-	TimeoutSeconds int64
-	ShowReuseHint  bool
+	TimeoutSeconds     int64
+	ShowReuseHint      bool
+	MCPRuntime         string   // Runtime the agent's MCP config launches playwriter with: "node", "bun", or an absolute path
+	MCPServerName      string   // Name of the playwriter server in the agent's MCP config (default: "playwriter")
+	Extension          string   // Name of the uploaded Kernel extension to load (default: "playwriter")
+	CloseExistingTabs  bool     // Close all tabs but the first; otherwise keep tabs and open StartURL if missing
+	ExtraExtensions    []string // Additional uploaded Kernel extensions to load alongside playwriter
+	PinExtraExtensions bool     // Also pin ExtraExtensions to the toolbar
+	StartURL           string   // Page to open after setup; "none" for a blank page (default: StartURL)
+	Headless           bool     // Create a headless browser: no live view, activated via ActivatePlaywriterHeadless
+	PlaywriterRepo     string   // Git repository to build playwriter from (default: DefaultPlaywriterRepo)
+	PlaywriterPatch    string   // Allowlist file to patch, relative to the repo root (default: DefaultPlaywriterPatchFile)
+	ExternalRelay      string   // Endpoint of a relay run outside the session; if set, playwriter isn't built and no relay is started
+	MaxSessions        int      // If set, wait until fewer than this many sessions are live on the account before creating one
+
+	// OnStep, if set, is called with the duration of each step of Setup and
+	// InstallPlaywriterFromSource as it completes
+	OnStep func(name string, d time.Duration)
+}
+
+// step reports the step that started at start to OnStep
+func (o SetupOptions) step(name string, start time.Time) {
+	if o.OnStep != nil {
+		o.OnStep(name, time.Since(start))
+	}
 }
 
 // SetupResult contains the result of browser setup
 type SetupResult struct {
 	SessionID   string
 	LiveViewURL string
+	ExtensionID string // Internal Chrome ID of the loaded extension
 }
 
 // Setup creates and configures a new browser session with the Playwriter extension.
 func Setup(ctx context.Context, client kernel.Client, opts SetupOptions) (*SetupResult, error) {
-	fmt.Println(headerStyle.Render("Creating browser session..."))
+	status(phaseSetup, headerStyle.Render("Creating browser session..."))
 
+	extension := playwriterExtensionName(opts)
+
+	start := time.Now()
+	release := func() {}
+	if opts.MaxSessions > 0 {
+		count := func(ctx context.Context) (int, error) { return countSessions(ctx, client) }
+		var err error
+		if release, err = acquireSessionSlot(ctx, count, opts.MaxSessions); err != nil {
+			return nil, err
+		}
+	}
 	browser, err := client.Browsers.New(ctx, kernel.BrowserNewParams{
-		Headless:       kernel.Opt(false),
+		Headless:       kernel.Opt(opts.Headless),
 		TimeoutSeconds: kernel.Opt(opts.TimeoutSeconds),
-		Extensions:     []shared.BrowserExtensionParam{{Name: kernel.Opt("playwriter")}},
+		Extensions:     extensionParams(opts),
 	})
+	// The new session now counts against the limit for the next caller
+	release()
+	if isQuotaExceeded(err) {
+		return nil, fmt.Errorf("create browser: %w: end unused sessions (-list-sessions), or set -max-concurrent-sessions below the account's limit to queue instead (%v)", ErrQuotaExceeded, err)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("create browser: %w", err)
 	}
+	opts.step("create", start)
 
 	result := &SetupResult{
 		SessionID:   browser.SessionID,
 		LiveViewURL: browser.BrowserLiveViewURL,
 	}
 
-	fmt.Println(successStyle.Render("Browser created: ") + result.SessionID)
-	fmt.Println(dimStyle.Render("Live view: ") + result.LiveViewURL)
+	status(phaseSetup, successStyle.Render("Browser created: ")+result.SessionID)
+	if result.LiveViewURL != "" {
+		status(phaseSetup, dimStyle.Render("Live view: ")+result.LiveViewURL)
+	}
 	if opts.ShowReuseHint {
-		fmt.Println(dimStyle.Render("Reuse: ") + "playwriter-in-kernel -s " + result.SessionID + " -p \"...\"")
+		status(phaseSetup, dimStyle.Render("Reuse: ")+"playwriter-in-kernel -s "+result.SessionID+" -p \"...\"")
+	}
+
+	// Resolve the extension's internal ID while Chrome's preferences are current
+	start = time.Now()
+	result.ExtensionID = ResolveExtensionID(ctx, client, result.SessionID, extension, PlaywriterWebStoreID)
+	opts.step("resolve_extension", start)
+	status(phaseSetup, dimStyle.Render("Extension ID: ")+result.ExtensionID)
+
+	// Pinning only matters for clicking the toolbar icon, which headless
+	// sessions don't have
+	if !opts.Headless {
+		if err := pinToolbar(ctx, client, result.SessionID, result.ExtensionID, opts); err != nil {
+			return result, err
+		}
 	}
 
+	// Navigate to a clean page, optionally keeping existing tabs
+	status(phaseSetup, headerStyle.Render("Setting up browser..."))
+	start = time.Now()
+	openStartPage(ctx, client, result.SessionID, opts)
+	time.Sleep(2 * time.Second)
+	opts.step("navigate", start)
+
+	return result, nil
+}
+
+// pinToolbar pins playwriter, and ExtraExtensions if PinExtraExtensions is
+// set, to the toolbar. Chrome is stopped while its preferences are edited.
+// If Chrome doesn't come back up with the new Preferences, the original file is
+// restored and Chrome is started once more.
+func pinToolbar(ctx context.Context, client kernel.Client, sessionID, extensionID string, opts SetupOptions) error {
+	// Pin extra extensions before playwriter so playwriter keeps the rightmost
+	// toolbar slot that ActivatePlaywriter clicks
+	var pinIDs []string
+	if opts.PinExtraExtensions {
+		for _, name := range opts.ExtraExtensions {
+			if id, ok := FindExtensionID(ctx, client, sessionID, name); ok {
+				pinIDs = append(pinIDs, id)
+			} else {
+				status(phaseSetup, warningStyle.Render("Warning: Could not find extension ID for "+name+", not pinning it"))
+			}
+		}
+	}
+	pinIDs = append(pinIDs, extensionID)
+
 	// Pin extension (requires stopping Chrome temporarily)
-	fmt.Println(headerStyle.Render("Pinning Playwriter extension..."))
-	proc := client.Browsers.Process
+	status(phaseSetup, headerStyle.Render("Pinning Playwriter extension..."))
+	start := time.Now()
+	stopChrome(ctx, client, sessionID)
+
+	original, err := pinExtensions(ctx, client, sessionID, pinIDs)
+	pinned := err == nil
+	if !pinned {
+		status(phaseSetup, warningStyle.Render("Warning: Failed to pin extension: "+err.Error()))
+	}
+	opts.step("pin", start)
 
-	proc.Exec(ctx, result.SessionID, kernel.BrowserProcessExecParams{
+	start = time.Now()
+	defer opts.step("restart", start)
+	err = startChrome(ctx, client, sessionID)
+	if err == nil {
+		return nil
+	}
+
+	// Chrome may crash-loop on the modified Preferences; put the original back
+	status(phaseSetup, warningStyle.Render("Warning: Chrome did not restart after pinning ("+err.Error()+"), retrying"))
+	stopChrome(ctx, client, sessionID)
+	if pinned {
+		status(phaseSetup, dimStyle.Render("Restoring original Preferences..."))
+		if err := restorePreferences(ctx, client, sessionID, original); err != nil {
+			return fmt.Errorf("restore preferences: %w", err)
+		}
+	}
+	if err := startChrome(ctx, client, sessionID); err != nil {
+		return fmt.Errorf("chrome failed to restart after pinning: %w", err)
+	}
+	return nil
+}
+
+// stopChrome stops Chrome so its Preferences file can be edited
+func stopChrome(ctx context.Context, client kernel.Client, sessionID string) {
+	client.Browsers.Process.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
 		Command: "supervisorctl", Args: []string{"stop", "chromium"},
 		AsRoot: kernel.Opt(true), TimeoutSec: kernel.Opt(int64(30)),
 	})
-	time.Sleep(2 * time.Second)
-
-	if err := pinExtension(ctx, client, result.SessionID, PlaywriterExtensionID); err != nil {
-		fmt.Println(warningStyle.Render("Warning: Failed to pin extension: " + err.Error()))
-	}
+	time.Sleep(chromeStopWait)
+}
 
-	proc.Exec(ctx, result.SessionID, kernel.BrowserProcessExecParams{
+// startChrome hands the Preferences file back to the kernel user, starts
+// Chrome, and waits for it to come up
+func startChrome(ctx context.Context, client kernel.Client, sessionID string) error {
+	proc := client.Browsers.Process
+	proc.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
 		Command: "chown", Args: []string{"kernel:kernel", PreferencesPath},
 		AsRoot: kernel.Opt(true), TimeoutSec: kernel.Opt(int64(10)),
 	})
 
-	proc.Spawn(ctx, result.SessionID, kernel.BrowserProcessSpawnParams{
+	proc.Spawn(ctx, sessionID, kernel.BrowserProcessSpawnParams{
 		Command: "supervisorctl", Args: []string{"start", "chromium"},
 		AsRoot: kernel.Opt(true),
 	})
-	time.Sleep(5 * time.Second)
-
-	// Navigate to a clean page
-	fmt.Println(headerStyle.Render("Setting up browser..."))
-	client.Browsers.Playwright.Execute(ctx, result.SessionID, kernel.BrowserPlaywrightExecuteParams{
-		Code: `
-			const pages = context.pages();
-			for (let i = 1; i < pages.length; i++) await pages[i].close();
-			if (pages.length > 0) await pages[0].goto('https://duckduckgo.com');
-		`,
-		TimeoutSec: kernel.Opt(int64(30)),
+	time.Sleep(chromeStartWait)
+
+	var err error
+	for attempt := 1; attempt <= chromeStartAttempts; attempt++ {
+		if err = checkChrome(ctx, client, sessionID); err == nil {
+			return nil
+		}
+		time.Sleep(chromeStartInterval)
+	}
+	return err
+}
+
+// checkChrome verifies that supervisor reports Chrome as running and that
+// Playwright can reach its pages
+func checkChrome(ctx context.Context, client kernel.Client, sessionID string) error {
+	result, err := client.Browsers.Process.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
+		Command: "supervisorctl", Args: []string{"status", "chromium"},
+		AsRoot: kernel.Opt(true), TimeoutSec: kernel.Opt(int64(10)),
 	})
-	time.Sleep(2 * time.Second)
+	if err != nil {
+		return fmt.Errorf("supervisor status: %w", err)
+	}
+	if out := strings.TrimSpace(agent.DecodeB64(result.StdoutB64)); !strings.Contains(out, "RUNNING") {
+		return fmt.Errorf("chromium is not running: %s", out)
+	}
 
-	return result, nil
+	resp, err := client.Browsers.Playwright.Execute(ctx, sessionID, kernel.BrowserPlaywrightExecuteParams{
+		Code:       "return context.pages().length;",
+		TimeoutSec: kernel.Opt(int64(10)),
+	})
+	if err != nil {
+		return fmt.Errorf("page probe: %w", err)
+	}
+	if !resp.Success {
+		return fmt.Errorf("page probe: %s", resp.Error)
+	}
+	return nil
 }
 
-// pinExtension adds an extension to Chrome's pinned toolbar extensions
-func pinExtension(ctx context.Context, client kernel.Client, sessionID, extensionID string) error {
-	resp, err := client.Browsers.Fs.ReadFile(ctx, sessionID, kernel.BrowserFReadFileParams{
+// CheckBrowser reports whether the session's browser is still up: Chrome
+// running under supervisor and its pages reachable through Playwright. It's
+// cheap enough to call periodically during a run.
+func CheckBrowser(ctx context.Context, client kernel.Client, sessionID string) error {
+	return checkChrome(ctx, client, sessionID)
+}
+
+// restorePreferences writes back the Preferences file read before pinning,
+// or removes the file if there was none
+func restorePreferences(ctx context.Context, client kernel.Client, sessionID string, original []byte) error {
+	if original == nil {
+		err := client.Browsers.Fs.DeleteFile(ctx, sessionID, kernel.BrowserFDeleteFileParams{Path: PreferencesPath})
+		if isNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	return client.Browsers.Fs.WriteFile(ctx, sessionID, bytes.NewReader(original), kernel.BrowserFWriteFileParams{
 		Path: PreferencesPath,
 	})
-	if err != nil {
-		return fmt.Errorf("read preferences: %w", err)
+}
+
+// startURL returns the URL to open after setup. "none" skips navigation and
+// leaves a blank page.
+func startURL(opts SetupOptions) string {
+	switch opts.StartURL {
+	case "":
+		return StartURL
+	case "none":
+		return BlankURL
+	default:
+		return opts.StartURL
+	}
+}
+
+// openStartPage opens the start page for opts. Navigation failures (e.g. the
+// network is blocked) are only warned about, falling back to a blank page.
+func openStartPage(ctx context.Context, client kernel.Client, sessionID string, opts SetupOptions) {
+	if err := prepareTabs(ctx, client, sessionID, startURL(opts), opts.CloseExistingTabs); err != nil {
+		// Don't leave the browser on a half-loaded page if navigation is blocked
+		status(phaseSetup, warningStyle.Render("Warning: Failed to open start page: "+err.Error()))
+		if err := prepareTabs(ctx, client, sessionID, BlankURL, opts.CloseExistingTabs); err != nil {
+			status(phaseSetup, warningStyle.Render("Warning: Failed to open blank page: "+err.Error()))
+		}
+	}
+}
+
+// prepareTabs opens url in the first tab, closing the others if closeOthers is
+// set; otherwise it keeps existing tabs and opens url in a new tab if no tab
+// is already on it
+func prepareTabs(ctx context.Context, client kernel.Client, sessionID, url string, closeOthers bool) error {
+	target, _ := json.Marshal(url)
+	code := `
+		const target = ` + string(target) + `;
+		let pages = context.pages();
+		for (let i = 1; i < pages.length; i++) await pages[i].close();
+		if (pages.length === 0) pages = [await context.newPage()];
+		await pages[0].goto(target);
+	`
+	if !closeOthers {
+		code = `
+		const target = ` + string(target) + `;
+		const pages = context.pages();
+		if (!pages.some(p => p.url().startsWith(target))) {
+			const page = await context.newPage();
+			await page.goto(target);
+		}
+	`
 	}
-	defer resp.Body.Close()
 
-	prefsData, err := io.ReadAll(resp.Body)
+	resp, err := client.Browsers.Playwright.Execute(ctx, sessionID, kernel.BrowserPlaywrightExecuteParams{
+		Code:       code,
+		TimeoutSec: kernel.Opt(int64(30)),
+	})
 	if err != nil {
-		return fmt.Errorf("read body: %w", err)
+		return err
+	}
+	if !resp.Success {
+		return fmt.Errorf("%s", resp.Error)
+	}
+	return nil
+}
+
+// shellQuote single-quotes s for use as one bash word
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "'\"'\"'") + "'"
+}
+
+// isNotFound reports whether err is a Kernel API 404 response
+func isNotFound(err error) bool {
+	var apiErr *kernel.Error
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// readPreferences reads and parses Chrome's Preferences file, also returning
+// the raw contents. If the file does not exist yet (e.g. first boot), it waits
+// briefly for Chrome to create it and then falls back to an empty preferences
+// map and nil contents.
+func readPreferences(ctx context.Context, client kernel.Client, sessionID string) (map[string]any, []byte, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := client.Browsers.Fs.ReadFile(ctx, sessionID, kernel.BrowserFReadFileParams{
+			Path: PreferencesPath,
+		})
+		if err != nil {
+			if !isNotFound(err) {
+				return nil, nil, fmt.Errorf("read preferences: %w", err)
+			}
+			if attempt >= preferencesWaitAttempts {
+				status(phaseSetup, dimStyle.Render("Preferences not found, creating a new one"))
+				return make(map[string]any), nil, nil
+			}
+			time.Sleep(preferencesWaitInterval)
+			continue
+		}
+
+		prefsData, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("read body: %w", err)
+		}
+
+		var prefs map[string]any
+		if err := json.Unmarshal(prefsData, &prefs); err != nil {
+			return nil, nil, fmt.Errorf("parse preferences: %w", err)
+		}
+		if prefs == nil {
+			prefs = make(map[string]any)
+		}
+		return prefs, prefsData, nil
+	}
+}
+
+// playwriterExtensionName returns the Kernel extension name used for playwriter
+func playwriterExtensionName(opts SetupOptions) string {
+	if opts.Extension != "" {
+		return opts.Extension
 	}
+	return "playwriter"
+}
+
+// extensionParams builds the list of extensions to load: playwriter first,
+// followed by any extra extensions (duplicates are skipped)
+func extensionParams(opts SetupOptions) []shared.BrowserExtensionParam {
+	names := []string{playwriterExtensionName(opts)}
+	for _, name := range opts.ExtraExtensions {
+		if name != "" && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+
+	params := make([]shared.BrowserExtensionParam, 0, len(names))
+	for _, name := range names {
+		params = append(params, shared.BrowserExtensionParam{Name: kernel.Opt(name)})
+	}
+	return params
+}
 
-	var prefs map[string]any
-	if err := json.Unmarshal(prefsData, &prefs); err != nil {
-		return fmt.Errorf("parse preferences: %w", err)
+// pinExtensions adds extensions to Chrome's pinned toolbar extensions. The
+// given IDs end up last, in order, so the last ID occupies the rightmost slot.
+// Returns the original Preferences contents, nil if the file didn't exist.
+func pinExtensions(ctx context.Context, client kernel.Client, sessionID string, extensionIDs []string) ([]byte, error) {
+	prefs, original, err := readPreferences(ctx, client, sessionID)
+	if err != nil {
+		return nil, err
 	}
 
 	extensions, _ := prefs["extensions"].(map[string]any)
@@ -154,40 +516,53 @@ func pinExtension(ctx context.Context, client kernel.Client, sessionID, extensio
 	var pinned []string
 	if existing, ok := extensions["pinned_extensions"].([]any); ok {
 		for _, id := range existing {
-			if s, ok := id.(string); ok {
-				if s == extensionID {
-					return nil // Already pinned
-				}
+			if s, ok := id.(string); ok && !slices.Contains(extensionIDs, s) {
 				pinned = append(pinned, s)
 			}
 		}
 	}
 
-	pinned = append(pinned, extensionID)
+	pinned = append(pinned, extensionIDs...)
 	extensions["pinned_extensions"] = pinned
 
+	// Make sure the profile directory exists in case Chrome hasn't created it yet
+	client.Browsers.Fs.NewDirectory(ctx, sessionID, kernel.BrowserFNewDirectoryParams{
+		Path: path.Dir(PreferencesPath),
+	})
+
 	newPrefs, _ := json.Marshal(prefs)
-	return client.Browsers.Fs.WriteFile(ctx, sessionID, bytes.NewReader(newPrefs), kernel.BrowserFWriteFileParams{
+	return original, client.Browsers.Fs.WriteFile(ctx, sessionID, bytes.NewReader(newPrefs), kernel.BrowserFWriteFileParams{
 		Path: PreferencesPath,
 	})
 }
 
-// InstallPlaywriterFromSource clones the playwriter repo, patches the extension ID
-// allowlist to include the Kernel extension, builds it, and creates a launch script.
-// This is needed because the npm package is outdated.
-func InstallPlaywriterFromSource(ctx context.Context, client kernel.Client, sessionID string) error {
-	fmt.Println(headerStyle.Render("Installing Playwriter from source..."))
+// InstallPlaywriterFromSource clones the playwriter repo (opts.PlaywriterRepo),
+// patches the extension ID allowlist to include the given extension ID, builds
+// it, and creates a launch script. This is needed because the npm package is
+// outdated.
+func InstallPlaywriterFromSource(ctx context.Context, client kernel.Client, sessionID, extensionID string, opts SetupOptions) error {
+	status(phaseInstall, headerStyle.Render("Installing Playwriter from source..."))
 
 	proc := client.Browsers.Process
 
-	// Clone the playwriter repo
-	fmt.Println(dimStyle.Render("Cloning repository..."))
-	result, err := proc.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
+	repo := opts.PlaywriterRepo
+	if repo == "" {
+		repo = DefaultPlaywriterRepo
+	}
+	patchFile := opts.PlaywriterPatch
+	if patchFile == "" {
+		patchFile = DefaultPlaywriterPatchFile
+	}
+
+	// Clone the playwriter repo into a fixed directory, whatever a fork is named
+	status(phaseInstall, dimStyle.Render("Cloning "+repo+"..."))
+	start := time.Now()
+	result, err := execWithProgress(ctx, client, sessionID, kernel.BrowserProcessExecParams{
 		Command: "bash",
 		Args: []string{"-c", `
 cd /home/kernel
 rm -rf playwriter 2>/dev/null
-git clone --depth 1 https://github.com/remorses/playwriter.git
+git clone --depth 1 ` + shellQuote(repo) + ` playwriter
 `},
 		TimeoutSec: kernel.Opt(int64(120)),
 	})
@@ -195,19 +570,28 @@ git clone --depth 1 https://github.com/remorses/playwriter.git
 		return fmt.Errorf("clone: %w", err)
 	}
 	if result.ExitCode != 0 {
-		return fmt.Errorf("clone failed (exit %d): %s", result.ExitCode, decodeB64(result.StderrB64))
+		return fmt.Errorf("clone failed (exit %d): %s", result.ExitCode, agent.DecodeB64(result.StderrB64))
 	}
+	opts.step("clone", start)
 
 	// Add the Kernel extension ID to the allowed list.
 	// The relay has a hardcoded list of allowed extension IDs, but our Kernel extension
-	// ID (hnenofdplkoaanpegekhdmbpckgdecba) isn't in that list.
-	fmt.Println(dimStyle.Render("Patching extension allowlist..."))
+	// ID isn't in that list. A fork may keep the list elsewhere, so fail if
+	// the file or the anchor ID is missing rather than building unpatched.
+	status(phaseInstall, dimStyle.Render("Patching extension allowlist..."))
+	start = time.Now()
+	// The ID goes into the sed script as-is, so only a well-formed one is used
+	if !extensionIDPattern.MatchString(extensionID) {
+		extensionID = PlaywriterExtensionID
+	}
 	result, err = proc.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
 		Command: "bash",
 		Args: []string{"-c", `
-cd /home/kernel/playwriter/playwriter
+cd /home/kernel/playwriter
+file=` + shellQuote(patchFile) + `
+grep -q elnnakgjclnapgflmidlpobefkdmapdm "$file" || { echo "allowlist not found in $file" >&2; exit 1; }
 # Add Kernel extension ID to the allowed list
-sed -i "/elnnakgjclnapgflmidlpobefkdmapdm/a\\    '` + PlaywriterExtensionID + `', // Kernel extension" src/cdp-relay.ts
+sed -i "/elnnakgjclnapgflmidlpobefkdmapdm/a\\    '` + extensionID + `', // Kernel extension" "$file"
 `},
 		TimeoutSec: kernel.Opt(int64(30)),
 	})
@@ -215,20 +599,23 @@ sed -i "/elnnakgjclnapgflmidlpobefkdmapdm/a\\    '` + PlaywriterExtensionID + `'
 		return fmt.Errorf("patch: %w", err)
 	}
 	if result.ExitCode != 0 {
-		return fmt.Errorf("patch failed (exit %d): %s", result.ExitCode, decodeB64(result.StderrB64))
+		return fmt.Errorf("patch failed (exit %d): %s", result.ExitCode, agent.DecodeB64(result.StderrB64))
 	}
+	opts.step("patch", start)
 
 	// Install pnpm
-	fmt.Println(dimStyle.Render("Installing pnpm..."))
+	status(phaseInstall, dimStyle.Render("Installing pnpm..."))
+	start = time.Now()
+	// The lock keeps this from racing an agent's own global npm install
 	proc.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
 		Command:    "bash",
-		Args:       []string{"-c", "npm install -g pnpm 2>/dev/null || true"},
+		Args:       []string{"-c", "flock /tmp/npm-global.lock npm install -g pnpm 2>/dev/null || true"},
 		TimeoutSec: kernel.Opt(int64(60)),
 	})
 
 	// Install bun
-	fmt.Println(dimStyle.Render("Installing bun..."))
-	result, err = proc.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
+	status(phaseInstall, dimStyle.Render("Installing bun..."))
+	result, err = execWithProgress(ctx, client, sessionID, kernel.BrowserProcessExecParams{
 		Command:    "bash",
 		Args:       []string{"-c", "export HOME=/home/kernel && curl -fsSL https://bun.sh/install | bash"},
 		TimeoutSec: kernel.Opt(int64(120)),
@@ -237,12 +624,14 @@ sed -i "/elnnakgjclnapgflmidlpobefkdmapdm/a\\    '` + PlaywriterExtensionID + `'
 		return fmt.Errorf("bun install: %w", err)
 	}
 	if result.ExitCode != 0 {
-		return fmt.Errorf("bun install failed (exit %d): %s", result.ExitCode, decodeB64(result.StderrB64))
+		return fmt.Errorf("bun install failed (exit %d): %s", result.ExitCode, agent.DecodeB64(result.StderrB64))
 	}
+	opts.step("tools", start)
 
 	// Install dependencies
-	fmt.Println(dimStyle.Render("Installing dependencies..."))
-	result, err = proc.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
+	status(phaseInstall, dimStyle.Render("Installing dependencies..."))
+	start = time.Now()
+	result, err = execWithProgress(ctx, client, sessionID, kernel.BrowserProcessExecParams{
 		Command:    "bash",
 		Args:       []string{"-c", "cd /home/kernel/playwriter && pnpm install --ignore-scripts"},
 		TimeoutSec: kernel.Opt(int64(180)),
@@ -251,12 +640,14 @@ sed -i "/elnnakgjclnapgflmidlpobefkdmapdm/a\\    '` + PlaywriterExtensionID + `'
 		return fmt.Errorf("pnpm install: %w", err)
 	}
 	if result.ExitCode != 0 {
-		return fmt.Errorf("pnpm install failed (exit %d): %s", result.ExitCode, decodeB64(result.StderrB64))
+		return fmt.Errorf("pnpm install failed (exit %d): %s", result.ExitCode, agent.DecodeB64(result.StderrB64))
 	}
+	opts.step("deps", start)
 
 	// Build playwriter
-	fmt.Println(dimStyle.Render("Building..."))
-	result, err = proc.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
+	status(phaseInstall, dimStyle.Render("Building..."))
+	start = time.Now()
+	result, err = execWithProgress(ctx, client, sessionID, kernel.BrowserProcessExecParams{
 		Command:    "bash",
 		Args:       []string{"-c", "export PATH=\"/home/kernel/.bun/bin:$PATH\" && cd /home/kernel/playwriter/playwriter && pnpm run build"},
 		TimeoutSec: kernel.Opt(int64(120)),
@@ -265,8 +656,9 @@ sed -i "/elnnakgjclnapgflmidlpobefkdmapdm/a\\    '` + PlaywriterExtensionID + `'
 		return fmt.Errorf("build: %w", err)
 	}
 	if result.ExitCode != 0 {
-		return fmt.Errorf("build failed (exit %d): %s", result.ExitCode, decodeB64(result.StderrB64))
+		return fmt.Errorf("build failed (exit %d): %s", result.ExitCode, agent.DecodeB64(result.StderrB64))
 	}
+	opts.step("build", start)
 
 	// Create launch script
 	proc.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
@@ -285,68 +677,182 @@ chown -R kernel:kernel /home/kernel/playwriter
 		TimeoutSec: kernel.Opt(int64(30)),
 	})
 
-	fmt.Println(successStyle.Render("Playwriter installed"))
+	status(phaseInstall, successStyle.Render("Playwriter installed"))
 	return nil
 }
 
 // StartPlaywriterRelay starts the playwriter relay server in the background.
+// Each check is bounded by CheckTimeout and by ctx's deadline.
 func StartPlaywriterRelay(ctx context.Context, client kernel.Client, sessionID string) error {
-	fmt.Println(headerStyle.Render("Starting Playwriter relay..."))
+	status(phaseRelay, headerStyle.Render("Starting Playwriter relay..."))
 
 	proc := client.Browsers.Process
 
 	// Kill any existing relay
-	proc.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
+	killCtx, cancel := checkContext(ctx)
+	proc.Exec(killCtx, sessionID, kernel.BrowserProcessExecParams{
 		Command:    "bash",
 		Args:       []string{"-c", "pkill -f 'start-relay-server' 2>/dev/null || true"},
-		TimeoutSec: kernel.Opt(int64(5)),
+		TimeoutSec: kernel.Opt(checkTimeoutSec(killCtx)),
 	})
-	time.Sleep(1 * time.Second)
+	cancel()
+	if err := sleepContext(ctx, 1*time.Second); err != nil {
+		return err
+	}
 
 	// Start the relay
 	proc.Spawn(ctx, sessionID, kernel.BrowserProcessSpawnParams{
 		Command: "bash",
-		Args:    []string{"-c", "su - kernel -c '/home/kernel/start-playwriter-relay.sh' &"},
+		Args:    []string{"-c", "su - kernel -c '/home/kernel/start-playwriter-relay.sh >> " + RelayLogPath + " 2>&1' &"},
 	})
 
 	// Wait for relay to start
-	time.Sleep(3 * time.Second)
+	if err := sleepContext(ctx, 3*time.Second); err != nil {
+		return err
+	}
 
 	// Verify it's running
-	result, _ := proc.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
-		Command:    "bash",
-		Args:       []string{"-c", "curl -s http://127.0.0.1:19988/version || echo 'not running'"},
-		TimeoutSec: kernel.Opt(int64(5)),
-	})
-	stdout := decodeB64(result.StdoutB64)
-	if result.ExitCode != 0 || stdout == "not running" {
-		return fmt.Errorf("relay failed to start")
+	version, err := RelayVersion(ctx, client, sessionID)
+	if err != nil {
+		return err
 	}
 
-	fmt.Println(successStyle.Render("Relay started: " + stdout))
+	status(phaseRelay, successStyle.Render("Relay started: "+version))
 	return nil
 }
 
-// ActivatePlaywriter clicks on the Playwriter extension icon to activate it
+// RelayVersion asks the running relay for its version. The check is bounded
+// by CheckTimeout and by ctx's deadline.
+func RelayVersion(ctx context.Context, client kernel.Client, sessionID string) (string, error) {
+	version, ok, err := relayVersion(ctx, client, sessionID, RelayURL)
+	if err == nil && !ok {
+		err = fmt.Errorf("relay failed to start")
+	}
+	return version, err
+}
+
+// ExternalRelayVersion asks a relay run outside the session, at endpoint,
+// for its version. It's checked from inside the session, where the MCP
+// server connects from. The check is bounded by CheckTimeout and by ctx's
+// deadline.
+func ExternalRelayVersion(ctx context.Context, client kernel.Client, sessionID, endpoint string) (string, error) {
+	version, ok, err := relayVersion(ctx, client, sessionID, strings.TrimSuffix(endpoint, "/"))
+	if err == nil && !ok {
+		err = fmt.Errorf("external relay at %s did not answer on /version", endpoint)
+	}
+	return version, err
+}
+
+// relayVersion fetches baseURL/version from inside the session. ok is false
+// if nothing answered.
+func relayVersion(ctx context.Context, client kernel.Client, sessionID, baseURL string) (version string, ok bool, err error) {
+	ctx, cancel := checkContext(ctx)
+	defer cancel()
+	result, err := client.Browsers.Process.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
+		Command:    "bash",
+		Args:       []string{"-c", "curl -sf " + shellQuote(baseURL+"/version") + " || echo 'not running'"},
+		TimeoutSec: kernel.Opt(checkTimeoutSec(ctx)),
+	})
+	if err != nil {
+		return "", false, fmt.Errorf("check relay: %w", err)
+	}
+	stdout := strings.TrimSpace(agent.DecodeB64(result.StdoutB64))
+	if result.ExitCode != 0 || stdout == "not running" || stdout == "" {
+		return "", false, nil
+	}
+	return stdout, true, nil
+}
+
+// ActivatePlaywriter clicks on the Playwriter extension icon to activate it,
+// then waits for the extension to connect to the relay. The icon is clicked
+// again if the connection doesn't appear, up to activationAttempts times.
 func ActivatePlaywriter(ctx context.Context, client kernel.Client, sessionID string) error {
-	fmt.Println(headerStyle.Render("Activating Playwriter extension..."))
-	client.Browsers.Computer.ClickMouse(ctx, sessionID, kernel.BrowserComputerClickMouseParams{
-		X: ExtensionIconX, Y: ExtensionIconY,
+	status(phaseActivate, headerStyle.Render("Activating Playwriter extension..."))
+	return clickToActivate(ctx, client, sessionID)
+}
+
+// clickToActivate is ActivatePlaywriter without the header
+func clickToActivate(ctx context.Context, client kernel.Client, sessionID string) error {
+	for attempt := 1; attempt <= activationAttempts; attempt++ {
+		client.Browsers.Computer.ClickMouse(ctx, sessionID, kernel.BrowserComputerClickMouseParams{
+			X: ExtensionIconX, Y: ExtensionIconY,
+		})
+
+		connected, err := waitForConnection(ctx, client, sessionID, activationWait)
+		if err != nil {
+			return err
+		}
+		if connected {
+			status(phaseActivate, successStyle.Render("Playwriter extension connected"))
+			return nil
+		}
+		if attempt < activationAttempts {
+			status(phaseActivate, dimStyle.Render(fmt.Sprintf("Extension not connected yet, clicking again (attempt %d/%d)", attempt+1, activationAttempts)))
+		}
+	}
+	return fmt.Errorf("playwriter extension did not connect to the relay after %d attempts", activationAttempts)
+}
+
+// IsPlaywriterInstalled checks that the playwriter build and relay launch
+// script InstallPlaywriterFromSource creates are present, e.g. in a reused
+// session whose build a soft cleanup removed. It reports false if the check
+// fails.
+func IsPlaywriterInstalled(ctx context.Context, client kernel.Client, sessionID string) bool {
+	ctx, cancel := checkContext(ctx)
+	defer cancel()
+	result, err := client.Browsers.Process.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
+		Command:    "bash",
+		Args:       []string{"-c", "test -f " + PlaywriterDir + "/playwriter/dist/cli.js && test -x /home/kernel/start-playwriter-relay.sh && echo installed"},
+		TimeoutSec: kernel.Opt(checkTimeoutSec(ctx)),
 	})
-	time.Sleep(2 * time.Second)
-	return nil
+	if err != nil {
+		return false
+	}
+	return strings.TrimSpace(agent.DecodeB64(result.StdoutB64)) == "installed"
 }
 
-// IsPlaywriterConnected checks if the extension is connected to the relay
+// IsPlaywriterConnected checks if the extension is connected to the relay.
+// The check is bounded by CheckTimeout and by ctx's deadline; it reports false
+// if ctx is cancelled.
 func IsPlaywriterConnected(ctx context.Context, client kernel.Client, sessionID string) bool {
+	ctx, cancel := checkContext(ctx)
+	defer cancel()
 	result, err := client.Browsers.Process.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
 		Command:    "bash",
 		Args:       []string{"-c", "netstat -tn 2>/dev/null | grep -q ':19988.*ESTABLISHED' && echo connected"},
-		TimeoutSec: kernel.Opt(int64(5)),
+		TimeoutSec: kernel.Opt(checkTimeoutSec(ctx)),
 	})
 	if err != nil {
 		return false
 	}
-	stdout := decodeB64(result.StdoutB64)
+	stdout := agent.DecodeB64(result.StdoutB64)
 	return stdout == "connected\n" || stdout == "connected"
 }
+
+// checkContext derives the context for a single relay or connection check,
+// limited to CheckTimeout
+func checkContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, CheckTimeout)
+}
+
+// checkTimeoutSec converts ctx's remaining time into the in-session process
+// timeout, so the command stops when the caller's deadline passes
+func checkTimeoutSec(ctx context.Context) int64 {
+	seconds := int64(CheckTimeout.Seconds())
+	if deadline, ok := ctx.Deadline(); ok {
+		seconds = int64(math.Ceil(time.Until(deadline).Seconds()))
+	}
+	return max(seconds, 1)
+}
+
+// sleepContext waits for d, returning early with ctx's error if it's cancelled
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,419 @@
+package browser
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/onkernel/kernel-go-sdk"
+)
+
+func TestPinExtensionsPreferences(t *testing.T) {
+	defer func(d time.Duration) { preferencesWaitInterval = d }(preferencesWaitInterval)
+	preferencesWaitInterval = time.Millisecond
+
+	tests := []struct {
+		name         string
+		existing     string // Preferences before pinning; "" for no file
+		appearsAfter int    // reads before Chrome writes existing; 0 if it's there from the start
+		wantPinned   []string
+		wantOriginal bool
+		wantKept     string // top-level key of existing that must survive
+	}{
+		{
+			name:       "no file bootstraps minimal preferences",
+			wantPinned: []string{"ext-a"},
+		},
+		{
+			name:         "file written while waiting",
+			existing:     `{"browser":{"has_seen_welcome_page":true}}`,
+			appearsAfter: 2,
+			wantPinned:   []string{"ext-a"},
+			wantOriginal: true,
+			wantKept:     "browser",
+		},
+		{
+			name:         "existing pins kept, ours moved last",
+			existing:     `{"extensions":{"pinned_extensions":["ext-a","other"]},"profile":{}}`,
+			wantPinned:   []string{"other", "ext-a"},
+			wantOriginal: true,
+			wantKept:     "profile",
+		},
+		{
+			name:       "null preferences treated as empty",
+			existing:   `null`,
+			wantPinned: []string{"ext-a"},
+			// Read and returned as-is so it can be restored
+			wantOriginal: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, client := newFakeKernel(t)
+			if tt.existing != "" {
+				if tt.appearsAfter == 0 {
+					fake.files[PreferencesPath] = tt.existing
+				} else {
+					reads := 0
+					fake.beforeRead = func(path string) {
+						if reads++; reads > tt.appearsAfter {
+							fake.files[PreferencesPath] = tt.existing
+						}
+					}
+				}
+			}
+
+			original, err := pinExtensions(context.Background(), client, testSessionID, []string{"ext-a"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (original != nil) != tt.wantOriginal || (tt.wantOriginal && string(original) != tt.existing) {
+				t.Errorf("original = %q, want %q", original, tt.existing)
+			}
+
+			written, ok := fake.file(PreferencesPath)
+			if !ok {
+				t.Fatal("Preferences not written")
+			}
+			var prefs struct {
+				Extensions struct {
+					Pinned []string `json:"pinned_extensions"`
+				} `json:"extensions"`
+			}
+			if err := json.Unmarshal([]byte(written), &prefs); err != nil {
+				t.Fatalf("written Preferences aren't valid JSON: %v\n%s", err, written)
+			}
+			if !slices.Equal(prefs.Extensions.Pinned, tt.wantPinned) {
+				t.Errorf("pinned_extensions = %q, want %q", prefs.Extensions.Pinned, tt.wantPinned)
+			}
+			if tt.wantKept != "" {
+				var all map[string]any
+				json.Unmarshal([]byte(written), &all)
+				if _, ok := all[tt.wantKept]; !ok {
+					t.Errorf("%q dropped from Preferences:\n%s", tt.wantKept, written)
+				}
+			}
+			if !slices.Contains(fake.dirs, "/home/kernel/user-data/Default") {
+				t.Errorf("profile directory not created, created %q", fake.dirs)
+			}
+		})
+	}
+}
+
+func TestReadPreferencesInvalid(t *testing.T) {
+	fake, client := newFakeKernel(t)
+	fake.files[PreferencesPath] = "{not json"
+	if _, _, err := readPreferences(context.Background(), client, testSessionID); err == nil {
+		t.Error("invalid Preferences read without an error")
+	}
+}
+
+func TestExtensionParams(t *testing.T) {
+	tests := []struct {
+		name string
+		opts SetupOptions
+		want []string
+	}{
+		{"playwriter only", SetupOptions{}, []string{"playwriter"}},
+		{"renamed playwriter", SetupOptions{Extension: "playwriter-dev"}, []string{"playwriter-dev"}},
+		{
+			name: "extras after playwriter",
+			opts: SetupOptions{ExtraExtensions: []string{"ublock", "dark-reader"}},
+			want: []string{"playwriter", "ublock", "dark-reader"},
+		},
+		{
+			name: "duplicates and empty names skipped",
+			opts: SetupOptions{Extension: "pw", ExtraExtensions: []string{"ublock", "", "pw", "ublock"}},
+			want: []string{"pw", "ublock"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, param := range extensionParams(tt.opts) {
+				if param.ID.Valid() {
+					t.Errorf("extension %q loaded by ID", param.ID.Value)
+				}
+				got = append(got, param.Name.Value)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("extensions = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenStartPage(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     SetupOptions
+		blocked  bool // navigation to anything but about:blank fails
+		wantURLs []string
+	}{
+		{name: "default start page", wantURLs: []string{StartURL}},
+		{name: "custom start page", opts: SetupOptions{StartURL: "https://example.com"}, wantURLs: []string{"https://example.com"}},
+		{name: "navigation skipped", opts: SetupOptions{StartURL: "none"}, wantURLs: []string{BlankURL}},
+		{name: "blocked network falls back to blank", blocked: true, wantURLs: []string{StartURL, BlankURL}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, client := newFakeKernel(t)
+			fake.execute = func(code string) playwrightResult {
+				if tt.blocked && !strings.Contains(code, BlankURL) {
+					return playwrightResult{error: "net::ERR_INTERNET_DISCONNECTED"}
+				}
+				return playwrightResult{success: true}
+			}
+			openStartPage(context.Background(), client, testSessionID, tt.opts)
+
+			if len(fake.codes) != len(tt.wantURLs) {
+				t.Fatalf("%d navigations, want %d", len(fake.codes), len(tt.wantURLs))
+			}
+			for i, url := range tt.wantURLs {
+				if !strings.Contains(fake.codes[i], `const target = "`+url+`";`) {
+					t.Errorf("navigation %d doesn't open %s:\n%s", i, url, fake.codes[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPrepareTabsCloseOthers(t *testing.T) {
+	tests := []struct {
+		closeOthers bool
+		want        string
+		forbidden   string
+	}{
+		{closeOthers: true, want: "await pages[i].close()", forbidden: "startsWith(target)"},
+		{closeOthers: false, want: "startsWith(target)", forbidden: ".close()"},
+	}
+	for _, tt := range tests {
+		fake, client := newFakeKernel(t)
+		if err := prepareTabs(context.Background(), client, testSessionID, `https://example.com/?q="x"`, tt.closeOthers); err != nil {
+			t.Fatal(err)
+		}
+		code := fake.codes[0]
+		if !strings.Contains(code, `const target = "https://example.com/?q=\"x\"";`) {
+			t.Errorf("target not quoted as a JS string:\n%s", code)
+		}
+		if !strings.Contains(code, tt.want) || strings.Contains(code, tt.forbidden) {
+			t.Errorf("closeOthers=%v code:\n%s", tt.closeOthers, code)
+		}
+	}
+}
+
+func TestChecksHonorContext(t *testing.T) {
+	checks := []struct {
+		name  string
+		check func(ctx context.Context, client kernel.Client) error
+	}{
+		{"IsPlaywriterConnected", func(ctx context.Context, client kernel.Client) error {
+			if IsPlaywriterConnected(ctx, client, testSessionID) {
+				return errors.New("reported connected")
+			}
+			return nil
+		}},
+		{"RelayVersion", func(ctx context.Context, client kernel.Client) error {
+			if _, err := RelayVersion(ctx, client, testSessionID); err == nil {
+				return errors.New("no error")
+			}
+			return nil
+		}},
+		{"ExternalRelayVersion", func(ctx context.Context, client kernel.Client) error {
+			if _, err := ExternalRelayVersion(ctx, client, testSessionID, "http://relay.example:19988"); err == nil {
+				return errors.New("no error")
+			}
+			return nil
+		}},
+	}
+	contexts := []struct {
+		name string
+		ctx  func() (context.Context, context.CancelFunc)
+	}{
+		{"cancelled", func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			return ctx, cancel
+		}},
+		{"parent deadline", func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 50*time.Millisecond)
+		}},
+	}
+	for _, check := range checks {
+		for _, c := range contexts {
+			t.Run(check.name+"/"+c.name, func(t *testing.T) {
+				fake, client := newFakeKernel(t)
+				fake.hang = true
+				ctx, cancel := c.ctx()
+				defer cancel()
+
+				start := time.Now()
+				if err := check.check(ctx, client); err != nil {
+					t.Error(err)
+				}
+				if elapsed := time.Since(start); elapsed > time.Second {
+					t.Errorf("returned after %v, want promptly", elapsed)
+				}
+			})
+		}
+	}
+}
+
+func TestCheckTimeout(t *testing.T) {
+	defer func(d time.Duration) { CheckTimeout = d }(CheckTimeout)
+	CheckTimeout = 50 * time.Millisecond
+
+	fake, client := newFakeKernel(t)
+	fake.hang = true
+	start := time.Now()
+	if IsPlaywriterConnected(context.Background(), client, testSessionID) {
+		t.Error("reported connected")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("returned after %v, want about CheckTimeout", elapsed)
+	}
+
+	// The in-session command gets the time left, rounded up, at least 1s
+	tests := []struct {
+		left time.Duration
+		want int64
+	}{
+		{0, 1},
+		{1500 * time.Millisecond, 2},
+		{10 * time.Second, 10},
+	}
+	for _, tt := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), tt.left)
+		if got := checkTimeoutSec(ctx); got != tt.want {
+			t.Errorf("checkTimeoutSec(%v left) = %d, want %d", tt.left, got, tt.want)
+		}
+		cancel()
+	}
+	if got := checkTimeoutSec(context.Background()); got != 1 {
+		t.Errorf("checkTimeoutSec without a deadline = %d, want CheckTimeout (1s)", got)
+	}
+}
+
+func TestIsPlaywriterConnected(t *testing.T) {
+	tests := []struct {
+		stdout string
+		want   bool
+	}{
+		{"connected\n", true},
+		{"connected", true},
+		{"", false},
+	}
+	for _, tt := range tests {
+		fake, client := newFakeKernel(t)
+		fake.exec = func(call execCall) execResult { return execResult{stdout: tt.stdout} }
+		if got := IsPlaywriterConnected(context.Background(), client, testSessionID); got != tt.want {
+			t.Errorf("IsPlaywriterConnected with output %q = %v, want %v", tt.stdout, got, tt.want)
+		}
+		if calls := fake.ran("ESTABLISHED"); len(calls) != 1 {
+			t.Errorf("connection checked %d times", len(calls))
+		}
+	}
+}
+
+func TestPinToolbar(t *testing.T) {
+	defer func(stop, start, interval, prefs time.Duration) {
+		chromeStopWait, chromeStartWait, chromeStartInterval, preferencesWaitInterval = stop, start, interval, prefs
+	}(chromeStopWait, chromeStartWait, chromeStartInterval, preferencesWaitInterval)
+	chromeStopWait, chromeStartWait, chromeStartInterval, preferencesWaitInterval = 0, 0, time.Millisecond, time.Millisecond
+
+	const existing = `{"browser":{"has_seen_welcome_page":true}}`
+	tests := []struct {
+		name       string
+		existing   string // Preferences before pinning; "" for no file
+		failStarts int    // Chrome starts that don't come up
+		wantErr    string
+		wantPinned bool // Preferences left pinned rather than restored
+		wantStops  int
+	}{
+		{name: "restarts", existing: existing, wantPinned: true, wantStops: 1},
+		{name: "restored after a failed restart", existing: existing, failStarts: 1, wantStops: 2},
+		{name: "bootstrapped file removed after a failed restart", failStarts: 1, wantStops: 2},
+		{name: "never restarts", existing: existing, failStarts: 2, wantStops: 2, wantErr: "chrome failed to restart after pinning"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, client := newFakeKernel(t)
+			if tt.existing != "" {
+				fake.files[PreferencesPath] = tt.existing
+			}
+			fake.exec = func(call execCall) execResult {
+				if call.line() == "supervisorctl status chromium" && len(fake.spawns) > tt.failStarts {
+					return execResult{stdout: "chromium RUNNING pid 42, uptime 0:00:03"}
+				}
+				return execResult{stdout: "chromium EXITED"}
+			}
+
+			err := pinToolbar(context.Background(), client, testSessionID, "ext-a", SetupOptions{})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			prefs, ok := fake.file(PreferencesPath)
+			switch {
+			case tt.wantPinned:
+				if !strings.Contains(prefs, `"ext-a"`) {
+					t.Errorf("Preferences not pinned:\n%s", prefs)
+				}
+			case tt.existing == "":
+				if ok {
+					t.Errorf("bootstrapped Preferences left behind:\n%s", prefs)
+				}
+			case prefs != tt.existing:
+				t.Errorf("Preferences = %s, want the original restored", prefs)
+			}
+			if stops := len(fake.ran("supervisorctl stop chromium")); stops != tt.wantStops {
+				t.Errorf("Chrome stopped %d times, want %d", stops, tt.wantStops)
+			}
+		})
+	}
+}
+
+func TestExternalRelayVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint string
+		result   execResult
+		want     string
+		wantErr  string
+	}{
+		{name: "answers", endpoint: "http://relay.example:19988", result: execResult{stdout: "0.0.42\n"}, want: "0.0.42"},
+		{name: "trailing slash", endpoint: "http://relay.example:19988/", result: execResult{stdout: "0.0.42"}, want: "0.0.42"},
+		{name: "not running", endpoint: "http://relay.example:19988", result: execResult{stdout: "not running\n"}, wantErr: "external relay at http://relay.example:19988 did not answer on /version"},
+		{name: "empty answer", endpoint: "http://relay.example:19988", result: execResult{}, wantErr: "did not answer"},
+		{name: "check failed", endpoint: "http://relay.example:19988", result: execResult{exitCode: 7}, wantErr: "did not answer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, client := newFakeKernel(t)
+			fake.exec = func(call execCall) execResult { return tt.result }
+
+			got, err := ExternalRelayVersion(context.Background(), client, testSessionID, tt.endpoint)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("ExternalRelayVersion() = %q, want %q", got, tt.want)
+			}
+			if calls := fake.ran("curl -sf 'http://relay.example:19988/version'"); len(calls) != 1 {
+				t.Errorf("version checks %v, want one against the endpoint", fake.execs)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package browser
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/onkernel/kernel-go-sdk"
+)
+
+// statusBannerID is the id of the element SetStatus injects into each page
+const statusBannerID = "__playwriter_status"
+
+// SetStatus shows text in a banner at the top of every open page so someone
+// watching the live view sees what the agent is doing. The page title is
+// left alone since agents read it. An empty text removes the banner.
+func SetStatus(ctx context.Context, client kernel.Client, sessionID, text string) error {
+	textJSON, _ := json.Marshal(text)
+	resp, err := client.Browsers.Playwright.Execute(ctx, sessionID, kernel.BrowserPlaywrightExecuteParams{
+		Code: fmt.Sprintf(`
+		const text = %s;
+		for (const page of context.pages()) {
+			await page.evaluate(([id, text]) => {
+				let el = document.getElementById(id);
+				if (!text) { if (el) el.remove(); return; }
+				if (!el) {
+					el = document.createElement("div");
+					el.id = id;
+					el.style.cssText = "position:fixed;top:0;left:0;right:0;z-index:2147483647;" +
+						"padding:4px 8px;font:12px monospace;color:#fff;background:rgba(0,0,0,0.75);" +
+						"pointer-events:none;white-space:nowrap;overflow:hidden;text-overflow:ellipsis";
+					document.documentElement.appendChild(el);
+				}
+				el.textContent = text;
+			}, [%q, text]).catch(() => {});
+		}
+	`, textJSON, statusBannerID),
+		TimeoutSec: kernel.Opt(int64(10)),
+	})
+	if err != nil {
+		return fmt.Errorf("set status: %w", err)
+	}
+	if !resp.Success {
+		return fmt.Errorf("set status: %s", resp.Error)
+	}
+	return nil
+}
+
+// StatusUpdater applies status updates in the background so the agent's
+// output isn't held up by the browser. Only the latest pending status is
+// kept; intermediate ones are skipped when updates arrive faster than they
+// can be shown.
+type StatusUpdater struct {
+	ctx       context.Context
+	client    kernel.Client
+	sessionID string
+	pending   chan string
+	done      chan struct{}
+}
+
+// NewStatusUpdater creates an updater for the session and starts its worker
+func NewStatusUpdater(ctx context.Context, client kernel.Client, sessionID string) *StatusUpdater {
+	u := &StatusUpdater{
+		ctx:       ctx,
+		client:    client,
+		sessionID: sessionID,
+		pending:   make(chan string, 1),
+		done:      make(chan struct{}),
+	}
+	go u.run()
+	return u
+}
+
+// Set queues text as the next status, replacing any status not yet shown
+func (u *StatusUpdater) Set(text string) {
+	for {
+		select {
+		case u.pending <- text:
+			return
+		default:
+		}
+		select {
+		case <-u.pending:
+		default:
+		}
+	}
+}
+
+// Close stops the worker after the last queued status is shown
+func (u *StatusUpdater) Close() {
+	close(u.pending)
+	<-u.done
+}
+
+// run shows queued statuses until the updater is closed. Failures are
+// ignored: the banner is a convenience and never affects the run.
+func (u *StatusUpdater) run() {
+	defer close(u.done)
+	for text := range u.pending {
+		SetStatus(u.ctx, u.client, u.sessionID, text)
+	}
+}
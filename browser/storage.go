@@ -0,0 +1,71 @@
+package browser
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/onkernel/kernel-go-sdk"
+)
+
+// importStorageCode loads a Playwright storage state, given as the JSON
+// literal %s: cookies are added to the context, and each origin's
+// localStorage is written from a temporary page on that origin
+const importStorageCode = `
+const state = %s;
+await context.addCookies(state.cookies || []);
+for (const origin of state.origins || []) {
+	const page = await context.newPage();
+	try {
+		await page.goto(origin.origin, { waitUntil: "domcontentloaded" });
+		await page.evaluate(items => {
+			for (const { name, value } of items) localStorage.setItem(name, value);
+		}, origin.localStorage || []);
+	} finally {
+		await page.close();
+	}
+}
+return (state.cookies || []).length;
+`
+
+// ImportStorageState loads a Playwright storage state (cookies and
+// localStorage, as written by ExportStorageState or Playwright's own
+// storageState) into the browser, e.g. to reuse a login. Returns the number
+// of cookies added.
+func ImportStorageState(ctx context.Context, client kernel.Client, sessionID string, state []byte) (int, error) {
+	if !json.Valid(state) {
+		return 0, fmt.Errorf("import storage state: not valid JSON")
+	}
+	resp, err := client.Browsers.Playwright.Execute(ctx, sessionID, kernel.BrowserPlaywrightExecuteParams{
+		Code:       fmt.Sprintf(importStorageCode, state),
+		TimeoutSec: kernel.Opt(int64(120)),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("import storage state: %w", err)
+	}
+	if !resp.Success {
+		return 0, fmt.Errorf("import storage state: %s", resp.Error)
+	}
+	cookies, _ := resp.Result.(float64)
+	return int(cookies), nil
+}
+
+// ExportStorageState returns the browser's current Playwright storage state:
+// its cookies and the localStorage of open origins, as indented JSON
+func ExportStorageState(ctx context.Context, client kernel.Client, sessionID string) ([]byte, error) {
+	resp, err := client.Browsers.Playwright.Execute(ctx, sessionID, kernel.BrowserPlaywrightExecuteParams{
+		Code:       "return await context.storageState();",
+		TimeoutSec: kernel.Opt(int64(60)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("export storage state: %w", err)
+	}
+	if !resp.Success {
+		return nil, fmt.Errorf("export storage state: %s", resp.Error)
+	}
+	state, err := json.MarshalIndent(resp.Result, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("export storage state: %w", err)
+	}
+	return state, nil
+}
@@ -0,0 +1,92 @@
+package browser
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/onkernel/kernel-go-sdk"
+
+	"playwriter-setup/agent"
+)
+
+// Upload copies the local file or directory at local to remote in the
+// session, recursing into directories, and hands the result to the kernel
+// user. Returns the number of files written.
+func Upload(ctx context.Context, client kernel.Client, sessionID, local, remote string) (int, error) {
+	status(phaseUpload, headerStyle.Render("Uploading "+local+" to "+remote+"..."))
+
+	info, err := os.Stat(local)
+	if err != nil {
+		return 0, fmt.Errorf("read %s: %w", local, err)
+	}
+
+	fsys := client.Browsers.Fs
+	files := 0
+	if !info.IsDir() {
+		fsys.NewDirectory(ctx, sessionID, kernel.BrowserFNewDirectoryParams{Path: path.Dir(remote)})
+		if err := uploadFile(ctx, client, sessionID, local, remote); err != nil {
+			return 0, err
+		}
+		files = 1
+	} else {
+		err = filepath.WalkDir(local, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return fmt.Errorf("read %s: %w", p, err)
+			}
+			rel, err := filepath.Rel(local, p)
+			if err != nil {
+				return err
+			}
+			target := path.Join(remote, filepath.ToSlash(rel))
+			if d.IsDir() {
+				if err := fsys.NewDirectory(ctx, sessionID, kernel.BrowserFNewDirectoryParams{Path: target}); err != nil {
+					return fmt.Errorf("create %s: %w", target, err)
+				}
+				return nil
+			}
+			if !d.Type().IsRegular() {
+				return nil // skip symlinks, sockets, and the like
+			}
+			if err := uploadFile(ctx, client, sessionID, p, target); err != nil {
+				return err
+			}
+			files++
+			return nil
+		})
+		if err != nil {
+			return files, err
+		}
+	}
+
+	result, err := client.Browsers.Process.Exec(ctx, sessionID, kernel.BrowserProcessExecParams{
+		Command: "chown", Args: []string{"-R", "kernel:kernel", remote},
+		AsRoot: kernel.Opt(true), TimeoutSec: kernel.Opt(int64(30)),
+	})
+	if err != nil {
+		return files, fmt.Errorf("chown %s: %w", remote, err)
+	}
+	if result.ExitCode != 0 {
+		return files, fmt.Errorf("chown %s failed (exit %d): %s", remote, result.ExitCode, agent.DecodeB64(result.StderrB64))
+	}
+
+	status(phaseUpload, successStyle.Render(fmt.Sprintf("Uploaded %d file(s) to %s", files, remote)))
+	return files, nil
+}
+
+// uploadFile writes one local file to remote in the session
+func uploadFile(ctx context.Context, client kernel.Client, sessionID, local, remote string) error {
+	f, err := os.Open(local)
+	if err != nil {
+		return fmt.Errorf("read %s: %w", local, err)
+	}
+	defer f.Close()
+
+	if err := client.Browsers.Fs.WriteFile(ctx, sessionID, f, kernel.BrowserFWriteFileParams{Path: remote}); err != nil {
+		return fmt.Errorf("write %s: %w", remote, err)
+	}
+	return nil
+}
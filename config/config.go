@@ -0,0 +1,292 @@
+// Package config loads playwriter-in-kernel settings from a YAML or JSON file
+// as an alternative to passing many command-line flags.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"playwriter-setup/agent"
+)
+
+// DefaultFiles are the config files discovered in the current directory, in order
+var DefaultFiles = []string{".playwriter.yaml", ".playwriter.yml", ".playwriter.json"}
+
+// Config mirrors the command-line flags. Unset fields leave the flag default
+// in place; flags given on the command line always win over file values.
+type Config struct {
+	Agent              string            `yaml:"agent" json:"agent"`
+	Prompt             string            `yaml:"prompt" json:"prompt"`
+	PromptFile         string            `yaml:"prompt_file" json:"prompt_file"`
+	Vars               map[string]string `yaml:"vars" json:"vars"`
+	AllowUndefinedVars *bool             `yaml:"allow_undefined_vars" json:"allow_undefined_vars"`
+	NoFileExpand       *bool             `yaml:"no_file_expand" json:"no_file_expand"`
+	Model              string            `yaml:"model" json:"model"`
+	Tag                string            `yaml:"tag" json:"tag"`
+	Session            string            `yaml:"session" json:"session"`
+	TimeoutSeconds     *int64            `yaml:"timeout_seconds" json:"timeout_seconds"`
+	AgentTimeout       *int64            `yaml:"agent_timeout" json:"agent_timeout"`
+	Resume             string            `yaml:"resume" json:"resume"`
+	MaxTurns           *int64            `yaml:"max_turns" json:"max_turns"`
+	MaxSessions        *int64            `yaml:"max_concurrent_sessions" json:"max_concurrent_sessions"`
+	Heartbeat          *int64            `yaml:"heartbeat" json:"heartbeat"`
+	RetryTransient     *bool             `yaml:"retry_transient" json:"retry_transient"`
+	IgnoreResultError  *bool             `yaml:"ignore_result_error" json:"ignore_result_error"`
+	Delete             *bool             `yaml:"delete" json:"delete"`
+	SoftCleanup        *bool             `yaml:"soft_cleanup" json:"soft_cleanup"`
+	RemovePlaywriter   *bool             `yaml:"remove_playwriter" json:"remove_playwriter"`
+	SetupScript        string            `yaml:"setup_script" json:"setup_script"`
+	StorageState       string            `yaml:"storage_state" json:"storage_state"`
+	Uploads            []string          `yaml:"uploads" json:"uploads"`
+	Hosts              []string          `yaml:"hosts" json:"hosts"`
+	Headless           *bool             `yaml:"headless" json:"headless"`
+	ReapTabs           *int64            `yaml:"reap_tabs" json:"reap_tabs"`
+	Extension          string            `yaml:"extension" json:"extension"`
+	ExtraExtensions    []string          `yaml:"extra_extensions" json:"extra_extensions"`
+	PinExtraExtensions *bool             `yaml:"pin_extra_extensions" json:"pin_extra_extensions"`
+	URL                string            `yaml:"url" json:"url"`
+	CloseTabs          *bool             `yaml:"close_tabs" json:"close_tabs"`
+	ConfigDir          string            `yaml:"config_dir" json:"config_dir"`
+	MCPRuntime         string            `yaml:"mcp_runtime" json:"mcp_runtime"`
+	MCPServerName      string            `yaml:"mcp_server_name" json:"mcp_server_name"`
+	MCPReplace         *bool             `yaml:"mcp_replace" json:"mcp_replace"`
+	PlaywriterRepo     string            `yaml:"playwriter_repo" json:"playwriter_repo"`
+	PlaywriterPatch    string            `yaml:"playwriter_patch_file" json:"playwriter_patch_file"`
+	ExternalRelay      string            `yaml:"external_relay" json:"external_relay"`
+	Webhook            string            `yaml:"webhook" json:"webhook"`
+	APIKeyFile         string            `yaml:"api_key_file" json:"api_key_file"`
+	APIKeyCmd          string            `yaml:"api_key_cmd" json:"api_key_cmd"`
+	KernelAPIKeyFile   string            `yaml:"kernel_api_key_file" json:"kernel_api_key_file"`
+	KernelAPIKeyCmd    string            `yaml:"kernel_api_key_cmd" json:"kernel_api_key_cmd"`
+	KernelBaseURL      string            `yaml:"kernel_base_url" json:"kernel_base_url"`
+	Open               *bool             `yaml:"open" json:"open"`
+	Force              *bool             `yaml:"force" json:"force"`
+	LiveStatus         *bool             `yaml:"live_status" json:"live_status"`
+	LogRequests        string            `yaml:"log_requests" json:"log_requests"`
+	PrintRecording     *bool             `yaml:"print_recording" json:"print_recording"`
+	VerifyKeys         *bool             `yaml:"verify_keys" json:"verify_keys"`
+	AsRoot             *bool             `yaml:"as_root" json:"as_root"`
+	NoPTY              *bool             `yaml:"no_pty" json:"no_pty"`
+	Quiet              *bool             `yaml:"quiet" json:"quiet"`
+	NoParallel         *bool             `yaml:"no_parallel" json:"no_parallel"`
+	Verbose            *bool             `yaml:"verbose" json:"verbose"`
+	WorkDir            string            `yaml:"workdir" json:"workdir"`
+	AutoApprove        *bool             `yaml:"auto_approve" json:"auto_approve"`
+	StreamText         *bool             `yaml:"stream_text" json:"stream_text"`
+	AgentOutputFormat  string            `yaml:"agent_output_format" json:"agent_output_format"`
+	RelayLogs          *bool             `yaml:"relay_logs" json:"relay_logs"`
+	JSONErrors         *bool             `yaml:"json_errors" json:"json_errors"`
+	Explain            *bool             `yaml:"explain" json:"explain"`
+	Timing             *bool             `yaml:"timing" json:"timing"`
+	Expect             string            `yaml:"expect" json:"expect"`
+	ExpectRegex        string            `yaml:"expect_regex" json:"expect_regex"`
+	AllowTools         []string          `yaml:"allow_tools" json:"allow_tools"`
+	DenyTools          []string          `yaml:"deny_tools" json:"deny_tools"`
+	AutoApproveTools   []string          `yaml:"auto_approve_tools" json:"auto_approve_tools"`
+
+	// Env holds environment variables (e.g. provider API keys). Variables
+	// already set in the process environment take precedence.
+	Env map[string]string `yaml:"env" json:"env"`
+
+	// MCPServers are extra MCP servers configured alongside playwriter
+	MCPServers map[string]agent.MCPServer `yaml:"mcp_servers" json:"mcp_servers"`
+
+	// InstallCommands replace an agent's default install command, keyed by
+	// agent name, e.g. to pin a version
+	InstallCommands map[string]string `yaml:"install_commands" json:"install_commands"`
+}
+
+// Load reads a config file. Files ending in .json are parsed as JSON,
+// everything else as YAML.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+
+	var cfg Config
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(data, &cfg)
+	} else {
+		err = yaml.Unmarshal(data, &cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse config %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// Discover returns the first of DefaultFiles present in dir, or "" if none exist
+func Discover(dir string) string {
+	for _, name := range DefaultFiles {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// FlagValues maps each set scalar field to its flag name and value, suitable
+// for flag.Set. Map fields (Vars, Env, MCPServers, InstallCommands) are applied
+// by the caller.
+func (c *Config) FlagValues() map[string]string {
+	values := make(map[string]string)
+	setString := func(name, v string) {
+		if v != "" {
+			values[name] = v
+		}
+	}
+	setBool := func(name string, v *bool) {
+		if v != nil {
+			values[name] = strconv.FormatBool(*v)
+		}
+	}
+	setInt := func(name string, v *int64) {
+		if v != nil {
+			values[name] = strconv.FormatInt(*v, 10)
+		}
+	}
+
+	setString("agent", c.Agent)
+	setString("p", c.Prompt)
+	setString("prompt-file", c.PromptFile)
+	setBool("allow-undefined-vars", c.AllowUndefinedVars)
+	setBool("no-file-expand", c.NoFileExpand)
+	setString("m", c.Model)
+	setString("s", c.Session)
+	setString("tag", c.Tag)
+	setInt("timeout-seconds", c.TimeoutSeconds)
+	setInt("agent-timeout", c.AgentTimeout)
+	setString("resume", c.Resume)
+	setInt("max-turns", c.MaxTurns)
+	setInt("max-concurrent-sessions", c.MaxSessions)
+	setInt("heartbeat", c.Heartbeat)
+	setBool("retry-transient", c.RetryTransient)
+	setBool("ignore-result-error", c.IgnoreResultError)
+	setBool("d", c.Delete)
+	setBool("soft-cleanup", c.SoftCleanup)
+	setBool("remove-playwriter", c.RemovePlaywriter)
+	setString("setup-script", c.SetupScript)
+	setString("storage-state", c.StorageState)
+	setBool("headless", c.Headless)
+	setInt("reap-tabs", c.ReapTabs)
+	setString("extension", c.Extension)
+	setBool("pin-extra-extensions", c.PinExtraExtensions)
+	setString("url", c.URL)
+	setBool("close-tabs", c.CloseTabs)
+	setString("config-dir", c.ConfigDir)
+	setString("mcp-runtime", c.MCPRuntime)
+	setString("mcp-server-name", c.MCPServerName)
+	setBool("mcp-replace", c.MCPReplace)
+	setString("playwriter-repo", c.PlaywriterRepo)
+	setString("playwriter-patch-file", c.PlaywriterPatch)
+	setString("external-relay", c.ExternalRelay)
+	setString("webhook", c.Webhook)
+	setString("api-key-file", c.APIKeyFile)
+	setString("api-key-cmd", c.APIKeyCmd)
+	setString("kernel-api-key-file", c.KernelAPIKeyFile)
+	setString("kernel-api-key-cmd", c.KernelAPIKeyCmd)
+	setString("kernel-base-url", c.KernelBaseURL)
+	setBool("open", c.Open)
+	setBool("force", c.Force)
+	setBool("live-status", c.LiveStatus)
+	setString("log-requests", c.LogRequests)
+	setBool("print-recording", c.PrintRecording)
+	setBool("verify-keys", c.VerifyKeys)
+	setBool("as-root", c.AsRoot)
+	setBool("no-pty", c.NoPTY)
+	setBool("quiet", c.Quiet)
+	setBool("no-parallel", c.NoParallel)
+	setBool("verbose", c.Verbose)
+	setString("workdir", c.WorkDir)
+	setBool("auto-approve", c.AutoApprove)
+	setBool("stream-text", c.StreamText)
+	setString("agent-output-format", c.AgentOutputFormat)
+	setBool("relay-logs", c.RelayLogs)
+	setBool("json-errors", c.JSONErrors)
+	setBool("explain", c.Explain)
+	setBool("timing", c.Timing)
+	setString("expect", c.Expect)
+	setString("expect-regex", c.ExpectRegex)
+	return values
+}
+
+// ListValues maps each set list field to its repeatable flag name; each value
+// is passed to flag.Set in turn.
+func (c *Config) ListValues() map[string][]string {
+	values := make(map[string][]string)
+	for name, list := range map[string][]string{
+		"extra-extension":    c.ExtraExtensions,
+		"allow-tool":         c.AllowTools,
+		"deny-tool":          c.DenyTools,
+		"auto-approve-tools": c.AutoApproveTools,
+		"upload":             c.Uploads,
+		"host":               c.Hosts,
+	} {
+		if len(list) > 0 {
+			values[name] = list
+		}
+	}
+	return values
+}
+
+// ApplyEnv sets Env entries in the process environment unless already set
+func (c *Config) ApplyEnv() error {
+	for key, value := range c.Env {
+		if _, ok := os.LookupEnv(key); ok {
+			continue
+		}
+		if err := os.Setenv(key, value); err != nil {
+			return fmt.Errorf("set %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// ErrNoConfig is returned by Resolve when no config file was given or found
+var ErrNoConfig = errors.New("no config file")
+
+// Resolve loads the config at path, or discovers one in the current
+// directory if path is empty. Returns ErrNoConfig if there is nothing to load.
+// A discovered file may belong to an untrusted checkout, so one that sets
+// LocalCommands is refused.
+func Resolve(path string) (*Config, string, error) {
+	discovered := false
+	if path == "" {
+		path = Discover(".")
+		if path == "" {
+			return nil, "", ErrNoConfig
+		}
+		discovered = true
+	}
+	cfg, err := Load(path)
+	if err != nil {
+		return nil, path, err
+	}
+	if keys := cfg.LocalCommands(); discovered && len(keys) > 0 {
+		return nil, path, fmt.Errorf("config %s: %s run commands on this machine and are only read from a file given with -config or PLAYWRITER_CONFIG",
+			path, strings.Join(keys, ", "))
+	}
+	return cfg, path, nil
+}
+
+// LocalCommands returns the keys set in c whose values are shell commands run
+// on this machine rather than in the session
+func (c *Config) LocalCommands() []string {
+	var keys []string
+	if c.APIKeyCmd != "" {
+		keys = append(keys, "api_key_cmd")
+	}
+	if c.KernelAPIKeyCmd != "" {
+		keys = append(keys, "kernel_api_key_cmd")
+	}
+	return keys
+}
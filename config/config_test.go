@@ -0,0 +1,175 @@
+package config
+
+import (
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		contents string
+		want     map[string]string // FlagValues
+		wantErr  bool
+	}{
+		{
+			name:     "yaml",
+			file:     "c.yaml",
+			contents: "agent: claude\nmodel: sonnet\ntimeout_seconds: 600\ndelete: false\n",
+			want:     map[string]string{"agent": "claude", "m": "sonnet", "timeout-seconds": "600", "d": "false"},
+		},
+		{
+			name:     "json",
+			file:     "c.json",
+			contents: `{"agent":"opencode","headless":true,"reap_tabs":3}`,
+			want:     map[string]string{"agent": "opencode", "headless": "true", "reap-tabs": "3"},
+		},
+		{
+			name:     "file expansion turned off",
+			file:     "c.yaml",
+			contents: "no_file_expand: true\n",
+			want:     map[string]string{"no-file-expand": "true"},
+		},
+		{
+			name:     "JSON extension in any case",
+			file:     "c.JSON",
+			contents: `{"url":"none"}`,
+			want:     map[string]string{"url": "none"},
+		},
+		{
+			name: "unset fields leave flags alone",
+			file: "c.yaml",
+			want: map[string]string{},
+		},
+		{
+			name:     "invalid yaml",
+			file:     "c.yaml",
+			contents: "agent: [claude\n",
+			wantErr:  true,
+		},
+		{
+			name:     "wrong type",
+			file:     "c.json",
+			contents: `{"timeout_seconds":"soon"}`,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.contents), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := Load(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := cfg.FlagValues(); !maps.Equal(got, tt.want) {
+				t.Errorf("FlagValues() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		want  string
+	}{
+		{name: "none"},
+		{name: "json only", files: []string{".playwriter.json"}, want: ".playwriter.json"},
+		{name: "yaml preferred", files: []string{".playwriter.json", ".playwriter.yml", ".playwriter.yaml"}, want: ".playwriter.yaml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, name := range tt.files {
+				os.WriteFile(filepath.Join(dir, name), []byte("{}"), 0o644)
+			}
+			want := ""
+			if tt.want != "" {
+				want = filepath.Join(dir, tt.want)
+			}
+			if got := Discover(dir); got != want {
+				t.Errorf("Discover() = %q, want %q", got, want)
+			}
+		})
+	}
+
+	t.Chdir(t.TempDir())
+	if _, _, err := Resolve(""); !errors.Is(err, ErrNoConfig) {
+		t.Errorf("Resolve(\"\") without a config = %v, want ErrNoConfig", err)
+	}
+}
+
+func TestResolveLocalCommands(t *testing.T) {
+	const contents = "agent: claude\napi_key_cmd: pass show anthropic\n"
+	tests := []struct {
+		name     string
+		explicit bool // passed with -config rather than discovered
+		contents string
+		wantErr  string
+	}{
+		{name: "discovered without commands", contents: "agent: claude\n"},
+		{name: "discovered with a command", contents: contents, wantErr: "api_key_cmd run commands on this machine"},
+		{name: "discovered with both commands", contents: contents + "kernel_api_key_cmd: pass show kernel\n", wantErr: "api_key_cmd, kernel_api_key_cmd run"},
+		{name: "explicit with a command", explicit: true, contents: contents},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			os.WriteFile(".playwriter.yaml", []byte(tt.contents), 0o644)
+			path := ""
+			if tt.explicit {
+				path = ".playwriter.yaml"
+			}
+			cfg, _, err := Resolve(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Resolve() err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Agent != "claude" {
+				t.Errorf("Agent = %q, want claude", cfg.Agent)
+			}
+		})
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	t.Setenv("PLAYWRITER_TEST_SET", "from-env")
+	os.Unsetenv("PLAYWRITER_TEST_UNSET")
+	defer os.Unsetenv("PLAYWRITER_TEST_UNSET")
+
+	cfg := &Config{Env: map[string]string{"PLAYWRITER_TEST_SET": "from-file", "PLAYWRITER_TEST_UNSET": "from-file"}}
+	if err := cfg.ApplyEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if got := os.Getenv("PLAYWRITER_TEST_SET"); got != "from-env" {
+		t.Errorf("PLAYWRITER_TEST_SET = %q, want the environment's value", got)
+	}
+	if got := os.Getenv("PLAYWRITER_TEST_UNSET"); got != "from-file" {
+		t.Errorf("PLAYWRITER_TEST_UNSET = %q, want the file's value", got)
+	}
+}
+
+func TestListValues(t *testing.T) {
+	cfg := &Config{ExtraExtensions: []string{"ublock"}, Hosts: []string{"a=1.2.3.4", "b=5.6.7.8"}}
+	got := cfg.ListValues()
+	if len(got) != 2 || len(got["host"]) != 2 || got["extra-extension"][0] != "ublock" {
+		t.Errorf("ListValues() = %v", got)
+	}
+}
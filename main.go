@@ -3,18 +3,30 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"net/url"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/charmbracelet/lipgloss"
+	"github.com/muesli/termenv"
 	"github.com/onkernel/kernel-go-sdk"
 	"github.com/onkernel/kernel-go-sdk/option"
 
 	"playwriter-setup/agent"
 	"playwriter-setup/browser"
+	"playwriter-setup/config"
+	"playwriter-setup/pool"
+	"playwriter-setup/prompt"
+	"playwriter-setup/sessions"
 	"playwriter-setup/stream"
 )
 
@@ -23,63 +35,918 @@ var (
 	successStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("10"))
 	errorStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("9"))
 	dimStyle     = lipgloss.NewStyle().Foreground(lipgloss.Color("8"))
+	warningStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("11"))
 )
 
-// getAgent returns the appropriate agent based on name
-func getAgent(name string) (agent.Agent, error) {
+// usePlainStyles drops styling from all output when stdout has no color
+// support. lipgloss already leaves out colors then, but bold and reset
+// sequences would still clutter piped output.
+func usePlainStyles() {
+	if lipgloss.ColorProfile() != termenv.Ascii {
+		return
+	}
+	successStyle = lipgloss.NewStyle()
+	errorStyle = lipgloss.NewStyle()
+	dimStyle = lipgloss.NewStyle()
+	warningStyle = lipgloss.NewStyle()
+	agent.UsePlainStyles()
+	browser.UsePlainStyles()
+	stream.UsePlainStyles()
+}
+
+// Exit codes. Codes below exitAgentBase describe failures in this tool; an
+// agent exiting non-zero is reported as exitAgentBase plus its own exit code.
+const (
+	exitSuccess      = 0
+	exitUsage        = 2   // Invalid flags, prompt, or missing environment variables
+	exitSetupFailure = 10  // Browser, agent, relay, or MCP setup failed
+	exitAgentTimeout = 11  // Agent exceeded -agent-timeout
+	exitRunFailure   = 12  // Agent could not be started or its output stream failed
+	exitExpectFailed = 13  // The final answer didn't match -expect or -expect-regex
+	exitResultError  = 14  // The agent exited 0 but its final result reported an error
+	exitAgentBase    = 100 // Agent exited non-zero: exitAgentBase + agent exit code (max 255)
+)
+
+// agentExitCode maps an agent's own exit code into the exitAgentBase range
+func agentExitCode(code int64) int {
+	if code > 255-exitAgentBase {
+		return 255
+	}
+	return exitAgentBase + int(code)
+}
+
+// stringList is a repeatable string flag
+type stringList []string
+
+// String returns the values as a comma-separated list
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+// Set appends a value
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// getAgent returns the appropriate agent based on name. configDir overrides
+// the agent's config location and installCmd its install command when non-empty.
+func getAgent(name, configDir, installCmd string, replaceMCP bool) (agent.Agent, error) {
 	switch strings.ToLower(name) {
 	case "cursor":
-		return agent.NewCursorAgent(), nil
+		return &agent.CursorAgent{ConfigDir: configDir, InstallCommand: installCmd, ReplaceMCP: replaceMCP}, nil
 	case "claude":
-		return agent.NewClaudeAgent(), nil
+		return &agent.ClaudeAgent{ConfigDir: configDir, InstallCommand: installCmd, ReplaceMCP: replaceMCP}, nil
 	case "opencode":
-		return agent.NewOpenCodeAgent(), nil
+		return &agent.OpenCodeAgent{ConfigDir: configDir, InstallCommand: installCmd, ReplaceMCP: replaceMCP}, nil
 	default:
 		return nil, fmt.Errorf("unknown agent: %s (supported: cursor, claude, opencode)", name)
 	}
 }
 
 func main() {
-	prompt := flag.String("p", "", "Prompt to send to the agent (required)")
-	session := flag.String("s", "", "Reuse an existing browser session ID")
+	os.Exit(run())
+}
+
+// verifyAPIKeys checks the Kernel key with a cheap SDK call and each agent key
+// with its provider where possible. Returns false if any key is rejected.
+func verifyAPIKeys(ctx context.Context, client kernel.Client, agentKeys map[string]string) bool {
+	fmt.Println(dimStyle.Render("Verifying API keys..."))
+
+	ok := true
+	if _, err := client.Browsers.List(ctx, kernel.BrowserListParams{Limit: kernel.Opt(int64(1))}); err != nil {
+		fmt.Fprintln(os.Stderr, errorStyle.Render("KERNEL_API_KEY verification failed: "+err.Error()))
+		ok = false
+	}
+
+	for envVar, key := range agentKeys {
+		err := agent.VerifyAPIKey(ctx, envVar, key)
+		switch {
+		case err == nil:
+		case errors.Is(err, agent.ErrVerifyUnsupported):
+			fmt.Println(dimStyle.Render("Skipping " + envVar + " verification (not supported)"))
+		case errors.Is(err, agent.ErrInvalidKey):
+			fmt.Fprintln(os.Stderr, errorStyle.Render(envVar+" was rejected by the provider"))
+			ok = false
+		default:
+			fmt.Println(dimStyle.Render("Could not verify " + envVar + ": " + err.Error()))
+		}
+	}
+
+	if ok {
+		fmt.Println(successStyle.Render("API keys verified"))
+	}
+	return ok
+}
+
+// validateBaseURL checks that raw is an absolute http or https URL
+func validateBaseURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%q: scheme must be http or https", raw)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%q: missing host", raw)
+	}
+	return nil
+}
+
+// envFlags maps environment variables to the flags they provide defaults for.
+// Kept to the key knobs for fixed-flag environments such as containers.
+var envFlags = map[string]string{
+	"PLAYWRITER_AGENT":           "agent",
+	"PLAYWRITER_MODEL":           "m",
+	"PLAYWRITER_TIMEOUT_SECONDS": "timeout-seconds",
+	"PLAYWRITER_AGENT_TIMEOUT":   "agent-timeout",
+	"PLAYWRITER_QUIET":           "quiet",
+	"PLAYWRITER_JSON_ERRORS":     "json-errors",
+	"PLAYWRITER_CONFIG":          "config",
+	"KERNEL_BASE_URL":            "kernel-base-url",
+}
+
+// setFlags returns the names of flags set so far, treating -model as -m
+func setFlags() map[string]bool {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "model" {
+			set["m"] = true
+		}
+		set[f.Name] = true
+	})
+	return set
+}
+
+// applyEnvFlags sets flags not given on the command line from envFlags. It
+// runs before loadConfig, which treats flags set here as explicit, giving the
+// precedence flag > env > config file > default.
+func applyEnvFlags() error {
+	explicit := setFlags()
+	for envVar, name := range envFlags {
+		value, ok := os.LookupEnv(envVar)
+		if !ok || value == "" || explicit[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("invalid %s: %w", envVar, err)
+		}
+	}
+	return nil
+}
+
+// loadConfig loads the config file at path (or one discovered in the current
+// directory) and applies it beneath the command line: file values only fill
+// flags that weren't given explicitly, and its env entries only fill variables
+// missing from the environment. Returns nil if there is no config file.
+func loadConfig(path string, promptVars prompt.Vars) (*config.Config, error) {
+	cfg, cfgPath, err := config.Resolve(path)
+	if errors.Is(err, config.ErrNoConfig) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	explicit := setFlags()
+	for name, value := range cfg.FlagValues() {
+		if explicit[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return nil, fmt.Errorf("config %s: invalid %s: %w", cfgPath, name, err)
+		}
+	}
+	for name, values := range cfg.ListValues() {
+		if explicit[name] {
+			continue
+		}
+		for _, value := range values {
+			if err := flag.Set(name, value); err != nil {
+				return nil, fmt.Errorf("config %s: invalid %s: %w", cfgPath, name, err)
+			}
+		}
+	}
+	for key, value := range cfg.Vars {
+		if _, ok := promptVars[key]; !ok {
+			promptVars[key] = value
+		}
+	}
+	if len(cfg.MCPServers) > 0 {
+		if err := agent.ValidateMCPConfig(agent.MCPConfig{MCPServers: cfg.MCPServers}); err != nil {
+			return nil, fmt.Errorf("config %s: %w", cfgPath, err)
+		}
+	}
+	for name, cmd := range cfg.InstallCommands {
+		if _, err := getAgent(name, "", "", false); err != nil {
+			return nil, fmt.Errorf("config %s: install_commands: %w", cfgPath, err)
+		}
+		if strings.TrimSpace(cmd) == "" {
+			return nil, fmt.Errorf("config %s: install_commands: empty command for %s", cfgPath, name)
+		}
+	}
+	if err := cfg.ApplyEnv(); err != nil {
+		return nil, fmt.Errorf("config %s: %w", cfgPath, err)
+	}
+
+	fmt.Println(dimStyle.Render("Using config: ") + cfgPath)
+	return cfg, nil
+}
+
+// replay renders a stream recorded with -record through the parser, writing
+// a plain transcript to logPath if it's set
+func replay(path, logPath string, explain, timing bool) int {
+	f, err := os.Open(path)
+	if err != nil {
+		return fatal("replay", exitUsage, "Failed to open replay file: "+err.Error())
+	}
+	defer f.Close()
+
+	parser := stream.NewParser()
+	if logPath != "" {
+		logFile, err := os.Create(logPath)
+		if err != nil {
+			return fatal("log", exitUsage, "Failed to create log file: "+err.Error())
+		}
+		defer logFile.Close()
+		parser.Log = logFile
+	}
+	if err := stream.ReplayFrom(f, parser); err != nil {
+		return fatal("replay", exitRunFailure, "Replay failed: "+err.Error())
+	}
+	fmt.Println()
+	summary := parser.Summary()
+	if explain {
+		fmt.Print(stream.FormatSummary(summary))
+	} else if timing && summary.Timing != nil {
+		fmt.Println(dimStyle.Render("Timing: ") + stream.FormatTiming(*summary.Timing))
+	}
+	printStderrTail(parser.StderrTail())
+	return exitSuccess
+}
+
+// requestLogMaxDuration bounds -log-requests when there's no -agent-timeout
+const requestLogMaxDuration = 6 * time.Hour
+
+// writeRequestLog writes requests to path, one JSON object per line
+func writeRequestLog(path string, requests []browser.LoggedRequest) error {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, r := range requests {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(path, b.Bytes(), 0o644)
+}
+
+// printSessions lists the sessions in store, most recently used first
+func printSessions(store *sessions.Store, maxAge time.Duration) int {
+	records, err := store.List()
+	if err != nil {
+		return fatal("usage", exitUsage, "Session store: "+err.Error())
+	}
+	now := time.Now()
+	listed := 0
+	for _, r := range records {
+		if maxAge > 0 && now.Sub(r.LastUsedAt) > maxAge {
+			continue
+		}
+		tag := r.Tag
+		if tag == "" {
+			tag = "-"
+		}
+		state := "active"
+		if r.Expired(now) {
+			state = "expired"
+		}
+		fmt.Printf("%-24s  %-20s  %-8s  %-7s  %s\n", r.SessionID, tag, r.Agent, state, dimStyle.Render("last used "+r.LastUsedAt.Format(time.RFC3339)))
+		listed++
+	}
+	if listed == 0 {
+		fmt.Println(dimStyle.Render("No sessions recorded in " + store.Dir))
+	}
+	return exitSuccess
+}
+
+// parseAge parses a -since duration: anything time.ParseDuration accepts,
+// or a whole number of days such as "3d"
+func parseAge(s string) (time.Duration, error) {
+	var d time.Duration
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("%q: expected a duration like 2h or 3d", s)
+		}
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if d, err = time.ParseDuration(s); err != nil {
+			return 0, fmt.Errorf("%q: expected a duration like 2h or 3d", s)
+		}
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("%q: must be positive", s)
+	}
+	return d, nil
+}
+
+// checkExpectations checks the agent's final answer against -expect and
+// -expect-regex. Returns a description of the first failed check, or "".
+func checkExpectations(final, substring string, re *regexp.Regexp) string {
+	if substring != "" && !strings.Contains(final, substring) {
+		return fmt.Sprintf("Expectation failed: final answer does not contain %q", substring)
+	}
+	if re != nil && !re.MatchString(final) {
+		return fmt.Sprintf("Expectation failed: final answer does not match %q", re.String())
+	}
+	return ""
+}
+
+// jsonErrors makes fatal errors print as JSON objects (-json-errors)
+var jsonErrors bool
+
+// fatalError describes a failure that ends the run. With -json-errors it is
+// printed to stderr as-is, so the field names are a stable interface.
+type fatalError struct {
+	Error      string   `json:"error"`
+	Phase      string   `json:"phase"`
+	ExitCode   int      `json:"exitCode"`
+	StderrTail []string `json:"stderrTail,omitempty"`
+}
+
+// fatal reports a failure in phase and returns code as the exit code
+func fatal(phase string, code int, msg string) int {
+	return reportFatal(fatalError{Error: msg, Phase: phase, ExitCode: code})
+}
+
+// agentFailure describes a run that ended with err, by the phase it failed in
+func agentFailure(err error, stderrTail []string) fatalError {
+	failure := fatalError{Error: err.Error(), Phase: "agent", ExitCode: exitRunFailure, StderrTail: stderrTail}
+	if errors.Is(err, context.DeadlineExceeded) {
+		failure.Phase, failure.ExitCode = "timeout", exitAgentTimeout
+	}
+	if errors.Is(err, agent.ErrAgentNotInstalled) {
+		failure.Phase, failure.ExitCode = "setup", exitSetupFailure
+	}
+	if errors.Is(err, agent.ErrBrowserDown) {
+		failure.Phase = "browser"
+	}
+	return failure
+}
+
+// reportFatal prints e to stderr, as JSON with -json-errors or as styled text
+// followed by the agent's last stderr lines, and returns its exit code
+func reportFatal(e fatalError) int {
+	// Commands and agent output in errors may echo an API key
+	e.Error = redactSecrets(e.Error, knownSecrets)
+	for i, line := range e.StderrTail {
+		e.StderrTail[i] = redactSecrets(line, knownSecrets)
+	}
+
+	if jsonErrors {
+		data, _ := json.Marshal(e)
+		fmt.Fprintln(os.Stderr, string(data))
+		return e.ExitCode
+	}
+	fmt.Fprintln(os.Stderr, errorStyle.Render(e.Error))
+	printStderrTail(e.StderrTail)
+	return e.ExitCode
+}
+
+// printStderrTail prints the agent's last stderr lines, where the real cause
+// of a failure usually is
+func printStderrTail(tail []string) {
+	if len(tail) == 0 {
+		return
+	}
+	fmt.Fprintln(os.Stderr, dimStyle.Render("Last stderr output:"))
+	for _, line := range tail {
+		fmt.Fprintln(os.Stderr, dimStyle.Render("  "+line))
+	}
+}
+
+// run executes the CLI and returns the process exit code. Returning instead of
+// calling os.Exit lets deferred cleanup run on every path.
+func run() int {
+	usePlainStyles()
+
+	promptText := flag.String("p", "", "Prompt to send to the agent (required unless -prompt-file, -conversation, or -setup-only is set)")
+	promptFile := flag.String("prompt-file", "", "Read the prompt from a file")
+	conversationFile := flag.String("conversation", "", "Seed the run with a JSON array of {role, content} turns; -p adds a final user turn")
+	promptVars := prompt.Vars{}
+	flag.Var(promptVars, "var", "Prompt template variable as key=value (repeatable)")
+	allowUndefinedVars := flag.Bool("allow-undefined-vars", false, "Leave undefined {{key}} placeholders in the prompt instead of failing")
+	noFileExpand := flag.Bool("no-file-expand", false, "Send @path references in the prompt as-is instead of inlining the files")
+	session := flag.String("s", "", "Reuse an existing browser session by ID or live view URL, or tag:NAME for the latest session tagged NAME")
+	tag := flag.String("tag", "", "Label the session and run with this tag, e.g. scrape-job-42")
+	listSessions := flag.Bool("list-sessions", false, "List the sessions recorded locally, with their tags, and exit")
+	since := flag.String("since", "", "With -list-sessions, only list sessions used within this long, e.g. 2h or 3d")
 	timeout := flag.Int64("timeout-seconds", 600, "Browser session timeout in seconds")
 	agentTimeout := flag.Int64("agent-timeout", 0, "Hard timeout for agent in seconds (0 = no limit)")
-	model := flag.String("m", "", "Model to use (default depends on agent)")
+	resume := flag.String("resume", "", "Continue the agent's conversation with this ID, as printed at the end of an earlier run")
+	maxTurns := flag.Int("max-turns", 0, "Stop the agent after this many agentic turns (0 = no limit; claude only)")
+	heartbeat := flag.Int64("heartbeat", 0, "Emit a heartbeat event after this many seconds without agent output (0 = off)")
+	retryTransient := flag.Bool("retry-transient", false, "Re-run the prompt once if the agent fails with a transient error (rate limit, network reset)")
+	ignoreResultError := flag.Bool("ignore-result-error", false, "Succeed whenever the agent exits 0, even if its final result reports an error")
+	model := flag.String("m", "", "Model to use, or an alias: fast, smart, default (default depends on agent)")
+	flag.StringVar(model, "model", "", "Alias for -m")
 	deleteBrowser := flag.Bool("d", false, "Delete browser session on exit")
+	setupOnly := flag.Bool("setup-only", false, "Set up the session, print its ID, and exit without running a prompt")
+	headless := flag.Bool("headless", false, "Create a headless browser (no live view; the extension is activated programmatically)")
+	setupScript := flag.String("setup-script", "", "Run this local script in the session as the kernel user before the agent starts")
+	storageState := flag.String("storage-state", "", "Load cookies and localStorage from this Playwright storage state file before the run and save them back on exit")
+	var uploads, hosts stringList
+	flag.Var(&hosts, "host", "Add an /etc/hosts entry in the session as name:ip, e.g. app.internal:10.0.0.5 (repeatable)")
+	flag.Var(&uploads, "upload", "Copy a local file or directory into the session before the agent starts, as local:remote (repeatable)")
+	reapTabs := flag.Int("reap-tabs", 0, "Before the run, close all but the N most recently active tabs (0 = off)")
+	softCleanup := flag.Bool("soft-cleanup", false, "On exit, stop the relay, close extra tabs, and remove temp files but keep the session")
+	removePlaywriter := flag.Bool("remove-playwriter", false, "With -soft-cleanup, also remove the playwriter build to reclaim space; the next run reinstalls it")
 	agentName := flag.String("agent", "", "Agent to use: cursor or claude (required)")
+	extension := flag.String("extension", "playwriter", "Name of the uploaded Kernel extension to load")
+	verifyKeys := flag.Bool("verify-keys", false, "Verify API keys with their providers before setup")
+	startPage := flag.String("url", browser.StartURL, "Page to open after setup (\"none\" for a blank page)")
+	closeTabs := flag.Bool("close-tabs", true, "Close existing tabs during setup (use -close-tabs=false to keep them)")
+	configDir := flag.String("config-dir", "", "Override the agent's config directory in the session (absolute path)")
+	webhookURL := flag.String("webhook", "", "POST each stream event as JSON to this URL")
+	printCommand := flag.Bool("print-command", false, "Print the command the agent would be run with (API keys masked) and exit without creating a session")
+	force := flag.Bool("force", false, "Run even if the session's run lock says another run is using it")
+	openLiveView := flag.Bool("open", false, "Open the live view in the local browser once the session is ready")
+	liveStatus := flag.Bool("live-status", false, "Show the agent's latest tool call in a banner in the live view")
+	logRequests := flag.String("log-requests", "", "Log the browser's outbound requests during the run to this file as JSON lines")
+	printRecording := flag.Bool("print-recording", false, "Record the session's display during the run and print the recording's URL")
+	asRoot := flag.Bool("as-root", false, "Run the agent as root instead of the kernel user (claude only without -auto-approve)")
+	mcpRuntime := flag.String("mcp-runtime", "node", "Runtime for the MCP server: node, bun, or an absolute path")
+	mcpServerName := flag.String("mcp-server-name", agent.PlaywriterServerName, "Name of the playwriter server in the agent's MCP config, which prefixes its tool names")
+	mcpReplace := flag.Bool("mcp-replace", false, "Overwrite the agent's MCP config instead of keeping servers already configured in the session")
+	playwriterRepo := flag.String("playwriter-repo", browser.DefaultPlaywriterRepo, "Git repository (e.g. a fork) to build playwriter from")
+	playwriterPatch := flag.String("playwriter-patch-file", browser.DefaultPlaywriterPatchFile, "Relay file whose extension allowlist is patched, relative to the repo root")
+	externalRelay := flag.String("external-relay", "", "Use a playwriter relay run outside the session at this endpoint instead of building and starting one")
+	var extraExtensions stringList
+	flag.Var(&extraExtensions, "extra-extension", "Additional uploaded Kernel extension to load (repeatable)")
+	pinExtra := flag.Bool("pin-extra-extensions", false, "Pin extensions added with -extra-extension to the toolbar")
+	verbose := flag.Bool("verbose", false, "Print debug details about the agent's output stream and a breakdown of setup timings")
+	quiet := flag.Bool("quiet", false, "Suppress progress indicators during setup")
+	noParallel := flag.Bool("no-parallel", false, "Run setup phases one at a time instead of installing the agent while playwriter builds")
+	noPTY := flag.Bool("no-pty", false, "Run the agent without allocating a PTY")
+	autoApprove := flag.Bool("auto-approve", true, "Approve the agent's tool and MCP use without prompting (use -auto-approve=false to surface approval requests)")
+	agentOutputFormat := flag.String("agent-output-format", "json", "Agent output format: json (events) or text (plain lines, a fallback when JSON mode misbehaves)")
+	streamText := flag.Bool("stream-text", false, "Render assistant text as it streams instead of whole messages (claude only)")
+	workDir := flag.String("workdir", "", "Directory in the session the agent runs in (default: /home/kernel)")
+	var allowTools, denyTools, autoApproveTools stringList
+	flag.Var(&autoApproveTools, "auto-approve-tools", "Comma-separated tools whose approval requests are answered automatically; others are surfaced. Implies -auto-approve=false (repeatable)")
+	flag.Var(&allowTools, "allow-tool", "Tool the agent may use, e.g. mcp__playwriter__execute (repeatable)")
+	flag.Var(&denyTools, "deny-tool", "Tool the agent may not use, e.g. Bash (repeatable)")
+	warmPool := flag.Int("warm-pool", 0, "Run as a daemon keeping N prepared sessions for the agent")
+	useWarm := flag.Bool("warm", false, "Claim a prepared session from the warm pool if one is available")
+	poolDir := flag.String("pool-dir", "", "Warm pool directory (default: ~/.playwriter-in-kernel/warm-pool)")
+	maxSessions := flag.Int("max-concurrent-sessions", 0, "Wait to create a session until fewer than N are live on the Kernel account (0 = no limit)")
+	relayLogs := flag.Bool("relay-logs", false, "Show the Playwriter relay's log alongside the agent output")
+	explain := flag.Bool("explain", false, "After the run, summarize the pages visited, tools used, files written, and final answer")
+	timing := flag.Bool("timing", false, "Stamp each event with ts and delta_ms, and report time to first token and the longest gap")
+	expect := flag.String("expect", "", "Fail unless the agent's final answer contains this substring")
+	expectRegex := flag.String("expect-regex", "", "Fail unless the agent's final answer matches this regular expression")
+	setupReportFile := flag.String("setup-report", "", "Write a JSON report of setup phases and timings to this file")
+	logPath := flag.String("log", "", "Also write the rendered output, without styling, to this file")
+	recordFile := flag.String("record", "", "Save the run's event stream to this file for -replay")
+	replayFile := flag.String("replay", "", "Render a stream saved with -record instead of running an agent")
+	jsonErrorsFlag := flag.Bool("json-errors", false, "Print fatal errors to stderr as JSON objects instead of styled text")
+	apiKeyFile := flag.String("api-key-file", "", "Read the agent's API key from this file instead of its environment variable")
+	apiKeyCmd := flag.String("api-key-cmd", "", "Read the agent's API key from the output of this shell command")
+	kernelKeyFile := flag.String("kernel-api-key-file", "", "Read KERNEL_API_KEY from this file")
+	kernelKeyCmd := flag.String("kernel-api-key-cmd", "", "Read KERNEL_API_KEY from the output of this shell command")
+	kernelBaseURL := flag.String("kernel-base-url", "", "Kernel API base URL for self-hosted or regional deployments (default: the SDK's)")
+	configFile := flag.String("config", "", "Load settings from a YAML or JSON file (default: .playwriter.yaml in the current directory)")
 	flag.Parse()
+	jsonErrors = *jsonErrorsFlag
+
+	// PLAYWRITER_* environment variables fill in flags not given explicitly
+	if err := applyEnvFlags(); err != nil {
+		return fatal("usage", exitUsage, err.Error())
+	}
+
+	// Load settings from a config file; flags given explicitly take precedence
+	cfg, err := loadConfig(*configFile, promptVars)
+	if err != nil {
+		return fatal("config", exitUsage, err.Error())
+	}
+	jsonErrors = *jsonErrorsFlag // the environment or config file may have enabled it
+	var extraMCP map[string]agent.MCPServer
+	if cfg != nil {
+		extraMCP = cfg.MCPServers
+	}
+
+	if *quiet {
+		browser.ProgressEnabled = false
+	}
+	parallelSetup = !*noParallel
+	agent.Verbose = *verbose
+
+	sessionStore := sessions.NewStore("")
+	if *listSessions {
+		var maxAge time.Duration
+		if *since != "" {
+			d, err := parseAge(*since)
+			if err != nil {
+				return fatal("usage", exitUsage, "invalid -since: "+err.Error())
+			}
+			maxAge = d
+		}
+		return printSessions(sessionStore, maxAge)
+	}
+
+	// Replay renders a recorded run locally; no browser or agent is needed
+	if *replayFile != "" {
+		return replay(*replayFile, *logPath, *explain, *timing)
+	}
+
+	if *promptFile != "" {
+		data, err := os.ReadFile(*promptFile)
+		if err != nil {
+			return fatal("usage", exitUsage, "Failed to read prompt file: "+err.Error())
+		}
+		*promptText = string(data)
+	}
+
+	// A seeded conversation is flattened into the prompt, since none of the
+	// agent CLIs accept a prior message history
+	if *conversationFile != "" {
+		turns, err := prompt.LoadConversation(*conversationFile)
+		if err != nil {
+			return fatal("usage", exitUsage, "Failed to load conversation: "+err.Error())
+		}
+		*promptText, err = prompt.FormatConversation(turns, *promptText)
+		if err != nil {
+			return fatal("usage", exitUsage, err.Error())
+		}
+	}
 
-	if *prompt == "" || *agentName == "" {
+	if (strings.TrimSpace(*promptText) == "" && *warmPool == 0 && !*setupOnly) || *agentName == "" {
 		fmt.Fprintln(os.Stderr, "Usage: playwriter-in-kernel -agent <cursor|claude|opencode> -p \"your prompt\" [options]")
+		fmt.Fprintln(os.Stderr, "       playwriter-in-kernel -agent <cursor|claude|opencode> -setup-only [options]")
+		fmt.Fprintln(os.Stderr, "       playwriter-in-kernel -agent <cursor|claude|opencode> -warm-pool N [options]")
 		fmt.Fprintln(os.Stderr, "")
 		fmt.Fprintln(os.Stderr, "Options:")
 		fmt.Fprintln(os.Stderr, "  -agent string       Agent to use: cursor, claude, or opencode (required)")
-		fmt.Fprintln(os.Stderr, "  -p string           Prompt to send to the agent (required)")
-		fmt.Fprintln(os.Stderr, "  -s string           Reuse an existing browser session ID")
-		fmt.Fprintln(os.Stderr, "  -m string           Model to use (default depends on agent)")
+		fmt.Fprintln(os.Stderr, "  -config path        Load settings from a YAML or JSON file (default: .playwriter.yaml)")
+		fmt.Fprintln(os.Stderr, "  -p string           Prompt to send to the agent (required unless -prompt-file, -conversation, or -setup-only)")
+		fmt.Fprintln(os.Stderr, "  -prompt-file path   Read the prompt from a file")
+		fmt.Fprintln(os.Stderr, "  -conversation path  Seed the run with a JSON array of {role, content} turns")
+		fmt.Fprintln(os.Stderr, "  -var key=value      Substitute {{key}} in the prompt (repeatable)")
+		fmt.Fprintln(os.Stderr, "  -allow-undefined-vars  Leave undefined {{key}} placeholders as-is")
+		fmt.Fprintln(os.Stderr, "  -no-file-expand     Send @path references as-is instead of inlining the files")
+		fmt.Fprintln(os.Stderr, "  -s string           Reuse an existing browser session by ID or live view URL, or tag:NAME")
+		fmt.Fprintln(os.Stderr, "  -tag name           Label the session and run with a tag")
+		fmt.Fprintln(os.Stderr, "  -list-sessions      List locally recorded sessions and their tags")
+		fmt.Fprintln(os.Stderr, "  -since duration     With -list-sessions, only sessions used within e.g. 2h or 3d")
+		fmt.Fprintln(os.Stderr, "  -m string           Model to use, or fast/smart/default (default depends on agent)")
 		fmt.Fprintln(os.Stderr, "  -timeout-seconds    Browser session timeout (default: 600)")
 		fmt.Fprintln(os.Stderr, "  -agent-timeout      Hard timeout for agent (default: 0 = no limit)")
+		fmt.Fprintln(os.Stderr, "  -resume id          Continue the agent's conversation from an earlier run")
+		fmt.Fprintln(os.Stderr, "  -max-turns N        Stop the agent after N agentic turns (claude only)")
+		fmt.Fprintln(os.Stderr, "  -heartbeat N        Emit a heartbeat after N seconds without agent output")
+		fmt.Fprintln(os.Stderr, "  -retry-transient    Re-run the prompt once after a transient failure (rate limit, network reset)")
+		fmt.Fprintln(os.Stderr, "  -ignore-result-error  Only the agent's exit code decides success, not its final result")
 		fmt.Fprintln(os.Stderr, "  -d                  Delete browser session on exit")
+		fmt.Fprintln(os.Stderr, "  -setup-only         Set up the session, print its ID, and exit; run prompts later with -s")
+		fmt.Fprintln(os.Stderr, "  -soft-cleanup       On exit, stop the relay, close extra tabs, and remove temp files")
+		fmt.Fprintln(os.Stderr, "  -remove-playwriter  With -soft-cleanup, also remove the playwriter build (reinstalled on reuse)")
+		fmt.Fprintln(os.Stderr, "  -headless           Create a headless browser (no live view)")
+		fmt.Fprintln(os.Stderr, "  -host name:ip       Add an /etc/hosts entry in the session (repeatable)")
+		fmt.Fprintln(os.Stderr, "  -setup-script file  Run a local script in the session before the agent starts")
+		fmt.Fprintln(os.Stderr, "  -storage-state file  Load cookies/localStorage from file before the run, save them on exit")
+		fmt.Fprintln(os.Stderr, "  -upload local:remote  Copy a local file or directory into the session (repeatable)")
+		fmt.Fprintln(os.Stderr, "  -reap-tabs N        Before the run, close all but the N most recently active tabs")
+		fmt.Fprintln(os.Stderr, "  -verify-keys        Verify API keys with their providers before setup")
+		fmt.Fprintln(os.Stderr, "  -url string         Page to open after setup, or \"none\" for a blank page (default: duckduckgo.com)")
+		fmt.Fprintln(os.Stderr, "  -close-tabs         Close existing tabs during setup (default: true)")
+		fmt.Fprintln(os.Stderr, "  -config-dir path    Override the agent's config directory in the session")
+		fmt.Fprintln(os.Stderr, "  -webhook url        POST each stream event as JSON to this URL")
+		fmt.Fprintln(os.Stderr, "  -open               Open the live view in the local browser")
+		fmt.Fprintln(os.Stderr, "  -force              Run even if another run appears to be using the session")
+		fmt.Fprintln(os.Stderr, "  -print-command      Print the agent command (API keys masked) and exit")
+		fmt.Fprintln(os.Stderr, "  -live-status        Show the agent's latest tool call in a banner in the live view")
+		fmt.Fprintln(os.Stderr, "  -log-requests file  Log the browser's outbound requests during the run as JSON lines")
+		fmt.Fprintln(os.Stderr, "  -print-recording    Record the display during the run and print the recording URL")
+		fmt.Fprintln(os.Stderr, "  -relay-logs         Show the Playwriter relay's log alongside agent output")
+		fmt.Fprintln(os.Stderr, "  -explain            After the run, summarize pages visited, tools used, and files written")
+		fmt.Fprintln(os.Stderr, "  -timing             Stamp events with ts and delta_ms; report time to first token and longest gap")
+		fmt.Fprintln(os.Stderr, "  -expect text        Fail (exit 13) unless the final answer contains text")
+		fmt.Fprintln(os.Stderr, "  -expect-regex re    Fail (exit 13) unless the final answer matches re")
+		fmt.Fprintln(os.Stderr, "  -json-errors        Print fatal errors as JSON objects (error, phase, exitCode)")
+		fmt.Fprintln(os.Stderr, "  -setup-report file  Write a JSON report of setup phases and timings")
+		fmt.Fprintln(os.Stderr, "  -log file           Also write the rendered output, without styling, to a file")
+		fmt.Fprintln(os.Stderr, "  -record file        Save the run's event stream to a file")
+		fmt.Fprintln(os.Stderr, "  -replay file        Render a stream saved with -record (no agent needed)")
+		fmt.Fprintln(os.Stderr, "  -as-root            Run the agent as root instead of the kernel user (claude: not with -auto-approve)")
+		fmt.Fprintln(os.Stderr, "  -extension          Name of the uploaded Kernel extension (default: playwriter)")
+		fmt.Fprintln(os.Stderr, "  -mcp-runtime        Runtime for the MCP server: node, bun, or absolute path (default: node)")
+		fmt.Fprintln(os.Stderr, "  -mcp-server-name    Name of the playwriter MCP server (default: playwriter)")
+		fmt.Fprintln(os.Stderr, "  -mcp-replace        Overwrite the MCP config instead of merging with existing servers")
+		fmt.Fprintln(os.Stderr, "  -playwriter-repo url  Git repository (e.g. a fork) to build playwriter from")
+		fmt.Fprintln(os.Stderr, "  -playwriter-patch-file path  Relay file with the extension allowlist, relative to the repo root")
+		fmt.Fprintln(os.Stderr, "  -external-relay url  Use a relay run outside the session instead of building one")
+		fmt.Fprintln(os.Stderr, "  -extra-extension name  Additional uploaded Kernel extension to load (repeatable)")
+		fmt.Fprintln(os.Stderr, "  -pin-extra-extensions  Pin extensions added with -extra-extension")
+		fmt.Fprintln(os.Stderr, "  -quiet              Suppress progress indicators during setup")
+		fmt.Fprintln(os.Stderr, "  -no-parallel        Run setup phases one at a time")
+		fmt.Fprintln(os.Stderr, "  -verbose            Print debug details about the output stream and setup timings")
+		fmt.Fprintln(os.Stderr, "  -no-pty             Run the agent without allocating a PTY")
+		fmt.Fprintln(os.Stderr, "  -auto-approve       Approve tool and MCP use without prompting (default true)")
+		fmt.Fprintln(os.Stderr, "  -auto-approve-tools list  Approve only these tools, e.g. navigate,screenshot (implies -auto-approve=false)")
+		fmt.Fprintln(os.Stderr, "  -stream-text        Render assistant text as it streams (claude only)")
+		fmt.Fprintln(os.Stderr, "  -agent-output-format  json (default) or text, a fallback when the agent's JSON mode misbehaves")
+		fmt.Fprintln(os.Stderr, "  -workdir path       Directory in the session the agent runs in (default: /home/kernel)")
+		fmt.Fprintln(os.Stderr, "  -allow-tool name    Tool the agent may use (repeatable, claude only)")
+		fmt.Fprintln(os.Stderr, "  -deny-tool name     Tool the agent may not use (repeatable, claude only)")
+		fmt.Fprintln(os.Stderr, "  -warm-pool N        Run as a daemon keeping N prepared sessions for the agent")
+		fmt.Fprintln(os.Stderr, "  -warm               Claim a prepared session from the warm pool if available")
+		fmt.Fprintln(os.Stderr, "  -pool-dir path      Warm pool directory (default: ~/.playwriter-in-kernel/warm-pool)")
+		fmt.Fprintln(os.Stderr, "  -max-concurrent-sessions N  Queue session creation while N sessions are live on the account")
+		fmt.Fprintln(os.Stderr, "  -api-key-file path  Read the agent's API key from a file (cursor, claude)")
+		fmt.Fprintln(os.Stderr, "  -api-key-cmd cmd    Read the agent's API key from a command's output (cursor, claude)")
+		fmt.Fprintln(os.Stderr, "  -kernel-api-key-file path  Read KERNEL_API_KEY from a file")
+		fmt.Fprintln(os.Stderr, "  -kernel-api-key-cmd cmd    Read KERNEL_API_KEY from a command's output")
+		fmt.Fprintln(os.Stderr, "  -kernel-base-url u  Kernel API base URL for self-hosted or regional deployments")
 		fmt.Fprintln(os.Stderr, "")
 		fmt.Fprintln(os.Stderr, "Environment variables:")
 		fmt.Fprintln(os.Stderr, "  KERNEL_API_KEY      Kernel API key (required)")
+		fmt.Fprintln(os.Stderr, "  KERNEL_BASE_URL     Default for -kernel-base-url")
 		fmt.Fprintln(os.Stderr, "  CURSOR_API_KEY      Cursor API key (required for cursor agent)")
 		fmt.Fprintln(os.Stderr, "  ANTHROPIC_API_KEY   Anthropic API key (required for claude agent)")
-		os.Exit(1)
+		fmt.Fprintln(os.Stderr, "  PLAYWRITER_AGENT, PLAYWRITER_MODEL, PLAYWRITER_TIMEOUT_SECONDS, PLAYWRITER_AGENT_TIMEOUT,")
+		fmt.Fprintln(os.Stderr, "  PLAYWRITER_QUIET, PLAYWRITER_JSON_ERRORS, PLAYWRITER_CONFIG")
+		fmt.Fprintln(os.Stderr, "                      Defaults for the matching flags (flags take precedence)")
+		fmt.Fprintln(os.Stderr, "")
+		fmt.Fprintln(os.Stderr, "Exit codes:")
+		fmt.Fprintln(os.Stderr, "  0                   Success")
+		fmt.Fprintln(os.Stderr, "  2                   Invalid usage or missing environment variables")
+		fmt.Fprintln(os.Stderr, "  10                  Setup failure (browser, agent install, relay, MCP)")
+		fmt.Fprintln(os.Stderr, "  11                  Agent timed out (-agent-timeout)")
+		fmt.Fprintln(os.Stderr, "  12                  Agent could not be run or its output stream failed")
+		fmt.Fprintln(os.Stderr, "  13                  Final answer didn't match -expect or -expect-regex")
+		fmt.Fprintln(os.Stderr, "  14                  Agent exited 0 but its final result reported an error")
+		fmt.Fprintln(os.Stderr, "  100+N               Agent exited with code N (capped at 255)")
+		return exitUsage
+	}
+
+	// Compile -expect-regex before setup so a typo fails fast
+	var expectRe *regexp.Regexp
+	if *expectRegex != "" {
+		expectRe, err = regexp.Compile(*expectRegex)
+		if err != nil {
+			return fatal("usage", exitUsage, "invalid -expect-regex: "+err.Error())
+		}
+	}
+
+	// Check uploads before creating anything so a typo fails fast
+	type upload struct{ local, remote string }
+	var uploadPaths []upload
+	for _, u := range uploads {
+		i := strings.LastIndex(u, ":")
+		if i <= 0 || !strings.HasPrefix(u[i+1:], "/") {
+			return fatal("usage", exitUsage, "invalid -upload: "+u+" (expected local:/absolute/remote/path)")
+		}
+		local, remote := u[:i], u[i+1:]
+		if _, err := os.Stat(local); err != nil {
+			return fatal("usage", exitUsage, "-upload: "+err.Error())
+		}
+		uploadPaths = append(uploadPaths, upload{local, remote})
+	}
+
+	var hostsEntries []browser.HostsEntry
+	for _, h := range hosts {
+		entry, err := browser.ParseHostsEntry(h)
+		if err != nil {
+			return fatal("usage", exitUsage, "-host: "+err.Error())
+		}
+		hostsEntries = append(hostsEntries, entry)
+	}
+
+	// Read the setup script now so a bad path fails before any setup
+	var setupScriptText string
+	if *setupScript != "" {
+		data, err := os.ReadFile(*setupScript)
+		if err != nil {
+			return fatal("usage", exitUsage, "Failed to read setup script: "+err.Error())
+		}
+		setupScriptText = string(data)
+	}
+
+	// Substitute template variables before the agent escapes the prompt
+	renderedPrompt, err := prompt.Render(*promptText, promptVars, *allowUndefinedVars)
+	if err != nil {
+		return fatal("usage", exitUsage, err.Error())
+	}
+
+	// Inline @path files after rendering, so their contents aren't templated.
+	// Only files under the working directory may be read.
+	if !*noFileExpand {
+		renderedPrompt, err = prompt.ExpandFiles(renderedPrompt, ".")
+		if err != nil {
+			return fatal("usage", exitUsage, "Failed to expand file reference: "+err.Error())
+		}
 	}
 
 	// Get the agent
-	ag, err := getAgent(*agentName)
+	if *configDir != "" && !strings.HasPrefix(*configDir, "/") {
+		return fatal("usage", exitUsage, "-config-dir must be an absolute path")
+	}
+	var installCmd string
+	if cfg != nil {
+		for name, cmd := range cfg.InstallCommands {
+			if strings.EqualFold(name, *agentName) {
+				installCmd = cmd
+			}
+		}
+	}
+	ag, err := getAgent(*agentName, *configDir, installCmd, *mcpReplace)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, errorStyle.Render(err.Error()))
-		os.Exit(1)
+		return fatal("usage", exitUsage, err.Error())
+	}
+	if err := agent.CheckPromptSize(ag, renderedPrompt); err != nil {
+		return fatal("usage", exitUsage, err.Error())
+	}
+
+	// Only Claude Code has a turn limit; the others would run unbounded
+	if *maxTurns < 0 {
+		return fatal("usage", exitUsage, "-max-turns must not be negative")
+	}
+	if *maxTurns > 0 && ag.Name() != "claude" {
+		fmt.Fprintln(os.Stderr, warningStyle.Render("Warning: -max-turns is not supported by "+ag.Name()+" and is ignored; use -agent-timeout to bound the run"))
+	}
+
+	if *resume != "" {
+		if err := agent.ValidateResumeID(*resume); err != nil {
+			return fatal("usage", exitUsage, "-resume: "+err.Error())
+		}
+	}
+
+	if *maxSessions < 0 {
+		return fatal("usage", exitUsage, "-max-concurrent-sessions must not be negative")
+	}
+
+	if *removePlaywriter && !*softCleanup {
+		return fatal("usage", exitUsage, "-remove-playwriter requires -soft-cleanup")
+	}
+
+	// A setup-only session is kept for later runs, so nothing may undo it on exit
+	if *setupOnly {
+		switch {
+		case *deleteBrowser:
+			return fatal("usage", exitUsage, "-setup-only can't be combined with -d")
+		case *softCleanup:
+			return fatal("usage", exitUsage, "-setup-only can't be combined with -soft-cleanup")
+		case *warmPool > 0:
+			return fatal("usage", exitUsage, "-setup-only can't be combined with -warm-pool")
+		case strings.TrimSpace(*promptText) != "":
+			fmt.Fprintln(os.Stderr, warningStyle.Render("Warning: -setup-only doesn't run a prompt; the prompt is ignored"))
+		}
+	}
+
+	// Validate the MCP runtime
+	if *mcpRuntime != "node" && *mcpRuntime != "bun" && !strings.HasPrefix(*mcpRuntime, "/") {
+		return fatal("usage", exitUsage, "invalid -mcp-runtime: "+*mcpRuntime+" (supported: node, bun, or an absolute path)")
+	}
+
+	// Approving only some tools means the agent must ask about the rest
+	var approveTools agent.ApprovalPolicy
+	for _, list := range autoApproveTools {
+		for _, tool := range strings.Split(list, ",") {
+			if tool = strings.TrimSpace(tool); tool != "" {
+				approveTools = append(approveTools, tool)
+			}
+		}
+	}
+	if len(approveTools) > 0 {
+		if *autoApprove && setFlags()["auto-approve"] {
+			return fatal("usage", exitUsage, "-auto-approve-tools can't be used with -auto-approve (it approves every tool)")
+		}
+		*autoApprove = false
+	}
+
+	// Claude Code refuses --dangerously-skip-permissions as root; fail before setup
+	if *asRoot && *autoApprove && ag.Name() == "claude" {
+		return fatal("usage", exitUsage, "-as-root with claude needs -auto-approve=false or -auto-approve-tools (it refuses --dangerously-skip-permissions as root)")
+	}
+
+	// Text output carries no events, so nothing that reads them can work
+	switch *agentOutputFormat {
+	case "json":
+	case "text":
+		if *streamText {
+			return fatal("usage", exitUsage, "-stream-text needs -agent-output-format json")
+		}
+		if len(approveTools) > 0 {
+			return fatal("usage", exitUsage, "-auto-approve-tools needs -agent-output-format json")
+		}
+	default:
+		return fatal("usage", exitUsage, "invalid -agent-output-format: "+*agentOutputFormat+" (supported: json, text)")
+	}
+
+	// An external relay's log and extension connection aren't ours to manage
+	if *externalRelay != "" {
+		if err := validateBaseURL(*externalRelay); err != nil {
+			return fatal("usage", exitUsage, "invalid -external-relay: "+err.Error())
+		}
+		if *relayLogs {
+			return fatal("usage", exitUsage, "-relay-logs can't be used with -external-relay (the relay's log isn't in the session)")
+		}
+	}
+
+	// Keys from files or commands take precedence over the environment
+	if err := loadSecretEnv("KERNEL_API_KEY", "kernel-api-key-file", "kernel-api-key-cmd", *kernelKeyFile, *kernelKeyCmd); err != nil {
+		return fatal("usage", exitUsage, err.Error())
+	}
+	if *apiKeyFile != "" || *apiKeyCmd != "" {
+		if ag.RequiredEnvVar() == "" {
+			return fatal("usage", exitUsage, "-api-key-file and -api-key-cmd are not supported by "+ag.Name()+" (it reads provider keys from the environment)")
+		}
+		if err := loadSecretEnv(ag.RequiredEnvVar(), "api-key-file", "api-key-cmd", *apiKeyFile, *apiKeyCmd); err != nil {
+			return fatal("usage", exitUsage, err.Error())
+		}
+	}
+
+	// Resolve the default model and aliases like fast/smart
+	modelToUse := agent.ResolveModel(ag, *model)
+	if known, suggestion := agent.CheckModel(ag, modelToUse); !known {
+		msg := fmt.Sprintf("Warning: model %q isn't known to %s; running with it anyway", modelToUse, ag.Name())
+		if suggestion != "" {
+			msg += fmt.Sprintf(" (did you mean %q?)", suggestion)
+		}
+		fmt.Fprintln(os.Stderr, warningStyle.Render(msg))
+	}
+
+	// The agent's keys are filled in once they're checked below
+	runOpts := agent.RunOptions{
+		Prompt:           renderedPrompt,
+		Model:            modelToUse,
+		AgentTimeout:     *agentTimeout,
+		RetryOnTransient: *retryTransient,
+		Heartbeat:        time.Duration(*heartbeat) * time.Second,
+		MaxTurns:         *maxTurns,
+		ResumeID:         *resume,
+		AsRoot:           *asRoot,
+		NoPTY:            *noPTY,
+		WorkDir:          *workDir,
+		AutoApprove:      *autoApprove,
+		ApproveTools:     approveTools,
+		StreamText:       *streamText,
+		Timing:           *timing,
+		TextOutput:       *agentOutputFormat == "text",
+		AllowedTools:     allowTools,
+		DisallowedTools:  denyTools,
+	}
+
+	// Show the command the agent would be spawned with and stop. No session
+	// is created, so placeholders stand in for the keys and none are required.
+	if *printCommand {
+		fmt.Println(redactSecrets(ag.Command(withPlaceholderKeys(ag, runOpts)), knownSecrets))
+		return exitSuccess
 	}
 
 	// Check environment variables
 	kernelKey := os.Getenv("KERNEL_API_KEY")
 	if kernelKey == "" {
-		fmt.Fprintln(os.Stderr, errorStyle.Render("KERNEL_API_KEY environment variable is required"))
-		os.Exit(1)
+		return fatal("usage", exitUsage, "KERNEL_API_KEY environment variable is required")
+	}
+
+	clientOpts := []option.RequestOption{option.WithAPIKey(kernelKey)}
+	if *kernelBaseURL != "" {
+		if err := validateBaseURL(*kernelBaseURL); err != nil {
+			return fatal("usage", exitUsage, "invalid -kernel-base-url: "+err.Error())
+		}
+		clientOpts = append(clientOpts, option.WithBaseURL(*kernelBaseURL))
+	}
+
+	ctx := context.Background()
+	client := kernel.NewClient(clientOpts...)
+
+	setupOpts := browser.SetupOptions{
+		TimeoutSeconds:     *timeout,
+		ShowReuseHint:      !*deleteBrowser && *warmPool == 0,
+		MCPRuntime:         *mcpRuntime,
+		MCPServerName:      *mcpServerName,
+		PlaywriterRepo:     *playwriterRepo,
+		PlaywriterPatch:    *playwriterPatch,
+		ExternalRelay:      *externalRelay,
+		Extension:          *extension,
+		CloseExistingTabs:  *closeTabs,
+		ExtraExtensions:    extraExtensions,
+		PinExtraExtensions: *pinExtra,
+		Headless:           *headless,
+		StartURL:           *startPage,
+		MaxSessions:        *maxSessions,
+	}
+	if err := agent.ValidateMCPConfig(playwriterMCPConfig(setupOpts)); err != nil {
+		return fatal("usage", exitUsage, "invalid -mcp-server-name: "+err.Error())
+	}
+	store := pool.NewStore(*poolDir)
+
+	// Warm pool daemon mode doesn't run a prompt, so agent keys aren't needed
+	if *warmPool > 0 {
+		return runWarmPool(ctx, client, store, ag, setupOpts, extraMCP, *warmPool)
 	}
 
 	// Collect API key(s) for the agent
@@ -90,8 +957,7 @@ func main() {
 		// Agent requires a single specific env var
 		agentAPIKey = os.Getenv(requiredEnv)
 		if agentAPIKey == "" {
-			fmt.Fprintln(os.Stderr, errorStyle.Render(requiredEnv+" environment variable is required"))
-			os.Exit(1)
+			return fatal("usage", exitUsage, requiredEnv+" environment variable is required")
 		}
 	} else if envVars := ag.ProviderEnvVars(); len(envVars) > 0 {
 		// Agent supports multiple providers - collect all available env vars
@@ -102,119 +968,514 @@ func main() {
 			}
 		}
 		if len(providerEnvVars) == 0 {
-			fmt.Fprintln(os.Stderr, errorStyle.Render("At least one provider API key is required for "+ag.Name()))
-			fmt.Fprintln(os.Stderr, dimStyle.Render("Supported: "+strings.Join(envVars, ", ")))
-			os.Exit(1)
+			return fatal("usage", exitUsage, "At least one provider API key is required for "+ag.Name()+" (supported: "+strings.Join(envVars, ", ")+")")
 		}
 	}
 
-	// Set default model if not specified
-	modelToUse := *model
-	if modelToUse == "" {
-		modelToUse = ag.DefaultModel()
+	// Keep the keys out of anything printed from here on
+	addSecrets(kernelKey, agentAPIKey)
+	for _, value := range providerEnvVars {
+		addSecrets(value)
 	}
 
-	ctx := context.Background()
-	client := kernel.NewClient(option.WithAPIKey(kernelKey))
+	runOpts.APIKey = agentAPIKey
+	runOpts.EnvVars = providerEnvVars
+
+	if *verifyKeys {
+		agentKeys := providerEnvVars
+		if agentAPIKey != "" {
+			agentKeys = map[string]string{ag.RequiredEnvVar(): agentAPIKey}
+		}
+		if !verifyAPIKeys(ctx, client, agentKeys) {
+			return fatal("verify", exitUsage, "API key verification failed")
+		}
+	}
 
 	var sessionID, liveViewURL string
 	var created bool
 
+	// Record setup phases when a report was requested; it's written on exit.
+	// -verbose also records them to print the timings once setup is done.
+	var report *setupReport
+	if *setupReportFile != "" || *verbose {
+		report = newSetupReport(ag.Name())
+		report.Tag = *tag
+	}
+	if *setupReportFile != "" {
+		defer func() {
+			if err := report.write(*setupReportFile); err != nil {
+				fmt.Fprintln(os.Stderr, errorStyle.Render("Failed to write setup report: "+err.Error()))
+			}
+		}()
+	}
+
+	var warm *pool.Entry
+	if *session == "" && *useWarm {
+		warm = claimWarmSession(ctx, client, store, ag)
+		if warm == nil {
+			fmt.Println(dimStyle.Render("No warm session available, creating a new one"))
+		}
+	}
+
 	if *session != "" {
 		// Reuse existing session
 		sessionID = *session
-		browserInfo, err := client.Browsers.Get(ctx, sessionID)
+		if name, ok := strings.CutPrefix(sessionID, "tag:"); ok {
+			record, err := sessionStore.FindByTag(name)
+			if err != nil {
+				return fatal("session", exitUsage, "Session store: "+err.Error())
+			}
+			if record == nil {
+				return fatal("session", exitUsage, "No session tagged "+name)
+			}
+			sessionID = record.SessionID
+		} else if browser.IsURL(sessionID) {
+			// A live view URL; a URL used by an earlier run is known from
+			// the session store even if the ID can't be read from it
+			id, err := browser.SessionIDFromLiveView(sessionID)
+			if err != nil {
+				record, storeErr := sessionStore.FindByLiveView(sessionID)
+				if storeErr != nil {
+					return fatal("session", exitUsage, "Session store: "+storeErr.Error())
+				}
+				if record == nil {
+					return fatal("session", exitUsage, "-s: "+err.Error()+"; pass the session ID instead")
+				}
+				id = record.SessionID
+			}
+			sessionID = id
+		}
+		var browserInfo *kernel.BrowserGetResponse
+		err := report.phase("session", func() (err error) {
+			browserInfo, err = client.Browsers.Get(ctx, sessionID)
+			return err
+		})
 		if err != nil {
-			fmt.Fprintln(os.Stderr, errorStyle.Render("Failed to get session: "+err.Error()))
-			os.Exit(1)
+			return fatal("session", exitSetupFailure, "Failed to get session: "+err.Error())
 		}
 		liveViewURL = browserInfo.BrowserLiveViewURL
+		*headless = browserInfo.Headless
+		*timeout = browserInfo.TimeoutSeconds
+		if report != nil {
+			report.Source = "reused"
+		}
 		fmt.Println(dimStyle.Render("Using session: ") + sessionID)
 		fmt.Println(dimStyle.Render("Live view: ") + liveViewURL)
-	} else {
-		// Create new session with full setup
-		result, err := browser.Setup(ctx, client, browser.SetupOptions{
-			TimeoutSeconds: *timeout,
-			ShowReuseHint:  !*deleteBrowser,
-		})
+
+		// Claim the session before touching its playwriter install, relay, or
+		// tabs, so a second run against it fails here instead of garbling both.
+		// Deferred first, the lock is released after the cleanup below.
+		releaseLock, err := browser.AcquireRunLock(ctx, client, sessionID, *force)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, errorStyle.Render("Browser setup failed: "+err.Error()))
-			os.Exit(1)
+			return fatal("lock", exitSetupFailure, err.Error())
 		}
-		sessionID = result.SessionID
-		liveViewURL = result.LiveViewURL
-		created = true
+		defer releaseLock()
 
-		// Install the agent CLI
-		if err := ag.Install(ctx, client, sessionID); err != nil {
-			fmt.Fprintln(os.Stderr, errorStyle.Render("Agent install failed: "+err.Error()))
-			os.Exit(1)
+		// Reinstall playwriter if a previous -remove-playwriter removed it
+		if *externalRelay == "" && !browser.IsPlaywriterInstalled(ctx, client, sessionID) {
+			if err := report.phase("playwriter_install", func() error {
+				extensionID := browser.ResolveExtensionID(ctx, client, sessionID, *extension, browser.PlaywriterWebStoreID)
+				return browser.InstallPlaywriterFromSource(ctx, client, sessionID, extensionID, setupOpts)
+			}); err != nil {
+				return fatal("playwriter_install", exitSetupFailure, "playwriter install failed: "+err.Error())
+			}
 		}
 
-		// Install playwriter from source (both agents use the same version)
-		if err := browser.InstallPlaywriterFromSource(ctx, client, sessionID); err != nil {
-			fmt.Fprintln(os.Stderr, errorStyle.Render("Playwriter install failed: "+err.Error()))
-			os.Exit(1)
+		// Restart the relay if a previous -soft-cleanup stopped it; an
+		// external relay only has to answer
+		if *externalRelay != "" {
+			if err := report.phase("relay", func() error {
+				_, err := browser.ExternalRelayVersion(ctx, client, sessionID, *externalRelay)
+				return err
+			}); err != nil {
+				return fatal("relay", exitSetupFailure, err.Error())
+			}
+		} else if _, err := browser.RelayVersion(ctx, client, sessionID); err != nil {
+			if err := report.phase("relay", func() error {
+				return browser.StartPlaywriterRelay(ctx, client, sessionID)
+			}); err != nil {
+				return fatal("relay", exitSetupFailure, "relay start failed: "+err.Error())
+			}
 		}
-
-		// Start the relay
-		if err := browser.StartPlaywriterRelay(ctx, client, sessionID); err != nil {
-			fmt.Fprintln(os.Stderr, errorStyle.Render("Relay start failed: "+err.Error()))
-			os.Exit(1)
+	} else if warm != nil {
+		// Use a session prepared by the warm pool daemon
+		sessionID = warm.SessionID
+		liveViewURL = warm.LiveViewURL
+		*headless = warm.Headless
+		created = true
+		if report != nil {
+			report.Source = "warm"
 		}
-
-		// Configure MCP with the locally built playwriter
-		if err := ag.ConfigureMCP(ctx, client, sessionID, agent.PlaywriterMCPConfig()); err != nil {
-			fmt.Fprintln(os.Stderr, errorStyle.Render("MCP configuration failed: "+err.Error()))
-			os.Exit(1)
+		fmt.Println(successStyle.Render("Using warm session: ") + sessionID)
+		fmt.Println(dimStyle.Render("Live view: ") + liveViewURL)
+	} else {
+		// Create new session with full setup
+		result, err := prepareSession(ctx, client, ag, setupOpts, extraMCP, report)
+		if result != nil {
+			sessionID = result.SessionID
+			liveViewURL = result.LiveViewURL
 		}
+		if err != nil {
+			return fatal(setupPhase(err), exitSetupFailure, err.Error())
+		}
+		created = true
 
 		fmt.Println(successStyle.Render("Setup complete"))
 		fmt.Println(strings.Repeat("-", 60))
 		fmt.Println(dimStyle.Render("Session: ") + sessionID)
-		fmt.Println(dimStyle.Render("Live view: ") + liveViewURL)
+		if liveViewURL != "" {
+			fmt.Println(dimStyle.Render("Live view: ") + liveViewURL)
+		}
 		fmt.Println(strings.Repeat("-", 60))
 	}
 
+	// A session this run set up or claimed from the warm pool is locked as
+	// soon as it's known, for the same reason
+	if *session == "" {
+		releaseLock, err := browser.AcquireRunLock(ctx, client, sessionID, *force)
+		if err != nil {
+			return fatal("lock", exitSetupFailure, err.Error())
+		}
+		defer releaseLock()
+	}
+
+	// Remember the session and its tag for -list-sessions and -s tag:NAME
+	if err := sessionStore.Touch(sessions.Record{
+		SessionID:      sessionID,
+		Tag:            *tag,
+		Agent:          ag.Name(),
+		LiveViewURL:    liveViewURL,
+		TimeoutSeconds: *timeout,
+	}); err != nil {
+		fmt.Println(dimStyle.Render("Session store: " + err.Error()))
+	}
+
+	// Open the live view locally; without a terminal (e.g. in CI) the printed
+	// URL is enough, and headless sessions have none
+	if *openLiveView && liveViewURL != "" && !*quiet && isTerminal(os.Stdout) {
+		if err := openURL(liveViewURL); err != nil {
+			fmt.Println(dimStyle.Render("Could not open the live view: " + err.Error()))
+		}
+	}
+
 	// Cleanup on exit if requested
 	if created && *deleteBrowser {
 		defer func() {
 			fmt.Println()
 			fmt.Println(dimStyle.Render("Cleaning up browser session..."))
 			client.Browsers.DeleteByID(ctx, sessionID)
+			sessionStore.Remove(sessionID)
+		}()
+	} else if *softCleanup {
+		defer func() {
+			fmt.Println()
+			fmt.Println(dimStyle.Render("Cleaning up session for reuse..."))
+			for _, item := range browser.SoftCleanup(context.Background(), client, sessionID, *removePlaywriter) {
+				fmt.Println(dimStyle.Render("  " + item))
+			}
 		}()
 	}
 
-	// Activate the extension (clicks the icon to trigger connection to relay)
-	if browser.IsPlaywriterConnected(ctx, client, sessionID) {
-		fmt.Println(dimStyle.Render("Playwriter extension already connected"))
-	} else {
-		browser.ActivatePlaywriter(ctx, client, sessionID)
+	if report != nil {
+		report.SessionID = sessionID
+		report.LiveViewURL = liveViewURL
+		report.RelayEndpoint = browser.RelayURL
+		if *externalRelay != "" {
+			report.RelayEndpoint = *externalRelay
+		}
+	}
+
+	// Close stale tabs left by earlier runs. This happens before activation
+	// so the extension is reconnected if its tab was closed.
+	if *reapTabs > 0 {
+		closed, err := browser.ReapTabs(ctx, client, sessionID, *reapTabs)
+		if err != nil {
+			fmt.Println(dimStyle.Render("Could not close stale tabs: " + err.Error()))
+		} else if closed > 0 {
+			fmt.Println(dimStyle.Render(fmt.Sprintf("Closed %d stale tab(s)", closed)))
+		}
+	}
+
+	// Activate the extension (clicks the icon to trigger connection to relay).
+	// An external relay is expected to have its extension connected already.
+	err = report.phase("activate", func() error {
+		if *externalRelay != "" {
+			fmt.Println(dimStyle.Render("Using external relay at " + *externalRelay + ", skipping activation"))
+			return nil
+		}
+		if browser.IsPlaywriterConnected(ctx, client, sessionID) {
+			fmt.Println(dimStyle.Render("Playwriter extension already connected"))
+			return nil
+		}
+		if *headless {
+			return browser.ActivatePlaywriterHeadless(ctx, client, sessionID)
+		}
+		return browser.ActivatePlaywriterProgrammatic(ctx, client, sessionID)
+	})
+	if err != nil {
+		return fatal("activate", exitSetupFailure, err.Error())
+	}
+
+	// Resolve private hostnames before anything navigates to them
+	if len(hostsEntries) > 0 {
+		if err := report.phase("hosts", func() error {
+			return browser.AddHostsEntries(ctx, client, sessionID, hostsEntries)
+		}); err != nil {
+			return fatal("hosts", exitSetupFailure, err.Error())
+		}
+	}
+
+	// Restore cookies and localStorage, e.g. a login saved by an earlier run,
+	// and save them back on exit. The file is created on the first run.
+	if *storageState != "" {
+		state, err := os.ReadFile(*storageState)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			fmt.Println(dimStyle.Render("No storage state in " + *storageState + " yet; it will be saved on exit"))
+		case err != nil:
+			return fatal("storage_state", exitUsage, "Failed to read storage state: "+err.Error())
+		default:
+			var cookies int
+			if err := report.phase("storage_state", func() (err error) {
+				cookies, err = browser.ImportStorageState(ctx, client, sessionID, state)
+				return err
+			}); err != nil {
+				return fatal("storage_state", exitSetupFailure, err.Error())
+			}
+			fmt.Println(dimStyle.Render(fmt.Sprintf("Loaded storage state from %s (%d cookie(s))", *storageState, cookies)))
+		}
+		defer func() {
+			state, err := browser.ExportStorageState(ctx, client, sessionID)
+			if err == nil {
+				err = os.WriteFile(*storageState, state, 0o600)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, errorStyle.Render("Failed to save storage state: "+err.Error()))
+				return
+			}
+			fmt.Println(dimStyle.Render("Saved storage state to " + *storageState))
+		}()
+	}
+
+	// Copy input files in before the setup script, which may use them
+	if len(uploadPaths) > 0 {
+		if err := report.phase("upload", func() error {
+			for _, u := range uploadPaths {
+				if _, err := browser.Upload(ctx, client, sessionID, u.local, u.remote); err != nil {
+					return fmt.Errorf("upload %s: %w", u.local, err)
+				}
+			}
+			return nil
+		}); err != nil {
+			return fatal("upload", exitSetupFailure, err.Error())
+		}
+	}
+
+	// Prepare the environment with the caller's own script
+	if setupScriptText != "" {
+		if err := report.phase("setup_script", func() error {
+			return browser.RunSetupScript(ctx, client, sessionID, setupScriptText)
+		}); err != nil {
+			return fatal("setup_script", exitSetupFailure, err.Error())
+		}
+	}
+	if *verbose {
+		report.printTimings()
+	}
+
+	// Leave the session ready for later runs. The ID is printed last, on its
+	// own line, so scripts can capture it.
+	if *setupOnly {
+		fmt.Println()
+		fmt.Println(successStyle.Render("Session ready") + dimStyle.Render("; run prompts with -s "+sessionID))
+		fmt.Println(sessionID)
+		return exitSuccess
 	}
 
 	// Create stream parser for output handling
 	parser := stream.NewParser()
 
+	// Optionally post every event to a webhook as it happens
+	var webhook *stream.WebhookSink
+	if *webhookURL != "" {
+		webhook = stream.NewWebhookSink(*webhookURL)
+		defer webhook.Close()
+	}
+
+	// Optionally mirror the latest tool call into the live view
+	if *liveStatus {
+		status := browser.NewStatusUpdater(ctx, client, sessionID)
+		defer func() {
+			status.Set("")
+			status.Close()
+		}()
+		parser.OnToolCall = func(toolName, summary string) {
+			text := "[agent] " + toolName
+			if summary != "" {
+				text += ": " + summary
+			}
+			status.Set(text)
+		}
+	}
+
+	// Optionally log what the browser requests while the agent runs, for
+	// auditing. The log is written on exit, whether or not the run succeeded.
+	if *logRequests != "" {
+		maxDuration := requestLogMaxDuration
+		if *agentTimeout > 0 {
+			maxDuration = time.Duration(*agentTimeout)*time.Second + time.Minute
+		}
+		requestLog := browser.StartRequestLog(ctx, client, sessionID, maxDuration)
+		defer func() {
+			requests, dropped, err := browser.StopRequestLog(context.Background(), client, sessionID, requestLog)
+			if err == nil {
+				err = writeRequestLog(*logRequests, requests)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, errorStyle.Render("Failed to log requests: "+err.Error()))
+				return
+			}
+			fmt.Println(dimStyle.Render(fmt.Sprintf("Logged %d request(s) to %s", len(requests), *logRequests)))
+			if dropped > 0 {
+				fmt.Fprintln(os.Stderr, warningStyle.Render(fmt.Sprintf("Warning: %d more request(s) were not logged (limit reached)", dropped)))
+			}
+		}()
+	}
+
+	// Optionally record the display while the agent runs. The URL is printed
+	// on exit, whether or not the run succeeded, and added to the report.
+	if *printRecording {
+		replayID, stopRecording, err := browser.StartRecording(ctx, client, sessionID)
+		if err != nil {
+			fmt.Println(dimStyle.Render("Recording unavailable: " + err.Error()))
+		} else {
+			defer func() {
+				stopRecording()
+				recordingURL, err := browser.RecordingURL(context.Background(), client, sessionID, replayID)
+				switch {
+				case errors.Is(err, browser.ErrNoRecording):
+					fmt.Println(dimStyle.Render("Recording: not available for this session"))
+				case err != nil:
+					fmt.Println(dimStyle.Render("Recording unavailable: " + err.Error()))
+				default:
+					fmt.Println(dimStyle.Render("Recording: ") + recordingURL)
+					if report != nil {
+						report.RecordingURL = recordingURL
+					}
+				}
+			}()
+		}
+	}
+
+	// Optionally keep a plain transcript alongside the styled output
+	if *logPath != "" {
+		logFile, err := os.Create(*logPath)
+		if err != nil {
+			return fatal("log", exitUsage, "Failed to create log file: "+err.Error())
+		}
+		defer logFile.Close()
+		parser.Log = logFile
+	}
+
+	// Optionally save the event stream for later replay
+	var record agent.StreamHandler
+	if *recordFile != "" {
+		f, err := os.Create(*recordFile)
+		if err != nil {
+			return fatal("record", exitUsage, "Failed to create record file: "+err.Error())
+		}
+		defer f.Close()
+		record = stream.RecordTo(f)
+		if *tag != "" {
+			record(agent.TextEvent(agent.RunTagEventType, *tag))
+		}
+	}
+
+	// Optionally interleave the relay's log with the agent output
+	if *relayLogs {
+		stopTail, err := browser.TailRelayLogs(ctx, client, sessionID, func(line string) {
+			fmt.Println(dimStyle.Render("[relay] " + line))
+		})
+		if err != nil {
+			fmt.Println(dimStyle.Render("Relay logs unavailable: " + err.Error()))
+		} else {
+			defer stopTail()
+		}
+	}
+
 	// Run the agent
-	exitCode, err := ag.Run(ctx, client, sessionID, agent.RunOptions{
-		Prompt:       *prompt,
-		Model:        modelToUse,
-		APIKey:       agentAPIKey,
-		EnvVars:      providerEnvVars,
-		AgentTimeout: *agentTimeout,
-	}, func(event agent.StreamEvent) {
-		parser.ProcessEvent(event)
-	})
+	// Each event is displayed, then posted, then recorded
+	// The agent's conversation ID lets a later run continue it with -resume
+	var agentSessionID string
+	handlers := []agent.StreamHandler{parser.ProcessEvent, func(event agent.StreamEvent) {
+		if agentSessionID == "" && event.SessionID != "" {
+			agentSessionID = event.SessionID
+		}
+	}}
+	if webhook != nil {
+		handlers = append(handlers, webhook.Send)
+	}
+	handlers = append(handlers, record)
+
+	// Stop the agent if Chrome crashes or is closed, instead of letting it
+	// retry tools against a browser that's gone
+	runOpts.BrowserCheck = func(ctx context.Context) error {
+		return browser.CheckBrowser(ctx, client, sessionID)
+	}
+	exitCode, err := ag.Run(ctx, client, sessionID, runOpts, agent.TeeHandler(handlers...))
 
 	if err != nil {
-		fmt.Fprintln(os.Stderr, errorStyle.Render(err.Error()))
-		os.Exit(1)
+		return reportFatal(agentFailure(err, parser.StderrTail()))
 	}
 
 	fmt.Println()
 
+	if agentSessionID != "" {
+		fmt.Println(dimStyle.Render("Resume: ") + "playwriter-in-kernel -agent " + ag.Name() + " -s " + sessionID + " -resume " + agentSessionID + " -p \"...\"")
+		if report != nil {
+			report.AgentSessionID = agentSessionID
+		}
+	}
+
+	// Summarize the run from the events seen, including a failed one
+	if *explain || *timing {
+		summary := parser.Summary()
+		if *explain {
+			fmt.Print(stream.FormatSummary(summary))
+		} else if summary.Timing != nil {
+			fmt.Println(dimStyle.Render("Timing: ") + stream.FormatTiming(*summary.Timing))
+		}
+		if report != nil {
+			report.Summary = &summary
+		}
+	}
+
+	// Without auto-approval, approval requests go unanswered in a headless run
+	if parser.ApprovalRequested() && !*autoApprove {
+		fmt.Fprintln(os.Stderr, errorStyle.Render("The agent requested tool approval; allow the tools with -allow-tool or -auto-approve-tools, or rerun with -auto-approve"))
+	}
+
 	if exitCode != 0 {
-		fmt.Fprintln(os.Stderr, errorStyle.Render(fmt.Sprintf("%s exited with code %d", ag.Name(), exitCode)))
-		os.Exit(int(exitCode))
+		return reportFatal(fatalError{
+			Error:      fmt.Sprintf("%s exited with code %d", ag.Name(), exitCode),
+			Phase:      "agent",
+			ExitCode:   agentExitCode(exitCode),
+			StderrTail: parser.StderrTail(),
+		})
+	}
+
+	// Agents can exit 0 after giving up, e.g. on hitting the turn limit
+	if msg := parser.ResultError(); msg != "" && !*ignoreResultError {
+		return reportFatal(fatalError{
+			Error:      fmt.Sprintf("%s reported an error: %s", ag.Name(), msg),
+			Phase:      "agent",
+			ExitCode:   exitResultError,
+			StderrTail: parser.StderrTail(),
+		})
+	}
+
+	if msg := checkExpectations(parser.FinalMessage(), *expect, expectRe); msg != "" {
+		return fatal("expect", exitExpectFailed, msg)
 	}
+	return exitSuccess
 }
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/muesli/termenv"
+
+	"playwriter-setup/agent"
+	"playwriter-setup/prompt"
+	"playwriter-setup/stream"
+)
+
+func TestConfigPrecedence(t *testing.T) {
+	const file = "agent: opencode\nmodel: file-model\ntimeout_seconds: 600\n"
+	tests := []struct {
+		name  string
+		args  []string
+		env   map[string]string
+		file  string
+		agent string
+		model string
+		secs  int64
+	}{
+		{name: "defaults", agent: "cursor", model: "", secs: 300},
+		{name: "file over default", file: file, agent: "opencode", model: "file-model", secs: 600},
+		{
+			name:  "env over file",
+			env:   map[string]string{"PLAYWRITER_AGENT": "claude", "PLAYWRITER_TIMEOUT_SECONDS": "900"},
+			file:  file,
+			agent: "claude", model: "file-model", secs: 900,
+		},
+		{
+			name:  "flag over env and file",
+			args:  []string{"-agent", "cursor", "-model", "flag-model"},
+			env:   map[string]string{"PLAYWRITER_AGENT": "claude", "PLAYWRITER_MODEL": "env-model"},
+			file:  file,
+			agent: "cursor", model: "flag-model", secs: 600,
+		},
+		{
+			name:  "env without a file",
+			env:   map[string]string{"PLAYWRITER_MODEL": "env-model"},
+			agent: "cursor", model: "env-model", secs: 300,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(cl *flag.FlagSet) { flag.CommandLine = cl }(flag.CommandLine)
+			flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+			agentName := flag.String("agent", "cursor", "")
+			model := flag.String("m", "", "")
+			flag.StringVar(model, "model", "", "")
+			secs := flag.Int64("timeout-seconds", 300, "")
+			flag.Int64("agent-timeout", 0, "")
+			flag.Bool("quiet", false, "")
+			flag.Bool("json-errors", false, "")
+			flag.String("config", "", "")
+			flag.String("kernel-base-url", "", "")
+			if err := flag.CommandLine.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			for envVar := range envFlags {
+				t.Setenv(envVar, tt.env[envVar])
+			}
+
+			// Keep discovery from finding a config in the package directory
+			t.Chdir(t.TempDir())
+			var path string
+			if tt.file != "" {
+				path = filepath.Join(t.TempDir(), "config.yaml")
+				if err := os.WriteFile(path, []byte(tt.file), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := applyEnvFlags(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := loadConfig(path, prompt.Vars{}); err != nil {
+				t.Fatal(err)
+			}
+			if *agentName != tt.agent || *model != tt.model || *secs != tt.secs {
+				t.Errorf("agent=%q model=%q timeout=%d, want %q %q %d", *agentName, *model, *secs, tt.agent, tt.model, tt.secs)
+			}
+		})
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	defer func(b bool, secrets []string) { jsonErrors, knownSecrets = b, secrets }(jsonErrors, knownSecrets)
+	jsonErrors = true
+	knownSecrets = []string{"sk-secret-key"}
+
+	tests := []struct {
+		name    string
+		failure fatalError
+		want    string
+	}{
+		{
+			name:    "setup failure",
+			failure: fatalError{Error: "Failed to get session: not found", Phase: "session", ExitCode: exitSetupFailure},
+			want:    `{"error":"Failed to get session: not found","phase":"session","exitCode":10}`,
+		},
+		{
+			name:    "agent not installed",
+			failure: agentFailure(fmt.Errorf("cursor: %w", agent.ErrAgentNotInstalled), nil),
+			want:    `{"error":"cursor: agent not installed","phase":"setup","exitCode":10}`,
+		},
+		{
+			name:    "timeout",
+			failure: agentFailure(fmt.Errorf("agent run: %w", context.DeadlineExceeded), []string{"still working"}),
+			want:    `{"error":"agent run: context deadline exceeded","phase":"timeout","exitCode":11,"stderrTail":["still working"]}`,
+		},
+		{
+			name:    "browser down",
+			failure: agentFailure(fmt.Errorf("chrome exited: %w", agent.ErrBrowserDown), nil),
+			want:    `{"error":"chrome exited: browser is down","phase":"browser","exitCode":12}`,
+		},
+		{
+			name:    "agent failure redacted",
+			failure: agentFailure(errors.New("exit status 1"), []string{"invalid key sk-secret-key"}),
+			want:    `{"error":"exit status 1","phase":"agent","exitCode":12,"stderrTail":["invalid key ***"]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var code int
+			got := captureStderr(t, func() { code = reportFatal(tt.failure) })
+			if got != tt.want+"\n" {
+				t.Errorf("stderr = %s\nwant     %s", got, tt.want)
+			}
+			if code != tt.failure.ExitCode {
+				t.Errorf("reportFatal() = %d, want %d", code, tt.failure.ExitCode)
+			}
+		})
+	}
+}
+
+// captureStderr returns what fn writes to os.Stderr
+func captureStderr(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(f *os.File) { os.Stderr = f }(os.Stderr)
+	os.Stderr = w
+	fn()
+	w.Close()
+	out, _ := io.ReadAll(r)
+	return string(out)
+}
+
+func TestPrintCommandRedacted(t *testing.T) {
+	defer func(secrets []string) { knownSecrets = secrets }(knownSecrets)
+
+	const (
+		agentKey  = "sk-ant-REDACTED"
+		openaiKey = "sk-proj-0123456789abcdef"
+	)
+	tests := []struct {
+		name string
+		ag   agent.Agent
+		opts agent.RunOptions
+	}{
+		{"cursor", &agent.CursorAgent{}, agent.RunOptions{APIKey: agentKey}},
+		{"claude", &agent.ClaudeAgent{}, agent.RunOptions{APIKey: agentKey}},
+		{"opencode", &agent.OpenCodeAgent{}, agent.RunOptions{EnvVars: map[string]string{"ANTHROPIC_API_KEY": agentKey, "OPENAI_API_KEY": openaiKey}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			knownSecrets = nil
+			addSecrets("", tt.opts.APIKey)
+			for _, value := range tt.opts.EnvVars {
+				addSecrets(value)
+			}
+			tt.opts.Prompt = "open example.com"
+
+			raw := tt.ag.Command(tt.opts)
+			if !strings.Contains(raw, agentKey) {
+				t.Fatalf("command doesn't pass the key; nothing to redact:\n%s", raw)
+			}
+			printed := redactSecrets(raw, knownSecrets)
+			for _, key := range []string{agentKey, openaiKey} {
+				if strings.Contains(printed, key) {
+					t.Errorf("printed command leaks %s:\n%s", key, printed)
+				}
+			}
+			if !strings.Contains(printed, "***") || !strings.Contains(printed, "open example.com") {
+				t.Errorf("printed command:\n%s\nwant the keys masked and the rest intact", printed)
+			}
+		})
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    time.Duration
+		wantErr bool
+	}{
+		{s: "90m", want: 90 * time.Minute},
+		{s: "2h30m", want: 150 * time.Minute},
+		{s: "3d", want: 72 * time.Hour},
+		{s: "1d", want: 24 * time.Hour},
+		{s: "0d", wantErr: true},
+		{s: "-2h", wantErr: true},
+		{s: "1.5d", wantErr: true},
+		{s: "d", wantErr: true},
+		{s: "3 days", wantErr: true},
+		{s: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseAge(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseAge(%q) err = %v, wantErr %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseAge(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestUsePlainStyles(t *testing.T) {
+	tests := []struct {
+		name      string
+		profile   termenv.Profile
+		wantPlain bool
+	}{
+		{"no color support", termenv.Ascii, true},
+		{"color terminal", termenv.ANSI256, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer lipgloss.SetColorProfile(lipgloss.ColorProfile())
+			mainStyles := []lipgloss.Style{successStyle, errorStyle, dimStyle, warningStyle}
+			agentStyles := []lipgloss.Style{agent.HeaderStyle, agent.SuccessStyle, agent.DimStyle, agent.WarningStyle}
+			streamStyles := []lipgloss.Style{stream.DimStyle, stream.ToolStyle, stream.AssistantStyle, stream.WarningStyle}
+			defer func() {
+				successStyle, errorStyle, dimStyle, warningStyle = mainStyles[0], mainStyles[1], mainStyles[2], mainStyles[3]
+				agent.HeaderStyle, agent.SuccessStyle, agent.DimStyle, agent.WarningStyle = agentStyles[0], agentStyles[1], agentStyles[2], agentStyles[3]
+				stream.DimStyle, stream.ToolStyle, stream.AssistantStyle, stream.WarningStyle = streamStyles[0], streamStyles[1], streamStyles[2], streamStyles[3]
+			}()
+
+			lipgloss.SetColorProfile(tt.profile)
+			usePlainStyles()
+
+			// Render with colors on, so only styles that were dropped print plain
+			lipgloss.SetColorProfile(termenv.ANSI256)
+			styles := map[string]lipgloss.Style{
+				"errorStyle":            errorStyle,
+				"dimStyle":              dimStyle,
+				"agent.HeaderStyle":     agent.HeaderStyle,
+				"agent.WarningStyle":    agent.WarningStyle,
+				"stream.ToolStyle":      stream.ToolStyle,
+				"stream.AssistantStyle": stream.AssistantStyle,
+			}
+			for name, style := range styles {
+				if plain := style.Render("x") == "x"; plain != tt.wantPlain {
+					t.Errorf("%s renders %q, want plain %v", name, style.Render("x"), tt.wantPlain)
+				}
+			}
+		})
+	}
+}
+
+func TestPrintCommandWithoutKeys(t *testing.T) {
+	defer func(cl *flag.FlagSet) { flag.CommandLine = cl }(flag.CommandLine)
+	flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+	defer func(args []string) { os.Args = args }(os.Args)
+	os.Args = []string{"playwriter-in-kernel", "-agent", "claude", "-p", "open example.com", "-print-command"}
+	t.Chdir(t.TempDir())
+	t.Setenv("KERNEL_API_KEY", "")
+	t.Setenv("ANTHROPIC_API_KEY", "")
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(f *os.File) { os.Stdout = f }(os.Stdout)
+	os.Stdout = w
+	var code int
+	stderr := captureStderr(t, func() { code = run() })
+	w.Close()
+	out, _ := io.ReadAll(r)
+
+	if code != exitSuccess {
+		t.Fatalf("run() = %d, want success; stderr:\n%s", code, stderr)
+	}
+	if !strings.Contains(string(out), "ANTHROPIC_API_KEY='"+keyPlaceholder+"'") || !strings.Contains(string(out), "open example.com") {
+		t.Errorf("printed command:\n%s\nwant a placeholder key and the prompt", out)
+	}
+}
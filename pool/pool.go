@@ -0,0 +1,130 @@
+// Package pool stores pre-created ("warm") browser sessions on local disk so
+// that later invocations can claim a fully prepared session instantly.
+package pool
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Entry describes a warm session prepared for a specific agent
+type Entry struct {
+	SessionID   string    `json:"session_id"`
+	LiveViewURL string    `json:"live_view_url"`
+	Agent       string    `json:"agent"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	Headless    bool      `json:"headless,omitempty"`
+}
+
+// Expired reports whether the session is likely to have timed out
+func (e Entry) Expired() bool {
+	return !e.ExpiresAt.IsZero() && time.Now().After(e.ExpiresAt)
+}
+
+// Store is a directory of warm session entries, one JSON file per session.
+// Claiming removes the file, which is atomic, so concurrent invocations never
+// receive the same session.
+type Store struct {
+	Dir string
+}
+
+// DefaultDir returns the default warm pool directory under the user's home
+func DefaultDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = os.TempDir()
+	}
+	return filepath.Join(home, ".playwriter-in-kernel", "warm-pool")
+}
+
+// NewStore returns a store rooted at dir, or DefaultDir if dir is empty
+func NewStore(dir string) *Store {
+	if dir == "" {
+		dir = DefaultDir()
+	}
+	return &Store{Dir: dir}
+}
+
+// Add writes an entry to the store
+func (s *Store) Add(e Entry) error {
+	if err := os.MkdirAll(s.Dir, 0o700); err != nil {
+		return fmt.Errorf("create pool dir: %w", err)
+	}
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal entry: %w", err)
+	}
+
+	// Write to a temp file first so readers never see a partial entry
+	tmp := filepath.Join(s.Dir, "."+e.SessionID+".tmp")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("write entry: %w", err)
+	}
+	return os.Rename(tmp, s.path(e.SessionID))
+}
+
+// List returns the unexpired entries for agentName, oldest first.
+// Expired entries are removed from the store.
+func (s *Store) List(agentName string) ([]Entry, error) {
+	files, err := os.ReadDir(s.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read pool dir: %w", err)
+	}
+
+	var entries []Entry
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(s.Dir, f.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue // claimed concurrently
+		}
+		var e Entry
+		if err := json.Unmarshal(data, &e); err != nil {
+			continue
+		}
+		if e.Expired() {
+			os.Remove(path)
+			continue
+		}
+		if agentName == "" || e.Agent == agentName {
+			entries = append(entries, e)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].CreatedAt.Before(entries[j].CreatedAt) })
+	return entries, nil
+}
+
+// Claim removes and returns the oldest unexpired entry for agentName.
+// Returns nil if the pool has no session for that agent.
+func (s *Store) Claim(agentName string) (*Entry, error) {
+	entries, err := s.List(agentName)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		// Whoever removes the file owns the session
+		if err := os.Remove(s.path(e.SessionID)); err == nil {
+			return &e, nil
+		}
+	}
+	return nil, nil
+}
+
+// path returns the file path for a session entry
+func (s *Store) path(sessionID string) string {
+	return filepath.Join(s.Dir, sessionID+".json")
+}
@@ -0,0 +1,63 @@
+package prompt
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Turn is one message of a seeded conversation
+type Turn struct {
+	Role    string `json:"role"` // "system", "user", or "assistant"
+	Content string `json:"content"`
+}
+
+// conversationPreamble tells the agent how to read a flattened conversation
+const conversationPreamble = "The following is a conversation so far, one turn per [role] block. Continue it by responding to the last user turn."
+
+// LoadConversation reads a JSON array of turns from path and validates it
+func LoadConversation(path string) ([]Turn, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var turns []Turn
+	if err := json.Unmarshal(data, &turns); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if len(turns) == 0 {
+		return nil, fmt.Errorf("%s: conversation is empty", path)
+	}
+	for i, turn := range turns {
+		switch turn.Role {
+		case "system", "user", "assistant":
+		default:
+			return nil, fmt.Errorf("%s: turn %d: unknown role %q (expected system, user, or assistant)", path, i+1, turn.Role)
+		}
+		if strings.TrimSpace(turn.Content) == "" {
+			return nil, fmt.Errorf("%s: turn %d: content is empty", path, i+1)
+		}
+	}
+	return turns, nil
+}
+
+// FormatConversation flattens turns into a single prompt with role markers,
+// for agents that take one prompt rather than a message history. A non-empty
+// next is appended as a final user turn. The conversation must end with a
+// user turn for the agent to respond to.
+func FormatConversation(turns []Turn, next string) (string, error) {
+	if strings.TrimSpace(next) != "" {
+		turns = append(turns[:len(turns):len(turns)], Turn{Role: "user", Content: next})
+	}
+	if len(turns) == 0 || turns[len(turns)-1].Role != "user" {
+		return "", fmt.Errorf("conversation must end with a user turn (add one or pass -p)")
+	}
+
+	var b strings.Builder
+	b.WriteString(conversationPreamble)
+	for _, turn := range turns {
+		fmt.Fprintf(&b, "\n\n[%s]\n%s", turn.Role, strings.TrimSpace(turn.Content))
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,100 @@
+package prompt
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConversation(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    int // turns loaded
+		wantErr string
+	}{
+		{
+			name: "all roles",
+			data: `[{"role":"system","content":"Be brief"},{"role":"user","content":"Hi"},{"role":"assistant","content":"Hello"}]`,
+			want: 3,
+		},
+		{name: "not JSON", data: `role: user`, wantErr: "parse"},
+		{name: "empty", data: `[]`, wantErr: "conversation is empty"},
+		{name: "unknown role", data: `[{"role":"tool","content":"x"}]`, wantErr: `turn 1: unknown role "tool"`},
+		{name: "blank content", data: `[{"role":"user","content":"Hi"},{"role":"assistant","content":"  "}]`, wantErr: "turn 2: content is empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "conversation.json")
+			if err := os.WriteFile(path, []byte(tt.data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			turns, err := LoadConversation(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(turns) != tt.want {
+				t.Errorf("loaded %d turns, want %d", len(turns), tt.want)
+			}
+		})
+	}
+
+	if _, err := LoadConversation(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("missing file loaded without an error")
+	}
+}
+
+func TestFormatConversation(t *testing.T) {
+	tests := []struct {
+		name    string
+		turns   []Turn
+		next    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "ends with user",
+			turns: []Turn{{"system", "Be brief"}, {"user", " Hi \n"}},
+			want:  conversationPreamble + "\n\n[system]\nBe brief\n\n[user]\nHi",
+		},
+		{
+			name:  "next appended as user turn",
+			turns: []Turn{{"user", "Hi"}, {"assistant", "Hello"}},
+			next:  "Open example.com",
+			want:  conversationPreamble + "\n\n[user]\nHi\n\n[assistant]\nHello\n\n[user]\nOpen example.com",
+		},
+		{name: "ends with assistant", turns: []Turn{{"user", "Hi"}, {"assistant", "Hello"}}, wantErr: true},
+		{name: "blank next ignored", turns: []Turn{{"assistant", "Hello"}}, next: " ", wantErr: true},
+		{name: "nothing", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(tt.turns)
+			got, err := FormatConversation(tt.turns, tt.next)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("FormatConversation() = %q\nwant %q", got, tt.want)
+			}
+			if len(tt.turns) != before {
+				t.Error("turns modified")
+			}
+		})
+	}
+
+	// Appending next must not write into the caller's backing array
+	turns := make([]Turn, 1, 2)
+	turns[0] = Turn{"user", "Hi"}
+	FormatConversation(turns, "next")
+	if spare := turns[:2][1]; spare != (Turn{}) {
+		t.Errorf("caller's array changed: %v", spare)
+	}
+}
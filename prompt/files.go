@@ -0,0 +1,99 @@
+package prompt
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// MaxFileBytes is the largest file an @path reference may inline
+const MaxFileBytes = 256 * 1024
+
+// fileRef matches @path at the start of the prompt or after whitespace, so
+// addresses like user@example.com and package@version are left alone
+var fileRef = regexp.MustCompile(`(^|\s)@([^\s@]+)`)
+
+// ExpandFiles resolves @path references in text against root, the directory
+// files may be read from. Each reference is replaced by its path, and the
+// file's contents are appended under a "--- path ---" header, once per file.
+// Missing files, files larger than MaxFileBytes, and paths outside root
+// (including through symlinks) are errors.
+func ExpandFiles(text, root string) (string, error) {
+	root, err := filepath.Abs(root)
+	if err == nil {
+		root, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil {
+		return "", fmt.Errorf("resolve file root: %w", err)
+	}
+
+	var (
+		files    []string
+		contents = map[string]string{}
+		firstErr error
+	)
+	out := fileRef.ReplaceAllStringFunc(text, func(match string) string {
+		sub := fileRef.FindStringSubmatch(match)
+		// Punctuation ending a sentence isn't part of the path
+		ref := strings.TrimRight(sub[2], ".,;:!?)]}'\"")
+		if ref == "" {
+			return match
+		}
+		if _, ok := contents[ref]; !ok && firstErr == nil {
+			data, err := readFileRef(root, ref)
+			if err != nil {
+				firstErr = err
+				return match
+			}
+			files = append(files, ref)
+			contents[ref] = data
+		}
+		return sub[1] + ref + sub[2][len(ref):]
+	})
+	if firstErr != nil {
+		return "", firstErr
+	}
+
+	var b strings.Builder
+	b.WriteString(out)
+	for _, ref := range files {
+		fmt.Fprintf(&b, "\n\n--- %s ---\n%s", ref, strings.TrimRight(contents[ref], "\n"))
+	}
+	return b.String(), nil
+}
+
+// readFileRef reads the file ref names, relative to root, checking that it
+// stays inside root and isn't too large to inline
+func readFileRef(root, ref string) (string, error) {
+	path := ref
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(root, path)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("@%s: file not found (use -no-file-expand to send @ references as-is)", ref)
+		}
+		return "", fmt.Errorf("@%s: %w", ref, err)
+	}
+	if rel, err := filepath.Rel(root, resolved); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("@%s: outside %s", ref, root)
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return "", fmt.Errorf("@%s: %w", ref, err)
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("@%s: is a directory", ref)
+	}
+	if info.Size() > MaxFileBytes {
+		return "", fmt.Errorf("@%s: %d bytes is over the %d byte limit", ref, info.Size(), MaxFileBytes)
+	}
+	data, err := os.ReadFile(resolved)
+	if err != nil {
+		return "", fmt.Errorf("@%s: %w", ref, err)
+	}
+	return string(data), nil
+}
@@ -0,0 +1,83 @@
+package prompt
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExpandFiles(t *testing.T) {
+	outside := t.TempDir()
+	secret := filepath.Join(outside, "secret.txt")
+	root := t.TempDir()
+	files := map[string]string{
+		"notes.txt":         "line one\nline two\n",
+		"data/input.csv":    "a,b\n1,2",
+		"big.txt":           strings.Repeat("x", MaxFileBytes+1),
+		secret:              "do not send",
+		"data/nested/.keep": "",
+	}
+	for name, contents := range files {
+		path := name
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(root, name)
+		}
+		os.MkdirAll(filepath.Dir(path), 0o755)
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(secret, filepath.Join(root, "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		text    string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "no references",
+			text: "Open example.com and mail admin@example.com",
+			want: "Open example.com and mail admin@example.com",
+		},
+		{
+			name: "file inlined",
+			text: "Summarize @notes.txt.",
+			want: "Summarize notes.txt.\n\n--- notes.txt ---\nline one\nline two",
+		},
+		{
+			name: "repeated file inlined once",
+			text: "@data/input.csv then compare @notes.txt with @data/input.csv",
+			want: "data/input.csv then compare notes.txt with data/input.csv\n\n--- data/input.csv ---\na,b\n1,2\n\n--- notes.txt ---\nline one\nline two",
+		},
+		{name: "missing file", text: "Read @missing.txt", wantErr: "@missing.txt: file not found (use -no-file-expand"},
+		{name: "parent traversal", text: "Read @../" + filepath.Base(outside) + "/secret.txt", wantErr: "outside"},
+		{name: "absolute path outside root", text: "Read @" + secret, wantErr: "outside"},
+		{name: "symlink out of root", text: "Read @link.txt", wantErr: "@link.txt: outside"},
+		{name: "directory", text: "List @data/nested", wantErr: "is a directory"},
+		{name: "too large", text: "Read @big.txt", wantErr: "over the 262144 byte limit"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ExpandFiles(tt.text, root)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+				}
+				if strings.Contains(err.Error(), "do not send") {
+					t.Errorf("error leaks the file: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("ExpandFiles() = %q\nwant %q", got, tt.want)
+			}
+		})
+	}
+}
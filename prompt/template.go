@@ -0,0 +1,61 @@
+// Package prompt provides utilities for building the prompt sent to an agent.
+package prompt
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// placeholder matches {{key}} with optional surrounding whitespace
+var placeholder = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.-]+)\s*\}\}`)
+
+// Vars holds template variables and implements flag.Value so it can be used
+// as a repeatable -var key=value flag
+type Vars map[string]string
+
+// String returns the variables as a comma-separated list of key=value pairs
+func (v Vars) String() string {
+	pairs := make([]string, 0, len(v))
+	for key, value := range v {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Set parses a single key=value pair
+func (v Vars) Set(s string) error {
+	key, value, ok := strings.Cut(s, "=")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" {
+		return fmt.Errorf("invalid variable %q (expected key=value)", s)
+	}
+	v[key] = value
+	return nil
+}
+
+// Render substitutes {{key}} placeholders in tmpl with values from vars.
+// Undefined variables cause an error unless allowUndefined is set, in which
+// case the placeholder is left as-is. Substitution is purely textual; shell
+// escaping is left to the agent when it builds its command.
+func Render(tmpl string, vars Vars, allowUndefined bool) (string, error) {
+	var missing []string
+	out := placeholder.ReplaceAllStringFunc(tmpl, func(match string) string {
+		key := placeholder.FindStringSubmatch(match)[1]
+		if value, ok := vars[key]; ok {
+			return value
+		}
+		if !slices.Contains(missing, key) {
+			missing = append(missing, key)
+		}
+		return match
+	})
+
+	if len(missing) > 0 && !allowUndefined {
+		return "", fmt.Errorf("undefined prompt variable(s): %s", strings.Join(missing, ", "))
+	}
+	return out, nil
+}
@@ -0,0 +1,109 @@
+package prompt
+
+import (
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name           string
+		tmpl           string
+		vars           Vars
+		allowUndefined bool
+		want           string
+		wantErr        string
+	}{
+		{
+			name: "multiple vars",
+			tmpl: "Scrape {{url}} and extract {{field}}",
+			vars: Vars{"url": "https://example.com", "field": "price"},
+			want: "Scrape https://example.com and extract price",
+		},
+		{
+			name: "repeated var and whitespace in braces",
+			tmpl: "{{ name }} then {{name}}",
+			vars: Vars{"name": "x"},
+			want: "x then x",
+		},
+		{
+			name: "special characters substituted verbatim",
+			tmpl: "Search for {{q}}",
+			vars: Vars{"q": `"quoted" $(whoami) ` + "`id`"},
+			want: `Search for "quoted" $(whoami) ` + "`id`",
+		},
+		{
+			name: "values are not re-expanded",
+			tmpl: "{{a}}",
+			vars: Vars{"a": "{{b}}", "b": "no"},
+			want: "{{b}}",
+		},
+		{
+			name:    "missing vars listed once each",
+			tmpl:    "{{url}} {{field}} {{url}}",
+			vars:    Vars{},
+			wantErr: "undefined prompt variable(s): url, field",
+		},
+		{
+			name:           "missing vars allowed",
+			tmpl:           "{{url}} {{field}}",
+			vars:           Vars{"field": "price"},
+			allowUndefined: true,
+			want:           "{{url}} price",
+		},
+		{
+			name: "no placeholders",
+			tmpl: "plain {prompt}",
+			want: "plain {prompt}",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Render(tt.tmpl, tt.vars, tt.allowUndefined)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Render() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVarsSet(t *testing.T) {
+	tests := []struct {
+		arg     string
+		key     string
+		value   string
+		wantErr bool
+	}{
+		{arg: "url=https://example.com/?a=b", key: "url", value: "https://example.com/?a=b"},
+		{arg: " field =price", key: "field", value: "price"},
+		{arg: "empty=", key: "empty", value: ""},
+		{arg: "novalue", wantErr: true},
+		{arg: "=value", wantErr: true},
+	}
+	for _, tt := range tests {
+		vars := Vars{}
+		err := vars.Set(tt.arg)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Set(%q) = %v, wantErr %v", tt.arg, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && (len(vars) != 1 || vars[tt.key] != tt.value) {
+			t.Errorf("Set(%q) = %v, want %s=%q", tt.arg, vars, tt.key, tt.value)
+		}
+	}
+
+	vars := Vars{}
+	vars.Set("b=2")
+	vars.Set("a=1")
+	if got := vars.String(); got != "a=1,b=2" {
+		t.Errorf("String() = %q, want sorted pairs", got)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"playwriter-setup/stream"
+)
+
+// setupReport is the machine-readable record of session setup written by
+// -setup-report, for tracking setup times in CI
+type setupReport struct {
+	Agent           string            `json:"agent"`
+	Tag             string            `json:"tag,omitempty"`
+	SessionID       string            `json:"session_id,omitempty"`
+	LiveViewURL     string            `json:"live_view_url,omitempty"`
+	RelayEndpoint   string            `json:"relay_endpoint,omitempty"`
+	RecordingURL    string            `json:"recording_url,omitempty"`
+	AgentSessionID  string            `json:"agent_session_id,omitempty"`
+	Summary         *stream.Summary   `json:"summary,omitempty"`
+	Source          string            `json:"source"` // "new", "reused" (-s), or "warm"
+	StartedAt       time.Time         `json:"started_at"`
+	DurationSeconds float64           `json:"duration_seconds"`
+	Phases          []phaseReport     `json:"phases"`
+	Versions        map[string]string `json:"versions,omitempty"`
+	Error           string            `json:"error,omitempty"`
+
+	mu      sync.Mutex              // phases may run concurrently
+	endedAt time.Time               // end of the last recorded phase
+	steps   map[string][]stepReport // steps of phases in progress, by phase name
+}
+
+// phaseReport records one setup phase
+type phaseReport struct {
+	Name            string    `json:"name"`
+	StartedAt       time.Time `json:"started_at"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Error           string    `json:"error,omitempty"`
+
+	// Steps break the phase down further, e.g. clone, deps, and build
+	Steps []stepReport `json:"steps,omitempty"`
+}
+
+// stepReport records one step within a phase
+type stepReport struct {
+	Name            string  `json:"name"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// newSetupReport starts a report for agentName
+func newSetupReport(agentName string) *setupReport {
+	return &setupReport{
+		Agent:     agentName,
+		Source:    "new",
+		StartedAt: time.Now(),
+		Versions:  make(map[string]string),
+		steps:     make(map[string][]stepReport),
+	}
+}
+
+// phase runs fn as the named phase and records its timing and error.
+// A nil report just runs fn, so callers needn't check. Phases may run
+// concurrently; each is recorded when it ends.
+func (r *setupReport) phase(name string, fn func() error) error {
+	if r == nil {
+		return fn()
+	}
+	start := time.Now()
+	err := fn()
+	p := phaseReport{
+		Name:            name,
+		StartedAt:       start,
+		DurationSeconds: time.Since(start).Seconds(),
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		p.Error = err.Error()
+		r.Error = err.Error()
+	}
+	p.Steps = r.steps[name]
+	delete(r.steps, name)
+	r.Phases = append(r.Phases, p)
+	r.endedAt = time.Now()
+	return err
+}
+
+// stepper returns a browser.SetupOptions.OnStep callback recording steps of
+// the named phase
+func (r *setupReport) stepper(phase string) func(name string, d time.Duration) {
+	return func(name string, d time.Duration) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.steps[phase] = append(r.steps[phase], stepReport{Name: name, DurationSeconds: d.Seconds()})
+	}
+}
+
+// printTimings prints the duration of each phase and its steps
+func (r *setupReport) printTimings() {
+	fmt.Println(dimStyle.Render("Setup timings:"))
+	for _, p := range r.Phases {
+		fmt.Println(dimStyle.Render(fmt.Sprintf("  %-22s %7.1fs", p.Name, p.DurationSeconds)))
+		for _, s := range p.Steps {
+			fmt.Println(dimStyle.Render(fmt.Sprintf("    %-20s %7.1fs", s.Name, s.DurationSeconds)))
+		}
+	}
+}
+
+// write saves the report to path as JSON. The total duration runs from the
+// start of the report to the end of the last phase, excluding the agent run.
+func (r *setupReport) write(path string) error {
+	if !r.endedAt.IsZero() {
+		r.DurationSeconds = r.endedAt.Sub(r.StartedAt).Seconds()
+	}
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"sort"
+	"strings"
+
+	"playwriter-setup/agent"
+)
+
+// knownSecrets are the API keys in use, redacted from printed commands and
+// errors. See addSecrets.
+var knownSecrets []string
+
+// addSecrets records secret values for redaction; empty values are ignored
+func addSecrets(values ...string) {
+	for _, v := range values {
+		if v != "" {
+			knownSecrets = append(knownSecrets, v)
+		}
+	}
+}
+
+// redactSecrets replaces every occurrence of each secret in s with "***".
+// Longer secrets are replaced first so one containing another is fully masked.
+func redactSecrets(s string, secrets []string) string {
+	sorted := append([]string(nil), secrets...)
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+	for _, secret := range sorted {
+		if secret != "" {
+			s = strings.ReplaceAll(s, secret, "***")
+		}
+	}
+	return s
+}
+
+// readSecret returns the secret stored in file or printed by the shell
+// command cmd, with trailing newlines trimmed. At most one may be set; if
+// neither is, it returns "" and no error.
+func readSecret(file, cmd string) (string, error) {
+	var secret string
+	switch {
+	case file != "" && cmd != "":
+		return "", fmt.Errorf("a file and a command were both given")
+	case file != "":
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		secret = string(data)
+	case cmd != "":
+		var stderr bytes.Buffer
+		c := exec.Command("sh", "-c", cmd)
+		c.Stderr = &stderr
+		out, err := c.Output()
+		if err != nil {
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				return "", fmt.Errorf("command %q failed: %w: %s", cmd, err, msg)
+			}
+			return "", fmt.Errorf("command %q failed: %w", cmd, err)
+		}
+		secret = string(out)
+	default:
+		return "", nil
+	}
+
+	secret = strings.TrimRight(secret, "\r\n")
+	if secret == "" {
+		return "", fmt.Errorf("secret is empty")
+	}
+	return secret, nil
+}
+
+// loadSecretEnv sets envVar from file or cmd (see readSecret) when either is
+// given, taking precedence over the existing environment. fileFlag and
+// cmdFlag name the flags they came from, for errors.
+func loadSecretEnv(envVar, fileFlag, cmdFlag, file, cmd string) error {
+	secret, err := readSecret(file, cmd)
+	if err != nil {
+		name := "-" + cmdFlag
+		if file != "" {
+			name = "-" + fileFlag
+		}
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if secret != "" {
+		os.Setenv(envVar, secret)
+	}
+	return nil
+}
+
+// keyPlaceholder stands in for API keys in -print-command output
+const keyPlaceholder = "***"
+
+// withPlaceholderKeys returns opts with placeholders for ag's API keys, so
+// -print-command can show the command without real keys. Provider keys set in
+// the environment are listed, or every provider key if none is.
+func withPlaceholderKeys(ag agent.Agent, opts agent.RunOptions) agent.RunOptions {
+	if ag.RequiredEnvVar() != "" {
+		opts.APIKey = keyPlaceholder
+		return opts
+	}
+	envVars := ag.ProviderEnvVars()
+	if set := slices.DeleteFunc(slices.Clone(envVars), func(name string) bool { return os.Getenv(name) == "" }); len(set) > 0 {
+		envVars = set
+	}
+	opts.EnvVars = make(map[string]string, len(envVars))
+	for _, name := range envVars {
+		opts.EnvVars[name] = keyPlaceholder
+	}
+	return opts
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"playwriter-setup/agent"
+)
+
+func TestReadSecret(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	keyFile := write("key", "sk-file-key\n")
+	crlfFile := write("crlf", "sk-crlf-key\r\n")
+	blankFile := write("blank", "\n\n")
+
+	tests := []struct {
+		name    string
+		file    string
+		cmd     string
+		want    string
+		wantErr string
+	}{
+		{name: "neither"},
+		{name: "file", file: keyFile, want: "sk-file-key"},
+		{name: "file with CRLF", file: crlfFile, want: "sk-crlf-key"},
+		{name: "missing file", file: filepath.Join(dir, "missing"), wantErr: "no such file"},
+		{name: "empty file", file: blankFile, wantErr: "secret is empty"},
+		{name: "command", cmd: "printf 'sk-cmd-key\\n'", want: "sk-cmd-key"},
+		{name: "inner whitespace kept", cmd: "echo ' sk key '", want: " sk key "},
+		{name: "failing command with stderr", cmd: "echo 'not logged in' >&2; exit 3", wantErr: "exit status 3: not logged in"},
+		{name: "failing command", cmd: "exit 1", wantErr: `command "exit 1" failed: exit status 1`},
+		{name: "command printing nothing", cmd: "true", wantErr: "secret is empty"},
+		{name: "both", file: keyFile, cmd: "echo x", wantErr: "a file and a command were both given"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readSecret(tt.file, tt.cmd)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("readSecret() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadSecretEnv(t *testing.T) {
+	const envVar = "PLAYWRITER_TEST_API_KEY"
+	tests := []struct {
+		name    string
+		file    string
+		cmd     string
+		want    string
+		wantErr string
+	}{
+		{name: "existing environment kept", want: "from-env"},
+		{name: "command overrides environment", cmd: "echo from-cmd", want: "from-cmd"},
+		{name: "failing command names its flag", cmd: "exit 1", want: "from-env", wantErr: "-api-key-cmd: "},
+		{name: "missing file names its flag", file: "/nonexistent/key", want: "from-env", wantErr: "-api-key-file: "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(envVar, "from-env")
+			err := loadSecretEnv(envVar, "api-key-file", "api-key-cmd", tt.file, tt.cmd)
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Errorf("err = %v, want it to start with %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if got := os.Getenv(envVar); got != tt.want {
+				t.Errorf("%s = %q, want %q", envVar, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactSecrets(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		secrets []string
+		want    string
+	}{
+		{"no secrets", "export KEY='abc'", nil, "export KEY='abc'"},
+		{"every occurrence", "key=abc123 again abc123", []string{"abc123"}, "key=*** again ***"},
+		{"several", "a=k1-xyz b=k2-uvw", []string{"k1-xyz", "k2-uvw"}, "a=*** b=***"},
+		{"longer secret first", "key=sk-ant-12345", []string{"sk-ant", "sk-ant-12345"}, "key=***"},
+		{"secret ending another", "key=sk-ant-12345 and sk-ant", []string{"12345", "sk-ant-12345"}, "key=*** and sk-ant"},
+		{"empty secret ignored", "nothing here", []string{""}, "nothing here"},
+		{"across lines", "export A='k-1'\nexport B='k-1'\n", []string{"k-1"}, "export A='***'\nexport B='***'\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := redactSecrets(tt.s, tt.secrets)
+			if got != tt.want {
+				t.Errorf("redactSecrets() = %q, want %q", got, tt.want)
+			}
+			for _, secret := range tt.secrets {
+				if secret != "" && strings.Contains(got, secret) {
+					t.Errorf("%q leaked in %q", secret, got)
+				}
+			}
+		})
+	}
+
+	// The caller's slice isn't reordered
+	secrets := []string{"a", "abc"}
+	redactSecrets("abc", secrets)
+	if secrets[0] != "a" {
+		t.Errorf("secrets reordered: %q", secrets)
+	}
+}
+
+func TestAddSecrets(t *testing.T) {
+	defer func(secrets []string) { knownSecrets = secrets }(knownSecrets)
+	knownSecrets = nil
+	addSecrets("", "k1", "", "k2")
+	if len(knownSecrets) != 2 || knownSecrets[0] != "k1" || knownSecrets[1] != "k2" {
+		t.Errorf("knownSecrets = %q, want [k1 k2]", knownSecrets)
+	}
+}
+
+func TestWithPlaceholderKeys(t *testing.T) {
+	tests := []struct {
+		name        string
+		ag          agent.Agent
+		env         map[string]string
+		wantAPIKey  string
+		wantEnvVars []string
+	}{
+		{name: "single key", ag: &agent.ClaudeAgent{}, wantAPIKey: keyPlaceholder},
+		{name: "single key set", ag: &agent.CursorAgent{}, env: map[string]string{"CURSOR_API_KEY": "key-0123456789"}, wantAPIKey: keyPlaceholder},
+		{name: "provider keys set", ag: &agent.OpenCodeAgent{}, env: map[string]string{"OPENAI_API_KEY": "sk-proj-0123456789"}, wantEnvVars: []string{"OPENAI_API_KEY"}},
+		{name: "no provider keys", ag: &agent.OpenCodeAgent{}, wantEnvVars: (&agent.OpenCodeAgent{}).ProviderEnvVars()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range append([]string{tt.ag.RequiredEnvVar()}, tt.ag.ProviderEnvVars()...) {
+				if name != "" {
+					t.Setenv(name, tt.env[name])
+				}
+			}
+			opts := withPlaceholderKeys(tt.ag, agent.RunOptions{Prompt: "hi"})
+			if opts.APIKey != tt.wantAPIKey || opts.Prompt != "hi" {
+				t.Errorf("APIKey = %q, want %q", opts.APIKey, tt.wantAPIKey)
+			}
+			names := slices.Sorted(maps.Keys(opts.EnvVars))
+			if !slices.Equal(names, slices.Sorted(slices.Values(tt.wantEnvVars))) {
+				t.Errorf("EnvVars = %v, want %v", names, tt.wantEnvVars)
+			}
+			for name, value := range opts.EnvVars {
+				if value != keyPlaceholder {
+					t.Errorf("%s = %q, want the placeholder", name, value)
+				}
+			}
+			for _, value := range tt.env {
+				if strings.Contains(tt.ag.Command(opts), value) {
+					t.Errorf("command has the real key %q", value)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/onkernel/kernel-go-sdk"
+
+	"playwriter-setup/agent"
+	"playwriter-setup/browser"
+	"playwriter-setup/pool"
+)
+
+// warmPoolInterval is how often the warm pool daemon checks the pool size
+const warmPoolInterval = 15 * time.Second
+
+// parallelSetup installs the agent CLI while playwriter builds. -no-parallel
+// turns it off to run every setup phase in order.
+var parallelSetup = true
+
+// setupError is returned by prepareSession and names the phase that failed
+type setupError struct {
+	Phase string // matches the setup report phase names
+	Err   error
+}
+
+func (e *setupError) Error() string { return e.Err.Error() }
+func (e *setupError) Unwrap() error { return e.Err }
+
+// setupPhase returns the failed phase of a prepareSession error
+func setupPhase(err error) string {
+	var se *setupError
+	if errors.As(err, &se) {
+		return se.Phase
+	}
+	return "setup"
+}
+
+// playwriterMCPConfig returns the MCP config for opts: the locally built
+// playwriter launched with opts.MCPRuntime, or the published one pointed at
+// opts.ExternalRelay
+func playwriterMCPConfig(opts browser.SetupOptions) agent.MCPConfig {
+	if opts.ExternalRelay != "" {
+		return agent.ExternalRelayMCPConfig(opts.MCPServerName, opts.ExternalRelay)
+	}
+	return agent.PlaywriterMCPConfig(opts.MCPServerName, opts.MCPRuntime)
+}
+
+// playwriterServerName returns the name of the playwriter server in the
+// agent's MCP config
+func playwriterServerName(opts browser.SetupOptions) string {
+	if opts.MCPServerName == "" {
+		return agent.PlaywriterServerName
+	}
+	return opts.MCPServerName
+}
+
+// prepareSession creates a new browser session and fully prepares it for ag:
+// browser setup, agent install, playwriter build, relay start, and MCP config.
+// With opts.ExternalRelay, the build and relay start are replaced by a check
+// that the external relay answers. extraMCP servers are configured alongside playwriter. Phases, and the steps
+// of the browser and playwriter_install phases, are recorded in report if it's
+// non-nil. The session ID is returned even on failure once the browser exists.
+func prepareSession(ctx context.Context, client kernel.Client, ag agent.Agent, opts browser.SetupOptions, extraMCP map[string]agent.MCPServer, report *setupReport) (*browser.SetupResult, error) {
+	var result *browser.SetupResult
+	err := report.phase("browser", func() (err error) {
+		browserOpts := opts
+		if report != nil {
+			browserOpts.OnStep = report.stepper("browser")
+		}
+		result, err = browser.Setup(ctx, client, browserOpts)
+		return err
+	})
+	if err != nil {
+		return result, &setupError{Phase: "browser", Err: fmt.Errorf("browser setup failed: %w", err)}
+	}
+	sessionID := result.SessionID
+	if report != nil {
+		report.SessionID = sessionID
+		report.LiveViewURL = result.LiveViewURL
+	}
+
+	// Install the agent CLI
+	installAgent := func() error {
+		if err := report.phase("agent_install", func() error {
+			return ag.Install(ctx, client, sessionID)
+		}); err != nil {
+			return &setupError{Phase: "agent_install", Err: fmt.Errorf("agent install failed: %w", err)}
+		}
+		return nil
+	}
+
+	// Install playwriter from source (all agents use the same version)
+	installPlaywriter := func() error {
+		if err := report.phase("playwriter_install", func() error {
+			installOpts := opts
+			if report != nil {
+				installOpts.OnStep = report.stepper("playwriter_install")
+			}
+			return browser.InstallPlaywriterFromSource(ctx, client, sessionID, result.ExtensionID, installOpts)
+		}); err != nil {
+			return &setupError{Phase: "playwriter_install", Err: fmt.Errorf("playwriter install failed: %w", err)}
+		}
+		return nil
+	}
+
+	// An external relay needs neither the playwriter build nor a local relay
+	if opts.ExternalRelay != "" {
+		if err := installAgent(); err != nil {
+			return result, err
+		}
+		var version string
+		if err := report.phase("relay", func() (err error) {
+			version, err = browser.ExternalRelayVersion(ctx, client, sessionID, opts.ExternalRelay)
+			return err
+		}); err != nil {
+			return result, &setupError{Phase: "relay", Err: err}
+		}
+		if report != nil {
+			report.RelayEndpoint = opts.ExternalRelay
+			report.Versions["playwriter_relay"] = version
+		}
+	} else {
+		// Both need the browser and must finish before the relay starts and
+		// MCP is configured, but don't depend on each other
+		if err := runConcurrently(parallelSetup, installAgent, installPlaywriter); err != nil {
+			return result, err
+		}
+
+		// Start the relay
+		if err := report.phase("relay", func() error {
+			return browser.StartPlaywriterRelay(ctx, client, sessionID)
+		}); err != nil {
+			return result, &setupError{Phase: "relay", Err: fmt.Errorf("relay start failed: %w", err)}
+		}
+		if report != nil {
+			report.RelayEndpoint = browser.RelayURL
+			if version, err := browser.RelayVersion(ctx, client, sessionID); err == nil {
+				report.Versions["playwriter_relay"] = version
+			}
+		}
+	}
+
+	serverName := playwriterServerName(opts)
+	mcpConfig := playwriterMCPConfig(opts)
+	for name, server := range extraMCP {
+		if _, exists := mcpConfig.MCPServers[name]; !exists {
+			mcpConfig.MCPServers[name] = server
+		}
+	}
+	if err := report.phase("mcp", func() error {
+		if err := ag.ConfigureMCP(ctx, client, sessionID, mcpConfig); err != nil {
+			return err
+		}
+		// Writing the config doesn't guarantee the agent reads it
+		if err := ag.VerifyMCP(ctx, client, sessionID, serverName); err != nil {
+			return fmt.Errorf("%s does not see the %s server: %w", ag.Name(), serverName, err)
+		}
+		return nil
+	}); err != nil {
+		return result, &setupError{Phase: "mcp", Err: fmt.Errorf("MCP configuration failed: %w", err)}
+	}
+
+	return result, nil
+}
+
+// runConcurrently runs fns at the same time if parallel is set, otherwise in
+// order, stopping at the first error. It returns the first error in fns order.
+// The progress spinner is turned off while fns run concurrently, since their
+// output would interleave with it.
+func runConcurrently(parallel bool, fns ...func() error) error {
+	if !parallel {
+		for _, fn := range fns {
+			if err := fn(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	progress := browser.ProgressEnabled
+	browser.ProgressEnabled = false
+	defer func() { browser.ProgressEnabled = progress }()
+
+	errs := make([]error, len(fns))
+	var wg sync.WaitGroup
+	for i, fn := range fns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = fn()
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claimWarmSession takes a live session for ag from the warm pool.
+// Returns nil if no warm session is available.
+func claimWarmSession(ctx context.Context, client kernel.Client, store *pool.Store, ag agent.Agent) *pool.Entry {
+	for {
+		entry, err := store.Claim(ag.Name())
+		if err != nil {
+			fmt.Println(dimStyle.Render("Warm pool unavailable: " + err.Error()))
+			return nil
+		}
+		if entry == nil {
+			return nil
+		}
+		// Skip sessions that timed out or were deleted since they were pooled
+		if _, err := client.Browsers.Get(ctx, entry.SessionID); err == nil {
+			return entry
+		}
+	}
+}
+
+// runWarmPool keeps size prepared sessions for ag in the store, replenishing
+// them as they are claimed or expire, until interrupted.
+func runWarmPool(ctx context.Context, client kernel.Client, store *pool.Store, ag agent.Agent, opts browser.SetupOptions, extraMCP map[string]agent.MCPServer, size int) int {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+
+	fmt.Println(successStyle.Render(fmt.Sprintf("Warm pool: keeping %d %s session(s) in %s", size, ag.Name(), store.Dir)))
+
+	// Stop pooling sessions a minute before Kernel would time them out
+	ttl := time.Duration(opts.TimeoutSeconds)*time.Second - time.Minute
+
+	for {
+		entries, err := store.List(ag.Name())
+		if err != nil {
+			return fatal("warm_pool", exitSetupFailure, "Warm pool: "+err.Error())
+		}
+
+		for missing := size - len(entries); missing > 0 && ctx.Err() == nil; missing-- {
+			result, err := prepareSession(ctx, client, ag, opts, extraMCP, nil)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, errorStyle.Render("Warm pool: "+err.Error()))
+				if result != nil {
+					client.Browsers.DeleteByID(context.Background(), result.SessionID)
+				}
+				break
+			}
+
+			now := time.Now()
+			entry := pool.Entry{
+				SessionID:   result.SessionID,
+				LiveViewURL: result.LiveViewURL,
+				Agent:       ag.Name(),
+				CreatedAt:   now,
+				Headless:    opts.Headless,
+			}
+			if ttl > 0 {
+				entry.ExpiresAt = now.Add(ttl)
+			}
+			if err := store.Add(entry); err != nil {
+				fmt.Fprintln(os.Stderr, errorStyle.Render("Warm pool: "+err.Error()))
+				client.Browsers.DeleteByID(context.Background(), result.SessionID)
+				break
+			}
+			fmt.Println(successStyle.Render("Warm pool: added " + result.SessionID))
+		}
+
+		select {
+		case <-ctx.Done():
+			fmt.Println(dimStyle.Render("Warm pool stopped; pooled sessions remain available"))
+			return exitSuccess
+		case <-time.After(warmPoolInterval):
+		}
+	}
+}
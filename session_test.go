@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"playwriter-setup/agent"
+	"playwriter-setup/browser"
+)
+
+func TestPlaywriterMCPConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		opts        browser.SetupOptions
+		wantName    string
+		wantCommand string
+	}{
+		{"default runtime", browser.SetupOptions{}, agent.PlaywriterServerName, "node"},
+		{"bun", browser.SetupOptions{MCPRuntime: "bun"}, agent.PlaywriterServerName, "bun"},
+		{"absolute path", browser.SetupOptions{MCPRuntime: "/usr/local/bin/node20", MCPServerName: "pw"}, "pw", "/usr/local/bin/node20"},
+		{"external relay ignores the runtime", browser.SetupOptions{MCPRuntime: "bun", ExternalRelay: "https://relay.example.com"}, agent.PlaywriterServerName, "npx"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := playwriterMCPConfig(tt.opts)
+			if name := playwriterServerName(tt.opts); name != tt.wantName {
+				t.Errorf("server name = %q, want %q", name, tt.wantName)
+			}
+			server, ok := config.MCPServers[tt.wantName]
+			if !ok || len(config.MCPServers) != 1 {
+				t.Fatalf("servers = %v, want only %q", config.MCPServers, tt.wantName)
+			}
+			if server.Command != tt.wantCommand {
+				t.Errorf("command = %q, want %q", server.Command, tt.wantCommand)
+			}
+			if err := agent.ValidateMCPConfig(config); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestRunConcurrently(t *testing.T) {
+	errAgent := errors.New("agent install failed")
+	errBuild := errors.New("playwriter build failed")
+	tests := []struct {
+		name     string
+		parallel bool
+		errs     []error // returned by each fn
+		wantErr  error
+		wantRan  []int // fns run, in order when not parallel
+	}{
+		{name: "sequential", errs: []error{nil, nil}, wantRan: []int{0, 1}},
+		{name: "sequential stops at the first error", errs: []error{errAgent, nil}, wantErr: errAgent, wantRan: []int{0}},
+		{name: "parallel", parallel: true, errs: []error{nil, nil}, wantRan: []int{0, 1}},
+		{name: "parallel runs every fn", parallel: true, errs: []error{errAgent, nil}, wantErr: errAgent, wantRan: []int{0, 1}},
+		{name: "parallel reports errors in fns order", parallel: true, errs: []error{errAgent, errBuild}, wantErr: errAgent, wantRan: []int{0, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(b bool) { browser.ProgressEnabled = b }(browser.ProgressEnabled)
+			browser.ProgressEnabled = true
+
+			var mu sync.Mutex
+			var ran []int
+			var started sync.WaitGroup
+			started.Add(len(tt.errs))
+			fns := make([]func() error, len(tt.errs))
+			for i, err := range tt.errs {
+				fns[i] = func() error {
+					mu.Lock()
+					ran = append(ran, i)
+					mu.Unlock()
+					if browser.ProgressEnabled == tt.parallel {
+						t.Errorf("fn %d ran with ProgressEnabled=%v", i, browser.ProgressEnabled)
+					}
+					if tt.parallel {
+						// Every fn must be running before any finishes; fail
+						// rather than hang if they're run one at a time
+						started.Done()
+						if !waitTimeout(&started, time.Second) {
+							t.Errorf("fn %d: other fns not started", i)
+						}
+						// Finish out of order so the first error isn't the first returned
+						time.Sleep(time.Duration(len(tt.errs)-i) * 5 * time.Millisecond)
+					}
+					return err
+				}
+			}
+
+			if err := runConcurrently(tt.parallel, fns...); err != tt.wantErr {
+				t.Errorf("runConcurrently() = %v, want %v", err, tt.wantErr)
+			}
+			if tt.parallel {
+				slices.Sort(ran)
+			}
+			if !slices.Equal(ran, tt.wantRan) {
+				t.Errorf("ran %v, want %v", ran, tt.wantRan)
+			}
+			if !browser.ProgressEnabled {
+				t.Error("ProgressEnabled not restored")
+			}
+		})
+	}
+}
+
+// waitTimeout waits for wg, reporting false if it takes longer than d
+func waitTimeout(wg *sync.WaitGroup, d time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
@@ -0,0 +1,186 @@
+// Package sessions keeps a local record of the browser sessions this tool has
+// used, so sessions can be labelled with a tag and found again by it.
+package sessions
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MaxSessionAge is the longest timeout Kernel allows a session. A record not
+// used for longer belongs to a session that can't still be alive.
+const MaxSessionAge = 72 * time.Hour
+
+// Record describes a session used by a run
+type Record struct {
+	SessionID      string    `json:"session_id"`
+	Tag            string    `json:"tag,omitempty"`
+	Agent          string    `json:"agent"`
+	LiveViewURL    string    `json:"live_view_url,omitempty"`
+	TimeoutSeconds int64     `json:"timeout_seconds,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	LastUsedAt     time.Time `json:"last_used_at"`
+}
+
+// Expired reports whether the session has likely timed out by now: it hasn't
+// been used for longer than its timeout, or MaxSessionAge if that's unknown
+func (r Record) Expired(now time.Time) bool {
+	timeout := MaxSessionAge
+	if r.TimeoutSeconds > 0 {
+		timeout = time.Duration(r.TimeoutSeconds) * time.Second
+	}
+	return now.Sub(r.LastUsedAt) > timeout
+}
+
+// Store is a directory of session records, one JSON file per session
+type Store struct {
+	Dir string
+}
+
+// DefaultDir returns the default session store directory under the user's home
+func DefaultDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = os.TempDir()
+	}
+	return filepath.Join(home, ".playwriter-in-kernel", "sessions")
+}
+
+// NewStore returns a store rooted at dir, or DefaultDir if dir is empty
+func NewStore(dir string) *Store {
+	if dir == "" {
+		dir = DefaultDir()
+	}
+	return &Store{Dir: dir}
+}
+
+// Touch records that r's session was just used. An existing record keeps its
+// creation time, and its tag and timeout unless r sets new ones.
+func (s *Store) Touch(r Record) error {
+	now := time.Now()
+	r.CreatedAt, r.LastUsedAt = now, now
+	if existing, err := s.Get(r.SessionID); err == nil && existing != nil {
+		r.CreatedAt = existing.CreatedAt
+		if r.Tag == "" {
+			r.Tag = existing.Tag
+		}
+		if r.TimeoutSeconds == 0 {
+			r.TimeoutSeconds = existing.TimeoutSeconds
+		}
+	}
+
+	if err := os.MkdirAll(s.Dir, 0o700); err != nil {
+		return fmt.Errorf("create session dir: %w", err)
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal record: %w", err)
+	}
+
+	// Write to a temp file first so readers never see a partial record
+	tmp := filepath.Join(s.Dir, "."+r.SessionID+".tmp")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("write record: %w", err)
+	}
+	return os.Rename(tmp, s.path(r.SessionID))
+}
+
+// Get returns the record for sessionID, or nil if there is none
+func (s *Store) Get(sessionID string) (*Record, error) {
+	data, err := os.ReadFile(s.path(sessionID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read record: %w", err)
+	}
+	var r Record
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("parse record: %w", err)
+	}
+	return &r, nil
+}
+
+// List returns all records, most recently used first. Records older than
+// MaxSessionAge are deleted instead of returned.
+func (s *Store) List() ([]Record, error) {
+	files, err := os.ReadDir(s.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read session dir: %w", err)
+	}
+
+	var records []Record
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.Dir, f.Name()))
+		if err != nil {
+			continue
+		}
+		var r Record
+		if err := json.Unmarshal(data, &r); err != nil {
+			continue
+		}
+		if time.Since(r.LastUsedAt) > MaxSessionAge {
+			os.Remove(filepath.Join(s.Dir, f.Name()))
+			continue
+		}
+		records = append(records, r)
+	}
+
+	sort.Slice(records, func(i, j int) bool { return records[i].LastUsedAt.After(records[j].LastUsedAt) })
+	return records, nil
+}
+
+// FindByTag returns the most recently used record with tag, or nil if none has it
+func (s *Store) FindByTag(tag string) (*Record, error) {
+	records, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		if r.Tag == tag {
+			return &r, nil
+		}
+	}
+	return nil, nil
+}
+
+// FindByLiveView returns the most recently used record with the live view
+// URL liveViewURL, or nil if none has it
+func (s *Store) FindByLiveView(liveViewURL string) (*Record, error) {
+	records, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		if r.LiveViewURL == liveViewURL {
+			return &r, nil
+		}
+	}
+	return nil, nil
+}
+
+// Remove deletes the record for sessionID, if any
+func (s *Store) Remove(sessionID string) error {
+	err := os.Remove(s.path(sessionID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// path returns the file path for a session record
+func (s *Store) path(sessionID string) string {
+	return filepath.Join(s.Dir, sessionID+".json")
+}
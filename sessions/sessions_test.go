@@ -0,0 +1,115 @@
+package sessions
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeRecord stores r as-is, keeping its timestamps
+func writeRecord(t *testing.T, s *Store, r Record) {
+	t.Helper()
+	data, _ := json.Marshal(r)
+	if err := os.MkdirAll(s.Dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(s.path(r.SessionID), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListPrunes(t *testing.T) {
+	now := time.Now()
+	s := NewStore(t.TempDir())
+	records := []Record{
+		{SessionID: "fresh", LastUsedAt: now.Add(-time.Hour)},
+		{SessionID: "yesterday", LastUsedAt: now.Add(-24 * time.Hour)},
+		{SessionID: "ancient", LastUsedAt: now.Add(-MaxSessionAge - time.Hour)},
+	}
+	for _, r := range records {
+		writeRecord(t, s, r)
+	}
+	os.WriteFile(filepath.Join(s.Dir, "garbage.json"), []byte("{"), 0o600)
+
+	listed, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, r := range listed {
+		ids = append(ids, r.SessionID)
+	}
+	if len(ids) != 2 || ids[0] != "fresh" || ids[1] != "yesterday" {
+		t.Errorf("listed %q, want [fresh yesterday], most recent first", ids)
+	}
+	if _, err := os.Stat(s.path("ancient")); !os.IsNotExist(err) {
+		t.Error("record older than MaxSessionAge not deleted")
+	}
+	if _, err := os.Stat(s.path("yesterday")); err != nil {
+		t.Errorf("live record deleted: %v", err)
+	}
+
+	// A missing store lists nothing
+	if listed, err := NewStore(filepath.Join(t.TempDir(), "missing")).List(); err != nil || listed != nil {
+		t.Errorf("List() on a missing dir = %v, %v", listed, err)
+	}
+}
+
+func TestRecordExpired(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		timeout int64
+		idle    time.Duration
+		want    bool
+	}{
+		{"within its timeout", 600, 5 * time.Minute, false},
+		{"past its timeout", 600, 11 * time.Minute, true},
+		{"unknown timeout within MaxSessionAge", 0, 48 * time.Hour, false},
+		{"unknown timeout past MaxSessionAge", 0, MaxSessionAge + time.Minute, true},
+	}
+	for _, tt := range tests {
+		r := Record{TimeoutSeconds: tt.timeout, LastUsedAt: now.Add(-tt.idle)}
+		if got := r.Expired(now); got != tt.want {
+			t.Errorf("%s: Expired() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTouch(t *testing.T) {
+	s := NewStore(t.TempDir())
+	created := time.Now().Add(-2 * time.Hour).Truncate(time.Second)
+	writeRecord(t, s, Record{SessionID: "s1", Tag: "checkout", TimeoutSeconds: 3600, CreatedAt: created, LastUsedAt: created})
+
+	if err := s.Touch(Record{SessionID: "s1", Agent: "claude"}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := s.Get("s1")
+	if err != nil || r == nil {
+		t.Fatalf("Get() = %v, %v", r, err)
+	}
+	if r.Tag != "checkout" || r.TimeoutSeconds != 3600 || !r.CreatedAt.Equal(created) || r.Agent != "claude" {
+		t.Errorf("record = %+v, want tag, timeout, and creation time kept", r)
+	}
+	if time.Since(r.LastUsedAt) > time.Minute {
+		t.Errorf("LastUsedAt = %v, want now", r.LastUsedAt)
+	}
+
+	if found, err := s.FindByTag("checkout"); err != nil || found == nil || found.SessionID != "s1" {
+		t.Errorf("FindByTag() = %v, %v", found, err)
+	}
+	if found, _ := s.FindByTag("other"); found != nil {
+		t.Errorf("FindByTag(other) = %+v, want nil", found)
+	}
+	if err := s.Remove("s1"); err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := s.Get("s1"); r != nil {
+		t.Error("record not removed")
+	}
+	if err := s.Remove("s1"); err != nil {
+		t.Errorf("removing a missing record: %v", err)
+	}
+}
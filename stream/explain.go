@@ -0,0 +1,160 @@
+package stream
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"playwriter-setup/agent"
+)
+
+// Summary describes what the agent did in a run, derived purely from the
+// events it sent
+type Summary struct {
+	Pages       []string       `json:"pages,omitempty"` // URLs navigated to, in order, without repeats
+	Tools       map[string]int `json:"tools,omitempty"` // Number of calls per tool
+	Files       []string       `json:"files,omitempty"` // Files written, e.g. screenshots, in order, without repeats
+	FinalAnswer string         `json:"final_answer,omitempty"`
+	Timing      *Timing        `json:"timing,omitempty"` // Set if the events were timed
+}
+
+// fileArgKeys are tool arguments naming a file the tool writes
+var fileArgKeys = []string{"file_path", "filePath", "path", "filename"}
+
+// writeToolWords mark tools whose file argument is written rather than read
+var writeToolWords = []string{"write", "edit", "save", "screenshot", "create"}
+
+// observeToolCall adds a tool call to the run's summary
+func (p *Parser) observeToolCall(toolName string, args agent.ToolArgs) {
+	if p.tools == nil {
+		p.tools = make(map[string]int)
+	}
+	p.tools[toolName]++
+
+	if url := args.Get("url"); url != "" {
+		p.pages = appendNew(p.pages, url)
+	}
+	if code := args.Code(); code != "" {
+		for _, m := range gotoRe.FindAllStringSubmatch(code, -1) {
+			p.pages = appendNew(p.pages, m[1])
+		}
+		for _, m := range screenshotRe.FindAllStringSubmatch(code, -1) {
+			if path := screenshotPath.FindStringSubmatch(m[1]); path != nil {
+				p.files = appendNew(p.files, path[1])
+			}
+		}
+	}
+
+	name := strings.ToLower(toolName)
+	for _, word := range writeToolWords {
+		if !strings.Contains(name, word) {
+			continue
+		}
+		for _, key := range fileArgKeys {
+			if path := args.Get(key); path != "" {
+				p.files = appendNew(p.files, path)
+				break
+			}
+		}
+		break
+	}
+}
+
+// appendNew appends s to list unless it's already there
+func appendNew(list []string, s string) []string {
+	if slices.Contains(list, s) {
+		return list
+	}
+	return append(list, s)
+}
+
+// Summary returns what the agent did so far: the pages it visited, the tools
+// it called, the files it wrote, and its final answer
+func (p *Parser) Summary() Summary {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := Summary{
+		Pages:       slices.Clone(p.pages),
+		Files:       slices.Clone(p.files),
+		FinalAnswer: p.finalMessage,
+	}
+	if p.timing.started {
+		timing := p.timing.timing
+		s.Timing = &timing
+	}
+	if len(p.tools) > 0 {
+		s.Tools = make(map[string]int, len(p.tools))
+		for name, n := range p.tools {
+			s.Tools[name] = n
+		}
+	}
+	return s
+}
+
+// FormatSummary renders s as a block of labeled lines for the terminal.
+// Tools are listed most used first.
+func FormatSummary(s Summary) string {
+	var b strings.Builder
+	b.WriteString(ToolStyle.Render("Summary") + "\n")
+
+	// Continuation lines of a list have an empty label
+	line := func(label, value string) {
+		if label != "" {
+			label += ":"
+		}
+		fmt.Fprintf(&b, "%s %s\n", DimStyle.Render(fmt.Sprintf("  %-8s", label)), value)
+	}
+	if len(s.Pages) == 0 {
+		line("Pages", DimStyle.Render("none"))
+	}
+	for i, page := range s.Pages {
+		label := ""
+		if i == 0 {
+			label = "Pages"
+		}
+		line(label, page)
+	}
+
+	if len(s.Tools) == 0 {
+		line("Tools", DimStyle.Render("none"))
+	} else {
+		names := make([]string, 0, len(s.Tools))
+		for name := range s.Tools {
+			names = append(names, name)
+		}
+		sort.Slice(names, func(i, j int) bool {
+			if s.Tools[names[i]] != s.Tools[names[j]] {
+				return s.Tools[names[i]] > s.Tools[names[j]]
+			}
+			return names[i] < names[j]
+		})
+		counts := make([]string, len(names))
+		for i, name := range names {
+			counts[i] = fmt.Sprintf("%s x%d", name, s.Tools[name])
+		}
+		line("Tools", strings.Join(counts, ", "))
+	}
+
+	if len(s.Files) == 0 {
+		line("Files", DimStyle.Render("none"))
+	}
+	for i, file := range s.Files {
+		label := ""
+		if i == 0 {
+			label = "Files"
+		}
+		line(label, file)
+	}
+
+	answer := truncate(collapseWhitespace(s.FinalAnswer), 200)
+	if answer == "" {
+		answer = DimStyle.Render("none")
+	}
+	line("Answer", answer)
+
+	if s.Timing != nil {
+		line("Timing", FormatTiming(*s.Timing))
+	}
+	return b.String()
+}
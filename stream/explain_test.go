@@ -0,0 +1,116 @@
+package stream
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParserSummary(t *testing.T) {
+	tests := []struct {
+		name      string
+		recording []string // recorded stream-json lines
+		want      Summary
+	}{
+		{
+			name: "pages, tools, and files",
+			recording: []string{
+				`{"type":"system","subtype":"init","session_id":"s1"}`,
+				`{"type":"assistant","message":{"id":"m1","content":[{"type":"tool_use","id":"t1","name":"mcp__playwriter__execute","input":{"code":"await page.goto('https://example.com'); await page.screenshot({ path: '/tmp/home.png' })"}}]}}`,
+				`{"type":"assistant","message":{"id":"m2","content":[{"type":"tool_use","id":"t2","name":"mcp__playwriter__execute","input":{"code":"await page.goto('https://example.com/docs'); await page.goto('https://example.com')"}}]}}`,
+				`{"type":"assistant","message":{"id":"m3","content":[{"type":"tool_use","id":"t3","name":"Write","input":{"file_path":"/tmp/notes.md","content":"x"}}]}}`,
+				`{"type":"assistant","message":{"id":"m4","content":[{"type":"tool_use","id":"t4","name":"Read","input":{"file_path":"/tmp/input.txt"}}]}}`,
+				`{"type":"assistant","message":{"id":"m5","content":[{"type":"text","text":"Done: two pages."}]}}`,
+				`{"type":"result","subtype":"success","result":"Done: two pages."}`,
+			},
+			want: Summary{
+				Pages:       []string{"https://example.com", "https://example.com/docs"},
+				Tools:       map[string]int{"mcp__playwriter__execute": 2, "Write": 1, "Read": 1},
+				Files:       []string{"/tmp/home.png", "/tmp/notes.md"},
+				FinalAnswer: "Done: two pages.",
+			},
+		},
+		{
+			name: "no tools",
+			recording: []string{
+				`{"type":"assistant","message":{"id":"m1","content":[{"type":"text","text":"Nothing to do."}]}}`,
+				`{"type":"result","subtype":"success","result":"Nothing to do."}`,
+			},
+			want: Summary{FinalAnswer: "Nothing to do."},
+		},
+		{
+			name: "timed events",
+			recording: []string{
+				`{"type":"assistant","message":{"id":"m1","content":[{"type":"text","text":"Hi."}]},"ts":1700000000000,"delta_ms":0}`,
+				`{"type":"result","subtype":"success","result":"Hi.","ts":1700000001500,"delta_ms":1500}`,
+			},
+			want: Summary{FinalAnswer: "Hi."},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parser := NewParser()
+			captureStdout(t, func() {
+				if err := ReplayFrom(strings.NewReader(strings.Join(tt.recording, "\n")), parser); err != nil {
+					t.Fatal(err)
+				}
+			})
+			got := parser.Summary()
+			timed := got.Timing != nil
+			got.Timing = nil
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Summary() = %+v\nwant %+v", got, tt.want)
+			}
+			if wantTimed := strings.Contains(tt.recording[0], `"ts"`); timed != wantTimed {
+				t.Errorf("Summary().Timing set = %v, want %v", timed, wantTimed)
+			}
+		})
+	}
+}
+
+func TestFormatSummary(t *testing.T) {
+	tests := []struct {
+		name    string
+		summary Summary
+		want    []string // lines, without trailing spaces
+	}{
+		{
+			name: "tools most used first",
+			summary: Summary{
+				Pages:       []string{"https://a.example", "https://b.example"},
+				Tools:       map[string]int{"b": 1, "a": 1, "execute": 3},
+				Files:       []string{"/tmp/shot.png"},
+				FinalAnswer: "Found\n\n  it.",
+			},
+			want: []string{
+				"Summary",
+				"  Pages:   https://a.example",
+				"           https://b.example",
+				"  Tools:   execute x3, a x1, b x1",
+				"  Files:   /tmp/shot.png",
+				"  Answer:  Found it.",
+			},
+		},
+		{
+			name: "empty run",
+			want: []string{
+				"Summary",
+				"  Pages:   none",
+				"  Tools:   none",
+				"  Files:   none",
+				"  Answer:  none",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := strings.Split(strings.TrimSuffix(FormatSummary(tt.summary), "\n"), "\n")
+			for i := range got {
+				got[i] = strings.TrimRight(got[i], " ")
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("FormatSummary() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
@@ -4,7 +4,12 @@ package stream
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/charmbracelet/lipgloss"
 
@@ -16,37 +21,146 @@ var (
 	DimStyle       = lipgloss.NewStyle().Foreground(lipgloss.Color("8"))
 	ToolStyle      = lipgloss.NewStyle().Foreground(lipgloss.Color("14"))
 	AssistantStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("15"))
+	WarningStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("11"))
 )
 
-// Parser handles parsing and displaying agent stream output
+// UsePlainStyles drops all styling from this package's output, for terminals
+// without color support
+func UsePlainStyles() {
+	DimStyle = lipgloss.NewStyle()
+	ToolStyle = lipgloss.NewStyle()
+	AssistantStyle = lipgloss.NewStyle()
+	WarningStyle = lipgloss.NewStyle()
+}
+
+// Parser handles parsing and displaying agent stream output. It is safe for
+// concurrent use; events are printed one at a time.
 type Parser struct {
+	// Log, if set, receives a plain copy of the output without styling,
+	// for a readable transcript without ANSI codes
+	Log io.Writer
+
+	// OnToolCall, if set, is called with the tool name and argument summary
+	// each time the agent starts a tool call. It must not block.
+	OnToolCall func(toolName, summary string)
+
+	mu                 sync.Mutex // guards the fields below and serializes output
 	lastPrintedMessage string
+	finalMessage       string
+	deltaMode          bool            // the agent streams text deltas; whole messages aren't printed
+	deltaText          strings.Builder // text of the block being streamed
+	textOutput         strings.Builder // plain text output so far (TextOutputEventType)
+	dotsPending        bool            // heartbeat dots were printed without a newline
+	approvalRequested  bool
+	resultError        string // set if the agent's final result reported an error
+	stderrLines        []string
+	stderrPartial      string
+	pages              []string       // URLs navigated to, for Summary
+	tools              map[string]int // calls per tool, for Summary
+	files              []string       // files written, for Summary
+	timing             timingState    // latency of timed events, for Summary
 }
 
+// stderrTailSize is the number of stderr lines kept for error reporting
+const stderrTailSize = 20
+
 // NewParser creates a new stream parser
 func NewParser() *Parser {
 	return &Parser{}
 }
 
-// ParseLine parses a single line of JSON output and returns a StreamEvent
+// ParseLine parses a single line of JSON output, as agents print it or as a
+// recording stores it (see agent.DecodeRecorded), and returns a StreamEvent
 func (p *Parser) ParseLine(line string) (*agent.StreamEvent, error) {
 	line = strings.TrimSpace(line)
 	if line == "" || strings.HasPrefix(line, "[?") || strings.HasPrefix(line, "\x1b[") {
 		return nil, nil
 	}
 
-	var event agent.StreamEvent
-	if err := json.Unmarshal([]byte(line), &event); err != nil {
+	event, err := agent.DecodeRecorded(json.RawMessage(line))
+	if err != nil {
 		return nil, err
 	}
+	event.Raw = json.RawMessage(line)
 
 	return &event, nil
 }
 
+// IsApprovalRequest reports whether an event asks for tool approval; see
+// agent.IsApprovalRequest
+func IsApprovalRequest(event agent.StreamEvent) bool {
+	return agent.IsApprovalRequest(event)
+}
+
+// ApprovalRequested reports whether any processed event asked for tool approval
+func (p *Parser) ApprovalRequested() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.approvalRequested
+}
+
 // ProcessEvent handles a stream event and prints appropriate output
 func (p *Parser) ProcessEvent(event agent.StreamEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.timing.observe(event)
+
+	// Show quiet periods as dots, leaving any streamed text block open
+	if event.Type == agent.HeartbeatEventType {
+		if p.deltaText.Len() == 0 {
+			p.print(span{DimStyle.Render, "."})
+			p.dotsPending = true
+		}
+		return
+	}
+	if event.Type != agent.StderrEventType {
+		p.endDots()
+	}
+
+	if IsApprovalRequest(event) {
+		p.approvalRequested = true
+		msg := "[approval] agent is waiting for tool approval"
+		if toolName := agent.ApprovalTool(event); toolName != "" {
+			msg += ": " + toolName
+		}
+		p.println(span{WarningStyle.Render, msg + " (the run may hang; check the agent's approval flags)"})
+		return
+	}
+	if event.Type == agent.AutoApprovedEventType {
+		p.println(span{DimStyle.Render, "[approval] approved " + agent.ApprovalTool(event) + " (-auto-approve-tools)"})
+		return
+	}
+
+	// Any other event ends a block being streamed
+	if event.Type != agent.StreamDeltaEventType && event.Type != agent.StderrEventType {
+		p.endDelta()
+	}
+
 	switch event.Type {
-	case "system", "user", "thinking", "result":
+	case agent.RetryEventType:
+		// Start over; only the retried attempt's output counts
+		p.reset()
+		for _, c := range event.Message.Content {
+			p.println(span{WarningStyle.Render, "[retry] " + c.Text})
+		}
+	case agent.StreamDeltaEventType:
+		p.processDelta(event)
+	case agent.StderrEventType:
+		for _, c := range event.Message.Content {
+			p.recordStderr(c.Text)
+		}
+	case agent.TextOutputEventType:
+		// Plain text output is printed as it comes; all of it is the answer
+		for _, c := range event.Message.Content {
+			p.println(span{AssistantStyle.Render, c.Text})
+			p.textOutput.WriteString(c.Text + "\n")
+		}
+		p.finalMessage = strings.TrimSpace(p.textOutput.String())
+	case "result", "error":
+		// Not printed, but the agent may report failure here while exiting 0
+		p.resultError = agent.ResultError(event)
+	case "system", "user", "thinking":
 		// Skip these event types
 	case "tool_call":
 		if event.Subtype == "started" {
@@ -55,23 +169,31 @@ func (p *Parser) ProcessEvent(event agent.StreamEvent) {
 				toolName = event.ToolCall.MCPToolCall.Args.ToolName
 			}
 			if toolName != "" {
-				// Show code preview for playwriter-execute
-				code := event.ToolCall.MCPToolCall.Args.Args.Code
-				if code != "" {
-					// Truncate and clean up the code for display
-					code = strings.ReplaceAll(code, "\n", " ")
-					code = strings.Join(strings.Fields(code), " ") // collapse whitespace
-					if len(code) > 80 {
-						code = code[:77] + "..."
-					}
-					fmt.Println(ToolStyle.Render("[tool] "+toolName+": ") + DimStyle.Render(code))
-				} else {
-					fmt.Println(ToolStyle.Render("[tool] " + toolName))
-				}
+				p.printToolCall(toolName, event.ToolCall.MCPToolCall.Args.Args)
 			}
 		}
 	case "assistant":
+		if text := messageText(event); text != "" {
+			p.finalMessage = text
+		}
 		for _, c := range event.Message.Content {
+			switch c.Type {
+			case "tool_use":
+				// Claude's tool calls arrive as blocks of its messages
+				if c.Name != "" {
+					p.printToolCall(c.Name, c.Input)
+				}
+				continue
+			case "tool_result":
+				if c.IsError {
+					p.println(span{WarningStyle.Render, "[tool] error: " + truncate(collapseWhitespace(c.ResultText()), 200)})
+				}
+				continue
+			}
+			if p.deltaMode {
+				// Text was already rendered as it streamed
+				continue
+			}
 			text := strings.TrimSpace(c.Text)
 			if text != "" && text != p.lastPrintedMessage {
 				// Collapse multiple consecutive newlines to single newlines
@@ -80,9 +202,9 @@ func (p *Parser) ProcessEvent(event agent.StreamEvent) {
 				}
 				// Single-line messages are typically planning/thinking, multi-line are final responses
 				if strings.Contains(text, "\n") {
-					fmt.Println(AssistantStyle.Render(text))
+					p.println(span{AssistantStyle.Render, text})
 				} else {
-					fmt.Println(DimStyle.Render("> ") + AssistantStyle.Render(text))
+					p.println(span{DimStyle.Render, "> "}, span{AssistantStyle.Render, text})
 				}
 				p.lastPrintedMessage = text
 			}
@@ -90,6 +212,264 @@ func (p *Parser) ProcessEvent(event agent.StreamEvent) {
 	}
 }
 
+// span is a piece of output and how it's styled on the terminal. A nil
+// render prints the text as-is.
+type span struct {
+	render func(strs ...string) string
+	text   string
+}
+
+// render returns the styled (terminal) and plain (log) forms of spans
+func render(spans ...span) (styled, plain string) {
+	var s, p strings.Builder
+	for _, sp := range spans {
+		if sp.render != nil {
+			s.WriteString(sp.render(sp.text))
+		} else {
+			s.WriteString(sp.text)
+		}
+		p.WriteString(sp.text)
+	}
+	return s.String(), p.String()
+}
+
+// print writes spans to stdout styled and to Log, if set, plain
+func (p *Parser) print(spans ...span) {
+	styled, plain := render(spans...)
+	fmt.Print(styled)
+	if p.Log != nil {
+		io.WriteString(p.Log, plain)
+	}
+}
+
+// println is print followed by a newline
+func (p *Parser) println(spans ...span) {
+	p.print(append(spans, span{text: "\n"})...)
+}
+
+// printToolCall prints a tool call line, reports it to OnToolCall, and adds
+// it to the run's Summary
+func (p *Parser) printToolCall(toolName string, args agent.ToolArgs) {
+	p.observeToolCall(toolName, args)
+	summary := toolSummary(args)
+	if summary != "" {
+		p.println(span{ToolStyle.Render, "[tool] " + toolName + ": "}, span{DimStyle.Render, summary})
+	} else {
+		p.println(span{ToolStyle.Render, "[tool] " + toolName})
+	}
+	if p.OnToolCall != nil {
+		p.OnToolCall(toolName, summary)
+	}
+}
+
+// endDots finishes a line of heartbeat dots so the next output starts on its own line
+func (p *Parser) endDots() {
+	if p.dotsPending {
+		p.println()
+		p.dotsPending = false
+	}
+}
+
+// reset clears the state gathered from the events processed so far
+func (p *Parser) reset() {
+	p.lastPrintedMessage = ""
+	p.finalMessage = ""
+	p.deltaMode = false
+	p.deltaText.Reset()
+	p.textOutput.Reset()
+	p.approvalRequested = false
+	p.resultError = ""
+	p.stderrLines = nil
+	p.stderrPartial = ""
+	p.pages, p.tools, p.files = nil, nil, nil
+	p.timing = timingState{}
+}
+
+// processDelta renders a partial-message update in place, appending new text
+// to the current line for a typing effect
+func (p *Parser) processDelta(event agent.StreamEvent) {
+	switch event.Event.Type {
+	case "content_block_delta":
+		if event.Event.Delta.Type != "text_delta" || event.Event.Delta.Text == "" {
+			return
+		}
+		p.deltaMode = true
+		text := event.Event.Delta.Text
+		if p.deltaText.Len() == 0 {
+			text = strings.TrimLeft(text, "\n")
+		}
+		p.deltaText.WriteString(text)
+		p.print(span{AssistantStyle.Render, text})
+	case "content_block_stop", "message_stop":
+		p.endDelta()
+	}
+}
+
+// endDelta finishes the line of a block being streamed, if any
+func (p *Parser) endDelta() {
+	if p.deltaText.Len() == 0 {
+		return
+	}
+	p.println()
+	p.lastPrintedMessage = strings.TrimSpace(p.deltaText.String())
+	p.deltaText.Reset()
+}
+
+// FinalMessage returns the text of the last assistant message, which is the
+// agent's final answer once the run has finished
+func (p *Parser) FinalMessage() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.finalMessage
+}
+
+// ResultError returns the error reported by the agent's final result event,
+// or "" if it succeeded or sent no result
+func (p *Parser) ResultError() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.resultError
+}
+
+// messageText joins the text content of an event's message
+func messageText(event agent.StreamEvent) string {
+	var parts []string
+	for _, c := range event.Message.Content {
+		if text := strings.TrimSpace(c.Text); text != "" {
+			parts = append(parts, text)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// summaryKeys are tool arguments worth showing, in order of preference
+var summaryKeys = []string{"url", "selector", "element", "ref", "text", "key", "path", "query"}
+
+// toolSummary returns a one-line description of a tool call's arguments.
+// Code (playwriter-execute) is shown as its first recognizable action, or as
+// a preview; other tools show their most meaningful argument, falling back to
+// a compact key=value list.
+func toolSummary(args agent.ToolArgs) string {
+	if len(args) == 0 {
+		return ""
+	}
+
+	if code := args.Code(); code != "" {
+		if action := codeAction(code); action != "" {
+			return "-> " + truncate(collapseWhitespace(action), 80)
+		}
+		return truncate(collapseWhitespace(code), 80)
+	}
+
+	for _, key := range summaryKeys {
+		if value := args.Get(key); value != "" {
+			return "-> " + truncate(collapseWhitespace(value), 80)
+		}
+	}
+
+	keys := make([]string, 0, len(args))
+	for key := range args {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+args.Get(key))
+	}
+	return truncate(collapseWhitespace(strings.Join(pairs, " ")), 80)
+}
+
+// Patterns for common Playwright calls in playwriter-execute code. Each
+// captures the call's first string argument; locatorActionRe also matches
+// actions chained on page.locator(...).
+var (
+	gotoRe          = regexp.MustCompile(`\.goto\(\s*['"\x60]([^'"\x60]+)`)
+	actionRe        = regexp.MustCompile(`\.(click|dblclick|fill|type|press|check|uncheck|hover|selectOption)\(\s*['"\x60]([^'"\x60]+)`)
+	locatorActionRe = regexp.MustCompile(`\.locator\(\s*['"\x60]([^'"\x60]+)['"\x60]\s*\)\s*\.(click|dblclick|fill|type|press|check|uncheck|hover|selectOption)\(`)
+	screenshotRe    = regexp.MustCompile(`\.screenshot\(([^)]*)`)
+	screenshotPath  = regexp.MustCompile(`path:\s*['"\x60]([^'"\x60]+)`)
+)
+
+// codeAction describes the first goto, click, fill, or screenshot (and the
+// like) in Playwright code, such as `goto example.com` or `click "#submit"`.
+// Values typed into fields are left out. Returns "" if nothing matches.
+func codeAction(code string) string {
+	first := -1
+	var action string
+	consider := func(loc []int, describe func() string) {
+		if loc != nil && (first < 0 || loc[0] < first) {
+			first = loc[0]
+			action = describe()
+		}
+	}
+
+	if m := gotoRe.FindStringSubmatchIndex(code); m != nil {
+		consider(m, func() string {
+			url := code[m[2]:m[3]]
+			url = strings.TrimPrefix(strings.TrimPrefix(url, "https://"), "http://")
+			return "goto " + strings.TrimSuffix(url, "/")
+		})
+	}
+	if m := actionRe.FindStringSubmatchIndex(code); m != nil {
+		consider(m, func() string {
+			return code[m[2]:m[3]] + " " + strconv.Quote(code[m[4]:m[5]])
+		})
+	}
+	if m := locatorActionRe.FindStringSubmatchIndex(code); m != nil {
+		consider(m, func() string {
+			return code[m[4]:m[5]] + " " + strconv.Quote(code[m[2]:m[3]])
+		})
+	}
+	if m := screenshotRe.FindStringSubmatchIndex(code); m != nil {
+		consider(m, func() string {
+			if p := screenshotPath.FindStringSubmatch(code[m[2]:m[3]]); p != nil {
+				return "screenshot " + p[1]
+			}
+			return "screenshot"
+		})
+	}
+	return action
+}
+
+// collapseWhitespace replaces newlines and runs of whitespace with single spaces
+func collapseWhitespace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// truncate shortens s to at most n bytes, adding an ellipsis when cut
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n-3] + "..."
+	}
+	return s
+}
+
+// recordStderr appends stderr output to the tail buffer, keeping complete
+// lines. The caller must hold p.mu.
+func (p *Parser) recordStderr(text string) {
+	lines := strings.Split(p.stderrPartial+text, "\n")
+	p.stderrPartial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		if line = strings.TrimRight(line, "\r"); strings.TrimSpace(line) != "" {
+			p.stderrLines = append(p.stderrLines, line)
+		}
+	}
+	if len(p.stderrLines) > stderrTailSize {
+		p.stderrLines = p.stderrLines[len(p.stderrLines)-stderrTailSize:]
+	}
+}
+
+// StderrTail returns the last lines the agent wrote to stderr
+func (p *Parser) StderrTail() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	tail := p.stderrLines
+	if partial := strings.TrimSpace(p.stderrPartial); partial != "" {
+		tail = append(tail[:len(tail):len(tail)], partial)
+	}
+	return tail
+}
+
 // ProcessLine parses and processes a single line, printing output as needed
 // Returns true if the line was valid JSON, false otherwise
 func (p *Parser) ProcessLine(line string) bool {
@@ -98,7 +478,10 @@ func (p *Parser) ProcessLine(line string) bool {
 		// Non-JSON output - print it directly if not a control sequence
 		line = strings.TrimSpace(line)
 		if line != "" && !strings.HasPrefix(line, "[?") {
-			fmt.Println(line)
+			p.mu.Lock()
+			p.endDots()
+			p.println(span{text: line})
+			p.mu.Unlock()
 		}
 		return false
 	}
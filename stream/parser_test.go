@@ -0,0 +1,522 @@
+package stream
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/muesli/termenv"
+
+	"playwriter-setup/agent"
+)
+
+// delta is a streamed text update
+func delta(text string) agent.StreamEvent {
+	var event agent.StreamEvent
+	event.Type = agent.StreamDeltaEventType
+	event.Event.Type = "content_block_delta"
+	event.Event.Delta.Type = "text_delta"
+	event.Event.Delta.Text = text
+	return event
+}
+
+// message is a whole assistant message
+func message(text string) agent.StreamEvent {
+	event := agent.TextEvent("assistant", text)
+	event.Subtype = agent.MessageCompleteSubtype
+	return event
+}
+
+// toolCall is a started tool call
+func toolCall(name, url string) agent.StreamEvent {
+	var event agent.StreamEvent
+	event.Type, event.Subtype = "tool_call", "started"
+	event.ToolCall.MCPToolCall.Args.Name = name
+	event.ToolCall.MCPToolCall.Args.Args = agent.ToolArgs{"url": url}
+	return event
+}
+
+// timed stamps event as RunOptions.Timing does
+func timed(event agent.StreamEvent, ts, deltaMS int64) agent.StreamEvent {
+	event.TS, event.DeltaMS = ts, &deltaMS
+	return event
+}
+
+func TestParserRetryReset(t *testing.T) {
+	failed := agent.StreamEvent{Type: "result", Subtype: "error", IsError: true, Result: "rate limited"}
+	retry := agent.TextEvent(agent.RetryEventType, "claude failed with a transient error (rate limited), retrying once")
+	tests := []struct {
+		name        string
+		first       []agent.StreamEvent // the failed attempt
+		second      []agent.StreamEvent // the retried attempt
+		wantPrinted string
+		wantFinal   string
+		wantTools   int
+		wantFirstMS int64
+	}{
+		{
+			name:        "streamed attempt retried without deltas",
+			first:       []agent.StreamEvent{delta("Thinking"), message("Thinking"), failed},
+			second:      []agent.StreamEvent{message("Done on the retry")},
+			wantPrinted: "> Done on the retry",
+			wantFinal:   "Done on the retry",
+		},
+		{
+			name:        "tools and stderr of the failed attempt dropped",
+			first:       []agent.StreamEvent{toolCall("navigate", "https://a.example"), agent.TextEvent(agent.StderrEventType, "429\n"), failed},
+			second:      []agent.StreamEvent{toolCall("navigate", "https://b.example"), message("b")},
+			wantPrinted: "> b",
+			wantFinal:   "b",
+			wantTools:   1,
+		},
+		{
+			name:        "timing restarts with the retried attempt",
+			first:       []agent.StreamEvent{timed(message("slow"), 10_000, 10_000), timed(failed, 10_100, 100)},
+			second:      []agent.StreamEvent{timed(message("fast"), 10_300, 200)},
+			wantPrinted: "> fast",
+			wantFinal:   "fast",
+			wantFirstMS: 200,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var log bytes.Buffer
+			p := NewParser()
+			p.Log = &log
+			for _, event := range tt.first {
+				p.ProcessEvent(event)
+			}
+			p.ProcessEvent(retry)
+			log.Reset()
+			for _, event := range tt.second {
+				p.ProcessEvent(event)
+			}
+
+			if !strings.Contains(log.String(), tt.wantPrinted) {
+				t.Errorf("printed %q, want %q", log.String(), tt.wantPrinted)
+			}
+			if got := p.FinalMessage(); got != tt.wantFinal {
+				t.Errorf("FinalMessage() = %q, want %q", got, tt.wantFinal)
+			}
+			if got := p.ResultError(); got != "" {
+				t.Errorf("ResultError() = %q, want none", got)
+			}
+			if got := p.StderrTail(); len(got) != 0 {
+				t.Errorf("StderrTail() = %q, want none", got)
+			}
+			summary := p.Summary()
+			if calls := summary.Tools["navigate"]; calls != tt.wantTools {
+				t.Errorf("navigate calls = %d, want %d", calls, tt.wantTools)
+			}
+			if tt.wantFirstMS != 0 && (summary.Timing == nil || summary.Timing.FirstTokenMS != tt.wantFirstMS) {
+				t.Errorf("Timing = %+v, want first token at %dms", summary.Timing, tt.wantFirstMS)
+			}
+		})
+	}
+}
+
+// TestParserConcurrent drives ProcessEvent and the accessors from several
+// goroutines; run with -race
+func TestParserConcurrent(t *testing.T) {
+	tests := []struct {
+		name    string
+		workers int
+		events  func(worker int) []agent.StreamEvent
+	}{
+		{
+			name:    "messages and tool calls",
+			workers: 8,
+			events: func(w int) []agent.StreamEvent {
+				return []agent.StreamEvent{toolCall("navigate", fmt.Sprintf("https://%d.example", w)), message(fmt.Sprintf("worker %d done", w))}
+			},
+		},
+		{
+			name:    "deltas, heartbeats, and stderr",
+			workers: 8,
+			events: func(w int) []agent.StreamEvent {
+				return []agent.StreamEvent{
+					delta("partial "), {Type: agent.HeartbeatEventType},
+					agent.TextEvent(agent.StderrEventType, fmt.Sprintf("warn %d\n", w)), toolCall("navigate", "https://x.example"),
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var log bytes.Buffer
+			p := NewParser()
+			p.Log = &log
+			const rounds = 50
+			var wg sync.WaitGroup
+			for w := range tt.workers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for range rounds {
+						for _, event := range tt.events(w) {
+							p.ProcessEvent(event)
+						}
+						p.FinalMessage()
+						p.StderrTail()
+						p.Summary()
+					}
+				}()
+			}
+			wg.Wait()
+
+			if calls := p.Summary().Tools["navigate"]; calls != tt.workers*rounds {
+				t.Errorf("navigate calls = %d, want %d", calls, tt.workers*rounds)
+			}
+			if lines := strings.Count(log.String(), "[tool] navigate"); lines != tt.workers*rounds {
+				t.Errorf("printed %d tool lines, want %d", lines, tt.workers*rounds)
+			}
+		})
+	}
+}
+
+func TestToolCallArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want string // printed tool line; "" for nothing printed
+	}{
+		{
+			name: "navigate with a url",
+			line: `{"type":"tool_call","subtype":"started","tool_call":{"mcpToolCall":{"args":{"name":"navigate","args":{"url":"https://example.com/a"}}}}}`,
+			want: "[tool] navigate: -> https://example.com/a",
+		},
+		{
+			name: "click with a selector and a ref",
+			line: `{"type":"tool_call","subtype":"started","tool_call":{"mcpToolCall":{"args":{"toolName":"click","args":{"ref":"e12","selector":"#submit"}}}}}`,
+			want: "[tool] click: -> #submit",
+		},
+		{
+			name: "screenshot with non-string args",
+			line: `{"type":"tool_call","subtype":"started","tool_call":{"mcpToolCall":{"args":{"name":"screenshot","args":{"fullPage":true,"quality":80}}}}}`,
+			want: "[tool] screenshot: fullPage=true quality=80",
+		},
+		{
+			name: "execute keeps the code preview",
+			line: `{"type":"tool_call","subtype":"started","tool_call":{"mcpToolCall":{"args":{"name":"execute","args":{"code":"const n = await page.title();\n return n;"}}}}}`,
+			want: "[tool] execute: const n = await page.title(); return n;",
+		},
+		{
+			name: "no args",
+			line: `{"type":"tool_call","subtype":"started","tool_call":{"mcpToolCall":{"args":{"name":"snapshot"}}}}`,
+			want: "[tool] snapshot\n",
+		},
+		{
+			name: "completed calls aren't printed",
+			line: `{"type":"tool_call","subtype":"completed","tool_call":{"mcpToolCall":{"args":{"name":"navigate","args":{"url":"https://example.com"}}}}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var log bytes.Buffer
+			p := NewParser()
+			p.Log = &log
+			if !p.ProcessLine(tt.line) {
+				t.Fatalf("line not parsed as an event: %s", tt.line)
+			}
+			if tt.want == "" {
+				if log.Len() != 0 {
+					t.Errorf("printed %q, want nothing", log.String())
+				}
+				return
+			}
+			if !strings.Contains(log.String(), tt.want) {
+				t.Errorf("printed %q, want %q", log.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestToolArgsGet(t *testing.T) {
+	args := agent.ToolArgs{"url": "https://example.com", "n": 3.0, "opts": map[string]any{"a": true}, "none": nil}
+	tests := []struct{ key, want string }{
+		{"url", "https://example.com"},
+		{"n", "3"},
+		{"opts", `{"a":true}`},
+		{"none", ""},
+		{"missing", ""},
+	}
+	for _, tt := range tests {
+		if got := args.Get(tt.key); got != tt.want {
+			t.Errorf("Get(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestParserStderrTail(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   []string
+	}{
+		{
+			name:   "lines joined across chunks",
+			chunks: []string{"Error: rate", " limited\n", "retry in 5s\n"},
+			want:   []string{"Error: rate limited", "retry in 5s"},
+		},
+		{
+			name:   "unterminated last line included",
+			chunks: []string{"first\n", "Error: exited"},
+			want:   []string{"first", "Error: exited"},
+		},
+		{
+			name:   "carriage returns and blank lines dropped",
+			chunks: []string{"a\r\n\r\n  \nb\r\n"},
+			want:   []string{"a", "b"},
+		},
+		{
+			name:   "only the last lines kept",
+			chunks: []string{strings.Repeat("old\n", 30) + strings.Repeat("new\n", stderrTailSize-1) + "last\n"},
+			want:   append(slices.Repeat([]string{"new"}, stderrTailSize-1), "last"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewParser()
+			for _, chunk := range tt.chunks {
+				p.ProcessEvent(agent.TextEvent(agent.StderrEventType, chunk))
+			}
+			if got := p.StderrTail(); !slices.Equal(got, tt.want) {
+				t.Errorf("StderrTail() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRender(t *testing.T) {
+	bold := func(strs ...string) string { return "<b>" + strings.Join(strs, "") + "</b>" }
+	tests := []struct {
+		name       string
+		spans      []span
+		wantStyled string
+		wantPlain  string
+	}{
+		{name: "nothing"},
+		{name: "unstyled", spans: []span{{text: "plain"}}, wantStyled: "plain", wantPlain: "plain"},
+		{
+			name:       "mixed",
+			spans:      []span{{bold, "[tool] navigate"}, {text: ": "}, {bold, "-> https://example.com"}, {text: "\n"}},
+			wantStyled: "<b>[tool] navigate</b>: <b>-> https://example.com</b>\n",
+			wantPlain:  "[tool] navigate: -> https://example.com\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			styled, plain := render(tt.spans...)
+			if styled != tt.wantStyled || plain != tt.wantPlain {
+				t.Errorf("render() = %q, %q\nwant %q, %q", styled, plain, tt.wantStyled, tt.wantPlain)
+			}
+		})
+	}
+}
+
+// ansiCode matches a terminal escape sequence
+var ansiCode = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+func TestParserLogPlain(t *testing.T) {
+	defer lipgloss.SetColorProfile(lipgloss.ColorProfile())
+	lipgloss.SetColorProfile(termenv.ANSI256)
+
+	lines := []string{
+		`{"type":"assistant","message":{"content":[{"type":"text","text":"Opening the page"}]}}`,
+		`{"type":"tool_call","subtype":"started","tool_call":{"mcpToolCall":{"args":{"name":"navigate","args":{"url":"https://example.com"}}}}}`,
+		`{"type":"assistant","message":{"content":[{"type":"text","text":"The title is Example Domain"}]}}`,
+	}
+	var log bytes.Buffer
+	p := NewParser()
+	p.Log = &log
+	stdout := captureStdout(t, func() {
+		for _, line := range lines {
+			p.ProcessLine(line)
+		}
+	})
+
+	if !ansiCode.MatchString(stdout) {
+		t.Fatalf("terminal output isn't styled: %q", stdout)
+	}
+	if ansiCode.MatchString(log.String()) {
+		t.Errorf("log has escape codes: %q", log.String())
+	}
+	if plain := ansiCode.ReplaceAllString(stdout, ""); plain != log.String() {
+		t.Errorf("log = %q\nwant the terminal output unstyled, %q", log.String(), plain)
+	}
+	for _, want := range []string{"Opening the page", "[tool] navigate: -> https://example.com", "The title is Example Domain"} {
+		if !strings.Contains(log.String(), want) {
+			t.Errorf("log is missing %q:\n%s", want, log.String())
+		}
+	}
+}
+
+// captureStdout returns what fn writes to os.Stdout
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(f *os.File) { os.Stdout = f }(os.Stdout)
+	os.Stdout = w
+	done := make(chan string)
+	go func() {
+		out, _ := io.ReadAll(r)
+		done <- string(out)
+	}()
+	fn()
+	w.Close()
+	return <-done
+}
+
+func TestParserResultError(t *testing.T) {
+	const (
+		failed    = `{"type":"result","subtype":"success","is_error":true,"result":"Invalid API key"}`
+		succeeded = `{"type":"result","subtype":"success","is_error":false,"result":"Done"}`
+		assistant = `{"type":"assistant","message":{"content":[{"type":"text","text":"Done"}]}}`
+	)
+	tests := []struct {
+		name  string
+		lines []string
+		want  string
+	}{
+		{name: "no result", lines: []string{assistant}},
+		{name: "failed result", lines: []string{assistant, failed}, want: "Invalid API key success"},
+		{name: "last result wins", lines: []string{failed, assistant, succeeded}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewParser()
+			p.Log = io.Discard
+			captureStdout(t, func() {
+				for _, line := range tt.lines {
+					p.ProcessLine(line)
+				}
+			})
+			if got := p.ResultError(); got != tt.want {
+				t.Errorf("ResultError() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCodeAction(t *testing.T) {
+	tests := []struct {
+		name string
+		code string
+		want string
+	}{
+		{"goto", `await page.goto("https://example.com/");`, "goto example.com"},
+		{"goto with a path and options", "await page.goto(`http://localhost:3000/login`, { waitUntil: 'load' })", "goto localhost:3000/login"},
+		{"click", `await page.click('#submit')`, `click "#submit"`},
+		{"fill leaves the value out", `await page.fill('input[name=q]', 'my secret query')`, `fill "input[name=q]"`},
+		{"locator action", `await page.locator("text=Sign in").click()`, `click "text=Sign in"`},
+		{"screenshot with a path", `await page.screenshot({ path: '/tmp/shot.png', fullPage: true })`, "screenshot /tmp/shot.png"},
+		{"screenshot without a path", `const buf = await page.screenshot()`, "screenshot"},
+		{"first action wins", "await page.click('#accept');\nawait page.goto('https://example.com/next');", `click "#accept"`},
+		{"goto before locator", "await page.goto('https://a.com');\nawait page.locator('#x').click();", "goto a.com"},
+		{"nothing recognized", `return await page.title();`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := codeAction(tt.code); got != tt.want {
+				t.Errorf("codeAction(%q) = %q, want %q", tt.code, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClaudeContentBlocks(t *testing.T) {
+	tests := []struct {
+		name      string
+		line      string
+		want      string // printed
+		wantTools []string
+		wantFinal string
+	}{
+		{
+			name:      "text then tool use",
+			line:      `{"type":"assistant","message":{"id":"msg_01","role":"assistant","model":"claude-sonnet-4-5","content":[{"type":"text","text":"I'll open the page first."},{"type":"tool_use","id":"toolu_01","name":"mcp__playwriter__execute","input":{"code":"await page.goto('https://example.com')"}}],"stop_reason":"tool_use"},"session_id":"s1"}`,
+			want:      "> I'll open the page first.\n[tool] mcp__playwriter__execute: -> goto example.com\n",
+			wantTools: []string{"mcp__playwriter__execute"},
+			wantFinal: "I'll open the page first.",
+		},
+		{
+			name:      "tool use only",
+			line:      `{"type":"assistant","message":{"content":[{"type":"tool_use","id":"toolu_02","name":"mcp__playwriter__screenshot","input":{}}]}}`,
+			want:      "[tool] mcp__playwriter__screenshot\n",
+			wantTools: []string{"mcp__playwriter__screenshot"},
+		},
+		{
+			name:      "failed tool result",
+			line:      `{"type":"assistant","message":{"content":[{"type":"tool_result","tool_use_id":"toolu_01","is_error":true,"content":[{"type":"text","text":"Timeout 30000ms\nexceeded"}]},{"type":"text","text":"Retrying."}]}}`,
+			want:      "[tool] error: Timeout 30000ms exceeded\n> Retrying.\n",
+			wantFinal: "Retrying.",
+		},
+		{
+			name: "successful tool result not printed",
+			line: `{"type":"assistant","message":{"content":[{"type":"tool_result","tool_use_id":"toolu_01","content":"Example Domain"}]}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var log bytes.Buffer
+			var tools []string
+			p := NewParser()
+			p.Log = &log
+			p.OnToolCall = func(toolName, summary string) { tools = append(tools, toolName) }
+			captureStdout(t, func() {
+				if !p.ProcessLine(tt.line) {
+					t.Fatalf("line not parsed as an event: %s", tt.line)
+				}
+			})
+			if log.String() != tt.want {
+				t.Errorf("printed %q, want %q", log.String(), tt.want)
+			}
+			if !slices.Equal(tools, tt.wantTools) {
+				t.Errorf("tool calls %q, want %q", tools, tt.wantTools)
+			}
+			if got := p.FinalMessage(); got != tt.wantFinal {
+				t.Errorf("FinalMessage() = %q, want %q", got, tt.wantFinal)
+			}
+		})
+	}
+}
+
+func TestParserTextOutput(t *testing.T) {
+	tests := []struct {
+		name      string
+		lines     []string
+		wantFinal string
+	}{
+		{name: "one line", lines: []string{"The title is Example Domain"}, wantFinal: "The title is Example Domain"},
+		{name: "all lines are the answer", lines: []string{"", "Found 2 links:", "  /about", "  /docs", ""}, wantFinal: "Found 2 links:\n  /about\n  /docs"},
+		{name: "JSON-looking line printed as-is", lines: []string{`{"type":"result"}`}, wantFinal: `{"type":"result"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var log bytes.Buffer
+			p := NewParser()
+			p.Log = &log
+			captureStdout(t, func() {
+				for _, line := range tt.lines {
+					p.ProcessEvent(agent.TextEvent(agent.TextOutputEventType, line))
+				}
+			})
+			if want := strings.Join(tt.lines, "\n") + "\n"; log.String() != want {
+				t.Errorf("printed %q, want %q", log.String(), want)
+			}
+			if got := p.FinalMessage(); got != tt.wantFinal {
+				t.Errorf("FinalMessage() = %q, want %q", got, tt.wantFinal)
+			}
+		})
+	}
+}
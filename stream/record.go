@@ -0,0 +1,78 @@
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"playwriter-setup/agent"
+)
+
+// maxRecordedLine bounds a single recorded event; tool results can be large
+const maxRecordedLine = 16 * 1024 * 1024
+
+// RecordTo returns a handler that writes each event to w as one JSON line,
+// producing a recording that ReplayFrom can render later. Events are written
+// as the agent sent them (see eventJSON). Write errors are ignored so
+// recording never interrupts a run.
+func RecordTo(w io.Writer) agent.StreamHandler {
+	return func(event agent.StreamEvent) {
+		line, err := eventJSON(event)
+		if err != nil {
+			return
+		}
+		w.Write(append(line, '\n'))
+	}
+}
+
+// eventJSON returns the JSON recorded for event: the original JSON it was
+// decoded from (agent.StreamEvent.Raw) on one line, so fields StreamEvent
+// doesn't model are kept, or the event itself if it was made locally.
+// Timing stamps are measured locally, so they're added to the original.
+func eventJSON(event agent.StreamEvent) ([]byte, error) {
+	if len(event.Raw) == 0 {
+		return json.Marshal(event)
+	}
+	var line bytes.Buffer
+	if err := json.Compact(&line, event.Raw); err != nil {
+		return nil, err
+	}
+	if event.TS == 0 && event.DeltaMS == nil {
+		return line.Bytes(), nil
+	}
+	object := bytes.TrimSuffix(line.Bytes(), []byte("}"))
+	if len(object) == line.Len() {
+		return line.Bytes(), nil // not an object; nowhere to add stamps
+	}
+	var stamps bytes.Buffer
+	if event.TS != 0 {
+		fmt.Fprintf(&stamps, `,"ts":%d`, event.TS)
+	}
+	if event.DeltaMS != nil {
+		fmt.Fprintf(&stamps, `,"delta_ms":%d`, *event.DeltaMS)
+	}
+	if len(object) == 1 {
+		stamps.Next(1) // "{" has no fields to follow
+	}
+	return append(append(object, stamps.Bytes()...), '}'), nil
+}
+
+// ReplayFrom feeds a recording made with RecordTo back through parser,
+// rendering the run as it was displayed live
+func ReplayFrom(r io.Reader, parser *Parser) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxRecordedLine)
+
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		event, err := parser.ParseLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		if event != nil {
+			parser.ProcessEvent(*event)
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,111 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"playwriter-setup/agent"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files in testdata")
+
+func TestRecordRoundTrip(t *testing.T) {
+	delta := int64(40)
+	tests := []struct {
+		name  string
+		event agent.StreamEvent
+		want  string // recorded line
+	}{
+		{
+			name:  "original JSON with unknown fields",
+			event: agent.StreamEvent{Type: "result", Subtype: "success", Raw: json.RawMessage(`{"type":"result","subtype":"success","total_cost_usd":0.01,"usage":{"input_tokens":3}}`)},
+			want:  `{"type":"result","subtype":"success","total_cost_usd":0.01,"usage":{"input_tokens":3}}`,
+		},
+		{
+			name:  "multi-line original kept on one line",
+			event: agent.StreamEvent{Type: "system", Raw: json.RawMessage("{\n  \"type\": \"system\",\n  \"cwd\": \"/tmp\"\n}")},
+			want:  `{"type":"system","cwd":"/tmp"}`,
+		},
+		{
+			name:  "timing stamps added to the original",
+			event: agent.StreamEvent{Type: "system", TS: 1700000000000, DeltaMS: &delta, Raw: json.RawMessage(`{"type":"system","cwd":"/tmp"}`)},
+			want:  `{"type":"system","cwd":"/tmp","ts":1700000000000,"delta_ms":40}`,
+		},
+		{
+			name:  "OpenCode original",
+			event: agent.StreamEvent{Type: "assistant", Raw: json.RawMessage(`{"type":"text","sessionID":"ses_1","part":{"type":"text","text":"hi"}}`)},
+			want:  `{"type":"text","sessionID":"ses_1","part":{"type":"text","text":"hi"}}`,
+		},
+		{
+			name:  "local event marshaled",
+			event: agent.TextEvent(agent.StderrEventType, "warn\n"),
+			want:  `{"type":"stderr","message":{"content":[{"type":"text","text":"warn\n"}]},"tool_call":{"mcpToolCall":{"args":{"name":"","toolName":"","args":null}}},"event":{"type":"","delta":{"type":"","text":""}}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			RecordTo(&buf)(tt.event)
+			got := strings.TrimSuffix(buf.String(), "\n")
+			if got != tt.want {
+				t.Fatalf("recorded\n%s\nwant\n%s", got, tt.want)
+			}
+
+			replayed, err := NewParser().ParseLine(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(replayed.Raw) != tt.want {
+				t.Errorf("replayed Raw = %s", replayed.Raw)
+			}
+			if replayed.Type != tt.event.Type || replayed.TS != tt.event.TS || (replayed.DeltaMS == nil) != (tt.event.DeltaMS == nil) {
+				t.Errorf("replayed %+v, want %+v", *replayed, tt.event)
+			}
+		})
+	}
+}
+
+// TestReplayGolden replays recordings of each agent's raw output and compares
+// the rendered run with testdata/*.golden. Run with -update to rewrite them.
+func TestReplayGolden(t *testing.T) {
+	recordings, err := filepath.Glob("testdata/*.jsonl")
+	if err != nil || len(recordings) == 0 {
+		t.Fatalf("no recordings in testdata: %v", err)
+	}
+	for _, path := range recordings {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			var log bytes.Buffer
+			parser := NewParser()
+			parser.Log = &log
+			if err := ReplayFrom(f, parser); err != nil {
+				t.Fatal(err)
+			}
+			log.WriteString("---\n" + FormatSummary(parser.Summary()))
+
+			golden := strings.TrimSuffix(path, ".jsonl") + ".golden"
+			if *update {
+				if err := os.WriteFile(golden, log.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if log.String() != string(want) {
+				t.Errorf("replay of %s differs from %s:\n%s", path, golden, log.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package stream
+
+import (
+	"fmt"
+	"time"
+
+	"playwriter-setup/agent"
+)
+
+// Timing is the latency of a run, derived from the ts and delta_ms of its
+// events (RunOptions.Timing)
+type Timing struct {
+	FirstTokenMS     int64  `json:"first_token_ms,omitempty"` // From the start of the run to the agent's first text; 0 if it sent none
+	LongestGapMS     int64  `json:"longest_gap_ms"`           // Longest time between two events, not counting heartbeats
+	LongestGapBefore string `json:"longest_gap_before,omitempty"`
+}
+
+// timingState accumulates Timing as events are processed
+type timingState struct {
+	start   int64 // Unix ms the run started, from the first timed event
+	last    int64 // Unix ms of the last event other than a heartbeat
+	timing  Timing
+	started bool
+}
+
+// observe adds a timed event. Events without DeltaMS weren't timed and are
+// ignored.
+func (t *timingState) observe(event agent.StreamEvent) {
+	if event.DeltaMS == nil {
+		return
+	}
+	if !t.started {
+		t.start = event.TS - *event.DeltaMS
+		t.last = t.start
+		t.started = true
+	}
+	// A heartbeat marks a quiet period rather than ending it
+	if event.Type == agent.HeartbeatEventType {
+		return
+	}
+	if gap := event.TS - t.last; gap > t.timing.LongestGapMS {
+		t.timing.LongestGapMS = gap
+		t.timing.LongestGapBefore = eventLabel(event)
+	}
+	t.last = event.TS
+	if t.timing.FirstTokenMS == 0 && isTokenEvent(event) {
+		t.timing.FirstTokenMS = max(event.TS-t.start, 1)
+	}
+}
+
+// isTokenEvent reports whether event carries text from the agent
+func isTokenEvent(event agent.StreamEvent) bool {
+	switch event.Type {
+	case agent.StreamDeltaEventType:
+		return event.Event.Delta.Type == "text_delta" && event.Event.Delta.Text != ""
+	case agent.TextOutputEventType:
+		return true
+	case "assistant":
+		for _, c := range event.Message.Content {
+			if c.Type != "tool_use" && c.Type != "tool_result" && c.Text != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// eventLabel names an event for the longest gap: its tool for tool calls,
+// otherwise its type
+func eventLabel(event agent.StreamEvent) string {
+	if event.Type == "tool_call" {
+		if name := event.ToolCall.MCPToolCall.Args.Name; name != "" {
+			return "tool " + name
+		}
+		if name := event.ToolCall.MCPToolCall.Args.ToolName; name != "" {
+			return "tool " + name
+		}
+	}
+	for _, c := range event.Message.Content {
+		if c.Type == "tool_use" && c.Name != "" {
+			return "tool " + c.Name
+		}
+	}
+	return event.Type
+}
+
+// FormatTiming renders t as a single line, e.g. "first token after 1.2s,
+// longest gap 8.4s (before tool Bash)"
+func FormatTiming(t Timing) string {
+	first := "no text"
+	if t.FirstTokenMS > 0 {
+		first = "first token after " + formatMS(t.FirstTokenMS)
+	}
+	gap := "longest gap " + formatMS(t.LongestGapMS)
+	if t.LongestGapBefore != "" {
+		gap += " (before " + t.LongestGapBefore + ")"
+	}
+	return fmt.Sprintf("%s, %s", first, gap)
+}
+
+// formatMS renders a duration in milliseconds to a tenth of a second
+func formatMS(ms int64) string {
+	return (time.Duration(ms) * time.Millisecond).Round(100 * time.Millisecond).String()
+}
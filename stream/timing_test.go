@@ -0,0 +1,97 @@
+package stream
+
+import (
+	"testing"
+
+	"playwriter-setup/agent"
+)
+
+func TestTimingObserve(t *testing.T) {
+	const start = 1700000000000
+	heartbeat := agent.StreamEvent{Type: agent.HeartbeatEventType}
+	tests := []struct {
+		name        string
+		events      []agent.StreamEvent
+		want        Timing
+		wantStarted bool
+	}{
+		{
+			name: "first token and longest gap",
+			events: []agent.StreamEvent{
+				timed(agent.StreamEvent{Type: "system", Subtype: "init"}, start+200, 200),
+				timed(toolCall("navigate", "https://example.com"), start+700, 500),
+				timed(heartbeat, start+3200, 2500),
+				timed(message("The title is Example Domain"), start+3900, 700),
+				timed(agent.StreamEvent{Type: "result"}, start+4000, 100),
+			},
+			want:        Timing{FirstTokenMS: 3900, LongestGapMS: 3200, LongestGapBefore: "assistant"},
+			wantStarted: true,
+		},
+		{
+			name: "first token from a delta",
+			events: []agent.StreamEvent{
+				timed(delta(""), start+100, 100),
+				timed(delta("Hel"), start+350, 250),
+				timed(delta("lo"), start+400, 50),
+			},
+			want:        Timing{FirstTokenMS: 350, LongestGapMS: 250, LongestGapBefore: agent.StreamDeltaEventType},
+			wantStarted: true,
+		},
+		{
+			name: "gap before a tool",
+			events: []agent.StreamEvent{
+				timed(message("Opening"), start+300, 300),
+				timed(toolCall("navigate", "https://example.com"), start+5300, 5000),
+			},
+			want:        Timing{FirstTokenMS: 300, LongestGapMS: 5000, LongestGapBefore: "tool navigate"},
+			wantStarted: true,
+		},
+		{
+			name: "text right away",
+			events: []agent.StreamEvent{
+				timed(agent.TextEvent(agent.TextOutputEventType, "done"), start, 0),
+			},
+			want:        Timing{FirstTokenMS: 1},
+			wantStarted: true,
+		},
+		{
+			name: "no text",
+			events: []agent.StreamEvent{
+				timed(toolCall("navigate", "https://example.com"), start+1000, 1000),
+			},
+			want:        Timing{LongestGapMS: 1000, LongestGapBefore: "tool navigate"},
+			wantStarted: true,
+		},
+		{
+			name:   "untimed events ignored",
+			events: []agent.StreamEvent{message("hi"), toolCall("navigate", "https://example.com")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var state timingState
+			for _, event := range tt.events {
+				state.observe(event)
+			}
+			if state.timing != tt.want || state.started != tt.wantStarted {
+				t.Errorf("timing = %+v (started %v), want %+v (started %v)", state.timing, state.started, tt.want, tt.wantStarted)
+			}
+		})
+	}
+}
+
+func TestFormatTiming(t *testing.T) {
+	tests := []struct {
+		timing Timing
+		want   string
+	}{
+		{Timing{FirstTokenMS: 1234, LongestGapMS: 8420, LongestGapBefore: "tool Bash"}, "first token after 1.2s, longest gap 8.4s (before tool Bash)"},
+		{Timing{LongestGapMS: 40}, "no text, longest gap 0s"},
+		{Timing{FirstTokenMS: 61000, LongestGapMS: 61000, LongestGapBefore: "assistant"}, "first token after 1m1s, longest gap 1m1s (before assistant)"},
+	}
+	for _, tt := range tests {
+		if got := FormatTiming(tt.timing); got != tt.want {
+			t.Errorf("FormatTiming(%+v) = %q, want %q", tt.timing, got, tt.want)
+		}
+	}
+}
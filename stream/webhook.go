@@ -0,0 +1,135 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"playwriter-setup/agent"
+)
+
+// webhookQueueSize bounds the number of events waiting to be posted
+const webhookQueueSize = 256
+
+// webhookDrainTimeout bounds how long Close waits for queued events to be
+// delivered, so an unreachable endpoint can't hold up exit
+var webhookDrainTimeout = 5 * time.Second
+
+// WebhookSink posts stream events to a URL as JSON in the background.
+// Sends never block: when the queue is full the oldest queued event is
+// dropped. Delivery failures are logged and never stop the run.
+type WebhookSink struct {
+	url    string
+	client *http.Client
+	queue  chan agent.StreamEvent
+	done   chan struct{}
+
+	// ctx is cancelled when Close gives up on the queue
+	ctx     context.Context
+	cancel  context.CancelFunc
+	dropped int // events not delivered because Close gave up; set by run
+}
+
+// NewWebhookSink creates a sink that posts events to url and starts its worker
+func NewWebhookSink(url string) *WebhookSink {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &WebhookSink{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan agent.StreamEvent, webhookQueueSize),
+		done:   make(chan struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	go w.run()
+	return w
+}
+
+// Send queues an event for delivery, dropping the oldest event if the queue is full
+func (w *WebhookSink) Send(event agent.StreamEvent) {
+	for {
+		select {
+		case w.queue <- event:
+			return
+		default:
+		}
+		select {
+		case <-w.queue:
+		default:
+		}
+	}
+}
+
+// Close stops accepting events and waits up to webhookDrainTimeout for queued
+// events to be delivered. Events still undelivered then are dropped and
+// counted in the log.
+func (w *WebhookSink) Close() {
+	close(w.queue)
+	select {
+	case <-w.done:
+	case <-time.After(webhookDrainTimeout):
+		w.cancel()
+		<-w.done
+	}
+	w.cancel()
+	if w.dropped > 0 {
+		fmt.Fprintln(os.Stderr, DimStyle.Render(fmt.Sprintf("webhook: dropped %d undelivered event(s) after waiting %s", w.dropped, webhookDrainTimeout)))
+	}
+}
+
+// run delivers queued events until the queue is closed. Once Close gives up,
+// the rest are only counted.
+func (w *WebhookSink) run() {
+	defer close(w.done)
+	for event := range w.queue {
+		if w.ctx.Err() != nil {
+			w.dropped++
+			continue
+		}
+		if err := w.post(event); err != nil {
+			if w.ctx.Err() != nil {
+				w.dropped++
+				continue
+			}
+			fmt.Fprintln(os.Stderr, DimStyle.Render("webhook: "+err.Error()))
+		}
+	}
+}
+
+// post sends a single event as the agent sent it (see eventJSON), retrying
+// once on a 5xx response
+func (w *WebhookSink) post(event agent.StreamEvent) error {
+	body, err := eventJSON(event)
+	if err != nil {
+		return fmt.Errorf("marshal event: %w", err)
+	}
+
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequestWithContext(w.ctx, http.MethodPost, w.url, bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("post: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := w.client.Do(req)
+		if err != nil {
+			return fmt.Errorf("post: %w", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode >= 500 && attempt < 2 {
+			select {
+			case <-time.After(500 * time.Millisecond):
+			case <-w.ctx.Done():
+				return w.ctx.Err()
+			}
+			continue
+		}
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("post: unexpected status %d", resp.StatusCode)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,68 @@
+package stream
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"playwriter-setup/agent"
+)
+
+func TestWebhookSendsRawEvents(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	raw := `{"type":"result","subtype":"success","total_cost_usd":0.01}`
+	heartbeat := agent.StreamEvent{Type: agent.HeartbeatEventType, TS: 1700000000000}
+	sink := NewWebhookSink(srv.URL)
+	sink.Send(agent.StreamEvent{Type: "result", Subtype: "success", Raw: json.RawMessage(raw)})
+	sink.Send(heartbeat)
+	sink.Close()
+
+	local, _ := json.Marshal(heartbeat)
+	if want := []string{raw, string(local)}; !slices.Equal(bodies, want) {
+		t.Errorf("posted %q, want %q", bodies, want)
+	}
+}
+
+func TestWebhookCloseGivesUp(t *testing.T) {
+	defer func(d time.Duration) { webhookDrainTimeout = d }(webhookDrainTimeout)
+	webhookDrainTimeout = 50 * time.Millisecond
+
+	// The endpoint doesn't answer until the test ends
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	sink := NewWebhookSink(srv.URL)
+	for range 3 {
+		sink.Send(agent.StreamEvent{Type: agent.HeartbeatEventType})
+	}
+	start := time.Now()
+	sink.Close()
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Close() took %s with an unreachable endpoint", elapsed)
+	}
+	if sink.dropped != 3 {
+		t.Errorf("dropped %d events, want 3", sink.dropped)
+	}
+}